@@ -179,3 +179,24 @@ func (b Bound) RightBottom() LatLon {
 func (b Bound) IsEmpty() bool {
 	return b.Min.Lon > b.Max.Lon || b.Min.Lat > b.Max.Lat
 }
+
+// SplitAntimeridian returns the bounds within the longitudes of -180 and 180,
+// the bound that goes beyond the antimeridian is split into the parts of the both sides.
+func (b Bound) SplitAntimeridian() []Bound {
+	if b.Max.Lon-b.Min.Lon >= 360 {
+		b.Min.Lon, b.Max.Lon = -180, 180
+		return []Bound{b}
+	}
+	if b.Min.Lon < -180 {
+		west, east := b, b
+		west.Min.Lon, west.Max.Lon = b.Min.Lon+360, 180
+		east.Min.Lon = -180
+		return []Bound{west, east}
+	} else if b.Max.Lon > 180 {
+		west, east := b, b
+		west.Max.Lon = 180
+		east.Min.Lon, east.Max.Lon = -180, b.Max.Lon-360
+		return []Bound{west, east}
+	}
+	return []Bound{b}
+}
@@ -0,0 +1,22 @@
+package geom_test
+
+import (
+	"testing"
+
+	. "github.com/OutOfBedlam/ots/geom"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSplitAntimeridian(t *testing.T) {
+	b := MakeBound(10, 100, 20, 110)
+	assert.Equal(t, []Bound{b}, b.SplitAntimeridian())
+
+	parts := MakeBound(10, 179, 20, 181).SplitAntimeridian()
+	assert.Equal(t, []Bound{MakeBound(10, 179, 20, 180), MakeBound(10, -180, 20, -179)}, parts)
+
+	parts = MakeBound(10, -180.5, 20, -179).SplitAntimeridian()
+	assert.Equal(t, []Bound{MakeBound(10, 179.5, 20, 180), MakeBound(10, -180, 20, -179)}, parts)
+
+	parts = MakeBound(-90, -181, 90, 181).SplitAntimeridian()
+	assert.Equal(t, []Bound{MakeBound(-90, -180, 90, 180)}, parts)
+}
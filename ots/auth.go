@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+type ServerTLSConfig struct {
+	Cert     string `name:"cert" placeholder:"<path>" help:"server certificate file (PEM), enables TLS"`
+	Key      string `name:"key" placeholder:"<path>" help:"private key file of the server certificate (PEM)"`
+	ClientCA string `name:"client-ca" placeholder:"<path>" help:"CA certificate file (PEM) to verify client certificates, enables mutual TLS"`
+}
+
+// returns nil if TLS is not configured
+func (conf *ServerTLSConfig) tlsConfig() (*tls.Config, error) {
+	if len(conf.Cert) == 0 {
+		return nil, nil
+	}
+	cert, err := tls.LoadX509KeyPair(conf.Cert, conf.Key)
+	if err != nil {
+		return nil, errors.Wrap(err, "tls cert")
+	}
+	ret := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+		// the server picks in its order, browsers get http/1.1 and grpc clients get h2
+		NextProtos: []string{"http/1.1", "h2"},
+	}
+	if len(conf.ClientCA) > 0 {
+		pool, err := loadCertPool(conf.ClientCA)
+		if err != nil {
+			return nil, errors.Wrap(err, "tls client-ca")
+		}
+		ret.ClientCAs = pool
+		ret.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return ret, nil
+}
+
+func loadCertPool(path string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, errors.Errorf("no certificate found in %s", path)
+	}
+	return pool, nil
+}
+
+// transportCredentials returns credentials of the connection to data server
+func (conf *RemoteConfig) transportCredentials() (credentials.TransportCredentials, error) {
+	if !conf.secure() {
+		return insecure.NewCredentials(), nil
+	}
+	tlsConf := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ServerName: conf.ServerName,
+	}
+	if len(conf.CA) > 0 {
+		pool, err := loadCertPool(conf.CA)
+		if err != nil {
+			return nil, errors.Wrap(err, "remote ca")
+		}
+		tlsConf.RootCAs = pool
+	}
+	if len(conf.Cert) > 0 {
+		cert, err := tls.LoadX509KeyPair(conf.Cert, conf.Key)
+		if err != nil {
+			return nil, errors.Wrap(err, "remote cert")
+		}
+		tlsConf.Certificates = []tls.Certificate{cert}
+	}
+	return credentials.NewTLS(tlsConf), nil
+}
+
+func (conf *RemoteConfig) secure() bool {
+	return conf.TLS || len(conf.CA) > 0 || len(conf.Cert) > 0
+}
+
+type AuthConfig struct {
+	Tokens []string `name:"tokens" placeholder:"<token>" help:"accepted bearer tokens or api keys, authentication is disabled if empty"`
+}
+
+// tokenAuth accepts the request that has one of the tokens in
+//
+//	'Authorization: Bearer <token>' header
+//	'X-API-Key: <token>' header
+//	'api_key=<token>' query parameter (http only, for the map libraries that can not set headers)
+type tokenAuth struct {
+	tokens [][]byte
+}
+
+// returns nil if there are no tokens, blank tokens are an error not to reject every request
+func newTokenAuth(conf *AuthConfig) (*tokenAuth, error) {
+	if len(conf.Tokens) == 0 {
+		return nil, nil
+	}
+	ta := &tokenAuth{}
+	for _, t := range conf.Tokens {
+		if t = strings.TrimSpace(t); len(t) > 0 {
+			ta.tokens = append(ta.tokens, []byte(t))
+		}
+	}
+	if len(ta.tokens) == 0 {
+		return nil, errors.New("no valid tokens")
+	}
+	return ta, nil
+}
+
+func (ta *tokenAuth) valid(token string) bool {
+	if len(token) == 0 {
+		return false
+	}
+	ok := 0
+	for _, t := range ta.tokens {
+		// compare all tokens in constant time, not to leak which one is matched
+		ok |= subtle.ConstantTimeCompare(t, []byte(token))
+	}
+	return ok == 1
+}
+
+func bearerToken(authorization string) string {
+	const prefix = "bearer "
+	if len(authorization) > len(prefix) && strings.EqualFold(authorization[:len(prefix)], prefix) {
+		return strings.TrimSpace(authorization[len(prefix):])
+	}
+	return ""
+}
+
+func (ta *tokenAuth) HttpHandler(c *gin.Context) {
+	token := bearerToken(c.GetHeader("Authorization"))
+	if len(token) == 0 {
+		token = c.GetHeader("X-API-Key")
+	}
+	if len(token) == 0 {
+		token = c.Query("api_key")
+	}
+	if !ta.valid(token) {
+		c.Header("WWW-Authenticate", "Bearer")
+		c.AbortWithStatus(http.StatusUnauthorized)
+		return
+	}
+	c.Next()
+}
+
+func (ta *tokenAuth) authorize(ctx context.Context, fullMethod string) error {
+	// health check is open for load balancers
+	if strings.HasPrefix(fullMethod, "/grpc.health.v1.Health/") {
+		return nil
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	token := ""
+	if v := md.Get("authorization"); len(v) > 0 {
+		token = bearerToken(v[0])
+	}
+	if v := md.Get("x-api-key"); len(token) == 0 && len(v) > 0 {
+		token = v[0]
+	}
+	if !ta.valid(token) {
+		return status.Error(codes.Unauthenticated, "invalid token")
+	}
+	return nil
+}
+
+func (ta *tokenAuth) UnaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if err := ta.authorize(ctx, info.FullMethod); err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+func (ta *tokenAuth) StreamInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if err := ta.authorize(ss.Context(), info.FullMethod); err != nil {
+		return err
+	}
+	return handler(srv, ss)
+}
+
+// tokenCredentials sends the token to data server as bearer token
+type tokenCredentials struct {
+	token  string
+	secure bool
+}
+
+func (tc *tokenCredentials) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	return map[string]string{"authorization": "Bearer " + tc.token}, nil
+}
+
+func (tc *tokenCredentials) RequireTransportSecurity() bool {
+	return tc.secure
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewTokenAuth(t *testing.T) {
+	ta, err := newTokenAuth(&AuthConfig{})
+	require.Nil(t, err)
+	assert.Nil(t, ta)
+
+	// blank tokens would reject every request
+	_, err = newTokenAuth(&AuthConfig{Tokens: []string{"", "  "}})
+	assert.EqualError(t, err, "no valid tokens")
+
+	ta, err = newTokenAuth(&AuthConfig{Tokens: []string{" secret ", ""}})
+	require.Nil(t, err)
+	assert.True(t, ta.valid("secret"))
+	assert.False(t, ta.valid(""))
+	assert.False(t, ta.valid("other"))
+}
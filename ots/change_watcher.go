@@ -0,0 +1,109 @@
+package main
+
+import (
+	"io/fs"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/OutOfBedlam/ots/logging"
+)
+
+type ChangeWatcherConfig struct {
+	Dir      string        `name:"dir" placeholder:"<path>" help:"directory of osm change files (.osc, .osc.gz) to apply, disabled if empty"`
+	Interval time.Duration `default:"1m" name:"interval" help:"interval of checking new change files"`
+}
+
+// changeWatcher applies change files in the directory in lexical order of the paths,
+// it fits to the layout of replication diffs, eg) 'dir/000/123/456.osc.gz'.
+// Since the data source is reloaded from osm.pbf on restart, all files are applied again at start.
+type changeWatcher struct {
+	log      logging.Log
+	dir      string
+	interval time.Duration
+	applier  ChangeApplier
+	onChange func(cs *ChangeSet)
+	applied  map[string]bool
+	closeCh  chan struct{}
+	doneCh   chan struct{}
+}
+
+func newChangeWatcher(conf *ChangeWatcherConfig, applier ChangeApplier, onChange func(cs *ChangeSet)) *changeWatcher {
+	return &changeWatcher{
+		log:      logging.GetLog("osm-change"),
+		dir:      conf.Dir,
+		interval: conf.Interval,
+		applier:  applier,
+		onChange: onChange,
+		applied:  make(map[string]bool),
+		closeCh:  make(chan struct{}),
+		doneCh:   make(chan struct{}),
+	}
+}
+
+// Start applies the existing files then keeps watching new files
+func (cw *changeWatcher) Start() {
+	cw.scan()
+	go func() {
+		defer close(cw.doneCh)
+		if cw.interval <= 0 {
+			return
+		}
+		ticker := time.NewTicker(cw.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-cw.closeCh:
+				return
+			case <-ticker.C:
+				cw.scan()
+			}
+		}
+	}()
+}
+
+func (cw *changeWatcher) Stop() {
+	close(cw.closeCh)
+	<-cw.doneCh
+}
+
+func (cw *changeWatcher) scan() {
+	files := make([]string, 0)
+	err := filepath.WalkDir(cw.dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || cw.applied[path] {
+			return nil
+		}
+		if strings.HasSuffix(path, ".osc") || strings.HasSuffix(path, ".osc.gz") {
+			files = append(files, path)
+		}
+		return nil
+	})
+	if err != nil {
+		cw.log.Warnf("change dir %s", err.Error())
+		return
+	}
+
+	for _, path := range files {
+		tick := time.Now()
+		change, err := readOsmChange(path)
+		if err != nil {
+			// the file might be incomplete yet, retry at next scan without skipping it
+			cw.log.Warnf("change %s", err.Error())
+			return
+		}
+		cs, err := cw.applier.ApplyChange(change)
+		if err != nil {
+			cw.log.Warnf("change %s %s", path, err.Error())
+			return
+		}
+		cw.applied[path] = true
+		if cw.onChange != nil {
+			cw.onChange(cs)
+		}
+		cw.log.Infof("applied %s nodes:%d ways:%d rels:%d %s",
+			path, len(cs.Nodes), len(cs.Ways), len(cs.Relations), time.Since(tick))
+	}
+}
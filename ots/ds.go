@@ -23,30 +23,55 @@ type DataSource interface {
 	SearchRelations(tag string, keyword string) []*tiles.Relation
 }
 
-func NewDataSource(dsaddr string, buffSize int) (DataSource, error) {
+// NewDataSource opens the data source of dsaddr,
+// remoteConf is applied only to the remote data source, the defaults are used if it is nil.
+func NewDataSource(dsaddr string, buffSize int, remoteConf *RemoteConfig) (DataSource, error) {
 	var ds DataSource
 
 	log := logging.GetLog("datasource")
 
 	if strings.HasPrefix(dsaddr, "tcp://") {
-		// data source is a remote grpc server
+		// data source is remote grpc server(s)
 		log.Infof("osm data source: %s", dsaddr)
-		rds := &remoteOsmd{
-			addr: dsaddr,
+		endpoints, err := parseRemoteEndpoints(dsaddr)
+		if err != nil {
+			return nil, err
+		}
+		var rds interface {
+			DataSource
+			HealthCheck() error
 		}
-		if buffSize > 0 {
-			rds.grpcMaxRecvMsgSize = buffSize
+		if len(endpoints) == 1 && endpoints[0].bounds == nil {
+			rds, err = newRemoteOsmd(endpoints[0].addr, remoteConf, buffSize, false)
+		} else {
+			rds, err = newRemoteCluster(endpoints, remoteConf, buffSize)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if err := rds.HealthCheck(); err != nil {
+			// not fatal, the connection will be recovered when the data server becomes available
+			log.Warnf("data server %s is not available, %s", dsaddr, err.Error())
 		}
 		ds = rds
+	} else if strings.HasSuffix(dsaddr, MmapIndexExt) {
+		// data source is on-disk index
+		log.Infof("opening osm index %s ...", dsaddr)
+		data, err := openMmapOsmData(dsaddr)
+		if err != nil {
+			return nil, err
+		}
+		ds = data
 	} else {
 		// data source is local file
 		log.Infof("reading osm data from %s ...", dsaddr)
 		startLoad := time.Now()
-		data, err := loadOsmData(dsaddr)
+		data, err := loadOsmDataSnapshot(dsaddr)
 		if err != nil {
 			return nil, err
 		}
 		log.Infof("loaded. %+v", time.Since(startLoad))
+		data.buildGeneralized()
 		ds = data
 	}
 
@@ -74,3 +99,34 @@ func (rs *ResultSet) LenWays() int {
 func (rs *ResultSet) LenRelations() int {
 	return len(rs.Relations)
 }
+
+// merge appends the objects of other that are not in rs
+func (rs *ResultSet) merge(other *ResultSet) {
+	nodes := make(map[int64]bool, len(rs.Nodes))
+	for _, n := range rs.Nodes {
+		nodes[n.Id] = true
+	}
+	for _, n := range other.Nodes {
+		if !nodes[n.Id] {
+			rs.Nodes = append(rs.Nodes, n)
+		}
+	}
+	ways := make(map[int64]bool, len(rs.Ways))
+	for _, w := range rs.Ways {
+		ways[w.Id] = true
+	}
+	for _, w := range other.Ways {
+		if !ways[w.Id] {
+			rs.Ways = append(rs.Ways, w)
+		}
+	}
+	relations := make(map[int64]bool, len(rs.Relations))
+	for _, r := range rs.Relations {
+		relations[r.Id] = true
+	}
+	for _, r := range other.Relations {
+		if !relations[r.Id] {
+			rs.Relations = append(rs.Relations, r)
+		}
+	}
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/xml"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/OutOfBedlam/ots/geom"
+	"github.com/paulmach/osm"
+	"github.com/pkg/errors"
+)
+
+// ChangeApplier is implemented by the data sources that can apply OsmChange diffs in place
+type ChangeApplier interface {
+	ApplyChange(change *osm.Change) (*ChangeSet, error)
+}
+
+// ChangeSet is the result of applying an OsmChange,
+// ids of the changed objects and the bounds (both of before and after) they covered.
+type ChangeSet struct {
+	Nodes     []int64
+	Ways      []int64
+	Relations []int64
+	Bounds    []geom.Bound
+}
+
+func (cs *ChangeSet) addBounds(b *osm.Bounds) {
+	if b == nil {
+		return
+	}
+	cs.Bounds = append(cs.Bounds, geom.MakeBound(b.MinLat, b.MinLon, b.MaxLat, b.MaxLon))
+}
+
+func (cs *ChangeSet) addNode(node *osm.Node) {
+	cs.Bounds = append(cs.Bounds, geom.MakeBound(node.Lat, node.Lon, node.Lat, node.Lon))
+}
+
+// readOsmChange reads OsmChange xml file, '.osc' or gzipped '.osc.gz'
+func readOsmChange(path string) (*osm.Change, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var r io.Reader = f
+	if strings.HasSuffix(path, ".gz") {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return nil, errors.Wrap(err, path)
+		}
+		defer gz.Close()
+		r = gz
+	}
+
+	change := &osm.Change{}
+	if err := xml.NewDecoder(r).Decode(change); err != nil {
+		return nil, errors.Wrap(err, path)
+	}
+	return change, nil
+}
+
+// ApplyChange applies creates and modifies first then deletes,
+// ways and relations that refer to the changed nodes and ways are resolved again
+// so that their coordinates and bounds are kept up to date.
+func (data *osmdata) ApplyChange(change *osm.Change) (*ChangeSet, error) {
+	data.lock.Lock()
+	defer data.lock.Unlock()
+
+	cs := &ChangeSet{}
+	dirtyNodes := map[osm.NodeID]bool{}
+	dirtyWays := map[osm.WayID]bool{}
+	dirtyRels := map[osm.RelationID]bool{}
+
+	upserts := make([]*osm.OSM, 0, 2)
+	if change.Create != nil {
+		upserts = append(upserts, change.Create)
+	}
+	if change.Modify != nil {
+		upserts = append(upserts, change.Modify)
+	}
+
+	for _, o := range upserts {
+		for _, node := range o.Nodes {
+			if old, ok := data.nodes.Get(node.ID); ok {
+				data.removeNode(old, cs, dirtyWays, dirtyRels)
+			}
+			data.nodes.Set(node.ID, node)
+			data.insertNode(node)
+			cs.addNode(node)
+			dirtyNodes[node.ID] = true
+		}
+	}
+	for _, o := range upserts {
+		for _, way := range o.Ways {
+			if old, ok := data.ways.Get(way.ID); ok {
+				data.removeWay(old, cs, dirtyRels)
+			}
+			way.Bounds = nil
+			data.ways.Set(way.ID, way)
+			dirtyWays[way.ID] = true
+		}
+	}
+	for _, o := range upserts {
+		for _, rel := range o.Relations {
+			if old, ok := data.relations.Get(rel.ID); ok {
+				data.removeParentRelation(old)
+				if old.Bounds != nil {
+					data.deleteRelation(old)
+					cs.addBounds(old.Bounds)
+				}
+			}
+			rel.Bounds = nil
+			data.relations.Set(rel.ID, rel)
+			data.addParentRelation(rel)
+			dirtyRels[rel.ID] = true
+		}
+	}
+
+	if change.Delete != nil {
+		for _, rel := range change.Delete.Relations {
+			if old, ok := data.relations.Get(rel.ID); ok {
+				data.removeParentRelation(old)
+				if old.Bounds != nil {
+					data.deleteRelation(old)
+					cs.addBounds(old.Bounds)
+				}
+				data.relations.Delete(rel.ID)
+			}
+			dirtyRels[rel.ID] = true
+		}
+		for _, way := range change.Delete.Ways {
+			if old, ok := data.ways.Get(way.ID); ok {
+				data.removeWay(old, cs, dirtyRels)
+				data.ways.Delete(way.ID)
+			}
+			dirtyWays[way.ID] = true
+		}
+		for _, node := range change.Delete.Nodes {
+			if old, ok := data.nodes.Get(node.ID); ok {
+				data.removeNode(old, cs, dirtyWays, dirtyRels)
+				data.nodes.Delete(node.ID)
+			}
+			dirtyNodes[node.ID] = true
+		}
+	}
+
+	// resolve ways before relations, relations copy nodes of the member ways
+	for id := range dirtyWays {
+		way, ok := data.ways.Get(id)
+		if !ok {
+			continue
+		}
+		// a way that refers to a changed node is still in the index with the old bounds
+		data.removeWay(way, cs, dirtyRels)
+		data.resolveWay(way)
+		if way.Bounds != nil {
+			data.insertWay(way)
+			cs.addBounds(way.Bounds)
+		}
+	}
+	// bounds of the parent relations cover their member relations
+	data.markParentRelations(dirtyRels)
+	for id := range dirtyRels {
+		rel, ok := data.relations.Get(id)
+		if !ok {
+			continue
+		}
+		if rel.Bounds != nil {
+			data.deleteRelation(rel)
+			cs.addBounds(rel.Bounds)
+		}
+		data.resolveRelation(rel)
+		if rel.Bounds != nil {
+			data.insertRelation(rel)
+			cs.addBounds(rel.Bounds)
+		}
+	}
+
+	for id := range dirtyNodes {
+		cs.Nodes = append(cs.Nodes, int64(id))
+	}
+	for id := range dirtyWays {
+		cs.Ways = append(cs.Ways, int64(id))
+	}
+	for id := range dirtyRels {
+		cs.Relations = append(cs.Relations, int64(id))
+	}
+	sort.Slice(cs.Nodes, func(i, j int) bool { return cs.Nodes[i] < cs.Nodes[j] })
+	sort.Slice(cs.Ways, func(i, j int) bool { return cs.Ways[i] < cs.Ways[j] })
+	sort.Slice(cs.Relations, func(i, j int) bool { return cs.Relations[i] < cs.Relations[j] })
+
+	if data.generalized != nil {
+		data.generalized.update(data, cs)
+	}
+
+	return cs, nil
+}
+
+// removeNode takes the node out of the index, and marks ways and relations that refer to it
+func (data *osmdata) removeNode(node *osm.Node, cs *ChangeSet, dirtyWays map[osm.WayID]bool, dirtyRels map[osm.RelationID]bool) {
+	data.deleteNode(node)
+	cs.addNode(node)
+
+	// ways and relations that refer to the node contain its old position in their bounds
+	b := &osm.Bounds{MinLat: node.Lat, MinLon: node.Lon, MaxLat: node.Lat, MaxLon: node.Lon}
+	data.searchWay(b, func(_ *osm.Bounds, way *osm.Way) bool {
+		for _, n := range way.Nodes {
+			if n.ID == node.ID {
+				dirtyWays[way.ID] = true
+				break
+			}
+		}
+		return true
+	})
+	data.searchRelation(b, func(_ *osm.Bounds, rel *osm.Relation) bool {
+		for _, m := range rel.Members {
+			if m.Type == osm.TypeNode && osm.NodeID(m.Ref) == node.ID {
+				dirtyRels[rel.ID] = true
+				break
+			}
+		}
+		return true
+	})
+}
+
+// markParentRelations marks the relations that have the marked relations as nested members, up to the top of the nesting
+func (data *osmdata) markParentRelations(dirtyRels map[osm.RelationID]bool) {
+	queue := make([]osm.RelationID, 0, len(dirtyRels))
+	for id := range dirtyRels {
+		queue = append(queue, id)
+	}
+	for len(queue) > 0 {
+		id := queue[len(queue)-1]
+		queue = queue[:len(queue)-1]
+		for _, parent := range data.parentRelations[id] {
+			if !dirtyRels[parent] {
+				dirtyRels[parent] = true
+				queue = append(queue, parent)
+			}
+		}
+	}
+}
+
+// removeWay takes the way out of the index, and marks relations that refer to it
+func (data *osmdata) removeWay(way *osm.Way, cs *ChangeSet, dirtyRels map[osm.RelationID]bool) {
+	if way.Bounds == nil {
+		return
+	}
+	data.deleteWay(way)
+	cs.addBounds(way.Bounds)
+
+	data.searchRelation(way.Bounds, func(_ *osm.Bounds, rel *osm.Relation) bool {
+		for _, m := range rel.Members {
+			if m.Type == osm.TypeWay && osm.WayID(m.Ref) == way.ID {
+				dirtyRels[rel.ID] = true
+				break
+			}
+		}
+		return true
+	})
+	// prevent dirty-way resolving from deleting it again
+	way.Bounds = nil
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"testing"
+
+	"github.com/OutOfBedlam/ots/logging"
+	"github.com/OutOfBedlam/ots/projection"
+	"github.com/paulmach/osm"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// searchIds returns the sorted ids of the nodes, the ways and the relations in the index that intersect the bounds
+func searchIds(data *osmdata, b *osm.Bounds) [3][]int64 {
+	var ret [3][]int64
+	data.searchNode(b, func(_, _ float64, node *osm.Node) bool {
+		ret[0] = append(ret[0], int64(node.ID))
+		return true
+	})
+	data.searchWay(b, func(_ *osm.Bounds, way *osm.Way) bool {
+		ret[1] = append(ret[1], int64(way.ID))
+		return true
+	})
+	data.searchRelation(b, func(_ *osm.Bounds, rel *osm.Relation) bool {
+		ret[2] = append(ret[2], int64(rel.ID))
+		return true
+	})
+	for _, ids := range ret {
+		sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	}
+	return ret
+}
+
+func pointBounds(lat, lon float64) *osm.Bounds {
+	return &osm.Bounds{MinLat: lat, MinLon: lon, MaxLat: lat, MaxLon: lon}
+}
+
+func TestApplyChangeNode(t *testing.T) {
+	data := newTestOsmData()
+
+	// NODE:0 is the first node of WAY:100 and the stop of REL:301, NODE:2 is an untagged node of WAY:100
+	cs, err := data.ApplyChange(&osm.Change{
+		Create: &osm.OSM{Nodes: osm.Nodes{
+			{ID: 600, Lat: 38, Lon: 128, Tags: osm.Tags{{Key: "amenity", Value: "cafe"}}},
+		}},
+		Modify: &osm.OSM{Nodes: osm.Nodes{
+			{ID: 0, Lat: 36.99, Lon: 126.99, Tags: osm.Tags{{Key: "amenity", Value: "cafe"}}},
+			{ID: 2, Lat: 36.995, Lon: 127.02},
+		}},
+		Delete: &osm.OSM{Nodes: osm.Nodes{{ID: 500}}},
+	})
+	require.Nil(t, err)
+	assert.Equal(t, []int64{0, 2, 500, 600}, cs.Nodes)
+	assert.Equal(t, []int64{100}, cs.Ways)
+	// REL:301 has NODE:0 and WAY:100 as members, REL:302 is the parent of REL:301
+	assert.Equal(t, []int64{301, 302}, cs.Relations)
+
+	assert.Equal(t, [3][]int64{{600}, nil, nil}, searchIds(data, pointBounds(38, 128)))
+	assert.Equal(t, [3][]int64{nil, nil, nil}, searchIds(data, pointBounds(37.095, 127.095)))
+	_, ok := data.GetNode(500)
+	assert.False(t, ok)
+
+	// the bounds of the way and the relations are resolved again with the new position
+	assert.Equal(t, [3][]int64{{0}, {100}, {301, 302}}, searchIds(data, pointBounds(36.99, 126.99)))
+	assert.Equal(t, [3][]int64{{2}, {100}, {301, 302}}, searchIds(data, pointBounds(36.995, 127.02)))
+	assert.Equal(t, [3][]int64{nil, {100}, {301, 302}}, searchIds(data, pointBounds(37, 127.02)))
+	way, _ := data.ways.Get(100)
+	assert.Equal(t, osm.Bounds{MinLat: 36.99, MinLon: 126.99, MaxLat: 37, MaxLon: 127.09}, *way.Bounds)
+	for _, id := range []osm.RelationID{301, 302} {
+		rel, _ := data.relations.Get(id)
+		assert.Equal(t, 36.99, rel.Bounds.MinLat, "REL:%d", id)
+		assert.Equal(t, 126.99, rel.Bounds.MinLon, "REL:%d", id)
+	}
+
+	// the bounds of the change cover both of the old and the new positions
+	for _, p := range [][2]float64{{37, 127}, {36.99, 126.99}, {38, 128}, {37.095, 127.095}} {
+		covered := false
+		for _, b := range cs.Bounds {
+			if b.Min.Lat <= p[0] && p[0] <= b.Max.Lat && b.Min.Lon <= p[1] && p[1] <= b.Max.Lon {
+				covered = true
+				break
+			}
+		}
+		assert.True(t, covered, "%v", p)
+	}
+}
+
+func TestApplyChangeWay(t *testing.T) {
+	data := newTestOsmData()
+
+	cs, err := data.ApplyChange(&osm.Change{
+		Create: &osm.OSM{
+			Nodes: osm.Nodes{{ID: 601, Lat: 38, Lon: 128}, {ID: 602, Lat: 38.01, Lon: 128.01}},
+			Ways: osm.Ways{{ID: 201, Nodes: osm.WayNodes{{ID: 601}, {ID: 602}},
+				Tags: osm.Tags{{Key: "highway", Value: "residential"}}}},
+		},
+		// WAY:200 is the outer of REL:300
+		Modify: &osm.OSM{Ways: osm.Ways{
+			{ID: 200, Nodes: osm.WayNodes{{ID: 12}, {ID: 17}, {ID: 47}, {ID: 42}, {ID: 12}}},
+		}},
+		Delete: &osm.OSM{Ways: osm.Ways{{ID: 109}}},
+	})
+	require.Nil(t, err)
+	assert.Equal(t, []int64{601, 602}, cs.Nodes)
+	assert.Equal(t, []int64{109, 200, 201}, cs.Ways)
+	assert.Equal(t, []int64{300}, cs.Relations)
+
+	assert.Equal(t, [3][]int64{nil, {201}, nil}, searchIds(data, pointBounds(38.005, 128.005)))
+	// NODE:95 of the deleted way is not deleted
+	assert.Equal(t, [3][]int64{{95}, nil, nil}, searchIds(data, pointBounds(37.09, 127.05)))
+	_, ok := data.GetWay(109)
+	assert.False(t, ok)
+
+	way, _ := data.ways.Get(200)
+	assert.Equal(t, osm.Bounds{MinLat: 37.01, MinLon: 127.02, MaxLat: 37.04, MaxLon: 127.07}, *way.Bounds)
+	rel, _ := data.relations.Get(300)
+	assert.Equal(t, *way.Bounds, *rel.Bounds)
+	// the old and the new bounds of WAY:200 are in the index only once
+	assert.Equal(t, [3][]int64{nil, {200}, {300}}, searchIds(data, pointBounds(37.025, 127.065)))
+	assert.Equal(t, [3][]int64{nil, nil, nil}, searchIds(data, pointBounds(37.025, 127.015)))
+}
+
+func TestApplyChangeRelation(t *testing.T) {
+	data := newTestOsmData()
+
+	cs, err := data.ApplyChange(&osm.Change{
+		Create: &osm.OSM{Relations: osm.Relations{{
+			ID:      303,
+			Tags:    osm.Tags{{Key: "type", Value: "route"}, {Key: "route", Value: "bicycle"}},
+			Members: osm.Members{{Type: osm.TypeWay, Ref: 109}},
+		}}},
+		// REL:301 is the member of REL:302
+		Modify: &osm.OSM{Relations: osm.Relations{{
+			ID:      301,
+			Tags:    osm.Tags{{Key: "type", Value: "route"}, {Key: "route", Value: "bus"}},
+			Members: osm.Members{{Type: osm.TypeWay, Ref: 100}},
+		}}},
+		Delete: &osm.OSM{Relations: osm.Relations{{ID: 300}}},
+	})
+	require.Nil(t, err)
+	assert.Nil(t, cs.Nodes)
+	assert.Nil(t, cs.Ways)
+	assert.Equal(t, []int64{300, 301, 302, 303}, cs.Relations)
+
+	assert.Equal(t, [3][]int64{{95}, {109}, {303}}, searchIds(data, pointBounds(37.09, 127.05)))
+	// WAY:101 is no longer the member of REL:301 and REL:302
+	assert.Equal(t, [3][]int64{{18}, {101}, nil}, searchIds(data, pointBounds(37.01, 127.08)))
+	assert.Equal(t, [3][]int64{nil, {200}, nil}, searchIds(data, pointBounds(37.025, 127.035)))
+	_, ok := data.GetRelation(300)
+	assert.False(t, ok)
+
+	for _, id := range []osm.RelationID{301, 302} {
+		rel, _ := data.relations.Get(id)
+		assert.Equal(t, osm.Bounds{MinLat: 37, MinLon: 127, MaxLat: 37, MaxLon: 127.09}, *rel.Bounds, "REL:%d", id)
+	}
+}
+
+func TestApplyChangeInvalidate(t *testing.T) {
+	data := newTestOsmData()
+	cache, err := newMemTileCache(100, 0)
+	require.Nil(t, err)
+	svr := &tileServer{log: logging.GetLog("test"), tileCache: cache}
+
+	const z = 14
+	x0, y0 := projection.LatLon2Tile(37.095, 127.095, z)
+	x1, y1 := projection.LatLon2Tile(38, 128, z)
+	x2, y2 := projection.LatLon2Tile(35, 129, z)
+	changed := []string{tileCacheKey(z, x0, y0, 256), "style/" + tileCacheKey(z, x1, y1, 512), fmt.Sprintf("%d/%d/%d.mvt", z-4, x1>>4, y1>>4)}
+	untouched := tileCacheKey(z, x2, y2, 256)
+	for _, key := range append(changed, untouched) {
+		cache.Add(key, []byte(key))
+	}
+
+	cs, err := data.ApplyChange(&osm.Change{
+		Create: &osm.OSM{Nodes: osm.Nodes{
+			{ID: 600, Lat: 38, Lon: 128, Tags: osm.Tags{{Key: "amenity", Value: "cafe"}}},
+		}},
+		Delete: &osm.OSM{Nodes: osm.Nodes{{ID: 500}}},
+	})
+	require.Nil(t, err)
+	svr.invalidate(cs)
+
+	for _, key := range changed {
+		_, ok := cache.Get(key)
+		assert.False(t, ok, key)
+	}
+	_, ok := cache.Get(untouched)
+	assert.True(t, ok, untouched)
+}
+
+func TestApplyChangeParentRelation(t *testing.T) {
+	data := newTestOsmData()
+
+	// the subarea of a boundary is not a part of the boundary, the member of a site is
+	_, err := data.ApplyChange(&osm.Change{
+		Create: &osm.OSM{Relations: osm.Relations{
+			{
+				ID:   304,
+				Tags: osm.Tags{{Key: "type", Value: "boundary"}, {Key: "boundary", Value: "administrative"}},
+				Members: osm.Members{
+					{Type: osm.TypeWay, Ref: 109, Role: "outer"},
+					{Type: osm.TypeRelation, Ref: 301, Role: "subarea"},
+				},
+			},
+			{
+				ID:      305,
+				Tags:    osm.Tags{{Key: "type", Value: "site"}},
+				Members: osm.Members{{Type: osm.TypeRelation, Ref: 300}},
+			},
+		}},
+	})
+	require.Nil(t, err)
+	rel, _ := data.relations.Get(304)
+	assert.Equal(t, osm.Bounds{MinLat: 37.09, MinLon: 127, MaxLat: 37.09, MaxLon: 127.09}, *rel.Bounds)
+	rel, _ = data.relations.Get(305)
+	assert.Equal(t, osm.Bounds{MinLat: 37.01, MinLon: 127.02, MaxLat: 37.04, MaxLon: 127.05}, *rel.Bounds)
+
+	cs, err := data.ApplyChange(&osm.Change{
+		Modify: &osm.OSM{Nodes: osm.Nodes{{ID: 1, Lat: 37, Lon: 127.015}}},
+	})
+	require.Nil(t, err)
+	assert.Equal(t, []int64{301, 302}, cs.Relations)
+
+	cs, err = data.ApplyChange(&osm.Change{
+		Modify: &osm.OSM{Ways: osm.Ways{
+			{ID: 200, Nodes: osm.WayNodes{{ID: 12}, {ID: 17}, {ID: 47}, {ID: 42}, {ID: 12}}},
+		}},
+	})
+	require.Nil(t, err)
+	assert.Equal(t, []int64{300, 305}, cs.Relations)
+	rel, _ = data.relations.Get(305)
+	assert.Equal(t, 127.07, rel.Bounds.MaxLon)
+
+	// the deleted parent is not marked any more
+	_, err = data.ApplyChange(&osm.Change{Delete: &osm.OSM{Relations: osm.Relations{{ID: 305}}}})
+	require.Nil(t, err)
+	cs, err = data.ApplyChange(&osm.Change{
+		Modify: &osm.OSM{Ways: osm.Ways{
+			{ID: 200, Nodes: osm.WayNodes{{ID: 12}, {ID: 15}, {ID: 45}, {ID: 42}, {ID: 12}}},
+		}},
+	})
+	require.Nil(t, err)
+	assert.Equal(t, []int64{300}, cs.Relations)
+	assert.Empty(t, data.parentRelations[300])
+}
@@ -2,9 +2,9 @@ package main
 
 import (
 	"context"
-	"fmt"
 	"os"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/OutOfBedlam/ots/geom"
@@ -13,7 +13,6 @@ import (
 	"github.com/paulmach/osm"
 	"github.com/paulmach/osm/osmpbf"
 	"github.com/tidwall/btree"
-	"github.com/tidwall/rtree"
 )
 
 type osmdata struct {
@@ -22,12 +21,24 @@ type osmdata struct {
 	relations     *btree.Map[osm.RelationID, *osm.Relation]
 	ways          *btree.Map[osm.WayID, *osm.Way]
 	nodes         *btree.Map[osm.NodeID, *osm.Node]
-	relationIndex *rtree.Generic[*osm.Relation]
-	wayIndex      *rtree.Generic[*osm.Way]
-	nodeIndex     *rtree.Generic[*osm.Node]
+	relationIndex *spatialIndex[*osm.Relation]
+	wayIndex      *spatialIndex[*osm.Way]
+	nodeIndex     *spatialIndex[*osm.Node]
+	// major features for low zoom tiles, nil if it is not built
+	generalized *generalizedIndex
+	// the relations that have the relation as a nested member, see tiles.IsNestedMember
+	parentRelations map[osm.RelationID][]osm.RelationID
+	// guards maps and indexes against changes applied while serving
+	lock sync.RWMutex
+	// the snapshot that the data is loaded from, the indexes refer to it
+	snapshot *mmapOsmd
 }
 
 func (data *osmdata) Close() {
+	if data.snapshot != nil {
+		data.snapshot.Close()
+		data.snapshot = nil
+	}
 }
 
 func (data *osmdata) insertWay(way *osm.Way) {
@@ -44,6 +55,185 @@ func (data *osmdata) insertNode(node *osm.Node) {
 	data.nodeIndex.Insert([2]float64{node.Lon, node.Lat}, [2]float64{node.Lon, node.Lat}, node)
 }
 
+func (data *osmdata) deleteWay(way *osm.Way) {
+	b := way.Bounds
+	data.wayIndex.Delete([2]float64{b.MinLon, b.MinLat}, [2]float64{b.MaxLon, b.MaxLat}, way)
+}
+
+func (data *osmdata) deleteRelation(rel *osm.Relation) {
+	b := rel.Bounds
+	data.relationIndex.Delete([2]float64{b.MinLon, b.MinLat}, [2]float64{b.MaxLon, b.MaxLat}, rel)
+}
+
+func (data *osmdata) deleteNode(node *osm.Node) {
+	data.nodeIndex.Delete([2]float64{node.Lon, node.Lat}, [2]float64{node.Lon, node.Lat}, node)
+}
+
+// addParentRelation registers the relation as the parent of its nested member relations
+func (data *osmdata) addParentRelation(rel *osm.Relation) {
+	typ := rel.Tags.Find("type")
+	for _, m := range rel.Members {
+		if m.Type != osm.TypeRelation || !tiles.IsNestedMember(typ, m.Role) {
+			continue
+		}
+		sub := osm.RelationID(m.Ref)
+		data.parentRelations[sub] = append(data.parentRelations[sub], rel.ID)
+	}
+}
+
+// removeParentRelation undoes addParentRelation, rel should have the members that it was added with
+func (data *osmdata) removeParentRelation(rel *osm.Relation) {
+	typ := rel.Tags.Find("type")
+	for _, m := range rel.Members {
+		if m.Type != osm.TypeRelation || !tiles.IsNestedMember(typ, m.Role) {
+			continue
+		}
+		sub := osm.RelationID(m.Ref)
+		parents := data.parentRelations[sub]
+		for i, p := range parents {
+			if p == rel.ID {
+				parents = append(parents[:i], parents[i+1:]...)
+				break
+			}
+		}
+		if len(parents) == 0 {
+			delete(data.parentRelations, sub)
+		} else {
+			data.parentRelations[sub] = parents
+		}
+	}
+}
+
+func extendBounds(b *osm.Bounds, node *osm.Node) *osm.Bounds {
+	if b == nil {
+		return &osm.Bounds{
+			MinLat: node.Lat, MinLon: node.Lon,
+			MaxLat: node.Lat, MaxLon: node.Lon,
+		}
+	}
+	if b.ContainsNode(node) {
+		return b
+	}
+	if node.Lat < b.MinLat {
+		b.MinLat = node.Lat
+	}
+	if node.Lat > b.MaxLat {
+		b.MaxLat = node.Lat
+	}
+	if node.Lon < b.MinLon {
+		b.MinLon = node.Lon
+	}
+	if node.Lon > b.MaxLon {
+		b.MaxLon = node.Lon
+	}
+	return b
+}
+
+// resolveWay fills coordinates of the way nodes and computes bounds of the way
+func (data *osmdata) resolveWay(way *osm.Way) {
+	way.Bounds = nil
+	for i, n := range way.Nodes {
+		node, b := data.nodes.Get(n.ID)
+		if !b {
+			continue
+		}
+		way.Nodes[i].Version = node.Version
+		way.Nodes[i].Lat = node.Lat
+		way.Nodes[i].Lon = node.Lon
+		way.Bounds = extendBounds(way.Bounds, node)
+	}
+}
+
+// mergeBounds extends b to cover o, b is returned as it is if o is nil
+func mergeBounds(b *osm.Bounds, o *osm.Bounds) *osm.Bounds {
+	if o == nil {
+		return b
+	}
+	b = extendBounds(b, &osm.Node{Lat: o.MinLat, Lon: o.MinLon})
+	return extendBounds(b, &osm.Node{Lat: o.MaxLat, Lon: o.MaxLon})
+}
+
+// resolveRelation fills coordinates of the node and way members and computes bounds of the relation,
+// the bounds include the members of the nested member relations.
+// ways should be resolved in advance.
+func (data *osmdata) resolveRelation(relation *osm.Relation) {
+	relation.Bounds = nil
+	typ := relation.Tags.Find("type")
+	visiting := map[osm.RelationID]bool{relation.ID: true}
+	for m := range relation.Members {
+		if relation.Members[m].Type == osm.TypeNode {
+			node, b := data.nodes.Get(osm.NodeID(relation.Members[m].Ref))
+			if !b {
+				continue
+			}
+			relation.Members[m].Lat = node.Lat
+			relation.Members[m].Lon = node.Lon
+			relation.Members[m].Version = node.Version
+			relation.Bounds = extendBounds(relation.Bounds, node)
+		} else if relation.Members[m].Type == osm.TypeWay {
+			way, b := data.ways.Get(osm.WayID(relation.Members[m].Ref))
+			if !b {
+				continue
+			}
+			relation.Members[m].Version = way.Version
+			relation.Members[m].Nodes = make([]osm.WayNode, len(way.Nodes))
+			copy(relation.Members[m].Nodes, way.Nodes)
+
+			for _, n := range relation.Members[m].Nodes {
+				node, b := data.nodes.Get(n.ID)
+				if !b {
+					continue
+				}
+				relation.Bounds = extendBounds(relation.Bounds, node)
+			}
+		} else if relation.Members[m].Type == osm.TypeRelation {
+			sub, b := data.relations.Get(osm.RelationID(relation.Members[m].Ref))
+			if !b {
+				continue
+			}
+			relation.Members[m].Version = sub.Version
+			if tiles.IsNestedMember(typ, relation.Members[m].Role) {
+				relation.Bounds = mergeBounds(relation.Bounds, data.nestedRelationBounds(sub, visiting))
+			}
+		}
+	}
+}
+
+// nestedRelationBounds computes bounds of the members of the relation and its nested member relations,
+// the bounds of the member relations are not used as they may not be resolved yet.
+// visiting has the relations that are being resolved, a relation in a cycle is not followed again.
+func (data *osmdata) nestedRelationBounds(relation *osm.Relation, visiting map[osm.RelationID]bool) *osm.Bounds {
+	if visiting[relation.ID] {
+		data.log.Debugf("REL:%d is in a cycle of relations", relation.ID)
+		return nil
+	}
+	visiting[relation.ID] = true
+	defer delete(visiting, relation.ID)
+
+	var bounds *osm.Bounds
+	typ := relation.Tags.Find("type")
+	for _, m := range relation.Members {
+		switch m.Type {
+		case osm.TypeNode:
+			if node, b := data.nodes.Get(osm.NodeID(m.Ref)); b {
+				bounds = extendBounds(bounds, node)
+			}
+		case osm.TypeWay:
+			if way, b := data.ways.Get(osm.WayID(m.Ref)); b {
+				bounds = mergeBounds(bounds, way.Bounds)
+			}
+		case osm.TypeRelation:
+			if !tiles.IsNestedMember(typ, m.Role) {
+				continue
+			}
+			if sub, b := data.relations.Get(osm.RelationID(m.Ref)); b {
+				bounds = mergeBounds(bounds, data.nestedRelationBounds(sub, visiting))
+			}
+		}
+	}
+	return bounds
+}
+
 func (data *osmdata) searchRelation(bound *osm.Bounds, cb func(b *osm.Bounds, value *osm.Relation) bool) {
 	data.relationIndex.Search(
 		[2]float64{bound.MinLon, bound.MinLat},
@@ -82,15 +272,7 @@ func loadOsmData(osmPbfPath string) (*osmdata, error) {
 	scanner := osmpbf.New(context.Background(), f, 3)
 	defer scanner.Close()
 
-	data := &osmdata{
-		log:           logging.GetLog("osm-data"),
-		relationIndex: &rtree.Generic[*osm.Relation]{},
-		wayIndex:      &rtree.Generic[*osm.Way]{},
-		nodeIndex:     &rtree.Generic[*osm.Node]{},
-		relations:     &btree.Map[osm.RelationID, *osm.Relation]{},
-		ways:          &btree.Map[osm.WayID, *osm.Way]{},
-		nodes:         &btree.Map[osm.NodeID, *osm.Node]{},
-	}
+	data := newOsmData()
 
 	tick := time.Now()
 	for scanner.Scan() {
@@ -109,49 +291,34 @@ func loadOsmData(osmPbfPath string) (*osmdata, error) {
 	}
 	data.log.Debugf("loading osm data time elapse: %s", time.Since(tick))
 
-	var extend = func(b *osm.Bounds, node *osm.Node) {
-		if b.ContainsNode(node) {
-			return
-		}
-		if node.Lat < b.MinLat {
-			b.MinLat = node.Lat
-		}
-		if node.Lat > b.MaxLat {
-			b.MaxLat = node.Lat
-		}
-		if node.Lon < b.MinLon {
-			b.MinLon = node.Lon
-		}
-		if node.Lon > b.MaxLon {
-			b.MaxLon = node.Lon
-		}
+	data.resolve()
+	return data, nil
+}
+
+func newOsmData() *osmdata {
+	return &osmdata{
+		log:             logging.GetLog("osm-data"),
+		relationIndex:   &spatialIndex[*osm.Relation]{},
+		wayIndex:        &spatialIndex[*osm.Way]{},
+		nodeIndex:       &spatialIndex[*osm.Node]{},
+		relations:       &btree.Map[osm.RelationID, *osm.Relation]{},
+		ways:            &btree.Map[osm.WayID, *osm.Way]{},
+		nodes:           &btree.Map[osm.NodeID, *osm.Node]{},
+		parentRelations: map[osm.RelationID][]osm.RelationID{},
 	}
+}
 
+// resolve fills coordinates and bounds of the loaded ways and relations, and builds the spatial indexes
+func (data *osmdata) resolve() {
 	for _, node := range data.nodes.Values() {
 		data.insertNode(node)
 	}
 
-	tick = time.Now()
+	tick := time.Now()
 	closeWay := 0
 	openWay := 0
 	for _, way := range data.ways.Values() {
-		for i, n := range way.Nodes {
-			node, b := data.nodes.Get(n.ID)
-			if !b {
-				continue
-			}
-			way.Nodes[i].Version = node.Version
-			way.Nodes[i].Lat = node.Lat
-			way.Nodes[i].Lon = node.Lon
-			if way.Bounds == nil {
-				way.Bounds = &osm.Bounds{
-					MinLat: node.Lat, MinLon: node.Lon,
-					MaxLat: node.Lat, MaxLon: node.Lon,
-				}
-			} else {
-				extend(way.Bounds, node)
-			}
-		}
+		data.resolveWay(way)
 		if len(way.Nodes) > 0 {
 			if way.Nodes[0].Lat == way.Nodes[len(way.Nodes)-1].Lat &&
 				way.Nodes[0].Lon == way.Nodes[len(way.Nodes)-1].Lon {
@@ -170,71 +337,22 @@ func loadOsmData(osmPbfPath string) (*osmdata, error) {
 
 	tick = time.Now()
 	for _, relation := range data.relations.Values() {
-		for m := range relation.Members {
-			if relation.Members[m].Type == osm.TypeNode {
-				node, b := data.nodes.Get(osm.NodeID(relation.Members[m].Ref))
-				if !b {
-					continue
-				}
-				relation.Members[m].Lat = node.Lat
-				relation.Members[m].Lon = node.Lon
-				relation.Members[m].Version = node.Version
-				if relation.Bounds == nil {
-					relation.Bounds = &osm.Bounds{
-						MinLat: node.Lat, MinLon: node.Lon,
-						MaxLat: node.Lat, MaxLon: node.Lon,
-					}
-				} else {
-					extend(relation.Bounds, node)
-				}
-			} else if relation.Members[m].Type == osm.TypeWay {
-				way, b := data.ways.Get(osm.WayID(relation.Members[m].Ref))
-				if !b {
-					continue
-				}
-				relation.Members[m].Version = way.Version
-				relation.Members[m].Nodes = make([]osm.WayNode, len(way.Nodes))
-				for i, node := range way.Nodes {
-					relation.Members[m].Nodes[i] = node
-				}
-
-				strPoints := make([]string, 0)
-				for i, n := range relation.Members[m].Nodes {
-					node, b := data.nodes.Get(n.ID)
-					if !b {
-						continue
-					}
-
-					strPoints = append(strPoints, fmt.Sprintf("%f %f", node.Lon, node.Lat))
-
-					relation.Members[m].Nodes[i].Lat = node.Lat
-					relation.Members[m].Nodes[i].Lon = node.Lon
-
-					if relation.Bounds == nil {
-						relation.Bounds = &osm.Bounds{
-							MinLat: node.Lat, MinLon: node.Lon,
-							MaxLat: node.Lat, MaxLon: node.Lon,
-						}
-					} else {
-						extend(relation.Bounds, node)
-					}
-				}
-			} else if relation.Members[m].Type == osm.TypeRelation {
-				continue
-			} else {
-				continue
-			}
-		}
+		data.addParentRelation(relation)
+		data.resolveRelation(relation)
 		if relation.Bounds != nil {
 			data.insertRelation(relation)
 		}
 	}
 	data.log.Debugf("loading relations time elapse: %s", time.Since(tick))
-
-	return data, nil
 }
 
 func (data *osmdata) GetWay(id int64) (*tiles.Way, bool) {
+	data.lock.RLock()
+	defer data.lock.RUnlock()
+	return data.getWay(id)
+}
+
+func (data *osmdata) getWay(id int64) (*tiles.Way, bool) {
 	way, b := data.ways.Get(osm.WayID(id))
 	if !b {
 		return nil, false
@@ -267,6 +385,12 @@ func (data *osmdata) GetWay(id int64) (*tiles.Way, bool) {
 }
 
 func (data *osmdata) GetNode(id int64) (*tiles.Node, bool) {
+	data.lock.RLock()
+	defer data.lock.RUnlock()
+	return data.getNode(id)
+}
+
+func (data *osmdata) getNode(id int64) (*tiles.Node, bool) {
 	n, b := data.nodes.Get(osm.NodeID(id))
 	if !b {
 		return nil, false
@@ -280,6 +404,12 @@ func (data *osmdata) GetNode(id int64) (*tiles.Node, bool) {
 }
 
 func (data *osmdata) GetRelation(id int64) (*tiles.Relation, bool) {
+	data.lock.RLock()
+	defer data.lock.RUnlock()
+	return data.getRelation(id)
+}
+
+func (data *osmdata) getRelation(id int64) (*tiles.Relation, bool) {
 	rel, b := data.relations.Get(osm.RelationID(id))
 	if !b {
 		return nil, false
@@ -306,11 +436,14 @@ func (data *osmdata) GetRelation(id int64) (*tiles.Relation, bool) {
 }
 
 func (data *osmdata) SearchNodes(tag string, keyword string) []*tiles.Node {
+	data.lock.RLock()
+	defer data.lock.RUnlock()
+
 	rt := make([]*tiles.Node, 0)
 	for _, node := range data.nodes.Values() {
 		tagValue := node.Tags.Find(tag)
 		if strings.Contains(tagValue, keyword) {
-			if n, b := data.GetNode(int64(node.ID)); b {
+			if n, b := data.getNode(int64(node.ID)); b {
 				rt = append(rt, n)
 			}
 		}
@@ -319,11 +452,14 @@ func (data *osmdata) SearchNodes(tag string, keyword string) []*tiles.Node {
 }
 
 func (data *osmdata) SearchWays(tag string, keyword string) []*tiles.Way {
+	data.lock.RLock()
+	defer data.lock.RUnlock()
+
 	rt := make([]*tiles.Way, 0)
 	for _, way := range data.ways.Values() {
 		tagValue := way.Tags.Find(tag)
 		if strings.Contains(tagValue, keyword) {
-			if n, b := data.GetWay(int64(way.ID)); b {
+			if n, b := data.getWay(int64(way.ID)); b {
 				rt = append(rt, n)
 			}
 		}
@@ -332,11 +468,14 @@ func (data *osmdata) SearchWays(tag string, keyword string) []*tiles.Way {
 }
 
 func (data *osmdata) SearchRelations(tag string, keyword string) []*tiles.Relation {
+	data.lock.RLock()
+	defer data.lock.RUnlock()
+
 	rt := make([]*tiles.Relation, 0)
 	for _, rel := range data.relations.Values() {
 		tagValue := rel.Tags.Find(tag)
 		if strings.Contains(tagValue, keyword) {
-			if n, b := data.GetRelation(int64(rel.ID)); b {
+			if n, b := data.getRelation(int64(rel.ID)); b {
 				rt = append(rt, n)
 			}
 		}
@@ -400,6 +539,7 @@ func (data *osmdata) _searchWay(b *osm.Bounds, rset *ResultSet, rawNodes *btree.
 }
 
 func (data *osmdata) _searchRelation(b *osm.Bounds, rset *ResultSet, rawNodes *btree.Map[int64, *osm.Node]) {
+	// member relations are not added here, the nested ones intersect the bounds as well if they are to be drawn
 	data.searchRelation(b, func(b *osm.Bounds, obj *osm.Relation) bool {
 		r := &tiles.Relation{
 			Id:      int64(obj.ID),
@@ -430,7 +570,7 @@ func (data *osmdata) _searchRelation(b *osm.Bounds, rset *ResultSet, rawNodes *b
 					}
 				}
 				if !contains {
-					if way, b := data.ways.Get(osm.WayID(m.Ref)); b {
+					if way, b := data.ways.Get(osm.WayID(m.Ref)); b && way.Bounds != nil {
 						w := _osmWayToTileWay(way)
 						rset.Ways = append(rset.Ways, w)
 					} else {
@@ -459,6 +599,9 @@ func (data *osmdata) IntersectsBounds(bounds geom.Bound) (rset *ResultSet, err e
 		}()
 	}
 
+	data.lock.RLock()
+	defer data.lock.RUnlock()
+
 	searchBound := &osm.Bounds{
 		MinLat: bounds.Min.Lat, MinLon: bounds.Min.Lon,
 		MaxLat: bounds.Max.Lat, MaxLon: bounds.Max.Lon}
@@ -0,0 +1,461 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/OutOfBedlam/ots/geom"
+	"github.com/OutOfBedlam/ots/tiles"
+	"github.com/paulmach/osm"
+	"github.com/tidwall/btree"
+	"github.com/tidwall/rtree"
+)
+
+// GeneralizedSource is implemented by the data sources that serve generalized objects for low zoom tiles
+type GeneralizedSource interface {
+	// IntersectsBoundsZoom returns the major features in the bounds
+	// with geometries simplified for the zoom level (up to tiles.GeneralizedMaxZoom).
+	IntersectsBoundsZoom(bounds geom.Bound, zoom int) (*ResultSet, error)
+}
+
+// intersectsBoundsZoom returns objects to render the tile of the zoom level,
+// the data source that does not support generalization returns all objects in the bounds
+// and the builder picks the major features.
+// The bounds that goes beyond the antimeridian is searched on the both sides.
+func intersectsBoundsZoom(ds DataSource, bounds geom.Bound, zoom int) (*ResultSet, error) {
+	parts := bounds.SplitAntimeridian()
+	rset, err := _intersectsBoundsZoom(ds, parts[0], zoom)
+	if err != nil {
+		return nil, err
+	}
+	for _, b := range parts[1:] {
+		more, err := _intersectsBoundsZoom(ds, b, zoom)
+		if err != nil {
+			return nil, err
+		}
+		rset.merge(more)
+	}
+	return rset, nil
+}
+
+func _intersectsBoundsZoom(ds DataSource, bounds geom.Bound, zoom int) (*ResultSet, error) {
+	if zoom <= tiles.GeneralizedMaxZoom {
+		if gs, ok := ds.(GeneralizedSource); ok {
+			return gs.IntersectsBoundsZoom(bounds, zoom)
+		}
+	}
+	return ds.IntersectsBounds(bounds)
+}
+
+// generalizedIndex keeps simplified copies of the major features for each low zoom level,
+// so that low zoom tiles are rendered without loading all objects of the bounds.
+type generalizedIndex struct {
+	levels [tiles.GeneralizedMaxZoom + 1]*generalizedLevel
+}
+
+type generalizedLevel struct {
+	wayIndex      rtree.Generic[*tiles.Way]
+	relationIndex rtree.Generic[*generalizedRelation]
+	nodeIndex     rtree.Generic[*tiles.Node]
+	ways          map[int64]*tiles.Way
+	relations     map[int64]*generalizedRelation
+	nodes         map[int64]*tiles.Node
+}
+
+// generalizedRelation carries its member ways, they are not major features by themselves in general.
+// The member relations and their member ways are carried as well.
+type generalizedRelation struct {
+	relation *tiles.Relation
+	members  []*tiles.Way
+	subs     []*tiles.Relation
+}
+
+// keys of tags that tiles.GeneralizedMinZoom looks into
+var generalizedTagKeys = map[string]bool{
+	"place": true, "highway": true, "boundary": true, "natural": true,
+	"waterway": true, "water": true, "landuse": true,
+}
+
+func generalizedMinZoom(tags osm.Tags, extent float64) int {
+	for _, t := range tags {
+		if generalizedTagKeys[t.Key] {
+			return tiles.GeneralizedMinZoom(tags.Map(), extent)
+		}
+	}
+	return tiles.GeneralizedMaxZoom + 1
+}
+
+func boundsExtent(b *osm.Bounds) float64 {
+	if b.MaxLat-b.MinLat > b.MaxLon-b.MinLon {
+		return b.MaxLat - b.MinLat
+	}
+	return b.MaxLon - b.MinLon
+}
+
+func newGeneralizedIndex() *generalizedIndex {
+	gi := &generalizedIndex{}
+	for z := range gi.levels {
+		gi.levels[z] = newGeneralizedLevel()
+	}
+	return gi
+}
+
+func newGeneralizedLevel() *generalizedLevel {
+	return &generalizedLevel{
+		ways:      map[int64]*tiles.Way{},
+		relations: map[int64]*generalizedRelation{},
+		nodes:     map[int64]*tiles.Node{},
+	}
+}
+
+// buildGeneralized builds the generalized index of all objects, the data should be resolved in advance.
+func (data *osmdata) buildGeneralized() {
+	tick := time.Now()
+	gi := newGeneralizedIndex()
+	for _, node := range data.nodes.Values() {
+		gi.setNode(node)
+	}
+	for _, way := range data.ways.Values() {
+		gi.setWay(way)
+	}
+	for _, rel := range data.relations.Values() {
+		gi.setRelation(data, rel)
+	}
+	data.generalized = gi
+
+	counts := gi.counts()
+	data.log.Debugf("generalized index nodes:%d ways:%d relations:%d %s", counts[0], counts[1], counts[2], time.Since(tick))
+}
+
+// kinds of the records of the major table of the on-disk index
+const (
+	mmapMajorNode uint8 = iota
+	mmapMajorWay
+	mmapMajorRelation
+)
+
+// mmapMajor is the record of the major table, the major feature is the index-th record of the table of the kind
+type mmapMajor struct {
+	index   uint64
+	kind    uint8
+	minZoom uint8
+}
+
+// mmapGeneralizedLevel is built from the major table when the level is queried first,
+// the index does not change so that it is built only once.
+type mmapGeneralizedLevel struct {
+	once  sync.Once
+	level *generalizedLevel
+}
+
+// generalizedLevel returns the level of the zoom, the levels that are not queried do not take memory
+func (ds *mmapOsmd) generalizedLevel(zoom int) *generalizedLevel {
+	gl := &ds.generalized[zoom]
+	gl.once.Do(func() {
+		gl.level = ds.buildGeneralizedLevel(zoom)
+	})
+	return gl.level
+}
+
+// buildGeneralizedLevel builds the level of the zoom from the major features of minZoom up to the zoom,
+// they are the prefix of the major table.
+func (ds *mmapOsmd) buildGeneralizedLevel(zoom int) *generalizedLevel {
+	tick := time.Now()
+	l := newGeneralizedLevel()
+	n := sort.Search(int(ds.hdr.MajorCount), func(i int) bool {
+		return int(ds.data[ds.majorRecord(i)+9]) > zoom
+	})
+	for i := 0; i < n; i++ {
+		rec := ds.majorRecord(i)
+		index := ds.u64(rec)
+		switch ds.data[rec+8] {
+		case mmapMajorNode:
+			if index < ds.hdr.NodeCount {
+				l.addNode(ds.node(int(index)))
+			}
+		case mmapMajorWay:
+			if index < ds.hdr.WayCount {
+				l.addWay(tiles.GeneralizeWay(ds.way(int(index)), zoom))
+			}
+		case mmapMajorRelation:
+			if index < ds.hdr.RelCount {
+				r := ds.relation(int(index))
+				members := make([]*tiles.Way, 0)
+				subs := make([]*tiles.Relation, 0)
+				ds.collectGeneralizedMembers(r, map[int64]bool{}, &members, &subs)
+				l.addRelation(r, members, subs, zoom)
+			}
+		}
+	}
+	ds.log.Infof("generalized level %d nodes:%d ways:%d relations:%d %s", zoom, len(l.nodes), len(l.ways), len(l.relations), time.Since(tick))
+	return l
+}
+
+// counts returns the number of nodes, ways and relations of all levels
+func (gi *generalizedIndex) counts() [3]int {
+	counts := [3]int{}
+	for _, l := range gi.levels {
+		counts[0] += len(l.nodes)
+		counts[1] += len(l.ways)
+		counts[2] += len(l.relations)
+	}
+	return counts
+}
+
+func (gi *generalizedIndex) setNode(node *osm.Node) {
+	minZoom := generalizedMinZoom(node.Tags, 0)
+	if minZoom > tiles.GeneralizedMaxZoom {
+		return
+	}
+	n := &tiles.Node{
+		Id:   int64(node.ID),
+		Tags: node.TagMap(),
+		Lat:  node.Lat,
+		Lon:  node.Lon,
+	}
+	gi.addNode(n, minZoom)
+}
+
+// addNode adds the node to the levels from minZoom
+func (gi *generalizedIndex) addNode(n *tiles.Node, minZoom int) {
+	for z := minZoom; z <= tiles.GeneralizedMaxZoom; z++ {
+		gi.levels[z].addNode(n)
+	}
+}
+
+func (l *generalizedLevel) addNode(n *tiles.Node) {
+	l.nodes[n.Id] = n
+	l.nodeIndex.Insert([2]float64{n.Lon, n.Lat}, [2]float64{n.Lon, n.Lat}, n)
+}
+
+func (gi *generalizedIndex) setWay(way *osm.Way) {
+	if way.Bounds == nil {
+		return
+	}
+	minZoom := generalizedMinZoom(way.Tags, boundsExtent(way.Bounds))
+	if minZoom > tiles.GeneralizedMaxZoom {
+		return
+	}
+	gi.addWay(_osmWayToTileWay(way), minZoom)
+}
+
+// addWay adds the way to the levels from minZoom, simplified for each level
+func (gi *generalizedIndex) addWay(w *tiles.Way, minZoom int) {
+	for z := minZoom; z <= tiles.GeneralizedMaxZoom; z++ {
+		gi.levels[z].addWay(tiles.GeneralizeWay(w, z))
+	}
+}
+
+// addWay adds the way that is simplified for the level
+func (l *generalizedLevel) addWay(gw *tiles.Way) {
+	l.ways[gw.Id] = gw
+	l.wayIndex.Insert([2]float64{gw.MinLon, gw.MinLat}, [2]float64{gw.MaxLon, gw.MaxLat}, gw)
+}
+
+func (gi *generalizedIndex) setRelation(data *osmdata, rel *osm.Relation) {
+	if rel.Bounds == nil {
+		return
+	}
+	minZoom := generalizedMinZoom(rel.Tags, boundsExtent(rel.Bounds))
+	if minZoom > tiles.GeneralizedMaxZoom {
+		return
+	}
+	r := _osmRelationToTileRelation(rel)
+	members := make([]*tiles.Way, 0)
+	subs := make([]*tiles.Relation, 0)
+	data.collectGeneralizedMembers(rel, map[osm.RelationID]bool{}, &members, &subs)
+	gi.addRelation(r, members, subs, minZoom)
+}
+
+// addRelation adds the relation to the levels from minZoom with its member ways simplified for each level
+func (gi *generalizedIndex) addRelation(r *tiles.Relation, members []*tiles.Way, subs []*tiles.Relation, minZoom int) {
+	for z := minZoom; z <= tiles.GeneralizedMaxZoom; z++ {
+		gi.levels[z].addRelation(r, members, subs, z)
+	}
+}
+
+// addRelation adds the relation with its member ways simplified for the zoom of the level
+func (l *generalizedLevel) addRelation(r *tiles.Relation, members []*tiles.Way, subs []*tiles.Relation, zoom int) {
+	gr := &generalizedRelation{relation: r, members: make([]*tiles.Way, len(members)), subs: subs}
+	for i, w := range members {
+		gr.members[i] = tiles.GeneralizeWay(w, zoom)
+	}
+	l.relations[r.Id] = gr
+	l.relationIndex.Insert([2]float64{r.MinLon, r.MinLat}, [2]float64{r.MaxLon, r.MaxLat}, gr)
+}
+
+// collectGeneralizedMembers collects the member ways of the relation and the nested member relations recursively,
+// a relation in a cycle is not followed again.
+func (data *osmdata) collectGeneralizedMembers(rel *osm.Relation, visiting map[osm.RelationID]bool, ways *[]*tiles.Way, subs *[]*tiles.Relation) {
+	visiting[rel.ID] = true
+	defer delete(visiting, rel.ID)
+	typ := rel.Tags.Find("type")
+	for _, m := range rel.Members {
+		switch m.Type {
+		case osm.TypeWay:
+			if way, ok := data.ways.Get(osm.WayID(m.Ref)); ok && way.Bounds != nil {
+				*ways = append(*ways, _osmWayToTileWay(way))
+			}
+		case osm.TypeRelation:
+			if !tiles.IsNestedMember(typ, m.Role) || visiting[osm.RelationID(m.Ref)] {
+				continue
+			}
+			if sub, ok := data.relations.Get(osm.RelationID(m.Ref)); ok {
+				*subs = append(*subs, _osmRelationToTileRelation(sub))
+				data.collectGeneralizedMembers(sub, visiting, ways, subs)
+			}
+		}
+	}
+}
+
+// collectGeneralizedMembers is the same with the one of osmdata for the on-disk index
+func (ds *mmapOsmd) collectGeneralizedMembers(rel *tiles.Relation, visiting map[int64]bool, ways *[]*tiles.Way, subs *[]*tiles.Relation) {
+	visiting[rel.Id] = true
+	defer delete(visiting, rel.Id)
+	for _, m := range rel.Members {
+		switch m.Type {
+		case tiles.Relation_WAY:
+			if i, ok := ds.find(ds.hdr.WayCount, ds.wayRecord, m.Id); ok && ds.osmBounds(ds.wayRecord(i)+8) != nil {
+				*ways = append(*ways, ds.way(i))
+			}
+		case tiles.Relation_RELATION:
+			if !tiles.IsNestedMember(rel.Tags["type"], m.Role) || visiting[m.Id] {
+				continue
+			}
+			if sub, ok := ds.GetRelation(m.Id); ok {
+				*subs = append(*subs, sub)
+				ds.collectGeneralizedMembers(sub, visiting, ways, subs)
+			}
+		}
+	}
+}
+
+func _osmRelationToTileRelation(rel *osm.Relation) *tiles.Relation {
+	r := &tiles.Relation{
+		Id:      int64(rel.ID),
+		Tags:    rel.TagMap(),
+		Members: make([]*tiles.Relation_Member, len(rel.Members)),
+	}
+	if rel.Bounds != nil {
+		r.MinLat, r.MinLon = rel.Bounds.MinLat, rel.Bounds.MinLon
+		r.MaxLat, r.MaxLon = rel.Bounds.MaxLat, rel.Bounds.MaxLon
+	}
+	for i, m := range rel.Members {
+		r.Members[i] = &tiles.Relation_Member{
+			Id:   m.Ref,
+			Type: tiles.RelationMemberType(m.Type),
+			Role: m.Role,
+		}
+	}
+	return r
+}
+
+func (gi *generalizedIndex) removeNode(id int64) {
+	for _, l := range gi.levels {
+		if n, ok := l.nodes[id]; ok {
+			l.nodeIndex.Delete([2]float64{n.Lon, n.Lat}, [2]float64{n.Lon, n.Lat}, n)
+			delete(l.nodes, id)
+		}
+	}
+}
+
+func (gi *generalizedIndex) removeWay(id int64) {
+	for _, l := range gi.levels {
+		if w, ok := l.ways[id]; ok {
+			l.wayIndex.Delete([2]float64{w.MinLon, w.MinLat}, [2]float64{w.MaxLon, w.MaxLat}, w)
+			delete(l.ways, id)
+		}
+	}
+}
+
+func (gi *generalizedIndex) removeRelation(id int64) {
+	for _, l := range gi.levels {
+		if gr, ok := l.relations[id]; ok {
+			r := gr.relation
+			l.relationIndex.Delete([2]float64{r.MinLon, r.MinLat}, [2]float64{r.MaxLon, r.MaxLat}, gr)
+			delete(l.relations, id)
+		}
+	}
+}
+
+// update replaces the generalized objects of the changes, the changes should be applied to the data in advance.
+func (gi *generalizedIndex) update(data *osmdata, cs *ChangeSet) {
+	for _, id := range cs.Nodes {
+		gi.removeNode(id)
+		if node, ok := data.nodes.Get(osm.NodeID(id)); ok {
+			gi.setNode(node)
+		}
+	}
+	for _, id := range cs.Ways {
+		gi.removeWay(id)
+		if way, ok := data.ways.Get(osm.WayID(id)); ok {
+			gi.setWay(way)
+		}
+	}
+	for _, id := range cs.Relations {
+		gi.removeRelation(id)
+		if rel, ok := data.relations.Get(osm.RelationID(id)); ok {
+			gi.setRelation(data, rel)
+		}
+	}
+}
+
+func (data *osmdata) IntersectsBoundsZoom(bounds geom.Bound, zoom int) (*ResultSet, error) {
+	if data.generalized == nil || zoom < 0 || zoom > tiles.GeneralizedMaxZoom {
+		return data.IntersectsBounds(bounds)
+	}
+
+	data.lock.RLock()
+	defer data.lock.RUnlock()
+	return data.generalized.intersects(bounds, zoom), nil
+}
+
+func (ds *mmapOsmd) IntersectsBoundsZoom(bounds geom.Bound, zoom int) (*ResultSet, error) {
+	if zoom < 0 || zoom > tiles.GeneralizedMaxZoom {
+		return ds.IntersectsBounds(bounds)
+	}
+	return ds.generalizedLevel(zoom).intersects(bounds), nil
+}
+
+// intersects returns the generalized objects of the zoom level in the bounds
+func (gi *generalizedIndex) intersects(bounds geom.Bound, zoom int) *ResultSet {
+	return gi.levels[zoom].intersects(bounds)
+}
+
+// intersects returns the generalized objects of the level in the bounds
+func (l *generalizedLevel) intersects(bounds geom.Bound) *ResultSet {
+	min, max := [2]float64{bounds.Min.Lon, bounds.Min.Lat}, [2]float64{bounds.Max.Lon, bounds.Max.Lat}
+
+	ways := btree.Map[int64, *tiles.Way]{}
+	rset := &ResultSet{
+		Nodes:     make([]*tiles.Node, 0),
+		Relations: make([]*tiles.Relation, 0),
+	}
+	l.nodeIndex.Search(min, max, func(_, _ [2]float64, n *tiles.Node) bool {
+		rset.Nodes = append(rset.Nodes, n)
+		return true
+	})
+	l.wayIndex.Search(min, max, func(_, _ [2]float64, w *tiles.Way) bool {
+		ways.Set(w.Id, w)
+		return true
+	})
+	relations := btree.Map[int64, *tiles.Relation]{}
+	l.relationIndex.Search(min, max, func(_, _ [2]float64, gr *generalizedRelation) bool {
+		relations.Set(gr.relation.Id, gr.relation)
+		for _, sub := range gr.subs {
+			if _, ok := relations.Get(sub.Id); !ok {
+				relations.Set(sub.Id, sub)
+			}
+		}
+		for _, w := range gr.members {
+			if _, ok := ways.Get(w.Id); !ok {
+				ways.Set(w.Id, w)
+			}
+		}
+		return true
+	})
+	rset.Relations = relations.Values()
+	rset.Ways = ways.Values()
+	return rset
+}
@@ -0,0 +1,705 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/OutOfBedlam/ots/geom"
+	"github.com/OutOfBedlam/ots/logging"
+	"github.com/OutOfBedlam/ots/tiles"
+	"github.com/paulmach/osm"
+	"github.com/pkg/errors"
+	"github.com/tidwall/btree"
+	"golang.org/x/sys/unix"
+)
+
+// On-disk index of osm data, the file is memory mapped and queried without loading into memory.
+//
+// layout (little endian)
+//
+//	header      magic[8] + mmapHeader, padded to mmapHeaderSize
+//	blob        tags, way nodes and relation members, referenced by offset from the records
+//	node table  [NodeCount]{id int64, lat int32, lon int32, blob uint64}  sorted by id
+//	way table   [WayCount]{id int64, minLat, minLon, maxLat, maxLon float64, blob uint64}  sorted by id
+//	rel table   [RelCount]{id int64, minLat, minLon, maxLat, maxLon float64, blob uint64}  sorted by id
+//	major table [MajorCount]{index uint64, kind uint8, minZoom uint8, pad[6]}  major features of low zoom levels sorted by minZoom
+//	node tree   packedRTree of nodes
+//	way tree    packedRTree of ways
+//	rel tree    packedRTree of relations
+const (
+	// the version is bumped whenever the layout or the resolving of the data is changed,
+	// so that the index files and the snapshots of the old versions are rebuilt
+	mmapMagic           = "OTSIDX04"
+	mmapHeaderSize      = 256
+	mmapNodeRecordSize  = 24
+	mmapWayRecordSize   = 48
+	mmapRelRecordSize   = 48
+	mmapMajorRecordSize = 16
+	mmapCoordScale      = 1e7
+	MmapIndexExt        = ".otsidx"
+)
+
+type mmapHeader struct {
+	NodeCount  uint64
+	WayCount   uint64
+	RelCount   uint64
+	Blob       uint64
+	NodeTable  uint64
+	WayTable   uint64
+	RelTable   uint64
+	NodeTree   uint64
+	WayTree    uint64
+	RelTree    uint64
+	Checksum   [32]byte // sha256 of the source osm.pbf file
+	MajorCount uint64
+	MajorTable uint64
+}
+
+// valid returns true if the sections are in the order of the layout within the file of the size,
+// and the tables have the records of the counts.
+func (hdr *mmapHeader) valid(size uint64) bool {
+	sections := []struct {
+		off        uint64
+		count      uint64
+		recordSize uint64
+	}{
+		{hdr.Blob, 0, 0},
+		{hdr.NodeTable, hdr.NodeCount, mmapNodeRecordSize},
+		{hdr.WayTable, hdr.WayCount, mmapWayRecordSize},
+		{hdr.RelTable, hdr.RelCount, mmapRelRecordSize},
+		{hdr.MajorTable, hdr.MajorCount, mmapMajorRecordSize},
+		{hdr.NodeTree, 0, 0},
+		{hdr.WayTree, 0, 0},
+		{hdr.RelTree, 0, 0},
+	}
+	end := uint64(mmapHeaderSize)
+	for _, s := range sections {
+		if s.off < end || s.off > size {
+			return false
+		}
+		if s.recordSize > 0 && s.count > (size-s.off)/s.recordSize {
+			return false
+		}
+		end = s.off + s.count*s.recordSize
+	}
+	return true
+}
+
+type mmapOsmd struct {
+	DataSource
+	log      logging.Log
+	data     []byte
+	hdr      mmapHeader
+	nodeTree *packedRTree
+	wayTree  *packedRTree
+	relTree  *packedRTree
+	// major features for low zoom tiles, each level is built from the major table when it is queried first
+	generalized [tiles.GeneralizedMaxZoom + 1]mmapGeneralizedLevel
+}
+
+func openMmapOsmData(path string) (*mmapOsmd, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if fi.Size() < mmapHeaderSize {
+		return nil, fmt.Errorf("invalid index file %s", path)
+	}
+
+	data, err := unix.Mmap(int(f.Fd()), 0, int(fi.Size()), unix.PROT_READ, unix.MAP_SHARED)
+	if err != nil {
+		return nil, errors.Wrap(err, "mmap")
+	}
+
+	if magic := string(data[:len(mmapMagic)]); magic != mmapMagic {
+		unix.Munmap(data)
+		if strings.HasPrefix(magic, mmapMagic[:6]) {
+			return nil, fmt.Errorf("index file %s is version %s, rebuild it for version %s", path, magic[6:], mmapMagic[6:])
+		}
+		return nil, fmt.Errorf("invalid index file %s", path)
+	}
+
+	ds := &mmapOsmd{
+		log:  logging.GetLog("osm-mmap"),
+		data: data,
+	}
+	if err := binary.Read(bytes.NewReader(data[len(mmapMagic):]), binary.LittleEndian, &ds.hdr); err != nil {
+		unix.Munmap(data)
+		return nil, err
+	}
+	if !ds.hdr.valid(uint64(len(data))) {
+		unix.Munmap(data)
+		return nil, fmt.Errorf("invalid index file %s, truncated or corrupted", path)
+	}
+	trees := []struct {
+		tree  **packedRTree
+		start uint64
+		end   uint64
+		count uint64
+	}{
+		{&ds.nodeTree, ds.hdr.NodeTree, ds.hdr.WayTree, ds.hdr.NodeCount},
+		{&ds.wayTree, ds.hdr.WayTree, ds.hdr.RelTree, ds.hdr.WayCount},
+		{&ds.relTree, ds.hdr.RelTree, uint64(len(data)), ds.hdr.RelCount},
+	}
+	for _, t := range trees {
+		tree, err := openPackedRTree(data[t.start:t.end])
+		if err == nil && uint64(tree.numItems) > t.count {
+			err = fmt.Errorf("%d items of %d records", tree.numItems, t.count)
+		}
+		if err != nil {
+			unix.Munmap(data)
+			return nil, fmt.Errorf("invalid index file %s, %s", path, err.Error())
+		}
+		*t.tree = tree
+	}
+
+	ds.log.Infof("index %s nodes:%d ways:%d relations:%d", path, ds.hdr.NodeCount, ds.hdr.WayCount, ds.hdr.RelCount)
+	return ds, nil
+}
+
+func (ds *mmapOsmd) Close() {
+	if ds.data != nil {
+		unix.Munmap(ds.data)
+		ds.data = nil
+	}
+}
+
+//#region record access
+
+func (ds *mmapOsmd) u64(off uint64) uint64 {
+	return binary.LittleEndian.Uint64(ds.data[off:])
+}
+
+func (ds *mmapOsmd) f64(off uint64) float64 {
+	return math.Float64frombits(ds.u64(off))
+}
+
+func (ds *mmapOsmd) coord(off uint64) float64 {
+	return float64(int32(binary.LittleEndian.Uint32(ds.data[off:]))) / mmapCoordScale
+}
+
+func (ds *mmapOsmd) nodeRecord(i int) uint64 {
+	return ds.hdr.NodeTable + uint64(i)*mmapNodeRecordSize
+}
+
+func (ds *mmapOsmd) wayRecord(i int) uint64 {
+	return ds.hdr.WayTable + uint64(i)*mmapWayRecordSize
+}
+
+func (ds *mmapOsmd) relRecord(i int) uint64 {
+	return ds.hdr.RelTable + uint64(i)*mmapRelRecordSize
+}
+
+func (ds *mmapOsmd) majorRecord(i int) uint64 {
+	return ds.hdr.MajorTable + uint64(i)*mmapMajorRecordSize
+}
+
+// binary search on the sorted id table
+func (ds *mmapOsmd) find(count uint64, record func(int) uint64, id int64) (int, bool) {
+	n := int(count)
+	i := sort.Search(n, func(i int) bool {
+		return int64(ds.u64(record(i))) >= id
+	})
+	if i < n && int64(ds.u64(record(i))) == id {
+		return i, true
+	}
+	return 0, false
+}
+
+// returns tags and the offset of next item in blob
+func (ds *mmapOsmd) tags(off uint64) (map[string]string, uint64) {
+	cnt, _ := binary.Uvarint(ds.data[off:])
+	tags := make(map[string]string, cnt)
+	off = ds.scanTags(off, func(k, v string) {
+		tags[k] = v
+	})
+	return tags, off
+}
+
+// calls cb for each tag in order, returns the offset of next item in blob
+func (ds *mmapOsmd) scanTags(off uint64, cb func(k, v string)) uint64 {
+	cnt, n := binary.Uvarint(ds.data[off:])
+	off += uint64(n)
+	for i := uint64(0); i < cnt; i++ {
+		var k, v string
+		k, off = ds.str(off)
+		v, off = ds.str(off)
+		cb(k, v)
+	}
+	return off
+}
+
+func (ds *mmapOsmd) str(off uint64) (string, uint64) {
+	l, n := binary.Uvarint(ds.data[off:])
+	off += uint64(n)
+	return string(ds.data[off : off+l]), off + l
+}
+
+func (ds *mmapOsmd) node(i int) *tiles.Node {
+	rec := ds.nodeRecord(i)
+	tags, _ := ds.tags(ds.hdr.Blob + ds.u64(rec+16))
+	return &tiles.Node{
+		Id:   int64(ds.u64(rec)),
+		Tags: tags,
+		Lat:  ds.coord(rec + 8),
+		Lon:  ds.coord(rec + 12),
+	}
+}
+
+func (ds *mmapOsmd) way(i int) *tiles.Way {
+	rec := ds.wayRecord(i)
+	tags, off := ds.tags(ds.hdr.Blob + ds.u64(rec+40))
+	cnt, n := binary.Uvarint(ds.data[off:])
+	off += uint64(n)
+	w := &tiles.Way{
+		Id:     int64(ds.u64(rec)),
+		Tags:   tags,
+		MinLat: ds.f64(rec + 8),
+		MinLon: ds.f64(rec + 16),
+		MaxLat: ds.f64(rec + 24),
+		MaxLon: ds.f64(rec + 32),
+		Nodes:  make([]*tiles.Way_NodeRef, cnt),
+	}
+	for i := range w.Nodes {
+		w.Nodes[i] = &tiles.Way_NodeRef{
+			Id:  int64(ds.u64(off)),
+			Lat: ds.coord(off + 8),
+			Lon: ds.coord(off + 12),
+		}
+		off += 16
+	}
+	return w
+}
+
+func (ds *mmapOsmd) relation(i int) *tiles.Relation {
+	rec := ds.relRecord(i)
+	tags, off := ds.tags(ds.hdr.Blob + ds.u64(rec+40))
+	cnt, n := binary.Uvarint(ds.data[off:])
+	off += uint64(n)
+	r := &tiles.Relation{
+		Id:      int64(ds.u64(rec)),
+		Tags:    tags,
+		MinLat:  ds.f64(rec + 8),
+		MinLon:  ds.f64(rec + 16),
+		MaxLat:  ds.f64(rec + 24),
+		MaxLon:  ds.f64(rec + 32),
+		Members: make([]*tiles.Relation_Member, cnt),
+	}
+	for i := range r.Members {
+		m := &tiles.Relation_Member{
+			Type: tiles.Relation_MemberType(ds.data[off]),
+			Id:   int64(ds.u64(off + 1)),
+		}
+		m.Role, off = ds.str(off + 9)
+		r.Members[i] = m
+	}
+	return r
+}
+
+//#endregion
+
+func (ds *mmapOsmd) GetNode(id int64) (*tiles.Node, bool) {
+	if i, ok := ds.find(ds.hdr.NodeCount, ds.nodeRecord, id); ok {
+		return ds.node(i), true
+	}
+	return nil, false
+}
+
+func (ds *mmapOsmd) GetWay(id int64) (*tiles.Way, bool) {
+	if i, ok := ds.find(ds.hdr.WayCount, ds.wayRecord, id); ok {
+		return ds.way(i), true
+	}
+	return nil, false
+}
+
+func (ds *mmapOsmd) GetRelation(id int64) (*tiles.Relation, bool) {
+	if i, ok := ds.find(ds.hdr.RelCount, ds.relRecord, id); ok {
+		return ds.relation(i), true
+	}
+	return nil, false
+}
+
+func (ds *mmapOsmd) SearchNodes(tag string, keyword string) []*tiles.Node {
+	rt := make([]*tiles.Node, 0)
+	for i := 0; i < int(ds.hdr.NodeCount); i++ {
+		tags, _ := ds.tags(ds.hdr.Blob + ds.u64(ds.nodeRecord(i)+16))
+		if strings.Contains(tags[tag], keyword) {
+			rt = append(rt, ds.node(i))
+		}
+	}
+	return rt
+}
+
+func (ds *mmapOsmd) SearchWays(tag string, keyword string) []*tiles.Way {
+	rt := make([]*tiles.Way, 0)
+	for i := 0; i < int(ds.hdr.WayCount); i++ {
+		tags, _ := ds.tags(ds.hdr.Blob + ds.u64(ds.wayRecord(i)+40))
+		if strings.Contains(tags[tag], keyword) {
+			rt = append(rt, ds.way(i))
+		}
+	}
+	return rt
+}
+
+func (ds *mmapOsmd) SearchRelations(tag string, keyword string) []*tiles.Relation {
+	rt := make([]*tiles.Relation, 0)
+	for i := 0; i < int(ds.hdr.RelCount); i++ {
+		tags, _ := ds.tags(ds.hdr.Blob + ds.u64(ds.relRecord(i)+40))
+		if strings.Contains(tags[tag], keyword) {
+			rt = append(rt, ds.relation(i))
+		}
+	}
+	return rt
+}
+
+func (ds *mmapOsmd) IntersectsBounds(bounds geom.Bound) (rset *ResultSet, err error) {
+	rset = &ResultSet{
+		Nodes:     make([]*tiles.Node, 0),
+		Ways:      make([]*tiles.Way, 0),
+		Relations: make([]*tiles.Relation, 0),
+	}
+
+	if ds.log != nil && ds.log.DebugEnabled() {
+		t1 := time.Now()
+		defer func() {
+			ds.log.Debugf("bound:%v rels:%d ways:%d nodes:%d %s",
+				bounds, rset.LenRelations(), rset.LenWays(), rset.LenNodes(), time.Since(t1))
+		}()
+	}
+
+	minLon, minLat, maxLon, maxLat := bounds.Min.Lon, bounds.Min.Lat, bounds.Max.Lon, bounds.Max.Lat
+
+	rawNodes := btree.Map[int64, *tiles.Node]{}
+	ds.nodeTree.Search(minLon, minLat, maxLon, maxLat, func(index int) bool {
+		n := ds.node(index)
+		rawNodes.Set(n.Id, n)
+		return true
+	})
+
+	wayIds := make(map[int64]bool)
+	ds.wayTree.Search(minLon, minLat, maxLon, maxLat, func(index int) bool {
+		w := ds.way(index)
+		for _, n := range w.Nodes {
+			// 반환할 node list에서 해당 node를 (way에 포함되었으므로) 제외시킨다.
+			rawNodes.Delete(n.Id)
+		}
+		wayIds[w.Id] = true
+		rset.Ways = append(rset.Ways, w)
+		return true
+	})
+
+	// member relations are not added here, the nested ones intersect the bounds as well if they are to be drawn
+	ds.relTree.Search(minLon, minLat, maxLon, maxLat, func(index int) bool {
+		r := ds.relation(index)
+		for _, m := range r.Members {
+			switch m.Type {
+			case tiles.Relation_NODE:
+				rawNodes.Delete(m.Id)
+			case tiles.Relation_WAY:
+				if wayIds[m.Id] {
+					continue
+				}
+				if w, ok := ds.GetWay(m.Id); ok {
+					wayIds[m.Id] = true
+					rset.Ways = append(rset.Ways, w)
+				}
+			}
+		}
+		rset.Relations = append(rset.Relations, r)
+		return true
+	})
+
+	rset.Nodes = append(rset.Nodes, rawNodes.Values()...)
+	return
+}
+
+//#region writer
+
+type mmapWriter struct {
+	w   *bufio.Writer
+	off uint64
+	buf [8]byte
+}
+
+func (mw *mmapWriter) Write(p []byte) (int, error) {
+	n, err := mw.w.Write(p)
+	mw.off += uint64(n)
+	return n, err
+}
+
+func (mw *mmapWriter) u64(v uint64) error {
+	binary.LittleEndian.PutUint64(mw.buf[:], v)
+	_, err := mw.Write(mw.buf[:8])
+	return err
+}
+
+func (mw *mmapWriter) f64(v float64) error {
+	return mw.u64(math.Float64bits(v))
+}
+
+func (mw *mmapWriter) coord(v float64) error {
+	binary.LittleEndian.PutUint32(mw.buf[:], uint32(int32(math.Round(v*mmapCoordScale))))
+	_, err := mw.Write(mw.buf[:4])
+	return err
+}
+
+func (mw *mmapWriter) uvarint(v uint64) error {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], v)
+	_, err := mw.Write(buf[:n])
+	return err
+}
+
+func (mw *mmapWriter) str(s string) error {
+	if err := mw.uvarint(uint64(len(s))); err != nil {
+		return err
+	}
+	_, err := io.WriteString(mw, s)
+	return err
+}
+
+func (mw *mmapWriter) tags(tags osm.Tags) error {
+	if err := mw.uvarint(uint64(len(tags))); err != nil {
+		return err
+	}
+	for _, t := range tags {
+		if err := mw.str(t.Key); err != nil {
+			return err
+		}
+		if err := mw.str(t.Value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (mw *mmapWriter) bounds(b *osm.Bounds) error {
+	if b == nil {
+		b = &osm.Bounds{}
+	}
+	for _, v := range []float64{b.MinLat, b.MinLon, b.MaxLat, b.MaxLon} {
+		if err := mw.f64(v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeMmapIndex writes the loaded osm data into the on-disk index file
+func writeMmapIndex(data *osmdata, path string, checksum [32]byte) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	hdr := mmapHeader{
+		NodeCount: uint64(data.nodes.Len()),
+		WayCount:  uint64(data.ways.Len()),
+		RelCount:  uint64(data.relations.Len()),
+		Checksum:  checksum,
+	}
+
+	mw := &mmapWriter{w: bufio.NewWriterSize(f, 1024*1024)}
+	if _, err := mw.Write(make([]byte, mmapHeaderSize)); err != nil {
+		return err
+	}
+
+	//// blob
+	hdr.Blob = mw.off
+	var blobOff = func() uint64 { return mw.off - hdr.Blob }
+	nodeBlobs := make([]uint64, 0, hdr.NodeCount)
+	wayBlobs := make([]uint64, 0, hdr.WayCount)
+	relBlobs := make([]uint64, 0, hdr.RelCount)
+
+	// offset 0 is shared by all objects that have no tags
+	if err = mw.tags(nil); err != nil {
+		return err
+	}
+	data.nodes.Scan(func(id osm.NodeID, node *osm.Node) bool {
+		if len(node.Tags) == 0 {
+			nodeBlobs = append(nodeBlobs, 0)
+			return true
+		}
+		nodeBlobs = append(nodeBlobs, blobOff())
+		err = mw.tags(node.Tags)
+		return err == nil
+	})
+	if err != nil {
+		return err
+	}
+	data.ways.Scan(func(id osm.WayID, way *osm.Way) bool {
+		wayBlobs = append(wayBlobs, blobOff())
+		if err = mw.tags(way.Tags); err != nil {
+			return false
+		}
+		if err = mw.uvarint(uint64(len(way.Nodes))); err != nil {
+			return false
+		}
+		for _, n := range way.Nodes {
+			if err = mw.u64(uint64(n.ID)); err != nil {
+				return false
+			}
+			if err = mw.coord(n.Lat); err != nil {
+				return false
+			}
+			if err = mw.coord(n.Lon); err != nil {
+				return false
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	data.relations.Scan(func(id osm.RelationID, rel *osm.Relation) bool {
+		relBlobs = append(relBlobs, blobOff())
+		if err = mw.tags(rel.Tags); err != nil {
+			return false
+		}
+		if err = mw.uvarint(uint64(len(rel.Members))); err != nil {
+			return false
+		}
+		for _, m := range rel.Members {
+			if _, err = mw.Write([]byte{byte(tiles.RelationMemberType(m.Type))}); err != nil {
+				return false
+			}
+			if err = mw.u64(uint64(m.Ref)); err != nil {
+				return false
+			}
+			if err = mw.str(m.Role); err != nil {
+				return false
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+
+	//// tables
+	nodeTree := &packedRTreeBuilder{}
+	wayTree := &packedRTreeBuilder{}
+	relTree := &packedRTreeBuilder{}
+	majors := make([]mmapMajor, 0)
+
+	hdr.NodeTable = mw.off
+	i := 0
+	data.nodes.Scan(func(id osm.NodeID, node *osm.Node) bool {
+		nodeTree.Add(node.Lon, node.Lat, node.Lon, node.Lat, i)
+		if minZoom := generalizedMinZoom(node.Tags, 0); minZoom <= tiles.GeneralizedMaxZoom {
+			majors = append(majors, mmapMajor{index: uint64(i), kind: mmapMajorNode, minZoom: uint8(minZoom)})
+		}
+		if err = mw.u64(uint64(id)); err == nil {
+			if err = mw.coord(node.Lat); err == nil {
+				if err = mw.coord(node.Lon); err == nil {
+					err = mw.u64(nodeBlobs[i])
+				}
+			}
+		}
+		i++
+		return err == nil
+	})
+	if err != nil {
+		return err
+	}
+
+	hdr.WayTable = mw.off
+	i = 0
+	data.ways.Scan(func(id osm.WayID, way *osm.Way) bool {
+		if b := way.Bounds; b != nil {
+			wayTree.Add(b.MinLon, b.MinLat, b.MaxLon, b.MaxLat, i)
+			if minZoom := generalizedMinZoom(way.Tags, boundsExtent(b)); minZoom <= tiles.GeneralizedMaxZoom {
+				majors = append(majors, mmapMajor{index: uint64(i), kind: mmapMajorWay, minZoom: uint8(minZoom)})
+			}
+		}
+		if err = mw.u64(uint64(id)); err == nil {
+			if err = mw.bounds(way.Bounds); err == nil {
+				err = mw.u64(wayBlobs[i])
+			}
+		}
+		i++
+		return err == nil
+	})
+	if err != nil {
+		return err
+	}
+
+	hdr.RelTable = mw.off
+	i = 0
+	data.relations.Scan(func(id osm.RelationID, rel *osm.Relation) bool {
+		if b := rel.Bounds; b != nil {
+			relTree.Add(b.MinLon, b.MinLat, b.MaxLon, b.MaxLat, i)
+			if minZoom := generalizedMinZoom(rel.Tags, boundsExtent(b)); minZoom <= tiles.GeneralizedMaxZoom {
+				majors = append(majors, mmapMajor{index: uint64(i), kind: mmapMajorRelation, minZoom: uint8(minZoom)})
+			}
+		}
+		if err = mw.u64(uint64(id)); err == nil {
+			if err = mw.bounds(rel.Bounds); err == nil {
+				err = mw.u64(relBlobs[i])
+			}
+		}
+		i++
+		return err == nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// a level of the zoom has the major features of the prefix of the table
+	sort.SliceStable(majors, func(i, j int) bool { return majors[i].minZoom < majors[j].minZoom })
+	hdr.MajorTable = mw.off
+	hdr.MajorCount = uint64(len(majors))
+	for _, m := range majors {
+		if err := mw.u64(m.index); err != nil {
+			return err
+		}
+		if _, err := mw.Write([]byte{m.kind, m.minZoom, 0, 0, 0, 0, 0, 0}); err != nil {
+			return err
+		}
+	}
+
+	//// spatial indexes
+	hdr.NodeTree = mw.off
+	if _, err := nodeTree.WriteTo(mw); err != nil {
+		return err
+	}
+	hdr.WayTree = mw.off
+	if _, err := wayTree.WriteTo(mw); err != nil {
+		return err
+	}
+	hdr.RelTree = mw.off
+	if _, err := relTree.WriteTo(mw); err != nil {
+		return err
+	}
+	if err := mw.w.Flush(); err != nil {
+		return err
+	}
+
+	//// header
+	var hbuf bytes.Buffer
+	hbuf.WriteString(mmapMagic)
+	if err := binary.Write(&hbuf, binary.LittleEndian, &hdr); err != nil {
+		return err
+	}
+	if _, err := f.WriteAt(hbuf.Bytes(), 0); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+//#endregion
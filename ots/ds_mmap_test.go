@@ -0,0 +1,225 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/OutOfBedlam/ots/geom"
+	"github.com/OutOfBedlam/ots/tiles"
+	"github.com/paulmach/osm"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestOsmData returns the resolved osm data of a 10 x 10 grid of nodes from 37N 127E at every 0.01 degree,
+// every row of the grid is a road, and a few nodes are tagged.
+//
+//	NODE:500     the tagged node that is not in the ways
+//	WAY:100-109  the roads of the rows
+//	WAY:200      the closed way around the nodes 12, 15, 45, 42
+//	REL:300      the multipolygon of WAY:200
+//	REL:301      the route of WAY:100, WAY:101 and NODE:1
+//	REL:302      the route master of REL:301
+func newTestOsmData() *osmdata {
+	data := newOsmData()
+	for i := 0; i < 10; i++ {
+		for j := 0; j < 10; j++ {
+			id := osm.NodeID(i*10 + j)
+			node := &osm.Node{ID: id, Lat: 37 + float64(i)*0.01, Lon: 127 + float64(j)*0.01}
+			if id%7 == 0 {
+				node.Tags = osm.Tags{{Key: "amenity", Value: "cafe"}, {Key: "name", Value: "cafe"}}
+			}
+			data.nodes.Set(id, node)
+		}
+	}
+	for i := 0; i < 10; i++ {
+		way := &osm.Way{ID: osm.WayID(100 + i), Tags: osm.Tags{{Key: "highway", Value: "primary"}}}
+		for j := 0; j < 10; j++ {
+			way.Nodes = append(way.Nodes, osm.WayNode{ID: osm.NodeID(i*10 + j)})
+		}
+		data.ways.Set(way.ID, way)
+	}
+	data.nodes.Set(500, &osm.Node{ID: 500, Lat: 37.095, Lon: 127.095, Tags: osm.Tags{{Key: "place", Value: "city"}}})
+	data.ways.Set(200, &osm.Way{ID: 200, Nodes: osm.WayNodes{{ID: 12}, {ID: 15}, {ID: 45}, {ID: 42}, {ID: 12}}})
+	data.relations.Set(300, &osm.Relation{
+		ID:      300,
+		Tags:    osm.Tags{{Key: "type", Value: "multipolygon"}, {Key: "natural", Value: "water"}},
+		Members: osm.Members{{Type: osm.TypeWay, Ref: 200, Role: "outer"}},
+	})
+	data.relations.Set(301, &osm.Relation{
+		ID:   301,
+		Tags: osm.Tags{{Key: "type", Value: "route"}, {Key: "route", Value: "bus"}},
+		Members: osm.Members{
+			{Type: osm.TypeWay, Ref: 100},
+			{Type: osm.TypeWay, Ref: 101},
+			{Type: osm.TypeNode, Ref: 1, Role: "stop"},
+		},
+	})
+	data.relations.Set(302, &osm.Relation{
+		ID:      302,
+		Tags:    osm.Tags{{Key: "type", Value: "route_master"}, {Key: "route_master", Value: "bus"}},
+		Members: osm.Members{{Type: osm.TypeRelation, Ref: 301}},
+	})
+	data.resolve()
+	return data
+}
+
+// resultIds returns the sorted ids of the nodes, the ways and the relations of the result set
+func resultIds(rset *ResultSet) [3][]int64 {
+	var ret [3][]int64
+	for _, n := range rset.Nodes {
+		ret[0] = append(ret[0], n.Id)
+	}
+	for _, w := range rset.Ways {
+		ret[1] = append(ret[1], w.Id)
+	}
+	for _, r := range rset.Relations {
+		ret[2] = append(ret[2], r.Id)
+	}
+	for _, ids := range ret {
+		sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	}
+	return ret
+}
+
+func TestMmapIndexRoundTrip(t *testing.T) {
+	data := newTestOsmData()
+	path := filepath.Join(t.TempDir(), "test"+MmapIndexExt)
+	checksum := [32]byte{1, 2, 3}
+	require.Nil(t, writeMmapIndex(data, path, checksum))
+
+	ds, err := openMmapOsmData(path)
+	require.Nil(t, err)
+	defer ds.Close()
+	assert.Equal(t, checksum, ds.hdr.Checksum)
+
+	for _, b := range []geom.Bound{
+		geom.MakeBound(37.005, 127.005, 37.025, 127.025),
+		geom.MakeBound(37.035, 127.035, 37.065, 127.065),
+		geom.MakeBound(36.9, 126.9, 37.2, 127.2),
+		geom.MakeBound(38, 128, 38.1, 128.1),
+	} {
+		expect, err := data.IntersectsBounds(b)
+		require.Nil(t, err)
+		found, err := ds.IntersectsBounds(b)
+		require.Nil(t, err)
+		assert.Equal(t, resultIds(expect), resultIds(found), "bounds %v", b)
+	}
+
+	all, err := ds.IntersectsBounds(geom.MakeBound(36.9, 126.9, 37.2, 127.2))
+	require.Nil(t, err)
+	ids := resultIds(all)
+	// the nodes of the ways are returned with the ways
+	assert.Equal(t, []int64{500}, ids[0])
+	assert.Equal(t, 11, len(ids[1]))
+	assert.Equal(t, []int64{300, 301, 302}, ids[2])
+
+	for _, id := range []int64{100, 200} {
+		expect, ok := data.GetWay(id)
+		require.True(t, ok)
+		found, ok := ds.GetWay(id)
+		require.True(t, ok)
+		assert.Equal(t, expect.Tags, found.Tags)
+		assert.Equal(t, [4]float64{expect.MinLat, expect.MinLon, expect.MaxLat, expect.MaxLon},
+			[4]float64{found.MinLat, found.MinLon, found.MaxLat, found.MaxLon})
+		require.Equal(t, len(expect.Nodes), len(found.Nodes))
+		for i, n := range expect.Nodes {
+			assert.Equal(t, n.Id, found.Nodes[i].Id)
+			assert.InDelta(t, n.Lat, found.Nodes[i].Lat, 1e-7)
+			assert.InDelta(t, n.Lon, found.Nodes[i].Lon, 1e-7)
+		}
+	}
+	for _, id := range []int64{300, 301, 302} {
+		expect, ok := data.GetRelation(id)
+		require.True(t, ok)
+		found, ok := ds.GetRelation(id)
+		require.True(t, ok)
+		assert.Equal(t, expect.Tags, found.Tags)
+		assert.Equal(t, [4]float64{expect.MinLat, expect.MinLon, expect.MaxLat, expect.MaxLon},
+			[4]float64{found.MinLat, found.MinLon, found.MaxLat, found.MaxLon})
+		assert.Equal(t, len(expect.Members), len(found.Members))
+	}
+	node, ok := ds.GetNode(7)
+	require.True(t, ok)
+	assert.Equal(t, "cafe", node.Tags["amenity"])
+	_, ok = ds.GetNode(1000)
+	assert.False(t, ok)
+
+	assert.Equal(t, len(data.SearchNodes("amenity", "cafe")), len(ds.SearchNodes("amenity", "cafe")))
+	assert.Equal(t, len(data.SearchRelations("route", "bus")), len(ds.SearchRelations("route", "bus")))
+}
+
+func TestMmapGeneralized(t *testing.T) {
+	data := newTestOsmData()
+	data.buildGeneralized()
+	path := filepath.Join(t.TempDir(), "test"+MmapIndexExt)
+	require.Nil(t, writeMmapIndex(data, path, [32]byte{}))
+
+	ds, err := openMmapOsmData(path)
+	require.Nil(t, err)
+	defer ds.Close()
+	var _ GeneralizedSource = ds
+	assert.Equal(t, uint64(12), ds.hdr.MajorCount)
+
+	// the levels are built when they are queried
+	for z := range ds.generalized {
+		assert.Nil(t, ds.generalized[z].level, "zoom %d", z)
+	}
+	b := geom.MakeBound(36.9, 126.9, 37.2, 127.2)
+	for z := 0; z <= tiles.GeneralizedMaxZoom; z++ {
+		expect, err := data.IntersectsBoundsZoom(b, z)
+		require.Nil(t, err)
+		found, err := ds.IntersectsBoundsZoom(b, z)
+		require.Nil(t, err)
+		assert.Equal(t, resultIds(expect), resultIds(found), "zoom %d", z)
+		for i, w := range found.Ways {
+			assert.Equal(t, len(expect.Ways[i].Nodes), len(w.Nodes), "zoom %d WAY:%d", z, w.Id)
+		}
+		l := ds.generalized[z].level
+		require.NotNil(t, l, "zoom %d", z)
+		expectLevel := data.generalized.levels[z]
+		assert.Equal(t, [3]int{len(expectLevel.nodes), len(expectLevel.ways), len(expectLevel.relations)},
+			[3]int{len(l.nodes), len(l.ways), len(l.relations)}, "zoom %d", z)
+	}
+
+	// the roads, the water and the city are the major features, the cafes and the bus routes are not
+	rset, err := ds.IntersectsBoundsZoom(b, tiles.GeneralizedMaxZoom)
+	require.Nil(t, err)
+	ids := resultIds(rset)
+	assert.Equal(t, []int64{500}, ids[0])
+	assert.Equal(t, []int64{100, 101, 102, 103, 104, 105, 106, 107, 108, 109, 200}, ids[1])
+	assert.Equal(t, []int64{300}, ids[2])
+}
+
+func TestMmapIndexTruncated(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "test"+MmapIndexExt)
+	require.Nil(t, writeMmapIndex(newTestOsmData(), path, [32]byte{}))
+	data, err := os.ReadFile(path)
+	require.Nil(t, err)
+
+	// the index is rejected with an error instead of a panic at the first query
+	for _, size := range []int{mmapHeaderSize + 8, len(data) / 2, len(data) - 200, len(data) - 1} {
+		truncated := filepath.Join(dir, fmt.Sprintf("truncated-%d%s", size, MmapIndexExt))
+		require.Nil(t, os.WriteFile(truncated, data[:size], 0644))
+		_, err := openMmapOsmData(truncated)
+		require.NotNil(t, err, "size %d", size)
+		assert.Contains(t, err.Error(), "invalid index file", "size %d", size)
+		// the snapshot loader falls back to the osm.pbf file
+		_, err = readOsmSnapshot(truncated, [32]byte{})
+		assert.NotNil(t, err, "size %d", size)
+	}
+
+	// the counts of the header that go beyond the file
+	corrupted := append([]byte{}, data...)
+	binary.LittleEndian.PutUint64(corrupted[len(mmapMagic):], 1<<60)
+	path = filepath.Join(dir, "corrupted"+MmapIndexExt)
+	require.Nil(t, os.WriteFile(path, corrupted, 0644))
+	_, err = openMmapOsmData(path)
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), "invalid index file")
+}
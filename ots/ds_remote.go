@@ -2,18 +2,124 @@ package main
 
 import (
 	"context"
+	"io"
+	"math/rand"
 	"strings"
+	"time"
 
 	"github.com/OutOfBedlam/ots/geom"
+	"github.com/OutOfBedlam/ots/logging"
 	"github.com/OutOfBedlam/ots/tiles"
+	"github.com/pkg/errors"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/backoff"
+	"google.golang.org/grpc/codes"
+	_ "google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/keepalive"
+	"google.golang.org/grpc/status"
 )
 
+type RemoteConfig struct {
+	Timeout   time.Duration `default:"10s" name:"timeout" help:"deadline of each request to data server"`
+	Retries   int           `default:"3" name:"retries" help:"max retries of a failed request to data server"`
+	Keepalive time.Duration `default:"30s" name:"keepalive" help:"interval of keepalive ping to data server"`
+
+	TLS        bool   `default:"false" name:"tls" help:"connect to data server with TLS"`
+	CA         string `name:"ca" placeholder:"<path>" help:"CA certificate file (PEM) to verify data server, enables TLS"`
+	Cert       string `name:"cert" placeholder:"<path>" help:"client certificate file (PEM) for mutual TLS, enables TLS"`
+	Key        string `name:"key" placeholder:"<path>" help:"private key file of the client certificate (PEM)"`
+	ServerName string `name:"server-name" help:"server name to verify the certificate of data server"`
+	Token      string `name:"token" help:"bearer token to authenticate to data server"`
+}
+
+var defaultRemoteConfig = RemoteConfig{
+	Timeout:   10 * time.Second,
+	Retries:   3,
+	Keepalive: 30 * time.Second,
+}
+
+var remoteReconnectBackoff = backoff.Config{
+	BaseDelay:  1 * time.Second,
+	Multiplier: 1.6,
+	Jitter:     0.2,
+	MaxDelay:   5 * time.Second,
+}
+
+const (
+	remoteRetryBaseDelay = 100 * time.Millisecond
+	remoteRetryMaxDelay  = 2 * time.Second
+)
+
+// remoteOsmd shares one client connection for all requests,
+// grpc reconnects it in background with backoff when the data server restarts.
 type remoteOsmd struct {
 	DataSource
+	log                logging.Log
 	addr               string
+	conf               RemoteConfig
 	grpcMaxRecvMsgSize int
 	grpcConn           *grpc.ClientConn
+	client             tiles.TileClient
+}
+
+// newRemoteOsmd connects to the data server,
+// if failFast is true requests fail immediately while the server is not available instead of waiting for reconnecting.
+func newRemoteOsmd(addr string, conf *RemoteConfig, grpcMaxRecvMsgSize int, failFast bool) (*remoteOsmd, error) {
+	if conf == nil {
+		conf = &defaultRemoteConfig
+	}
+	r := &remoteOsmd{
+		log:                logging.GetLog("remote-osmd"),
+		addr:               strings.TrimPrefix(addr, "tcp://"),
+		conf:               *conf,
+		grpcMaxRecvMsgSize: grpcMaxRecvMsgSize,
+	}
+
+	callOpts := []grpc.CallOption{
+		// wait for reconnecting until the deadline instead of failing fast while the server restarts
+		grpc.WaitForReady(!failFast),
+	}
+	if r.grpcMaxRecvMsgSize > 0 {
+		callOpts = append(callOpts, grpc.MaxCallRecvMsgSize(r.grpcMaxRecvMsgSize))
+	}
+	creds, err := r.conf.transportCredentials()
+	if err != nil {
+		return nil, err
+	}
+	dialOpts := []grpc.DialOption{
+		grpc.WithTransportCredentials(creds),
+		grpc.WithDefaultCallOptions(callOpts...),
+		// do not send requests to the server that is not serving
+		grpc.WithDefaultServiceConfig(`{"healthCheckConfig":{"serviceName":""}}`),
+		grpc.WithConnectParams(grpc.ConnectParams{
+			Backoff:           remoteReconnectBackoff,
+			MinConnectTimeout: r.conf.Timeout,
+		}),
+	}
+	if r.conf.Keepalive > 0 {
+		dialOpts = append(dialOpts, grpc.WithKeepaliveParams(keepalive.ClientParameters{
+			Time:                r.conf.Keepalive,
+			Timeout:             r.conf.Timeout,
+			PermitWithoutStream: true,
+		}))
+	}
+
+	if len(r.conf.Token) > 0 {
+		if !r.conf.secure() {
+			r.log.Warnf("token is sent to %s without TLS", r.addr)
+		}
+		dialOpts = append(dialOpts, grpc.WithPerRPCCredentials(&tokenCredentials{token: r.conf.Token, secure: r.conf.secure()}))
+	}
+
+	// non-blocking, the connection is established in background
+	conn, err := grpc.Dial(r.addr, dialOpts...)
+	if err != nil {
+		return nil, err
+	}
+	r.grpcConn = conn
+	r.client = tiles.NewTileClient(conn)
+	return r, nil
 }
 
 func (r *remoteOsmd) Close() {
@@ -23,25 +129,71 @@ func (r *remoteOsmd) Close() {
 	}
 }
 
-func (r *remoteOsmd) _getObjById(id int64, typ tiles.GetRequest_Type) (*tiles.GetResponse, error) {
-	// connect to server
-	if r.grpcConn == nil {
-		if strings.HasPrefix(r.addr, "tcp://") {
-			r.addr = r.addr[6:]
+// HealthCheck returns nil if the data server is serving
+func (r *remoteOsmd) HealthCheck() error {
+	ctx, cancel := context.WithTimeout(context.Background(), r.conf.Timeout)
+	defer cancel()
+	rsp, err := healthpb.NewHealthClient(r.grpcConn).Check(ctx, &healthpb.HealthCheckRequest{})
+	if err != nil {
+		return err
+	}
+	if rsp.Status != healthpb.HealthCheckResponse_SERVING {
+		return errors.Errorf("data server %s is %s", r.addr, rsp.Status.String())
+	}
+	return nil
+}
+
+// _invoke calls fn with deadline, retries with exponential backoff if the server is not available
+func (r *remoteOsmd) _invoke(fn func(ctx context.Context) error) error {
+	var err error
+	for attempt := 0; attempt <= r.conf.Retries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(remoteRetryDelay(attempt))
 		}
-		var err error
-		r.grpcConn, err = grpc.Dial(r.addr, grpc.WithInsecure(), grpc.WithBlock())
-		if err != nil {
-			return nil, err
+
+		ctx, cancel := context.WithTimeout(context.Background(), r.conf.Timeout)
+		err = fn(ctx)
+		cancel()
+
+		if err == nil || !remoteRetryable(err) {
+			return err
 		}
+		r.log.Debugf("%s attempt %d/%d, %s", r.addr, attempt+1, r.conf.Retries+1, err.Error())
 	}
+	return err
+}
 
-	client := tiles.NewTileClient(r.grpcConn)
-	rsp, err := client.Get(context.Background(),
-		&tiles.GetRequest{
-			Type: typ,
-			Id:   id,
-		})
+// remoteRetryDelay returns exponential backoff delay of the attempt (starts from 1) with jitter
+func remoteRetryDelay(attempt int) time.Duration {
+	delay := remoteRetryBaseDelay << (attempt - 1)
+	if delay > remoteRetryMaxDelay || delay <= 0 {
+		delay = remoteRetryMaxDelay
+	}
+	// jitter, so that the render servers do not retry all at once
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// remoteRetryable returns true if the request can be sent again,
+// a request that exceeded the deadline is not retried as the query would be slow again
+func remoteRetryable(err error) bool {
+	switch status.Code(err) {
+	case codes.Unavailable, codes.Aborted:
+		return true
+	default:
+		return false
+	}
+}
+
+func (r *remoteOsmd) _getObjById(id int64, typ tiles.GetRequest_Type) (*tiles.GetResponse, error) {
+	var rsp *tiles.GetResponse
+	err := r._invoke(func(ctx context.Context) (err error) {
+		rsp, err = r.client.Get(ctx,
+			&tiles.GetRequest{
+				Type: typ,
+				Id:   id,
+			})
+		return
+	})
 	return rsp, err
 }
 
@@ -73,27 +225,22 @@ func (r *remoteOsmd) GetRelation(id int64) (*tiles.Relation, bool) {
 }
 
 func (r *remoteOsmd) _scanObj(tag string, keyword string, scope tiles.ScanRequest_Scope) (*tiles.ScanResponse, error) {
-	// connect to server
-	if strings.HasPrefix(r.addr, "tcp://") {
-		r.addr = r.addr[6:]
-	}
-	callOpt := grpc.WithDefaultCallOptions(
-		grpc.MaxCallRecvMsgSize(1024 * 1024 * 100),
-	)
-	conn, err := grpc.Dial(r.addr, callOpt, grpc.WithInsecure(), grpc.WithBlock())
+	var rsp *tiles.ScanResponse
+	err := r._invoke(func(ctx context.Context) (err error) {
+		rsp, err = r.client.Scan(ctx,
+			&tiles.ScanRequest{
+				Scope:   scope,
+				Tag:     tag,
+				Keyword: keyword,
+			},
+			grpc.MaxCallRecvMsgSize(1024*1024*100))
+		return
+	})
 	if err != nil {
-		return nil, err
+		r.log.Warnf("scan %s, %s", r.addr, err.Error())
+		return &tiles.ScanResponse{}, err
 	}
-	defer conn.Close()
-
-	client := tiles.NewTileClient(conn)
-	rsp, err := client.Scan(context.Background(),
-		&tiles.ScanRequest{
-			Scope:   scope,
-			Tag:     tag,
-			Keyword: keyword,
-		})
-	return rsp, err
+	return rsp, nil
 }
 
 func (r *remoteOsmd) SearchNodes(tag string, keyword string) []*tiles.Node {
@@ -110,29 +257,70 @@ func (r *remoteOsmd) SearchRelations(tag string, keyword string) []*tiles.Relati
 }
 
 func (r *remoteOsmd) IntersectsBounds(bounds geom.Bound) (*ResultSet, error) {
-	// connect to server
-	if strings.HasPrefix(r.addr, "tcp://") {
-		r.addr = r.addr[6:]
-	}
-	callOpt := grpc.WithDefaultCallOptions(
-		grpc.MaxCallRecvMsgSize(r.grpcMaxRecvMsgSize),
-	)
-	conn, err := grpc.Dial(r.addr, callOpt, grpc.WithInsecure(), grpc.WithBlock())
+	return r._find(&tiles.FindRequest{
+		MinLat: bounds.Min.Lat,
+		MinLon: bounds.Min.Lon,
+		MaxLat: bounds.Max.Lat,
+		MaxLon: bounds.Max.Lon,
+	})
+}
+
+// IntersectsBoundsZoom requests generalized objects,
+// the data server of older version returns all objects in the bounds.
+func (r *remoteOsmd) IntersectsBoundsZoom(bounds geom.Bound, zoom int) (*ResultSet, error) {
+	return r._find(&tiles.FindRequest{
+		MinLat:     bounds.Min.Lat,
+		MinLon:     bounds.Min.Lon,
+		MaxLat:     bounds.Max.Lat,
+		MaxLon:     bounds.Max.Lon,
+		Generalize: true,
+		Zoom:       int32(zoom),
+	})
+}
+
+func (r *remoteOsmd) _find(req *tiles.FindRequest) (*ResultSet, error) {
+	var rset *ResultSet
+	err := r._invoke(func(ctx context.Context) (err error) {
+		rset, err = r._findStream(ctx, req)
+		if status.Code(err) == codes.Unimplemented {
+			// data server of older version that does not support streaming
+			var rsp *tiles.FindResponse
+			rsp, err = r.client.Find(ctx, req)
+			if err != nil {
+				return err
+			}
+			rset = &ResultSet{rsp.Nodes, rsp.Ways, rsp.Relations}
+		}
+		return
+	})
 	if err != nil {
 		return nil, err
 	}
-	defer conn.Close()
+	return rset, nil
+}
 
-	client := tiles.NewTileClient(conn)
-	rsp, err := client.Find(context.Background(),
-		&tiles.FindRequest{
-			MinLat: bounds.Min.Lat,
-			MinLon: bounds.Min.Lon,
-			MaxLat: bounds.Max.Lat,
-			MaxLon: bounds.Max.Lon,
-		})
+func (r *remoteOsmd) _findStream(ctx context.Context, req *tiles.FindRequest) (*ResultSet, error) {
+	stream, err := r.client.FindStream(ctx, req)
 	if err != nil {
 		return nil, err
 	}
-	return &ResultSet{rsp.Nodes, rsp.Ways, rsp.Relations}, nil
+	rset := &ResultSet{
+		Nodes:     make([]*tiles.Node, 0),
+		Ways:      make([]*tiles.Way, 0),
+		Relations: make([]*tiles.Relation, 0),
+	}
+	for {
+		rsp, err := stream.Recv()
+		if err == io.EOF {
+			return rset, nil
+		} else if err != nil {
+			return nil, err
+		}
+		if rsp.Code != 0 {
+			return nil, errors.New(rsp.Reason)
+		}
+		rset.Nodes = append(rset.Nodes, rsp.Nodes...)
+		rset.Ways = append(rset.Ways, rsp.Ways...)
+		rset.Relations = append(rset.Relations, rsp.Relations...)
+	}
 }
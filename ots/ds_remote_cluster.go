@@ -0,0 +1,313 @@
+package main
+
+import (
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/OutOfBedlam/ots/geom"
+	"github.com/OutOfBedlam/ots/logging"
+	"github.com/OutOfBedlam/ots/tiles"
+	"github.com/pkg/errors"
+	"github.com/tidwall/btree"
+)
+
+// remoteEndpoint is an element of the data source address
+//
+//	tcp://host:port
+//	tcp://host:port?bounds=minLat,minLon,maxLat,maxLon
+type remoteEndpoint struct {
+	addr   string
+	bounds *geom.Bound
+}
+
+// parseRemoteEndpoints parses comma separated endpoints of the data source address
+func parseRemoteEndpoints(dsaddr string) ([]*remoteEndpoint, error) {
+	// bounds contain commas too, a new endpoint starts with 'tcp://'
+	addrs := make([]string, 0)
+	for _, tok := range strings.Split(dsaddr, ",") {
+		tok = strings.TrimSpace(tok)
+		if len(addrs) == 0 || strings.HasPrefix(tok, "tcp://") {
+			addrs = append(addrs, tok)
+		} else {
+			addrs[len(addrs)-1] += "," + tok
+		}
+	}
+
+	ret := make([]*remoteEndpoint, 0)
+	for _, str := range addrs {
+		if len(str) == 0 {
+			continue
+		}
+		u, err := url.Parse(str)
+		if err != nil {
+			return nil, errors.Wrap(err, "data source")
+		}
+		if u.Scheme != "tcp" || len(u.Host) == 0 {
+			return nil, errors.Errorf("data source %q should be tcp://host:port", str)
+		}
+		ep := &remoteEndpoint{addr: "tcp://" + u.Host}
+		if b := u.Query().Get("bounds"); len(b) > 0 {
+			tok := strings.Split(b, ",")
+			if len(tok) != 4 {
+				return nil, errors.Errorf("data source %q bounds should be minLat,minLon,maxLat,maxLon", str)
+			}
+			v := [4]float64{}
+			for i := range tok {
+				if v[i], err = strconv.ParseFloat(strings.TrimSpace(tok[i]), 64); err != nil {
+					return nil, errors.Errorf("data source %q invalid bounds", str)
+				}
+			}
+			bound := geom.MakeBound(v[0], v[1], v[2], v[3])
+			ep.bounds = &bound
+		}
+		ret = append(ret, ep)
+	}
+	if len(ret) == 0 {
+		return nil, errors.New("data source is empty")
+	}
+	return ret, nil
+}
+
+// remoteCluster is the data source of multiple data servers.
+// Endpoints of the same bounds are the replicas of a shard, the endpoints without bounds cover all area.
+// The requests to a shard are distributed to the replicas in round-robin,
+// and fail over to the next replica if a replica is not available.
+// IntersectsBounds fans out to the shards that overlap the bounds then merges the results.
+type remoteCluster struct {
+	DataSource
+	log    logging.Log
+	shards []*remoteShard
+}
+
+type remoteShard struct {
+	bounds   *geom.Bound
+	replicas []*remoteOsmd
+	retries  int
+	next     uint32
+}
+
+func newRemoteCluster(endpoints []*remoteEndpoint, conf *RemoteConfig, grpcMaxRecvMsgSize int) (*remoteCluster, error) {
+	if conf == nil {
+		conf = &defaultRemoteConfig
+	}
+	// retries are done by the cluster across replicas, not by each replica
+	memberConf := *conf
+	memberConf.Retries = 0
+
+	rc := &remoteCluster{log: logging.GetLog("remote-cluster")}
+	for _, ep := range endpoints {
+		var shard *remoteShard
+		for _, s := range rc.shards {
+			if (s.bounds == nil && ep.bounds == nil) || (s.bounds != nil && ep.bounds != nil && *s.bounds == *ep.bounds) {
+				shard = s
+				break
+			}
+		}
+		if shard == nil {
+			shard = &remoteShard{bounds: ep.bounds, retries: conf.Retries}
+			rc.shards = append(rc.shards, shard)
+		}
+		r, err := newRemoteOsmd(ep.addr, &memberConf, grpcMaxRecvMsgSize, true)
+		if err != nil {
+			rc.Close()
+			return nil, err
+		}
+		shard.replicas = append(shard.replicas, r)
+	}
+	for _, s := range rc.shards {
+		if s.bounds == nil {
+			rc.log.Infof("shard all replicas:%d", len(s.replicas))
+		} else {
+			rc.log.Infof("shard %v replicas:%d", *s.bounds, len(s.replicas))
+		}
+	}
+	return rc, nil
+}
+
+// invoke calls fn with the replicas in round-robin order until it succeeds,
+// each round over all replicas is retried with backoff.
+func (s *remoteShard) invoke(fn func(r *remoteOsmd) error) error {
+	n := len(s.replicas)
+	start := int(atomic.AddUint32(&s.next, 1) % uint32(n))
+	var err error
+	for attempt := 0; attempt <= s.retries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(remoteRetryDelay(attempt))
+		}
+		for i := 0; i < n; i++ {
+			r := s.replicas[(start+i)%n]
+			err = fn(r)
+			if err == nil || !remoteRetryable(err) {
+				return err
+			}
+			r.log.Debugf("%s failed, %s", r.addr, err.Error())
+		}
+	}
+	return err
+}
+
+func (s *remoteShard) intersects(bounds geom.Bound) bool {
+	return s.bounds == nil || s.bounds.Intersects(bounds)
+}
+
+func (rc *remoteCluster) Close() {
+	for _, s := range rc.shards {
+		for _, r := range s.replicas {
+			r.Close()
+		}
+	}
+}
+
+func (rc *remoteCluster) HealthCheck() error {
+	for _, s := range rc.shards {
+		var err error
+		for _, r := range s.replicas {
+			if err = r.HealthCheck(); err == nil {
+				break
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (rc *remoteCluster) IntersectsBounds(bounds geom.Bound) (*ResultSet, error) {
+	return rc._intersects(bounds, func(r *remoteOsmd) (*ResultSet, error) {
+		return r.IntersectsBounds(bounds)
+	})
+}
+
+func (rc *remoteCluster) IntersectsBoundsZoom(bounds geom.Bound, zoom int) (*ResultSet, error) {
+	return rc._intersects(bounds, func(r *remoteOsmd) (*ResultSet, error) {
+		return r.IntersectsBoundsZoom(bounds, zoom)
+	})
+}
+
+func (rc *remoteCluster) _intersects(bounds geom.Bound, find func(r *remoteOsmd) (*ResultSet, error)) (*ResultSet, error) {
+	shards := make([]*remoteShard, 0, len(rc.shards))
+	for _, s := range rc.shards {
+		if s.intersects(bounds) {
+			shards = append(shards, s)
+		}
+	}
+
+	results := make([]*ResultSet, len(shards))
+	errs := make([]error, len(shards))
+	wg := sync.WaitGroup{}
+	for i, s := range shards {
+		wg.Add(1)
+		go func(i int, s *remoteShard) {
+			defer wg.Done()
+			errs[i] = s.invoke(func(r *remoteOsmd) (err error) {
+				results[i], err = find(r)
+				return
+			})
+		}(i, s)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			// partial result should not be rendered (and cached)
+			return nil, err
+		}
+	}
+	if len(results) == 1 {
+		return results[0], nil
+	}
+	return mergeResultSets(results...), nil
+}
+
+// mergeResultSets merges results of shards, the objects across the boundary of shards are found in both
+func mergeResultSets(results ...*ResultSet) *ResultSet {
+	nodes := btree.Map[int64, *tiles.Node]{}
+	ways := btree.Map[int64, *tiles.Way]{}
+	relations := btree.Map[int64, *tiles.Relation]{}
+	for _, rs := range results {
+		if rs == nil {
+			continue
+		}
+		for _, n := range rs.Nodes {
+			nodes.Set(n.Id, n)
+		}
+		for _, w := range rs.Ways {
+			ways.Set(w.Id, w)
+		}
+		for _, r := range rs.Relations {
+			relations.Set(r.Id, r)
+		}
+	}
+	return &ResultSet{
+		Nodes:     nodes.Values(),
+		Ways:      ways.Values(),
+		Relations: relations.Values(),
+	}
+}
+
+func (rc *remoteCluster) _getObjById(id int64, typ tiles.GetRequest_Type) *tiles.GetResponse {
+	for _, s := range rc.shards {
+		var rsp *tiles.GetResponse
+		err := s.invoke(func(r *remoteOsmd) (err error) {
+			rsp, err = r._getObjById(id, typ)
+			return
+		})
+		if err != nil {
+			rc.log.Warnf("get %d, %s", id, err.Error())
+			continue
+		}
+		if rsp.Node != nil || rsp.Way != nil || rsp.Relation != nil {
+			return rsp
+		}
+	}
+	return &tiles.GetResponse{}
+}
+
+func (rc *remoteCluster) GetWay(id int64) (*tiles.Way, bool) {
+	rsp := rc._getObjById(id, tiles.GetRequest_WAY)
+	return rsp.Way, rsp.Way != nil
+}
+
+func (rc *remoteCluster) GetNode(id int64) (*tiles.Node, bool) {
+	rsp := rc._getObjById(id, tiles.GetRequest_NODE)
+	return rsp.Node, rsp.Node != nil
+}
+
+func (rc *remoteCluster) GetRelation(id int64) (*tiles.Relation, bool) {
+	rsp := rc._getObjById(id, tiles.GetRequest_RELATION)
+	return rsp.Relation, rsp.Relation != nil
+}
+
+func (rc *remoteCluster) _scanObj(tag string, keyword string, scope tiles.ScanRequest_Scope) *ResultSet {
+	results := make([]*ResultSet, 0, len(rc.shards))
+	for _, s := range rc.shards {
+		var rsp *tiles.ScanResponse
+		err := s.invoke(func(r *remoteOsmd) (err error) {
+			rsp, err = r._scanObj(tag, keyword, scope)
+			return
+		})
+		if err != nil {
+			rc.log.Warnf("scan %s, %s", keyword, err.Error())
+			continue
+		}
+		results = append(results, &ResultSet{rsp.Nodes, rsp.Ways, rsp.Relations})
+	}
+	return mergeResultSets(results...)
+}
+
+func (rc *remoteCluster) SearchNodes(tag string, keyword string) []*tiles.Node {
+	return rc._scanObj(tag, keyword, tiles.ScanRequest_NODE).Nodes
+}
+
+func (rc *remoteCluster) SearchWays(tag string, keyword string) []*tiles.Way {
+	return rc._scanObj(tag, keyword, tiles.ScanRequest_WAY).Ways
+}
+
+func (rc *remoteCluster) SearchRelations(tag string, keyword string) []*tiles.Relation {
+	return rc._scanObj(tag, keyword, tiles.ScanRequest_RELATION).Relations
+}
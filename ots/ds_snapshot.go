@@ -0,0 +1,217 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/OutOfBedlam/ots/logging"
+	"github.com/OutOfBedlam/ots/tiles"
+	"github.com/paulmach/osm"
+)
+
+// loadOsmDataSnapshot loads osm data from the snapshot that is saved next to the osm.pbf file,
+// the snapshot is written in the same format of on-disk index ('<osm.pbf>.otsidx').
+// If the snapshot does not exist or the checksum of osm.pbf is changed,
+// it parses osm.pbf then saves a new snapshot.
+func loadOsmDataSnapshot(osmPbfPath string) (*osmdata, error) {
+	log := logging.GetLog("osm-snapshot")
+	snapshotPath := osmPbfPath + MmapIndexExt
+
+	tick := time.Now()
+	checksum, err := fileChecksum(osmPbfPath)
+	if err != nil {
+		return nil, err
+	}
+	log.Debugf("checksum %s %x %s", osmPbfPath, checksum, time.Since(tick))
+
+	if data, err := readOsmSnapshot(snapshotPath, checksum); err == nil {
+		log.Infof("loaded snapshot %s", snapshotPath)
+		return data, nil
+	} else if !os.IsNotExist(err) {
+		log.Warnf("snapshot %s ignored, %s", snapshotPath, err.Error())
+	}
+
+	data, err := loadOsmData(osmPbfPath)
+	if err != nil {
+		return nil, err
+	}
+
+	tick = time.Now()
+	tmpPath := snapshotPath + ".tmp"
+	if err := writeMmapIndex(data, tmpPath, checksum); err != nil {
+		os.Remove(tmpPath)
+		log.Warnf("fail to write snapshot %s, %s", snapshotPath, err.Error())
+	} else if err := os.Rename(tmpPath, snapshotPath); err != nil {
+		os.Remove(tmpPath)
+		log.Warnf("fail to write snapshot %s, %s", snapshotPath, err.Error())
+	} else {
+		log.Infof("saved snapshot %s %s", snapshotPath, time.Since(tick))
+	}
+	return data, nil
+}
+
+func fileChecksum(path string) ([32]byte, error) {
+	var sum [32]byte
+	f, err := os.Open(path)
+	if err != nil {
+		return sum, err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return sum, err
+	}
+	copy(sum[:], h.Sum(nil))
+	return sum, nil
+}
+
+// readOsmSnapshot rebuilds osmdata from the snapshot file,
+// coordinates and bounds of ways and relations are already resolved in the snapshot.
+// The spatial indexes are the packed R-trees of the snapshot, so the snapshot is kept mapped until the data is closed.
+func readOsmSnapshot(path string, checksum [32]byte) (*osmdata, error) {
+	if _, err := os.Stat(path); err != nil {
+		return nil, err
+	}
+	snap, err := openMmapOsmData(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if snap.hdr.Checksum != checksum {
+		snap.Close()
+		return nil, fmt.Errorf("checksum mismatch")
+	}
+
+	data := newOsmData()
+	data.snapshot = snap
+	nodes := make([]*osm.Node, snap.hdr.NodeCount)
+	ways := make([]*osm.Way, snap.hdr.WayCount)
+	rels := make([]*osm.Relation, snap.hdr.RelCount)
+	data.nodeIndex = newPackedSpatialIndex(snap.nodeTree, nodes)
+	data.wayIndex = newPackedSpatialIndex(snap.wayTree, ways)
+	data.relationIndex = newPackedSpatialIndex(snap.relTree, rels)
+
+	tick := time.Now()
+	for i := 0; i < int(snap.hdr.NodeCount); i++ {
+		rec := snap.nodeRecord(i)
+		node := &osm.Node{
+			ID:  osm.NodeID(snap.u64(rec)),
+			Lat: snap.coord(rec + 8),
+			Lon: snap.coord(rec + 12),
+		}
+		node.Tags = snap.osmTags(snap.hdr.Blob+snap.u64(rec+16), nil)
+		data.nodes.Set(node.ID, node)
+		nodes[i] = node
+	}
+	data.log.Debugf("loading nodes from snapshot time elapse: %s", time.Since(tick))
+
+	tick = time.Now()
+	for i := 0; i < int(snap.hdr.WayCount); i++ {
+		rec := snap.wayRecord(i)
+		way := &osm.Way{
+			ID:     osm.WayID(snap.u64(rec)),
+			Bounds: snap.osmBounds(rec + 8),
+		}
+		off := snap.hdr.Blob + snap.u64(rec+40)
+		way.Tags = snap.osmTags(off, &off)
+		cnt, n := binary.Uvarint(snap.data[off:])
+		off += uint64(n)
+		way.Nodes = make(osm.WayNodes, cnt)
+		for j := range way.Nodes {
+			way.Nodes[j] = osm.WayNode{
+				ID:  osm.NodeID(snap.u64(off)),
+				Lat: snap.coord(off + 8),
+				Lon: snap.coord(off + 12),
+			}
+			off += 16
+		}
+		data.ways.Set(way.ID, way)
+		ways[i] = way
+	}
+	data.log.Debugf("loading ways from snapshot time elapse: %s", time.Since(tick))
+
+	tick = time.Now()
+	for i := 0; i < int(snap.hdr.RelCount); i++ {
+		rec := snap.relRecord(i)
+		rel := &osm.Relation{
+			ID:     osm.RelationID(snap.u64(rec)),
+			Bounds: snap.osmBounds(rec + 8),
+		}
+		off := snap.hdr.Blob + snap.u64(rec+40)
+		rel.Tags = snap.osmTags(off, &off)
+		cnt, n := binary.Uvarint(snap.data[off:])
+		off += uint64(n)
+		rel.Members = make(osm.Members, cnt)
+		for j := range rel.Members {
+			m := osm.Member{
+				Type: osmMemberType(snap.data[off]),
+				Ref:  int64(snap.u64(off + 1)),
+			}
+			m.Role, off = snap.str(off + 9)
+			switch m.Type {
+			case osm.TypeNode:
+				if node, ok := data.nodes.Get(osm.NodeID(m.Ref)); ok {
+					m.Lat, m.Lon = node.Lat, node.Lon
+				}
+			case osm.TypeWay:
+				if way, ok := data.ways.Get(osm.WayID(m.Ref)); ok {
+					m.Nodes = make([]osm.WayNode, len(way.Nodes))
+					copy(m.Nodes, way.Nodes)
+				}
+			}
+			rel.Members[j] = m
+		}
+		data.relations.Set(rel.ID, rel)
+		data.addParentRelation(rel)
+		rels[i] = rel
+	}
+	data.log.Debugf("loading relations from snapshot time elapse: %s", time.Since(tick))
+
+	return data, nil
+}
+
+// returns nil if there are no tags, and set next offset into 'next' if it is not nil
+func (ds *mmapOsmd) osmTags(off uint64, next *uint64) osm.Tags {
+	var tags osm.Tags
+	end := ds.scanTags(off, func(k, v string) {
+		tags = append(tags, osm.Tag{Key: k, Value: v})
+	})
+	if next != nil {
+		*next = end
+	}
+	return tags
+}
+
+// returns nil if the object had no bounds when it was written
+func (ds *mmapOsmd) osmBounds(off uint64) *osm.Bounds {
+	b := &osm.Bounds{
+		MinLat: ds.f64(off),
+		MinLon: ds.f64(off + 8),
+		MaxLat: ds.f64(off + 16),
+		MaxLon: ds.f64(off + 24),
+	}
+	if *b == (osm.Bounds{}) {
+		return nil
+	}
+	return b
+}
+
+func osmMemberType(t byte) osm.Type {
+	switch tiles.Relation_MemberType(t) {
+	case tiles.Relation_NODE:
+		return osm.TypeNode
+	case tiles.Relation_WAY:
+		return osm.TypeWay
+	case tiles.Relation_RELATION:
+		return osm.TypeRelation
+	case tiles.Relation_BOUNDS:
+		return osm.TypeBounds
+	default:
+		return osm.Type("")
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/OutOfBedlam/ots/geom"
+	"github.com/paulmach/osm"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOsmSnapshot(t *testing.T) {
+	data := newTestOsmData()
+	path := filepath.Join(t.TempDir(), "test.osm.pbf"+MmapIndexExt)
+	checksum := [32]byte{4, 5, 6}
+	require.Nil(t, writeMmapIndex(data, path, checksum))
+
+	_, err := readOsmSnapshot(path, [32]byte{})
+	assert.NotNil(t, err)
+
+	snap, err := readOsmSnapshot(path, checksum)
+	require.Nil(t, err)
+	defer snap.Close()
+
+	bounds := []geom.Bound{
+		geom.MakeBound(37.005, 127.005, 37.025, 127.025),
+		geom.MakeBound(36.9, 126.9, 37.2, 127.2),
+	}
+	for _, b := range bounds {
+		expect, err := data.IntersectsBounds(b)
+		require.Nil(t, err)
+		found, err := snap.IntersectsBounds(b)
+		require.Nil(t, err)
+		assert.Equal(t, resultIds(expect), resultIds(found), "bounds %v", b)
+	}
+	assert.Equal(t, map[osm.RelationID][]osm.RelationID{301: {302}}, snap.parentRelations)
+
+	// the objects in the packed R-tree of the snapshot are removed and inserted again with the new bounds
+	way, _ := snap.ways.Get(105)
+	snap.deleteWay(way)
+	found, err := snap.IntersectsBounds(bounds[1])
+	require.Nil(t, err)
+	assert.NotContains(t, resultIds(found)[1], int64(105))
+	way.Bounds = &osm.Bounds{MinLat: 38, MinLon: 128, MaxLat: 38.01, MaxLon: 128.01}
+	snap.insertWay(way)
+	found, err = snap.IntersectsBounds(geom.MakeBound(37.995, 127.995, 38.005, 128.005))
+	require.Nil(t, err)
+	assert.Equal(t, []int64{105}, resultIds(found)[1])
+	found, err = snap.IntersectsBounds(bounds[1])
+	require.Nil(t, err)
+	assert.NotContains(t, resultIds(found)[1], int64(105))
+}
+
+func TestMmapIndexVersion(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "old"+MmapIndexExt)
+	require.Nil(t, writeMmapIndex(newTestOsmData(), path, [32]byte{}))
+
+	// the index of the previous version is rejected
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	require.Nil(t, err)
+	_, err = f.WriteAt([]byte("OTSIDX01"), 0)
+	require.Nil(t, err)
+	require.Nil(t, f.Close())
+
+	_, err = openMmapOsmData(path)
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), "version 01")
+	_, err = readOsmSnapshot(path, [32]byte{})
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+type IndexCmd struct {
+	OsmPbfFile string `arg:"" required:"" name:"osm pbf file" help:"osm data file, eg) ./data/my.osm.pbf"`
+	Output     string `arg:"" required:"" name:"output file name" help:"index file name, eg) ./data/my.otsidx"`
+}
+
+// index loads the whole osm data into memory once, then writes it into the on-disk index
+// that can be used as osm data source without loading, eg) ots server -i ./data/my.otsidx
+func (cmd *IndexCmd) index() {
+	tick := time.Now()
+	data, err := loadOsmData(cmd.OsmPbfFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "loading %s failed, %s\n", cmd.OsmPbfFile, err.Error())
+		os.Exit(1)
+	}
+	fmt.Printf("loaded %s nodes:%d ways:%d relations:%d %s\n", cmd.OsmPbfFile,
+		data.nodes.Len(), data.ways.Len(), data.relations.Len(), time.Since(tick))
+
+	tick = time.Now()
+	checksum, err := fileChecksum(cmd.OsmPbfFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "checksum %s failed, %s\n", cmd.OsmPbfFile, err.Error())
+		os.Exit(1)
+	}
+	if err := writeMmapIndex(data, cmd.Output, checksum); err != nil {
+		fmt.Fprintf(os.Stderr, "writing %s failed, %s\n", cmd.Output, err.Error())
+		os.Exit(1)
+	}
+	fmt.Printf("written %s %s\n", cmd.Output, time.Since(tick))
+}
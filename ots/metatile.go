@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/OutOfBedlam/ots/tiles"
+)
+
+const metatileMax = 8
+
+func validMetatile(n int) bool {
+	return n >= 1 && n <= metatileMax && n&(n-1) == 0
+}
+
+// metatileSize returns the number of tiles of a side of the metatile in the zoom level,
+// a metatile can not be larger than the world.
+func metatileSize(n int, z int) int {
+	for n > 1 && n > 1<<z {
+		n /= 2
+	}
+	return n
+}
+
+// metatiles renders a metatile once for the concurrent requests of its tiles
+type metatiles struct {
+	sync.Mutex
+	calls map[string]*metatileCall
+}
+
+type metatileCall struct {
+	done  chan struct{}
+	tiles [][]byte
+	err   error
+}
+
+// renderMetatile renders the metatile that contains the tile (x, y) and returns the png of the tile,
+// all tiles of the metatile are added to the cache.
+// Labels are placed once for the metatile so that the neighbour tiles in the metatile agree on the labels.
+func (svr *tileServer) renderMetatile(style *tiles.StyleSheet, z, x, y, n int, tileSize int) ([]byte, error) {
+	mx, my := x/n*n, y/n*n
+	prefix := ""
+	if style != nil {
+		prefix = style.Name + "/"
+	}
+	metaKey := fmt.Sprintf("%s%s/meta%d", prefix, tileCacheKey(z, mx, my, tileSize), n)
+
+	svr.metatiles.Lock()
+	if svr.metatiles.calls == nil {
+		svr.metatiles.calls = map[string]*metatileCall{}
+	}
+	call, inflight := svr.metatiles.calls[metaKey]
+	if !inflight {
+		call = &metatileCall{done: make(chan struct{})}
+		svr.metatiles.calls[metaKey] = call
+	}
+	svr.metatiles.Unlock()
+
+	if !inflight {
+		call.tiles, call.err = svr._buildMetatile(style, z, mx, my, n, tileSize)
+		if call.err == nil && svr.tileCache != nil {
+			for i, pngBytes := range call.tiles {
+				svr.tileCache.Add(prefix+tileCacheKey(z, mx+i%n, my+i/n, tileSize), pngBytes)
+			}
+		}
+		svr.metatiles.Lock()
+		delete(svr.metatiles.calls, metaKey)
+		svr.metatiles.Unlock()
+		close(call.done)
+	} else {
+		<-call.done
+	}
+
+	if call.err != nil {
+		return nil, call.err
+	}
+	return call.tiles[(y-my)*n+(x-mx)], nil
+}
+
+func (svr *tileServer) _buildMetatile(style *tiles.StyleSheet, z, x, y, n int, tileSize int) ([][]byte, error) {
+	//// search objects that intersect the bounds
+	t1 := time.Now()
+	// labels are placed over the margin around the metatile
+	tileBounds := tiles.MetatileToBufferedBounds(x, y, z, n).Pad(0.001)
+	rset, err := intersectsBoundsZoom(svr.ds, tileBounds, z)
+	if err != nil {
+		return nil, err
+	}
+	resultSetCount := rset.LenObjs()
+
+	//// make builder
+	t2 := time.Now()
+	builder := tiles.NewMetaBuilder(x, y, z, n, tileSize)
+	builder.SetVerbose(svr.options.Debug)
+	builder.SetHideLabels(!svr.options.ShowLabels)
+	if style != nil {
+		builder.SetStyleSheet(style)
+	}
+	builder.AddWays(rset.Ways...)
+	builder.AddNodes(rset.Nodes...)
+	builder.AddRelations(rset.Relations...)
+
+	if svr.options.ShowWatermark {
+		builder.SetWatermark(fmt.Sprintf("%d/%d/%d x%d", z, x, y, n))
+		builder.SetTint((x/n)%2 == (y/n)%2)
+	}
+
+	//// build tile
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5*time.Duration(n))
+	tile, err := builder.Build(ctx)
+	cancel()
+	if err != nil {
+		svr.log.Errorf("Builder timeout error %d/%d/%d x%d", z, x, y, n)
+		return nil, err
+	}
+	objsCount := tile.CountObjects()
+
+	t3 := time.Now()
+	pngs, err := tile.EncodePNGTiles(n)
+	if err != nil {
+		return nil, err
+	}
+	svr.log.Infof("%d/%d/%d x%d query:%s %d compile:%s %d render:%s",
+		z, x, y, n, t2.Sub(t1), resultSetCount, t3.Sub(t2), objsCount, time.Since(t3))
+	return pngs, nil
+}
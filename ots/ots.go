@@ -20,6 +20,7 @@ func main() {
 		Render     RenderCmd        `cmd:"" help:"render specified object"`
 		Search     Search           `cmd:"" help:"search osm elements"`
 		Count      Counter          `cmd:"" help:"count osm data features"`
+		Index      IndexCmd         `cmd:"" help:"build on-disk index of osm data"`
 	}
 
 	var cmd *kong.Context
@@ -47,6 +48,8 @@ func main() {
 			cli.Count.count(true)
 		case "render <osm data source> <output file name> <TYPE_IDs>":
 			_render(&cli.Render)
+		case "index <osm pbf file> <output file name>":
+			cli.Index.index()
 		default:
 			panic(cmd.Command())
 		}
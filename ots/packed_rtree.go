@@ -0,0 +1,271 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"math"
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+// packedRTree is a static R-tree that is packed in hilbert curve order.
+// Since it is stored as flat arrays of boxes and indices,
+// it can be searched directly on the bytes of a memory mapped file.
+//
+// layout (little endian)
+//
+//	numItems  uint64
+//	nodeSize  uint64
+//	boxes     [numBoxes][4]float64   minLon, minLat, maxLon, maxLat
+//	indices   [numBoxes]uint64
+type packedRTree struct {
+	numItems    int
+	nodeSize    int
+	numBoxes    int
+	levelBounds []int
+	boxes       []byte
+	indices     []byte
+}
+
+const (
+	packedRTreeNodeSize   = 16
+	packedRTreeHeaderSize = 16
+	packedRTreeBoxSize    = 32
+	packedRTreeIndexSize  = 8
+)
+
+func packedRTreeLevelBounds(numItems, nodeSize int) []int {
+	n := numItems
+	numBoxes := n
+	bounds := []int{n}
+	for {
+		n = (n + nodeSize - 1) / nodeSize
+		numBoxes += n
+		bounds = append(bounds, numBoxes)
+		if n <= 1 {
+			break
+		}
+	}
+	return bounds
+}
+
+// openPackedRTree opens the tree on buf, an error is returned if the tree does not fit in buf
+func openPackedRTree(buf []byte) (*packedRTree, error) {
+	if len(buf) < packedRTreeHeaderSize {
+		return nil, errors.New("truncated packed r-tree")
+	}
+	numItems := binary.LittleEndian.Uint64(buf[0:])
+	nodeSize := binary.LittleEndian.Uint64(buf[8:])
+	if numItems == 0 {
+		return &packedRTree{}, nil
+	}
+	// the number of boxes is less than twice of the items
+	if nodeSize < 2 || numItems > uint64(len(buf))/(packedRTreeBoxSize+packedRTreeIndexSize) {
+		return nil, errors.Errorf("invalid packed r-tree of %d items", numItems)
+	}
+	t := &packedRTree{
+		numItems: int(numItems),
+		nodeSize: int(nodeSize),
+	}
+	t.levelBounds = packedRTreeLevelBounds(t.numItems, t.nodeSize)
+	t.numBoxes = t.levelBounds[len(t.levelBounds)-1]
+	boxesEnd := packedRTreeHeaderSize + t.numBoxes*packedRTreeBoxSize
+	indicesEnd := boxesEnd + t.numBoxes*packedRTreeIndexSize
+	if indicesEnd > len(buf) {
+		return nil, errors.Errorf("truncated packed r-tree of %d items", numItems)
+	}
+	t.boxes = buf[packedRTreeHeaderSize:boxesEnd]
+	t.indices = buf[boxesEnd:indicesEnd]
+	return t, nil
+}
+
+func (t *packedRTree) box(pos int) (minLon, minLat, maxLon, maxLat float64) {
+	b := t.boxes[pos*packedRTreeBoxSize:]
+	minLon = math.Float64frombits(binary.LittleEndian.Uint64(b[0:]))
+	minLat = math.Float64frombits(binary.LittleEndian.Uint64(b[8:]))
+	maxLon = math.Float64frombits(binary.LittleEndian.Uint64(b[16:]))
+	maxLat = math.Float64frombits(binary.LittleEndian.Uint64(b[24:]))
+	return
+}
+
+func (t *packedRTree) index(pos int) int {
+	return int(binary.LittleEndian.Uint64(t.indices[pos*packedRTreeIndexSize:]))
+}
+
+// Search calls cb with the indices of items that intersect the given box, stop searching if cb returns false
+func (t *packedRTree) Search(minLon, minLat, maxLon, maxLat float64, cb func(index int) bool) {
+	t.SearchBox(minLon, minLat, maxLon, maxLat, func(index int, _ [4]float64) bool {
+		return cb(index)
+	})
+}
+
+// SearchBox is the same as Search, but cb is also called with the box of the item
+func (t *packedRTree) SearchBox(minLon, minLat, maxLon, maxLat float64, cb func(index int, box [4]float64) bool) {
+	if t.numItems == 0 {
+		return
+	}
+	nodeIndex := t.numBoxes - 1
+	level := len(t.levelBounds) - 1
+	queue := make([]int, 0)
+	for {
+		end := nodeIndex + t.nodeSize
+		if end > t.levelBounds[level] {
+			end = t.levelBounds[level]
+		}
+		for pos := nodeIndex; pos < end; pos++ {
+			bMinLon, bMinLat, bMaxLon, bMaxLat := t.box(pos)
+			if maxLon < bMinLon || maxLat < bMinLat || minLon > bMaxLon || minLat > bMaxLat {
+				continue
+			}
+			if nodeIndex < t.numItems {
+				if !cb(t.index(pos), [4]float64{bMinLon, bMinLat, bMaxLon, bMaxLat}) {
+					return
+				}
+			} else {
+				queue = append(queue, t.index(pos), level-1)
+			}
+		}
+		if len(queue) == 0 {
+			return
+		}
+		nodeIndex, level = queue[len(queue)-2], queue[len(queue)-1]
+		queue = queue[:len(queue)-2]
+	}
+}
+
+type packedRTreeBuilder struct {
+	boxes   [][4]float64
+	indices []int
+}
+
+func (b *packedRTreeBuilder) Add(minLon, minLat, maxLon, maxLat float64, index int) {
+	b.boxes = append(b.boxes, [4]float64{minLon, minLat, maxLon, maxLat})
+	b.indices = append(b.indices, index)
+}
+
+func (b *packedRTreeBuilder) WriteTo(writer io.Writer) (int64, error) {
+	w := bufio.NewWriter(writer)
+	numItems := len(b.boxes)
+	nodeSize := packedRTreeNodeSize
+
+	var written int64
+	var put = func(v uint64) error {
+		var buf [8]byte
+		binary.LittleEndian.PutUint64(buf[:], v)
+		n, err := w.Write(buf[:])
+		written += int64(n)
+		return err
+	}
+
+	if err := put(uint64(numItems)); err != nil {
+		return written, err
+	}
+	if err := put(uint64(nodeSize)); err != nil {
+		return written, err
+	}
+	if numItems == 0 {
+		return written, w.Flush()
+	}
+
+	b.sortHilbert()
+
+	boxes := b.boxes
+	indices := b.indices
+	levelBounds := packedRTreeLevelBounds(numItems, nodeSize)
+	pos := 0
+	for _, end := range levelBounds[:len(levelBounds)-1] {
+		for pos < end {
+			nodeIndex := pos
+			box := boxes[pos]
+			pos++
+			for j := 1; j < nodeSize && pos < end; j++ {
+				box[0] = math.Min(box[0], boxes[pos][0])
+				box[1] = math.Min(box[1], boxes[pos][1])
+				box[2] = math.Max(box[2], boxes[pos][2])
+				box[3] = math.Max(box[3], boxes[pos][3])
+				pos++
+			}
+			boxes = append(boxes, box)
+			indices = append(indices, nodeIndex)
+		}
+	}
+
+	for _, box := range boxes {
+		for _, v := range box {
+			if err := put(math.Float64bits(v)); err != nil {
+				return written, err
+			}
+		}
+	}
+	for _, idx := range indices {
+		if err := put(uint64(idx)); err != nil {
+			return written, err
+		}
+	}
+	return written, w.Flush()
+}
+
+func (b *packedRTreeBuilder) sortHilbert() {
+	ext := [4]float64{math.Inf(1), math.Inf(1), math.Inf(-1), math.Inf(-1)}
+	for _, box := range b.boxes {
+		ext[0] = math.Min(ext[0], box[0])
+		ext[1] = math.Min(ext[1], box[1])
+		ext[2] = math.Max(ext[2], box[2])
+		ext[3] = math.Max(ext[3], box[3])
+	}
+	width, height := ext[2]-ext[0], ext[3]-ext[1]
+	if width == 0 {
+		width = 1
+	}
+	if height == 0 {
+		height = 1
+	}
+
+	const hilbertMax = (1 << 16) - 1
+	values := make([]uint64, len(b.boxes))
+	for i, box := range b.boxes {
+		x := uint32(hilbertMax * ((box[0]+box[2])/2 - ext[0]) / width)
+		y := uint32(hilbertMax * ((box[1]+box[3])/2 - ext[1]) / height)
+		values[i] = hilbertIndex(x, y)
+	}
+	sort.Sort(&hilbertSorter{values: values, b: b})
+}
+
+type hilbertSorter struct {
+	values []uint64
+	b      *packedRTreeBuilder
+}
+
+func (s *hilbertSorter) Len() int           { return len(s.values) }
+func (s *hilbertSorter) Less(i, j int) bool { return s.values[i] < s.values[j] }
+func (s *hilbertSorter) Swap(i, j int) {
+	s.values[i], s.values[j] = s.values[j], s.values[i]
+	s.b.boxes[i], s.b.boxes[j] = s.b.boxes[j], s.b.boxes[i]
+	s.b.indices[i], s.b.indices[j] = s.b.indices[j], s.b.indices[i]
+}
+
+// hilbertIndex returns the distance of (x,y) along the hilbert curve of 2^16 x 2^16 grid
+func hilbertIndex(x, y uint32) uint64 {
+	const n = 1 << 16
+	var d uint64
+	for s := uint32(n / 2); s > 0; s /= 2 {
+		var rx, ry uint32
+		if x&s > 0 {
+			rx = 1
+		}
+		if y&s > 0 {
+			ry = 1
+		}
+		d += uint64(s) * uint64(s) * uint64((3*rx)^ry)
+		if ry == 0 {
+			if rx == 1 {
+				x = n - 1 - x
+				y = n - 1 - y
+			}
+			x, y = y, x
+		}
+	}
+	return d
+}
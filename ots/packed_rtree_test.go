@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"math/rand"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPackedRTreeSearch(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	boxes := make([][4]float64, 1000)
+	builder := &packedRTreeBuilder{}
+	for i := range boxes {
+		lon, lat := rnd.Float64()*10, rnd.Float64()*10
+		// points and small boxes
+		w, h := 0.0, 0.0
+		if i%2 == 0 {
+			w, h = rnd.Float64()*0.5, rnd.Float64()*0.5
+		}
+		boxes[i] = [4]float64{lon, lat, lon + w, lat + h}
+		builder.Add(lon, lat, lon+w, lat+h, i)
+	}
+	buf := &bytes.Buffer{}
+	_, err := builder.WriteTo(buf)
+	require.Nil(t, err)
+	tree, err := openPackedRTree(buf.Bytes())
+	require.Nil(t, err)
+
+	for q := 0; q < 100; q++ {
+		minLon, minLat := rnd.Float64()*10, rnd.Float64()*10
+		maxLon, maxLat := minLon+rnd.Float64()*2, minLat+rnd.Float64()*2
+
+		expect := make([]int, 0)
+		for i, b := range boxes {
+			if b[0] <= maxLon && b[1] <= maxLat && b[2] >= minLon && b[3] >= minLat {
+				expect = append(expect, i)
+			}
+		}
+		found := make([]int, 0)
+		tree.Search(minLon, minLat, maxLon, maxLat, func(index int) bool {
+			found = append(found, index)
+			return true
+		})
+		sort.Ints(found)
+		require.Equal(t, expect, found)
+	}
+
+	// stops when the callback returns false
+	count := 0
+	tree.Search(0, 0, 10, 10, func(index int) bool {
+		count++
+		return count < 3
+	})
+	assert.Equal(t, 3, count)
+}
+
+func TestPackedRTreeEmpty(t *testing.T) {
+	buf := &bytes.Buffer{}
+	_, err := (&packedRTreeBuilder{}).WriteTo(buf)
+	require.Nil(t, err)
+	tree, err := openPackedRTree(buf.Bytes())
+	require.Nil(t, err)
+	tree.Search(-180, -90, 180, 90, func(index int) bool {
+		t.Fatal("empty tree should not find any item")
+		return false
+	})
+}
@@ -23,7 +23,12 @@ type RenderCmd struct {
 	Time          bool     `negatable:"" default:"false" help:"show elapse time"`
 	ShowWatermark bool     `negatable:"" default:"false" help:"show watermark"`
 	ShowLabels    bool     `negatable:"" default:"true" help:"show labels"`
+	Style         string   `placeholder:"<path>" help:"style sheet file (*.hcl, *.json)"`
+	Icons         []string `placeholder:"<dir>" help:"directories of icons (*.svg, *.png) referenced by name in style sheets"`
+	Fonts         []string `placeholder:"<path>" help:"font files (*.ttf, *.otf) of labels in the order of fallback, 'Script,...:<path>' for the scripts only"`
+	BoldFonts     []string `placeholder:"<path>" help:"font files of labels in bold"`
 
+	styleSheet  *tiles.StyleSheet
 	targetTiles []renderTileTarget
 	targetIds   []renderIdTarget
 	layerStart  int
@@ -53,7 +58,21 @@ func (opt *RenderCmd) render() {
 	}
 	logging.SetDefaultPrefixWidth(10)
 
-	ds, err := NewDataSource(opt.OsmDataSource, 0)
+	if err := tiles.SetFonts(opt.Fonts, opt.BoldFonts); err != nil {
+		panic(err)
+	}
+	if err := loadIcons(opt.Icons); err != nil {
+		panic(err)
+	}
+	if len(opt.Style) > 0 {
+		ss, err := tiles.LoadStyleSheet(opt.Style)
+		if err != nil {
+			panic(err)
+		}
+		opt.styleSheet = ss
+	}
+
+	ds, err := NewDataSource(opt.OsmDataSource, 0, nil)
 	if err != nil {
 		panic(err)
 	}
@@ -78,7 +97,7 @@ func (opt *RenderCmd) renderTiles(ds DataSource) error {
 	//// search ways in the bounds
 	t0 := time.Now()
 	tileBounds := tiles.TilesToBounds(x, y, z).Pad(0.001)
-	rset, err := ds.IntersectsBounds(tileBounds)
+	rset, err := intersectsBoundsZoom(ds, tileBounds, z)
 	if err != nil {
 		return err
 	}
@@ -92,6 +111,9 @@ func (opt *RenderCmd) renderTiles(ds DataSource) error {
 	builder.AddNodes(rset.Nodes...)
 	builder.AddRelations(rset.Relations...)
 	builder.SetHideLabels(!opt.ShowLabels)
+	if opt.styleSheet != nil {
+		builder.SetStyleSheet(opt.styleSheet)
+	}
 	if opt.ShowWatermark {
 		builder.SetWatermark(fmt.Sprintf("%d/%d/%d", z, x, y))
 	}
@@ -189,6 +211,9 @@ func (opt *RenderCmd) renderIds(ds DataSource) error {
 	builder.SetVerbose(opt.Verbose)
 	builder.SetBuildLayerRange(opt.layerStart, opt.layerEnd)
 	builder.SetHideLabels(!opt.ShowLabels)
+	if opt.styleSheet != nil {
+		builder.SetStyleSheet(opt.styleSheet)
+	}
 	for _, obj := range builderObjs {
 		switch o := obj.(type) {
 		case *tiles.Node:
@@ -22,8 +22,16 @@ func (s *Search) search() {
 	var ds DataSource
 
 	if strings.HasPrefix(s.OsmDataSource, "tcp://") {
-		ds = &remoteOsmd{
-			addr: s.OsmDataSource,
+		var err error
+		ds, err = NewDataSource(s.OsmDataSource, 0, nil)
+		if err != nil {
+			panic(err)
+		}
+	} else if strings.HasSuffix(s.OsmDataSource, MmapIndexExt) {
+		var err error
+		ds, err = openMmapOsmData(s.OsmDataSource)
+		if err != nil {
+			panic(err)
 		}
 	} else {
 		var err error
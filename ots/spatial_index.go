@@ -0,0 +1,63 @@
+package main
+
+import (
+	"github.com/tidwall/rtree"
+)
+
+// spatialIndex is the spatial index of the osm objects of osmdata.
+// The objects that are loaded from a snapshot are searched in the packed R-tree of the snapshot as it is,
+// the objects that are inserted later are kept in the dynamic R-tree.
+type spatialIndex[T comparable] struct {
+	packed *packedRTree
+	// objects of the packed R-tree by the index
+	items   []T
+	removed map[int]bool
+	tree    rtree.Generic[T]
+}
+
+// newPackedSpatialIndex returns the index on the packed R-tree, items are the objects of the indices of the tree
+func newPackedSpatialIndex[T comparable](packed *packedRTree, items []T) *spatialIndex[T] {
+	return &spatialIndex[T]{packed: packed, items: items, removed: map[int]bool{}}
+}
+
+func (si *spatialIndex[T]) Insert(min, max [2]float64, value T) {
+	si.tree.Insert(min, max, value)
+}
+
+// Delete removes the value of the box, the box should be the one that the value was indexed with
+func (si *spatialIndex[T]) Delete(min, max [2]float64, value T) {
+	found := false
+	if si.packed != nil {
+		si.packed.Search(min[0], min[1], max[0], max[1], func(index int) bool {
+			if si.items[index] == value && !si.removed[index] {
+				si.removed[index] = true
+				found = true
+				return false
+			}
+			return true
+		})
+	}
+	if !found {
+		si.tree.Delete(min, max, value)
+	}
+}
+
+func (si *spatialIndex[T]) Search(min, max [2]float64, iter func(min, max [2]float64, value T) bool) {
+	if si.packed != nil {
+		stopped := false
+		si.packed.SearchBox(min[0], min[1], max[0], max[1], func(index int, box [4]float64) bool {
+			if si.removed[index] {
+				return true
+			}
+			if !iter([2]float64{box[0], box[1]}, [2]float64{box[2], box[3]}, si.items[index]) {
+				stopped = true
+				return false
+			}
+			return true
+		})
+		if stopped {
+			return
+		}
+	}
+	si.tree.Search(min, max, iter)
+}
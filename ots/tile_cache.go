@@ -0,0 +1,576 @@
+package main
+
+import (
+	"container/list"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/OutOfBedlam/ots/logging"
+	"github.com/hashicorp/golang-lru/simplelru"
+	"github.com/pkg/errors"
+)
+
+// TileCache keeps encoded tile images by the key 'z/x/y' (png) or 'z/x/y.ext'
+type TileCache interface {
+	Get(key string) ([]byte, bool)
+	Add(key string, data []byte)
+	Remove(key string)
+	// TileKeys returns the keys of the cached tiles of zoom z in the range of x and y, inclusive
+	TileKeys(z, minX, minY, maxX, maxY int) []string
+	Close()
+}
+
+// parseTileCacheKey returns z, x, y of the key, the last three path elements of the key
+// are taken and the file extension is ignored.
+func parseTileCacheKey(key string) (z, x, y int, ok bool) {
+	tok := strings.Split(key, "/")
+	if len(tok) < 3 {
+		return
+	}
+	tok = tok[len(tok)-3:]
+	if i := strings.IndexFunc(tok[2], func(r rune) bool { return r < '0' || r > '9' }); i >= 0 {
+		tok[2] = tok[2][:i]
+	}
+	var err error
+	if z, err = strconv.Atoi(tok[0]); err != nil {
+		return
+	}
+	if x, err = strconv.Atoi(tok[1]); err != nil {
+		return
+	}
+	if y, err = strconv.Atoi(tok[2]); err != nil {
+		return
+	}
+	return z, x, y, true
+}
+
+// tileKeyIndex has the keys of the cached tiles by zoom and by tile, so that the tiles of an area are found
+// without walking all keys of the cache. A tile has keys of each style and size. Caller should hold the lock of the cache.
+type tileKeyIndex map[int]map[[2]int][]string
+
+func (ti tileKeyIndex) add(key string) {
+	z, x, y, ok := parseTileCacheKey(key)
+	if !ok {
+		return
+	}
+	zt, ok := ti[z]
+	if !ok {
+		zt = make(map[[2]int][]string)
+		ti[z] = zt
+	}
+	xy := [2]int{x, y}
+	for _, k := range zt[xy] {
+		if k == key {
+			return
+		}
+	}
+	zt[xy] = append(zt[xy], key)
+}
+
+func (ti tileKeyIndex) remove(key string) {
+	z, x, y, ok := parseTileCacheKey(key)
+	if !ok {
+		return
+	}
+	zt := ti[z]
+	xy := [2]int{x, y}
+	keys := zt[xy]
+	for i, k := range keys {
+		if k == key {
+			keys = append(keys[:i], keys[i+1:]...)
+			break
+		}
+	}
+	if len(keys) > 0 {
+		zt[xy] = keys
+		return
+	}
+	delete(zt, xy)
+	if len(zt) == 0 {
+		delete(ti, z)
+	}
+}
+
+// keys walks the tiles in the range or the cached tiles of the zoom, whichever is fewer
+func (ti tileKeyIndex) keys(z, minX, minY, maxX, maxY int) []string {
+	zt := ti[z]
+	if len(zt) == 0 || minX > maxX || minY > maxY {
+		return nil
+	}
+	var keys []string
+	if (maxX-minX+1)*(maxY-minY+1) <= len(zt) {
+		for x := minX; x <= maxX; x++ {
+			for y := minY; y <= maxY; y++ {
+				keys = append(keys, zt[[2]int{x, y}]...)
+			}
+		}
+		return keys
+	}
+	for xy, k := range zt {
+		if xy[0] >= minX && xy[0] <= maxX && xy[1] >= minY && xy[1] <= maxY {
+			keys = append(keys, k...)
+		}
+	}
+	return keys
+}
+
+type TileCacheConfig struct {
+	Size     int           `default:"2000" name:"size" help:"lru cache size for generated images"`
+	Dir      string        `name:"dir" placeholder:"<path>" help:"directory of persistent tile cache, disabled if empty"`
+	DiskSize int           `default:"1024" name:"disk-size" help:"max size of persistent tile cache in MB"`
+	TTL      time.Duration `default:"0s" name:"ttl" help:"expiration time of cached tiles in memory and persistent cache, never expire if 0"`
+}
+
+func NewTileCache(conf *TileCacheConfig) (TileCache, error) {
+	tiers := make([]TileCache, 0)
+	if conf.Size > 0 {
+		mc, err := newMemTileCache(conf.Size, conf.TTL)
+		if err != nil {
+			return nil, err
+		}
+		tiers = append(tiers, mc)
+	}
+	if len(conf.Dir) > 0 {
+		fc, err := newFsTileCache(conf.Dir, int64(conf.DiskSize)*1024*1024, conf.TTL)
+		if err != nil {
+			return nil, err
+		}
+		tiers = append(tiers, fc)
+	}
+
+	switch len(tiers) {
+	case 0:
+		return nil, nil
+	case 1:
+		return tiers[0], nil
+	default:
+		return &tieredTileCache{tiers: tiers}, nil
+	}
+}
+
+//#region tieredTileCache
+
+// tieredTileCache looks up tiers in order, the faster tier should come first
+type tieredTileCache struct {
+	tiers []TileCache
+}
+
+// agedTileCache keeps the time when each tile was added,
+// the time is carried to the upper tiers so that a tile expires at the same time in every tier
+type agedTileCache interface {
+	getAged(key string) ([]byte, time.Time, bool)
+	addAged(key string, data []byte, mtime time.Time)
+}
+
+func (tc *tieredTileCache) Get(key string) ([]byte, bool) {
+	for i, t := range tc.tiers {
+		var data []byte
+		var mtime time.Time
+		var ok bool
+		if at, aged := t.(agedTileCache); aged {
+			data, mtime, ok = at.getAged(key)
+		} else {
+			data, ok = t.Get(key)
+			mtime = time.Now()
+		}
+		if !ok {
+			continue
+		}
+		// fill upper tiers
+		for _, upper := range tc.tiers[:i] {
+			if at, aged := upper.(agedTileCache); aged {
+				at.addAged(key, data, mtime)
+			} else {
+				upper.Add(key, data)
+			}
+		}
+		return data, true
+	}
+	return nil, false
+}
+
+func (tc *tieredTileCache) Add(key string, data []byte) {
+	for _, t := range tc.tiers {
+		t.Add(key, data)
+	}
+}
+
+func (tc *tieredTileCache) Remove(key string) {
+	for _, t := range tc.tiers {
+		t.Remove(key)
+	}
+}
+
+func (tc *tieredTileCache) TileKeys(z, minX, minY, maxX, maxY int) []string {
+	set := make(map[string]bool)
+	for _, t := range tc.tiers {
+		for _, k := range t.TileKeys(z, minX, minY, maxX, maxY) {
+			set[k] = true
+		}
+	}
+	keys := make([]string, 0, len(set))
+	for k := range set {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+func (tc *tieredTileCache) Close() {
+	for _, t := range tc.tiers {
+		t.Close()
+	}
+}
+
+//#endregion
+
+//#region memTileCache
+
+type memTileCache struct {
+	lock  sync.Mutex
+	cache *simplelru.LRU
+	index tileKeyIndex
+	ttl   time.Duration
+}
+
+type memTileEntry struct {
+	data  []byte
+	mtime time.Time
+}
+
+func newMemTileCache(size int, ttl time.Duration) (*memTileCache, error) {
+	mc := &memTileCache{index: make(tileKeyIndex), ttl: ttl}
+	// evicted and removed entries are taken out of the index while the lock is held by the caller
+	cache, err := simplelru.NewLRU(size, func(key, value interface{}) {
+		mc.index.remove(key.(string))
+	})
+	if err != nil {
+		return nil, err
+	}
+	mc.cache = cache
+	return mc, nil
+}
+
+func (mc *memTileCache) Get(key string) ([]byte, bool) {
+	data, _, ok := mc.getAged(key)
+	return data, ok
+}
+
+func (mc *memTileCache) getAged(key string) ([]byte, time.Time, bool) {
+	mc.lock.Lock()
+	defer mc.lock.Unlock()
+	a, ok := mc.cache.Get(key)
+	if !ok {
+		return nil, time.Time{}, false
+	}
+	ent := a.(*memTileEntry)
+	if mc.ttl > 0 && time.Since(ent.mtime) > mc.ttl {
+		mc.cache.Remove(key)
+		return nil, time.Time{}, false
+	}
+	return ent.data, ent.mtime, true
+}
+
+func (mc *memTileCache) Add(key string, data []byte) {
+	mc.addAged(key, data, time.Now())
+}
+
+func (mc *memTileCache) addAged(key string, data []byte, mtime time.Time) {
+	mc.lock.Lock()
+	defer mc.lock.Unlock()
+	mc.cache.Add(key, &memTileEntry{data: data, mtime: mtime})
+	mc.index.add(key)
+}
+
+func (mc *memTileCache) Remove(key string) {
+	mc.lock.Lock()
+	defer mc.lock.Unlock()
+	mc.cache.Remove(key)
+}
+
+func (mc *memTileCache) TileKeys(z, minX, minY, maxX, maxY int) []string {
+	mc.lock.Lock()
+	defer mc.lock.Unlock()
+	return mc.index.keys(z, minX, minY, maxX, maxY)
+}
+
+func (mc *memTileCache) Close() {
+	mc.lock.Lock()
+	defer mc.lock.Unlock()
+	mc.cache.Purge()
+}
+
+//#endregion
+
+//#region fsTileCache
+
+// fsTileCache stores tiles in the 'dir/z/x/y.png' layout,
+// evicts least recently used tiles when the total size exceeds maxSize.
+type fsTileCache struct {
+	log     logging.Log
+	dir     string
+	maxSize int64
+	ttl     time.Duration
+
+	lock  sync.Mutex
+	size  int64
+	lru   *list.List
+	index map[string]*list.Element
+	tiles tileKeyIndex
+}
+
+type fsTileEntry struct {
+	key   string
+	size  int64
+	mtime time.Time
+}
+
+const fsTileCacheDefaultExt = ".png"
+
+func newFsTileCache(dir string, maxSize int64, ttl time.Duration) (*fsTileCache, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, errors.Wrap(err, "tile cache dir")
+	}
+	fc := &fsTileCache{
+		log:     logging.GetLog("tile-cache"),
+		dir:     dir,
+		maxSize: maxSize,
+		ttl:     ttl,
+		lru:     list.New(),
+		index:   make(map[string]*list.Element),
+		tiles:   make(tileKeyIndex),
+	}
+	if err := fc.warmUp(); err != nil {
+		return nil, err
+	}
+	return fc, nil
+}
+
+// warmUp builds the index from the files that were cached in previous runs
+func (fc *fsTileCache) warmUp() error {
+	tick := time.Now()
+	entries := make([]*fsTileEntry, 0)
+	err := filepath.WalkDir(fc.dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		if strings.HasSuffix(path, ".tmp") {
+			// incomplete file of previous run
+			os.Remove(path)
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(fc.dir, path)
+		if err != nil {
+			return err
+		}
+		key := strings.TrimSuffix(filepath.ToSlash(rel), fsTileCacheDefaultExt)
+		entries = append(entries, &fsTileEntry{key: key, size: info.Size(), mtime: info.ModTime()})
+		return nil
+	})
+	if err != nil {
+		return errors.Wrap(err, "tile cache warm-up")
+	}
+
+	// the most recent one goes to the front
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].mtime.Before(entries[j].mtime)
+	})
+
+	fc.lock.Lock()
+	for _, ent := range entries {
+		fc.index[ent.key] = fc.lru.PushFront(ent)
+		fc.tiles.add(ent.key)
+		fc.size += ent.size
+	}
+	evicted := fc.evict()
+	fc.lock.Unlock()
+	fc.unlink(evicted)
+
+	fc.log.Infof("tile cache %s tiles:%d size:%dMB %s", fc.dir, len(fc.index), fc.size/1024/1024, time.Since(tick))
+	return nil
+}
+
+func (fc *fsTileCache) path(key string) string {
+	if len(filepath.Ext(key)) == 0 {
+		key = key + fsTileCacheDefaultExt
+	}
+	return filepath.Join(fc.dir, filepath.FromSlash(key))
+}
+
+func (fc *fsTileCache) Get(key string) ([]byte, bool) {
+	data, _, ok := fc.getAged(key)
+	return data, ok
+}
+
+func (fc *fsTileCache) getAged(key string) ([]byte, time.Time, bool) {
+	fc.lock.Lock()
+	elm, ok := fc.index[key]
+	if !ok {
+		fc.lock.Unlock()
+		return nil, time.Time{}, false
+	}
+	ent := elm.Value.(*fsTileEntry)
+	if fc.ttl > 0 && time.Since(ent.mtime) > fc.ttl {
+		path := fc.remove(elm)
+		fc.lock.Unlock()
+		fc.unlink([]string{path})
+		return nil, time.Time{}, false
+	}
+	mtime := ent.mtime
+	fc.lru.MoveToFront(elm)
+	fc.lock.Unlock()
+
+	data, err := os.ReadFile(fc.path(key))
+	if err != nil {
+		fc.Remove(key)
+		return nil, time.Time{}, false
+	}
+	return data, mtime, true
+}
+
+func (fc *fsTileCache) Add(key string, data []byte) {
+	fc.addAged(key, data, time.Now())
+}
+
+func (fc *fsTileCache) addAged(key string, data []byte, mtime time.Time) {
+	path := fc.path(key)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		fc.log.Warnf("tile cache %s %s", key, err.Error())
+		return
+	}
+	// write to temp file then rename, so that readers never see partial content,
+	// the temp file is unique for the concurrent writers of the same key
+	if err := fc.writeFile(path, data, mtime); err != nil {
+		fc.log.Warnf("tile cache %s %s", key, err.Error())
+		return
+	}
+
+	fc.lock.Lock()
+	if elm, ok := fc.index[key]; ok {
+		ent := elm.Value.(*fsTileEntry)
+		fc.size -= ent.size
+		ent.size = int64(len(data))
+		ent.mtime = mtime
+		fc.size += ent.size
+		fc.lru.MoveToFront(elm)
+	} else {
+		ent := &fsTileEntry{key: key, size: int64(len(data)), mtime: mtime}
+		fc.index[key] = fc.lru.PushFront(ent)
+		fc.tiles.add(key)
+		fc.size += ent.size
+	}
+	evicted := fc.evict()
+	fc.lock.Unlock()
+	fc.unlink(evicted)
+}
+
+// writeFile writes the data to a temp file and renames it to the path,
+// the modification time of the file is set to mtime so that warm-up restores the age of the tile
+func (fc *fsTileCache) writeFile(path string, data []byte, mtime time.Time) error {
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	if _, err = f.Write(data); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err = f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err = os.Chmod(tmp, 0644); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err = os.Chtimes(tmp, mtime, mtime); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err = os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+func (fc *fsTileCache) Remove(key string) {
+	fc.lock.Lock()
+	elm, ok := fc.index[key]
+	if !ok {
+		fc.lock.Unlock()
+		return
+	}
+	path := fc.remove(elm)
+	fc.lock.Unlock()
+	fc.unlink([]string{path})
+}
+
+func (fc *fsTileCache) TileKeys(z, minX, minY, maxX, maxY int) []string {
+	fc.lock.Lock()
+	defer fc.lock.Unlock()
+	return fc.tiles.keys(z, minX, minY, maxX, maxY)
+}
+
+func (fc *fsTileCache) Keys() []string {
+	fc.lock.Lock()
+	defer fc.lock.Unlock()
+	keys := make([]string, 0, len(fc.index))
+	for k := range fc.index {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+func (fc *fsTileCache) Close() {
+}
+
+// evict removes the least recently used tiles from the index and returns their files to unlink,
+// caller should hold the lock
+func (fc *fsTileCache) evict() []string {
+	var paths []string
+	for fc.maxSize > 0 && fc.size > fc.maxSize {
+		elm := fc.lru.Back()
+		if elm == nil {
+			break
+		}
+		paths = append(paths, fc.remove(elm))
+	}
+	return paths
+}
+
+// remove removes the tile from the index and returns its file to unlink,
+// caller should hold the lock
+func (fc *fsTileCache) remove(elm *list.Element) string {
+	ent := elm.Value.(*fsTileEntry)
+	fc.lru.Remove(elm)
+	delete(fc.index, ent.key)
+	fc.tiles.remove(ent.key)
+	fc.size -= ent.size
+	return fc.path(ent.key)
+}
+
+// unlink removes the files without the lock, so that the disk does not block the other requests.
+// A tile that is added again before its old file is unlinked loses the file,
+// and it is removed from the index when the missing file is read.
+func (fc *fsTileCache) unlink(paths []string) {
+	for _, path := range paths {
+		os.Remove(path)
+	}
+}
+
+//#endregion
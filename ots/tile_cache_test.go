@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFsTileCacheEviction(t *testing.T) {
+	dir := t.TempDir()
+	fc, err := newFsTileCache(dir, 250, 0)
+	require.Nil(t, err)
+
+	tile := bytes.Repeat([]byte{1}, 100)
+	fc.Add("10/1/1", tile)
+	fc.Add("10/1/2", tile)
+	// the first one becomes the most recently used
+	_, ok := fc.Get("10/1/1")
+	require.True(t, ok)
+	// over 250 bytes, the least recently used one is evicted
+	fc.Add("10/1/3", tile)
+
+	keys := fc.Keys()
+	sort.Strings(keys)
+	assert.Equal(t, []string{"10/1/1", "10/1/3"}, keys)
+	assert.Equal(t, int64(200), fc.size)
+	_, err = os.Stat(filepath.Join(dir, "10", "1", "2.png"))
+	assert.True(t, os.IsNotExist(err))
+
+	// replacing a tile counts the new size
+	fc.Add("10/1/3", bytes.Repeat([]byte{1}, 150))
+	assert.Equal(t, int64(250), fc.size)
+	assert.Equal(t, 2, len(fc.Keys()))
+}
+
+func TestTileCacheTTL(t *testing.T) {
+	ttl := 200 * time.Millisecond
+
+	mc, err := newMemTileCache(10, ttl)
+	require.Nil(t, err)
+	mc.Add("10/1/1", []byte("tile"))
+	_, ok := mc.Get("10/1/1")
+	assert.True(t, ok)
+	mc.addAged("10/1/2", []byte("tile"), time.Now().Add(-2*ttl))
+	_, ok = mc.Get("10/1/2")
+	assert.False(t, ok)
+
+	fc, err := newFsTileCache(t.TempDir(), 0, ttl)
+	require.Nil(t, err)
+	fc.addAged("10/1/2", []byte("tile"), time.Now().Add(-2*ttl))
+	_, ok = fc.Get("10/1/2")
+	assert.False(t, ok)
+	assert.Equal(t, 0, len(fc.Keys()))
+
+	// the tile from the disk keeps its age in the memory
+	mc, err = newMemTileCache(10, ttl)
+	require.Nil(t, err)
+	tc := &tieredTileCache{tiers: []TileCache{mc, fc}}
+	fc.addAged("10/1/3", []byte("tile"), time.Now().Add(-ttl/2))
+	_, ok = tc.Get("10/1/3")
+	require.True(t, ok)
+	_, ok = mc.Get("10/1/3")
+	require.True(t, ok)
+	time.Sleep(ttl/2 + 50*time.Millisecond)
+	_, ok = mc.Get("10/1/3")
+	assert.False(t, ok)
+	_, ok = tc.Get("10/1/3")
+	assert.False(t, ok)
+}
+
+func TestFsTileCacheWarmUp(t *testing.T) {
+	dir := t.TempDir()
+	write := func(path string, size int, age time.Duration) {
+		path = filepath.Join(dir, filepath.FromSlash(path))
+		require.Nil(t, os.MkdirAll(filepath.Dir(path), 0755))
+		require.Nil(t, os.WriteFile(path, bytes.Repeat([]byte{1}, size), 0644))
+		mtime := time.Now().Add(-age)
+		require.Nil(t, os.Chtimes(path, mtime, mtime))
+	}
+	write("10/1/1.png", 100, 3*time.Hour)
+	write("10/1/2.png", 100, 2*time.Hour)
+	write("10/1/3.mvt", 100, time.Hour)
+	// incomplete file of the previous run
+	write("10/1/4.png.123.tmp", 100, 0)
+
+	// the oldest one is evicted
+	fc, err := newFsTileCache(dir, 250, 0)
+	require.Nil(t, err)
+	keys := fc.Keys()
+	sort.Strings(keys)
+	assert.Equal(t, []string{"10/1/2", "10/1/3.mvt"}, keys)
+	_, err = os.Stat(filepath.Join(dir, "10", "1", "4.png.123.tmp"))
+	assert.True(t, os.IsNotExist(err))
+
+	data, ok := fc.Get("10/1/3.mvt")
+	assert.True(t, ok)
+	assert.Equal(t, 100, len(data))
+
+	// the age of the tile is restored from the file
+	fc, err = newFsTileCache(dir, 0, 90*time.Minute)
+	require.Nil(t, err)
+	_, ok = fc.Get("10/1/2")
+	assert.False(t, ok)
+	_, ok = fc.Get("10/1/3.mvt")
+	assert.True(t, ok)
+}
+
+func TestFsTileCacheConcurrentAdd(t *testing.T) {
+	dir := t.TempDir()
+	fc, err := newFsTileCache(dir, 0, 0)
+	require.Nil(t, err)
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			fc.Add("10/1/1", bytes.Repeat([]byte(fmt.Sprintf("%d", i)), 1000))
+		}(i)
+	}
+	wg.Wait()
+
+	data, ok := fc.Get("10/1/1")
+	require.True(t, ok)
+	assert.Equal(t, bytes.Repeat(data[:1], 1000), data)
+	entries, err := os.ReadDir(filepath.Join(dir, "10", "1"))
+	require.Nil(t, err)
+	assert.Equal(t, 1, len(entries))
+}
+
+func TestTileCacheTileKeys(t *testing.T) {
+	mc, err := newMemTileCache(4, 0)
+	require.Nil(t, err)
+	fc, err := newFsTileCache(t.TempDir(), 0, 0)
+	require.Nil(t, err)
+	tileKeys := func(tc TileCache, z, minX, minY, maxX, maxY int) []string {
+		keys := tc.TileKeys(z, minX, minY, maxX, maxY)
+		sort.Strings(keys)
+		return keys
+	}
+
+	for _, tc := range []TileCache{mc, fc} {
+		for _, key := range []string{"10/1/1", "style/10/1/1@1024px", "10/2/3.mvt", "11/1/1"} {
+			tc.Add(key, []byte(key))
+		}
+		// the tiles in the range and the cached tiles of the zoom are walked
+		assert.Equal(t, []string{"10/1/1", "style/10/1/1@1024px"}, tileKeys(tc, 10, 1, 1, 1, 1))
+		assert.Equal(t, []string{"10/1/1", "10/2/3.mvt", "style/10/1/1@1024px"}, tileKeys(tc, 10, 0, 0, 1023, 1023))
+		assert.Nil(t, tileKeys(tc, 12, 0, 0, 4095, 4095))
+
+		tc.Remove("10/1/1")
+		assert.Equal(t, []string{"style/10/1/1@1024px"}, tileKeys(tc, 10, 1, 1, 1, 1))
+	}
+
+	// evicted tiles are not in the range
+	mc.Add("12/1/1", []byte("tile"))
+	mc.Add("12/1/2", []byte("tile"))
+	assert.Nil(t, tileKeys(mc, 10, 1, 1, 1, 1))
+	assert.Equal(t, []string{"12/1/1", "12/1/2"}, tileKeys(mc, 12, 1, 1, 1, 2))
+}
@@ -4,6 +4,7 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"crypto/tls"
 	_ "embed"
 	"fmt"
 	"net"
@@ -19,14 +20,19 @@ import (
 	"github.com/OutOfBedlam/ots/geom"
 	"github.com/OutOfBedlam/ots/httpsvr"
 	"github.com/OutOfBedlam/ots/logging"
+	"github.com/OutOfBedlam/ots/projection"
+	"github.com/OutOfBedlam/ots/projection/mercator"
 	"github.com/OutOfBedlam/ots/tiles"
 	"github.com/alecthomas/kong"
 	"github.com/gin-gonic/gin"
-	lru "github.com/hashicorp/golang-lru"
 	"github.com/pkg/errors"
 	"github.com/soheilhy/cmux"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/keepalive"
 	"google.golang.org/grpc/reflection"
+	"google.golang.org/protobuf/proto"
 )
 
 type tileServer struct {
@@ -36,30 +42,44 @@ type tileServer struct {
 	ds        DataSource
 	quit      chan os.Signal
 	options   *TileServerOptions
-	tileCache *lru.Cache
+	tileCache TileCache
+	styles    map[string]*tiles.StyleSheet
+	metatiles metatiles
 }
 
 type TileServerConfig struct {
-	Config        kong.ConfigFlag   `short:"c" type:"existingfile" placeholder:"<path>" help:"path to config file"`
-	OsmDataSource string            `short:"i" placeholder:"<datasource>" help:"osm data source, eg) ./data/my.osm.pbf or tcp://host:port"`
-	Bind          string            `short:"b" default:"127.0.0.1" help:"bind address"`
-	Port          int               `short:"p" default:"1919" help:"bind port"`
-	CacheSize     int               `default:"2000" name:"cache-size" help:"lru cache size for generated images"`
-	Options       TileServerOptions `embed:"" prefix:""`
+	Config        kong.ConfigFlag     `short:"c" type:"existingfile" placeholder:"<path>" help:"path to config file"`
+	OsmDataSource string              `short:"i" placeholder:"<datasource>" help:"osm data source, eg) ./data/my.osm.pbf or tcp://host:port"`
+	Bind          string              `short:"b" default:"127.0.0.1" help:"bind address"`
+	Port          int                 `short:"p" default:"1919" help:"bind port"`
+	Cache         TileCacheConfig     `embed:"" prefix:"cache-"`
+	Changes       ChangeWatcherConfig `embed:"" prefix:"changes-"`
+	Remote        RemoteConfig        `embed:"" prefix:"remote-"`
+	TLS           ServerTLSConfig     `embed:"" prefix:"tls-"`
+	Auth          AuthConfig          `embed:"" prefix:"auth-"`
+	Options       TileServerOptions   `embed:"" prefix:""`
 	//// Caution!! by inconsistency (bug?) b/w kong and kong-hcl, do not use "group" tag, it will not work
 	HttpLogConfig   logging.Config `embed:"" name:"httplog" prefix:"httplog-"`
 	ServerLogConfig logging.Config `embed:"" name:"log" prefix:"log-"`
 }
 
 type TileServerOptions struct {
-	Pname              string `default:"tilesvr" name:"pname" help:"server instance name"`
-	GrpcMaxRecvMsgSize int    `default:"10" help:"grpc max recv message size in MB"`
-	GrpcMaxSendMsgSize int    `default:"10" help:"grpc max send message size in MB"`
-	ShowWatermark      bool   `default:"false" negatable:"" help:"show watermark"`
-	ShowLabels         bool   `default:"true" negatable:"" help:"show labels"`
-	Debug              bool   `default:"false" help:"debug mode"`
-	HttpConsoleColor   bool   `default:"false" help:"http colored console log"`
-	HttpDebugMode      bool   `default:"false" help:"http debug mode"`
+	Pname              string   `default:"tilesvr" name:"pname" help:"server instance name"`
+	GrpcMaxRecvMsgSize int      `default:"10" help:"grpc max recv message size in MB"`
+	GrpcMaxSendMsgSize int      `default:"10" help:"grpc max send message size in MB"`
+	GrpcReflection     bool     `default:"true" negatable:"" help:"register grpc reflection service"`
+	TileSize           int      `default:"512" help:"pixel size of {y}.png tiles, {y}@1x.png and {y}@2x.png are always 256 and 512"`
+	Styles             []string `name:"styles" placeholder:"<path>" help:"style sheet files (*.hcl, *.json), selected by '?style=<name>' of tile requests"`
+	Icons              []string `name:"icons" placeholder:"<dir>" help:"directories of icons (*.svg, *.png) referenced by name in style sheets"`
+	Fonts              []string `name:"fonts" placeholder:"<path>" help:"font files (*.ttf, *.otf) of labels in the order of fallback, 'Script,...:<path>' for the scripts only"`
+	BoldFonts          []string `name:"bold-fonts" placeholder:"<path>" help:"font files of labels in bold, labels are drawn with fonts if no bold font has the character"`
+	DefaultStyle       string   `name:"default-style" help:"name of the style sheet for the requests without '?style', built-in styles if empty"`
+	Metatile           int      `default:"1" help:"render N x N tiles at once (1, 2, 4, 8), labels agree across the tiles of a metatile"`
+	ShowWatermark      bool     `default:"false" negatable:"" help:"show watermark"`
+	ShowLabels         bool     `default:"true" negatable:"" help:"show labels"`
+	Debug              bool     `default:"false" help:"debug mode"`
+	HttpConsoleColor   bool     `default:"false" help:"http colored console log"`
+	HttpDebugMode      bool     `default:"false" help:"http debug mode"`
 }
 
 func tile_server(conf *TileServerConfig) {
@@ -72,25 +92,77 @@ func tile_server(conf *TileServerConfig) {
 	// Banner
 	log.Info(banner.GenBootBanner(conf.Options.Pname, banner.Version()))
 
-	var err error
+	tileCache, err := NewTileCache(&conf.Cache)
+	if err != nil {
+		log.Errorf("fail to create cache, %s", err.Error())
+		os.Exit(1)
+	}
+	if tileCache != nil {
+		defer tileCache.Close()
+	}
 
-	var tileCache *lru.Cache
-	if conf.CacheSize > 0 {
-		if tileCache, err = lru.New(conf.CacheSize); err != nil {
-			log.Errorf("fail to create cache")
-			os.Exit(1)
-		}
+	if !validTileSize(conf.Options.TileSize) {
+		log.Errorf("unsupported tile-size %d, should be one of 256, 512, 768, 1024", conf.Options.TileSize)
+		os.Exit(1)
+	}
+
+	if !validMetatile(conf.Options.Metatile) {
+		log.Errorf("unsupported metatile %d, should be one of 1, 2, 4, 8", conf.Options.Metatile)
+		os.Exit(1)
+	}
+
+	if conf.Options.Metatile > 1 && tileCache == nil {
+		// the other tiles of the metatile would be rendered again for each request
+		log.Errorf("metatile %d requires the tile cache, set cache-size or cache-dir", conf.Options.Metatile)
+		os.Exit(1)
+	}
+
+	if err := tiles.SetFonts(conf.Options.Fonts, conf.Options.BoldFonts); err != nil {
+		log.Errorf("fail to load fonts, %s", err.Error())
+		os.Exit(1)
+	}
+
+	if err := loadIcons(conf.Options.Icons); err != nil {
+		log.Errorf("fail to load icons, %s", err.Error())
+		os.Exit(1)
+	}
+
+	styles, err := loadStyleSheets(conf.Options.Styles)
+	if err != nil {
+		log.Errorf("fail to load style sheets, %s", err.Error())
+		os.Exit(1)
+	}
+	if _, ok := styles[conf.Options.DefaultStyle]; len(conf.Options.DefaultStyle) > 0 && !ok {
+		log.Errorf("default-style %q is not found in styles", conf.Options.DefaultStyle)
+		os.Exit(1)
 	}
 
 	lsnrAddr := fmt.Sprintf("%s:%d", conf.Bind, conf.Port)
 
+	tlsConf, err := conf.TLS.tlsConfig()
+	if err != nil {
+		log.Errorf("fail to load tls config, %s", err.Error())
+		os.Exit(1)
+	}
+	auth, err := newTokenAuth(&conf.Auth)
+	if err != nil {
+		log.Errorf("fail to load auth config, %s", err.Error())
+		os.Exit(1)
+	}
+
 	lsnr, err := net.Listen("tcp", lsnrAddr)
 	if err != nil {
 		log.Errorf("fail to listen port %s", err)
 		os.Exit(1)
 	}
+	scheme := "tcp"
+	if tlsConf != nil {
+		// both of grpc and http are served on the decrypted connections
+		lsnr = tls.NewListener(lsnr, tlsConf)
+		scheme = "tls"
+	}
 
-	ds, err := NewDataSource(conf.OsmDataSource, conf.Options.GrpcMaxRecvMsgSize*1024*1024)
+	ds, err := NewDataSource(conf.OsmDataSource, conf.Options.GrpcMaxRecvMsgSize*1024*1024, &conf.Remote)
 	if err != nil {
 		log.Errorf("datasource %s loading failed, %s", conf.OsmDataSource, err.Error())
 		os.Exit(1)
@@ -103,6 +175,17 @@ func tile_server(conf *TileServerConfig) {
 		quit:      make(chan os.Signal, 1),
 		options:   &conf.Options,
 		tileCache: tileCache,
+		styles:    styles,
+	}
+
+	if len(conf.Changes.Dir) > 0 {
+		if applier, ok := ds.(ChangeApplier); ok {
+			cw := newChangeWatcher(&conf.Changes, applier, svr.invalidate)
+			cw.Start()
+			defer cw.Stop()
+		} else {
+			log.Warnf("changes-dir %s ignored, data source %s does not support changes", conf.Changes.Dir, conf.OsmDataSource)
+		}
 	}
 
 	// New Mux Server
@@ -116,11 +199,26 @@ func tile_server(conf *TileServerConfig) {
 	grpcOpt := []grpc.ServerOption{
 		grpc.MaxRecvMsgSize(conf.Options.GrpcMaxRecvMsgSize * 1024 * 1024),
 		grpc.MaxSendMsgSize(conf.Options.GrpcMaxSendMsgSize * 1024 * 1024),
+		// allow keepalive pings of the rendering servers
+		grpc.KeepaliveEnforcementPolicy(keepalive.EnforcementPolicy{
+			MinTime:             10 * time.Second,
+			PermitWithoutStream: true,
+		}),
+	}
+	if auth != nil {
+		grpcOpt = append(grpcOpt,
+			grpc.UnaryInterceptor(auth.UnaryInterceptor),
+			grpc.StreamInterceptor(auth.StreamInterceptor),
+		)
 	}
 
 	grpcS := grpc.NewServer(grpcOpt...)
 	tiles.RegisterTileServer(grpcS, &svr)
-	reflection.Register(grpcS)
+	healthS := health.NewServer()
+	healthpb.RegisterHealthServer(grpcS, healthS)
+	if conf.Options.GrpcReflection {
+		reflection.Register(grpcS)
+	}
 
 	httpSvr := httpsvr.NewServer(&httpsvr.HttpServerConfig{
 		DisableConsoleColor: !conf.Options.HttpConsoleColor,
@@ -129,9 +227,14 @@ func tile_server(conf *TileServerConfig) {
 		LoggingConfig:       &conf.HttpLogConfig,
 	})
 
-	httpSvr.GET("tiles/:Z/:X/:Y", svr.handleGetTile)
+	// '/tiles/{z}/{x}/{y}.png' and '/tiles/{style}/{z}/{x}/{y}.png'
+	if auth != nil {
+		httpSvr.GET("tiles/*path", auth.HttpHandler, svr.handleTiles)
+	} else {
+		httpSvr.GET("tiles/*path", svr.handleTiles)
+	}
 	httpSvr.GET("", svr.handleDemoPage)
-	log.Infof("grpc on tcp://%s", lsnrAddr)
+	log.Infof("grpc on %s://%s", scheme, lsnrAddr)
 
 	httpSvr.Start(httpL)
 	go grpcS.Serve(grpcL)
@@ -140,6 +243,8 @@ func tile_server(conf *TileServerConfig) {
 	signal.Notify(svr.quit, os.Interrupt, syscall.SIGINT, syscall.SIGTERM)
 	<-svr.quit
 
+	// let the clients know before closing the connections
+	healthS.Shutdown()
 	mux.Close()
 	grpcS.Stop()
 	httpSvr.Stop()
@@ -152,27 +257,70 @@ func (svr *tileServer) handleDemoPage(c *gin.Context) {
 	c.Data(http.StatusOK, "text/html", htmlData)
 }
 
-func (svr *tileServer) handleGetTile(c *gin.Context) {
-	z, x, y, err := _parseZXY(c)
+func (svr *tileServer) handleTiles(c *gin.Context) {
+	styleName, zxy, ok := _splitTilePath(c.Param("path"))
+	if !ok {
+		c.String(http.StatusNotFound, "not found")
+		return
+	}
+	if strings.HasSuffix(zxy[2], ".mvt") {
+		if len(styleName) > 0 {
+			// vector tiles are styled by the clients
+			c.String(http.StatusBadRequest, "vector tiles do not have styles")
+			return
+		}
+		svr.handleGetVectorTile(c, zxy)
+	} else {
+		if len(styleName) == 0 {
+			styleName = c.Query("style")
+		}
+		svr.handleGetTile(c, styleName, zxy)
+	}
+}
+
+func (svr *tileServer) handleGetTile(c *gin.Context, styleName string, zxy [3]string) {
+	z, x, y, density, err := _parseZXY(zxy, ".png")
 	if err != nil {
 		c.String(http.StatusBadRequest, err.Error())
 		return
 	}
+	tileSize := svr.options.TileSize
+	if density > 0 {
+		tileSize = density * tileDensitySize
+	}
+	style, err := svr.styleSheet(styleName)
+	if err != nil {
+		c.String(http.StatusNotFound, err.Error())
+		return
+	}
 
-	cacheKey := fmt.Sprintf("%d/%d/%d", z, x, y)
+	cacheKey := tileCacheKey(z, x, y, tileSize)
+	if style != nil {
+		cacheKey = style.Name + "/" + cacheKey
+	}
 	if svr.tileCache != nil {
-		if a, ok := svr.tileCache.Get(cacheKey); ok {
-			pngBytes := a.([]byte)
+		if pngBytes, ok := svr.tileCache.Get(cacheKey); ok {
 			c.Data(http.StatusOK, "image/png", pngBytes)
 			c.Writer.Flush()
 			return
 		}
 	}
 
+	if n := metatileSize(svr.options.Metatile, z); n > 1 {
+		pngBytes, err := svr.renderMetatile(style, z, x, y, n, tileSize)
+		if err != nil {
+			c.String(http.StatusInternalServerError, err.Error())
+			return
+		}
+		c.Data(http.StatusOK, "image/png", pngBytes)
+		c.Writer.Flush()
+		return
+	}
+
 	//// search objects that intersect the bounds
 	t1 := time.Now()
 	tileBounds := tiles.TilesToBounds(x, y, z).Pad(0.001)
-	rset, err := svr.ds.IntersectsBounds(tileBounds)
+	rset, err := intersectsBoundsZoom(svr.ds, tileBounds, z)
 	if err != nil {
 		c.String(http.StatusInternalServerError, err.Error())
 		return
@@ -181,9 +329,12 @@ func (svr *tileServer) handleGetTile(c *gin.Context) {
 
 	//// make builder
 	t2 := time.Now()
-	builder := tiles.NewBuilder(x, y, z)
+	builder := tiles.NewBuilderSize(x, y, z, tileSize)
 	builder.SetVerbose(svr.options.Debug)
 	builder.SetHideLabels(!svr.options.ShowLabels)
+	if style != nil {
+		builder.SetStyleSheet(style)
+	}
 	builder.AddWays(rset.Ways...)
 	builder.AddNodes(rset.Nodes...)
 	builder.AddRelations(rset.Relations...)
@@ -224,48 +375,244 @@ func (svr *tileServer) handleGetTile(c *gin.Context) {
 		cacheKey, t2.Sub(t1), resultSetCount, t3.Sub(t2), objsCount, time.Since(t3))
 }
 
-func _parseZXY(c *gin.Context) (z, x, y int, err error) {
-	z, err = strconv.Atoi(c.Param("Z"))
+func (svr *tileServer) handleGetVectorTile(c *gin.Context, zxy [3]string) {
+	z, x, y, density, err := _parseZXY(zxy, ".mvt")
+	if err == nil && density > 0 {
+		// vector tiles are resolution independent
+		err = errors.New("unsupported file extension")
+	}
+	if err != nil {
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	cacheKey := fmt.Sprintf("%d/%d/%d.mvt", z, x, y)
+	if svr.tileCache != nil {
+		if mvtBytes, ok := svr.tileCache.Get(cacheKey); ok {
+			c.Data(http.StatusOK, mvtContentType, mvtBytes)
+			c.Writer.Flush()
+			return
+		}
+	}
+
+	//// search objects that intersect the bounds
+	t1 := time.Now()
+	tileBounds := tiles.TilesToBounds(x, y, z).Pad(0.001)
+	rset, err := intersectsBoundsZoom(svr.ds, tileBounds, z)
+	if err != nil {
+		c.String(http.StatusInternalServerError, err.Error())
+		return
+	}
+	resultSetCount := rset.LenObjs()
+
+	//// make builder
+	t2 := time.Now()
+	builder := tiles.NewVectorBuilder(x, y, z)
+	builder.AddWays(rset.Ways...)
+	builder.AddNodes(rset.Nodes...)
+	builder.AddRelations(rset.Relations...)
+
+	//// build tile
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	tile, err := builder.Build(ctx)
+	cancel()
+	if err != nil {
+		svr.log.Errorf("Builder timeout error %d/%d/%d.mvt", z, x, y)
+		c.String(http.StatusInternalServerError, err.Error())
+		return
+	}
+	objsCount := tile.CountObjects()
+
+	t3 := time.Now()
+	var b bytes.Buffer
+	if err := tile.EncodeMVT(&b); err != nil {
+		c.String(http.StatusInternalServerError, err.Error())
+		return
+	}
+	mvtBytes := b.Bytes()
+
+	if svr.tileCache != nil {
+		svr.tileCache.Add(cacheKey, mvtBytes)
+	}
+
+	c.Data(http.StatusOK, mvtContentType, mvtBytes)
+	c.Writer.Flush()
+	svr.log.Infof("%s query:%s %d compile:%s %d encode:%s",
+		cacheKey, t2.Sub(t1), resultSetCount, t3.Sub(t2), objsCount, time.Since(t3))
+}
+
+// invalidate removes cached tiles and compiled objects that are affected by the changes
+func (svr *tileServer) invalidate(cs *ChangeSet) {
+	tiles.InvalidateObjectCache(cs.Nodes, cs.Ways, cs.Relations)
+	if svr.tileCache == nil || len(cs.Bounds) == 0 {
+		return
+	}
+
+	// the cached tiles of the ranges that cover the changed bounds in each zoom level
+	removed := make(map[string]bool)
+	for _, b := range cs.Bounds {
+		// same padding with the query of tile rendering
+		b = b.Pad(0.001)
+		maxLat, minLat := mercator.ClampLatitude(b.Max.Lat), mercator.ClampLatitude(b.Min.Lat)
+		for z := 0; z <= tileMaxZoom; z++ {
+			minX, minY := projection.LatLon2Tile(maxLat, b.Min.Lon, z)
+			maxX, maxY := projection.LatLon2Tile(minLat, b.Max.Lon, z)
+			for _, key := range svr.tileCache.TileKeys(z, minX, minY, maxX, maxY) {
+				if !removed[key] {
+					svr.tileCache.Remove(key)
+					removed[key] = true
+				}
+			}
+		}
+	}
+	svr.log.Debugf("invalidated tiles:%d", len(removed))
+}
+
+// loadIcons registers the icons in the directories, the icons of the later directories replace the icons of the same names
+func loadIcons(dirs []string) error {
+	for _, dir := range dirs {
+		if _, err := tiles.LoadIcons(dir); err != nil {
+			return errors.Wrapf(err, "icons %s", dir)
+		}
+	}
+	return nil
+}
+
+// loadStyleSheets loads the style sheet files, the names of the style sheets should be unique
+func loadStyleSheets(paths []string) (map[string]*tiles.StyleSheet, error) {
+	ret := map[string]*tiles.StyleSheet{}
+	for _, path := range paths {
+		ss, err := tiles.LoadStyleSheet(path)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := ret[ss.Name]; ok {
+			return nil, errors.Errorf("duplicated style name %q in %s", ss.Name, path)
+		}
+		ret[ss.Name] = ss
+	}
+	return ret, nil
+}
+
+// styleSheet returns the style sheet of the name or the default style sheet if the name is empty,
+// nil if the tile is rendered with the built-in styles.
+func (svr *tileServer) styleSheet(name string) (*tiles.StyleSheet, error) {
+	if len(name) == 0 {
+		name = svr.options.DefaultStyle
+	}
+	if len(name) == 0 {
+		return nil, nil
+	}
+	ss, ok := svr.styles[name]
+	if !ok {
+		return nil, errors.Errorf("unknown style %q", name)
+	}
+	return ss, nil
+}
+
+const mvtContentType = "application/vnd.mapbox-vector-tile"
+
+// tiles are served up to this zoom level
+const tileMaxZoom = 19
+
+// pixel size of a tile in density 1x, {y}@2x.png is rendered in 512 pixels
+const (
+	tileDensitySize = 256
+	tileDensityMax  = 4
+)
+
+func validTileSize(size int) bool {
+	return size > 0 && size%tileDensitySize == 0 && size/tileDensitySize <= tileDensityMax
+}
+
+// tileCacheKey returns cache key of the tile rendered in size pixels,
+// tiles of tiles.DefaultTileSize keep the key without suffix which is used before size variants.
+func tileCacheKey(z, x, y int, size int) string {
+	if size == tiles.DefaultTileSize {
+		return fmt.Sprintf("%d/%d/%d", z, x, y)
+	}
+	return fmt.Sprintf("%d/%d/%d@%dpx", z, x, y, size)
+}
+
+// _splitTilePath splits '/{z}/{x}/{y}.ext' or '/{style}/{z}/{x}/{y}.ext' of the tile route
+func _splitTilePath(path string) (style string, zxy [3]string, ok bool) {
+	tok := strings.Split(strings.TrimPrefix(path, "/"), "/")
+	switch len(tok) {
+	case 3:
+	case 4:
+		style, tok = tok[0], tok[1:]
+		if len(style) == 0 {
+			return
+		}
+	default:
+		return
+	}
+	copy(zxy[:], tok)
+	return style, zxy, true
+}
+
+// _parseZXY parses '{z}/{x}/{y}.ext' or '{z}/{x}/{y}@{density}x.ext' of the tile path,
+// density is 0 if the suffix is not specified.
+func _parseZXY(zxy [3]string, ext string) (z, x, y, density int, err error) {
+	z, err = strconv.Atoi(zxy[0])
 	if err != nil {
 		err = errors.New("invalid Z")
 		return
 	}
-	if z < 11 || z > 19 {
+	if z < 0 || z > tileMaxZoom {
 		err = errors.New("unsupported Z level")
 		return
 	}
 
-	x, err = strconv.Atoi(c.Param("X"))
-	if err != nil {
+	x, err = strconv.Atoi(zxy[1])
+	if err != nil || x < 0 || x >= 1<<z {
 		err = errors.New("invalid X")
 		return
 	}
-	stry := c.Param("Y")
-	if !strings.HasSuffix(stry, ".png") {
+	stry := zxy[2]
+	if !strings.HasSuffix(stry, ext) {
 		err = errors.New("unsupported file extension")
 		return
 	}
-	y, err = strconv.Atoi(stry[:len(stry)-4]) // remove '.png' suffix
-	if err != nil {
+	stry = stry[:len(stry)-len(ext)] // remove '.png' or '.mvt' suffix
+	if i := strings.LastIndex(stry, "@"); i >= 0 {
+		density, err = strconv.Atoi(strings.TrimSuffix(stry[i+1:], "x"))
+		if err != nil || !strings.HasSuffix(stry, "x") || density < 1 || density > tileDensityMax {
+			err = errors.New("unsupported tile density")
+			return
+		}
+		stry = stry[:i]
+	}
+	y, err = strconv.Atoi(stry)
+	if err != nil || y < 0 || y >= 1<<z {
 		err = errors.New("invalid Y")
 		return
 	}
 	return
 }
 
-func (svr *tileServer) Find(ctx context.Context, req *tiles.FindRequest) (*tiles.FindResponse, error) {
-	tick := time.Now()
-
+// _find returns objects of the request, generalized objects if the request is for a low zoom tile
+func (svr *tileServer) _find(req *tiles.FindRequest) (*ResultSet, error) {
 	findBounds := geom.Bound{
 		Min: geom.LatLon{Lat: req.MinLat, Lon: req.MinLon},
 		Max: geom.LatLon{Lat: req.MaxLat, Lon: req.MaxLon},
 	}.Pad(0.001)
 
-	rset, err := svr.ds.IntersectsBounds(findBounds)
-	rsp := &tiles.FindResponse{
-		Nodes:     rset.Nodes,
-		Ways:      rset.Ways,
-		Relations: rset.Relations,
+	if req.Generalize {
+		return intersectsBoundsZoom(svr.ds, findBounds, int(req.Zoom))
+	}
+	return svr.ds.IntersectsBounds(findBounds)
+}
+
+func (svr *tileServer) Find(ctx context.Context, req *tiles.FindRequest) (*tiles.FindResponse, error) {
+	tick := time.Now()
+
+	rset, err := svr._find(req)
+	rsp := &tiles.FindResponse{}
+	if rset != nil {
+		rsp.Nodes = rset.Nodes
+		rsp.Ways = rset.Ways
+		rsp.Relations = rset.Relations
 	}
 
 	if err == nil {
@@ -280,6 +627,62 @@ func (svr *tileServer) Find(ctx context.Context, req *tiles.FindRequest) (*tiles
 	return rsp, nil
 }
 
+// max size of a chunk in FindStream, far less than the default grpc message size limit (4MB)
+const findStreamChunkSize = 1024 * 1024
+
+func (svr *tileServer) FindStream(req *tiles.FindRequest, stream tiles.Tile_FindStreamServer) error {
+	tick := time.Now()
+
+	rset, err := svr._find(req)
+	if err != nil {
+		return stream.Send(&tiles.FindResponse{
+			Code:    1,
+			Reason:  err.Error(),
+			Elapsed: time.Since(tick).String(),
+		})
+	}
+
+	chunk := &tiles.FindResponse{}
+	chunkSize := 0
+	var flush = func(size int) error {
+		if chunkSize+size <= findStreamChunkSize || chunkSize == 0 {
+			chunkSize += size
+			return nil
+		}
+		if err := stream.Send(chunk); err != nil {
+			return err
+		}
+		chunk = &tiles.FindResponse{}
+		chunkSize = size
+		return nil
+	}
+
+	for _, n := range rset.Nodes {
+		if err := flush(proto.Size(n)); err != nil {
+			return err
+		}
+		chunk.Nodes = append(chunk.Nodes, n)
+	}
+	for _, w := range rset.Ways {
+		if err := flush(proto.Size(w)); err != nil {
+			return err
+		}
+		chunk.Ways = append(chunk.Ways, w)
+	}
+	for _, r := range rset.Relations {
+		if err := flush(proto.Size(r)); err != nil {
+			return err
+		}
+		chunk.Relations = append(chunk.Relations, r)
+	}
+
+	// the last chunk carries the result
+	chunk.Code = 0
+	chunk.Reason = "ok"
+	chunk.Elapsed = time.Since(tick).String()
+	return stream.Send(chunk)
+}
+
 func (svr *tileServer) Get(ctx context.Context, req *tiles.GetRequest) (*tiles.GetResponse, error) {
 	tick := time.Now()
 	rsp := &tiles.GetResponse{}
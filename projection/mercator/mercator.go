@@ -10,6 +10,15 @@ const (
 	originShift       = 2 * math.Pi * 6378137 / 2
 )
 
+// MaxLatitude is the latitude of the top edge of the tile at the zoom level 0,
+// the latitudes beyond it are projected to the infinity.
+const MaxLatitude = 85.05112877980659
+
+// ClampLatitude returns the latitude within the range of the projection
+func ClampLatitude(lat float64) float64 {
+	return math.Max(-MaxLatitude, math.Min(MaxLatitude, lat))
+}
+
 func round(a float64) float64 {
 	if a < 0 {
 		return math.Ceil(a - 0.5)
@@ -4,17 +4,45 @@ osm-data-source="./tmp/south-korea-2022-04-18.osm.pbf"
 // osm-data-source="tcp://127.0.0.1:1918"
 bind="127.0.0.1"
 port=1919
+// changes-dir="./tmp/changes"
+// changes-interval="1m"
 
 /////// redering server
 cache-size=2000
+// cache-dir="./tmp/cache"
+// cache-disk-size=1024
+// cache-ttl="24h"
+// remote-timeout="10s"
+// remote-retries=3
+// remote-keepalive="30s"
+// remote-ca="./ca.pem"
+// remote-token="change-me"
+// tile-size=512
+// styles=["./style-sample.hcl", "./styles/night.hcl"]
+// default-style="muted"
+// icons=["./icons"]
+// fonts=["Arabic:./fonts/NotoSansArabic-Regular.ttf", "./fonts/NotoSans-Regular.ttf"]
+// bold-fonts=["./fonts/NotoSans-Bold.ttf"]
+// metatile=4
 show-watermark = true
 show-labels = true
 
 grpc {
     max-recv-msg-size=100
     max-send-msg-size=100
+    // reflection=false
 }
 
+// tls {
+//     cert="./server.pem"
+//     key="./server.key"
+//     client-ca="./ca.pem"
+// }
+
+// auth {
+//     tokens=["change-me"]
+// }
+
 log {
     console=true
     filename="-"
@@ -0,0 +1,46 @@
+// style sheet of muted colors, server option: styles=["./style-sample.hcl"]
+// tile request: /tiles/muted/{z}/{x}/{y}.png
+name = "muted"
+base = "default"
+background = "#f5f5f0"
+
+rule "natural=water|bay|strait" {
+    fill = "#b3c7d6"
+    line = "none"
+}
+
+rule "waterway=riverbank" {
+    fill = "#b3c7d6"
+}
+
+rule "landuse=forest|wood" {
+    fill = "#c9d6bf"
+}
+
+rule "highway=motorway|trunk" {
+    line       = "#c9a27e"
+    line-width = 3
+}
+
+rule "highway=primary|secondary" {
+    line       = "#d9c7a7"
+    line-width = 2
+}
+
+rule "highway=footway|path|steps" {
+    line     = "#a1887f"
+    dash     = [2, 2]
+    min-zoom = 16
+}
+
+rule "building" {
+    closed   = true
+    fill     = "#d7ccc8"
+    line     = "#bcaaa4"
+    min-zoom = 15
+}
+
+rule "amenity=school|university" {
+    marker       = "school"
+    marker-color = "#5d4037"
+}
@@ -0,0 +1,2 @@
+// grayscale variant of the built-in styles, /tiles/grayscale/{z}/{x}/{y}.png
+color-filter = "grayscale"
@@ -0,0 +1,2 @@
+// high-contrast variant of the built-in styles, /tiles/high-contrast/{z}/{x}/{y}.png
+color-filter = "high-contrast"
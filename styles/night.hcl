@@ -0,0 +1,2 @@
+// night variant of the built-in styles, /tiles/night/{z}/{x}/{y}.png
+color-filter = "night"
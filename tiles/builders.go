@@ -4,9 +4,10 @@ import (
 	"context"
 	_ "embed"
 	"fmt"
-	"math"
+	"image/color"
 	reflect "reflect"
 	"sort"
+	"strings"
 
 	"github.com/OutOfBedlam/ots/geom"
 	"github.com/OutOfBedlam/ots/logging"
@@ -32,8 +33,62 @@ func init() {
 	}
 }
 
+// InvalidateObjectCache removes compiled objects of the changed osm elements,
+// relations should be included if their member ways are changed.
+func InvalidateObjectCache(nodes, ways, relations []int64) {
+	changed := make(map[string]bool, len(nodes)+len(ways)+len(relations))
+	for _, id := range nodes {
+		changed[fmt.Sprintf("NODE:%d", id)] = true
+	}
+	for _, id := range ways {
+		changed[fmt.Sprintf("WAY:%d", id)] = true
+	}
+	for _, id := range relations {
+		changed[fmt.Sprintf("REL:%d", id)] = true
+	}
+	// an element has the compiled objects of each style and each generalized zoom level
+	for _, k := range objectCache.Keys() {
+		key := k.(string)
+		if i := strings.IndexAny(key, "@#"); i > 0 {
+			key = key[:i]
+		}
+		if changed[key] {
+			objectCache.Remove(k)
+		}
+	}
+}
+
+// objectCacheKey returns the key of compiled objects,
+// objects of generalized tiles are cached per zoom level as they have simplified geometries,
+// so are the objects whose styles vary by zoom level, like the widths of roads and the styles of zoom dependent style sheets.
+// objects of a style other than the built-in styles are cached per style.
+func (br *DefaultBuilder) objectCacheKey(prefix string, id int64, tags map[string]string) string {
+	key := fmt.Sprintf("%s:%d", prefix, id)
+	if br.generalized || br.zoomStyled || zoomStyledTags(tags) {
+		key += fmt.Sprintf("@z%d", br.zoom)
+	}
+	if len(br.styleName) > 0 {
+		key += "#" + br.styleName
+	}
+	return key
+}
+
 type CoordTransFunc func(coord geom.LatLon) (float64, float64)
 
+// nearCenter returns true if the object is within the radius from the center,
+// the object on the other side of the antimeridian is measured from the copy of the center.
+func nearCenter(o Object, center geom.LatLon, radius float64) bool {
+	if o.DistanceFrom(center) <= radius {
+		return true
+	}
+	if center.Lon+radius > 180 {
+		return o.DistanceFrom(geom.LatLon{Lat: center.Lat, Lon: center.Lon - 360}) <= radius
+	} else if center.Lon-radius < -180 {
+		return o.DistanceFrom(geom.LatLon{Lat: center.Lat, Lon: center.Lon + 360}) <= radius
+	}
+	return false
+}
+
 type DefaultBuilder struct {
 	ctx             context.Context
 	log             logging.Log
@@ -43,6 +98,8 @@ type DefaultBuilder struct {
 	watermark       string
 	canvasWidth     float64
 	canvasHeight    float64
+	margin          float64
+	scale           float64
 	buildLayerStart int
 	buildLayerEnd   int
 	bounds          geom.Bound
@@ -51,7 +108,12 @@ type DefaultBuilder struct {
 	relations       btree.Map[int64, *Relation]
 	nodes           btree.Map[int64, *Node]
 	zoom            int
+	generalized     bool
+	styleName       string
+	zoomStyled      bool
+	labelsInside    bool
 	customStyler    StyleFunc
+	background      color.Color
 }
 
 func (br *DefaultBuilder) SetVerbose(v bool) {
@@ -70,6 +132,15 @@ func (br *DefaultBuilder) SetHideLabels(b bool) {
 	br.hideLabels = b
 }
 
+// SetStyleSheet applies the style sheet over the built-in styles,
+// the name of the style sheet identifies the style in the cache of compiled objects.
+func (br *DefaultBuilder) SetStyleSheet(ss *StyleSheet) {
+	br.styleName = ss.Name
+	br.zoomStyled = ss.ZoomDependent()
+	br.customStyler = ss.StyleFunc()
+	br.background = ss.BackgroundColor(br.zoom)
+}
+
 func (br *DefaultBuilder) SetBuildLayerRange(start, end int) {
 	br.buildLayerStart = start
 	br.buildLayerEnd = end
@@ -108,7 +179,10 @@ func (br *DefaultBuilder) Build(ctx context.Context) (*Tile, error) {
 
 	objects := make([]Object, 0)
 	for _, rel := range br.relations.Values() {
-		cacheKey := fmt.Sprintf("REL:%d", rel.Id)
+		if br.generalized && !br.generalizedVisible(rel.Tags, rel.Extent()) {
+			continue
+		}
+		cacheKey := br.objectCacheKey("REL", rel.Id, rel.Tags)
 		var rset []Object
 		if objs, ok := objectCache.Get(cacheKey); ok {
 			rset = objs.([]Object)
@@ -117,13 +191,16 @@ func (br *DefaultBuilder) Build(ctx context.Context) (*Tile, error) {
 			objectCache.Add(cacheKey, rset)
 		}
 		for _, o := range rset {
-			if o.Visible(br.zoom) && o.DistanceFrom(center) <= radius {
+			if o.Visible(br.zoom) && nearCenter(o, center, radius) {
 				objects = append(objects, o)
 			}
 		}
 	}
 	for _, way := range br.ways.Values() {
-		cacheKey := fmt.Sprintf("WAY:%d", way.Id)
+		if br.generalized && !br.generalizedVisible(way.Tags, way.Extent()) {
+			continue
+		}
+		cacheKey := br.objectCacheKey("WAY", way.Id, way.Tags)
 		var rset []Object
 		if objs, ok := objectCache.Get(cacheKey); ok {
 			rset = objs.([]Object)
@@ -132,13 +209,20 @@ func (br *DefaultBuilder) Build(ctx context.Context) (*Tile, error) {
 			objectCache.Add(cacheKey, rset)
 		}
 		for _, o := range rset {
-			if o.Visible(br.zoom) && o.DistanceFrom(center) <= radius {
+			if o.Visible(br.zoom) && nearCenter(o, center, radius) {
 				objects = append(objects, o)
 			}
 		}
 	}
 	for _, node := range br.nodes.Values() {
-		cacheKey := fmt.Sprintf("NODE:%d", node.Id)
+		if len(node.Tags) == 0 {
+			// nodes of the ways
+			continue
+		}
+		if br.generalized && !br.generalizedVisible(node.Tags, 0) {
+			continue
+		}
+		cacheKey := br.objectCacheKey("NODE", node.Id, node.Tags)
 		var rset []Object
 		if objs, ok := objectCache.Get(cacheKey); ok {
 			rset = objs.([]Object)
@@ -147,7 +231,7 @@ func (br *DefaultBuilder) Build(ctx context.Context) (*Tile, error) {
 			objectCache.Add(cacheKey, rset)
 		}
 		for _, o := range rset {
-			if o.Visible(br.zoom) && o.DistanceFrom(center) <= radius {
+			if o.Visible(br.zoom) && nearCenter(o, center, radius) {
 				objects = append(objects, o)
 			}
 		}
@@ -157,12 +241,14 @@ func (br *DefaultBuilder) Build(ctx context.Context) (*Tile, error) {
 	tile := &Tile{
 		width:       int(br.canvasWidth),
 		height:      int(br.canvasHeight),
+		margin:      int(br.margin),
+		scale:       br.scale,
 		defaultFont: FontD2Coding,
 		objs:        objects,
 	}
 
 	// z-order layers
-	sort.Slice(tile.objs, func(i, j int) bool {
+	sort.SliceStable(tile.objs, func(i, j int) bool {
 		lo := tile.objs[i]
 		ro := tile.objs[j]
 		return LayerCompareOrder(lo, ro)
@@ -177,7 +263,7 @@ func (br *DefaultBuilder) Build(ctx context.Context) (*Tile, error) {
 	if start > end {
 		start = end
 	}
-	tile.objs = tile.objs[start:end]
+	tile.objs = br.placeLabels(tile.objs[start:end])
 	tile.coordTranslator = br.transCoordToXY
 
 	if br.verbose {
@@ -198,8 +284,12 @@ func (br *DefaultBuilder) Build(ctx context.Context) (*Tile, error) {
 	}
 
 	// background
+	background := br.background
+	if background == nil {
+		background = Gray50
+	}
 	tile.addFirst(&TileBackground{
-		color:  Gray50,
+		color:  background,
 		width:  float64(br.canvasWidth),
 		height: float64(br.canvasHeight),
 	})
@@ -212,141 +302,17 @@ func (br *DefaultBuilder) Build(ctx context.Context) (*Tile, error) {
 	return tile, nil
 }
 
-type roleItem struct {
-	role       string
-	points     []geom.LatLon
-	sourceInfo string
-}
-
-func (r *roleItem) firstLatLon() (float64, float64) {
-	if len(r.points) == 0 {
-		panic(fmt.Sprintf("no points in a role '%s' %s", r.role, r.sourceInfo))
-	}
-	return r.points[0].Lat, r.points[0].Lon
-}
-
-func (r *roleItem) lastLatLon() (float64, float64) {
-	l := len(r.points)
-	if l >= 2 {
-		return r.points[l-1].Lat, r.points[l-1].Lon
-	}
-	return 0, 0
+// generalizedVisible returns true if the feature is a major feature that is drawn in the generalized tile of the zoom
+func (br *DefaultBuilder) generalizedVisible(tags map[string]string, extent float64) bool {
+	return GeneralizedMinZoom(tags, extent) <= br.zoom
 }
 
-func (r *roleItem) isClosed() bool {
-	if len(r.points) > 2 {
-		x1, y1 := r.firstLatLon()
-		x2, y2 := r.lastLatLon()
-		return x1 == x2 && y1 == y2
-	}
-	return false
-
-}
-func (r *roleItem) canConnectTo(other *roleItem) bool {
-	lastLat, lastLon := r.lastLatLon()
-	firstLat, fistLon := other.firstLatLon()
-	return lastLat == firstLat && lastLon == fistLon
-}
-
-func (r *roleItem) hasOriginLatLon(lat, lon float64) bool {
-	aLat, aLon := r.firstLatLon()
-	return aLat == lat && aLon == lon
-}
-
-func (r *roleItem) hasOriginPoint(origin [2]float64) bool {
-	aLat, aLon := r.firstLatLon()
-	return aLat == origin[0] && aLon == origin[1]
-}
-
-func (r *roleItem) hasSameOrigin(other *roleItem) bool {
-	aLat, aLon := r.firstLatLon()
-	bLat, bLon := other.firstLatLon()
-	return aLat == bLat && aLon == bLon
-}
-
-func (r *roleItem) hasSameTermination(other *roleItem) bool {
-	aLat, aLon := r.lastLatLon()
-	bLat, bLon := other.lastLatLon()
-	return aLat == bLat && aLon == bLon
-}
-
-type roleItemGroup []*roleItem
-
-// find item that has same origin
-func (rg roleItemGroup) findOrigin() ([2]float64, bool) {
-	var origin [2]float64
-	for i, r1 := range rg {
-		for n, r2 := range rg {
-			if i == n {
-				continue
-			}
-			if r1.hasSameOrigin(r2) {
-				lat, lon := r1.firstLatLon()
-				origin = [2]float64{lat, lon}
-				return origin, true
-			}
-		}
-	}
-	return origin, false
-}
-
-func (rg roleItemGroup) linearizeCoords() [][]geom.LatLon {
-	var rt = make([][]geom.LatLon, 0)
-
-	noneClosed := make([]*roleItem, 0)
-	for _, r1 := range rg {
-		if r1.isClosed() {
-			rt = append(rt, r1.points)
-		} else {
-			noneClosed = append(noneClosed, r1)
-		}
-	}
-	rg = noneClosed
-	if len(rg) == 0 {
-		return rt
-	}
-
-	leaders := make([]*roleItem, 0)
-	others := make([]*roleItem, 0)
-	if origin, b := rg.findOrigin(); b {
-		for _, r2 := range rg {
-			if r2.hasOriginPoint(origin) {
-				leaders = append(leaders, r2)
-			} else {
-				others = append(others, r2)
-			}
-		}
-	} else {
-		leaders = append(leaders, rg[0])
-		others = append(others, rg[1:]...)
-	}
-
-	for _, leader := range leaders {
-	repeat:
-		remains := make([]*roleItem, 0)
-		for _, other := range others {
-			if leader.canConnectTo(other) {
-				leader.points = append(leader.points, other.points...)
-			} else {
-				remains = append(remains, other)
-			}
-		}
-		if len(others) != len(remains) {
-			others = remains
-			//// leader has been appended
-			goto repeat
-		}
-	}
-
-	for _, leader := range leaders {
-		//fmt.Fprintf(os.Stderr, "leader: %f %f ~ %f %f\n", leader.points[0][0], leader.points[0][1], leader.points[len(leader.points)-1][0], leader.points[len(leader.points)-1][1])
-		rt = append(rt, leader.points)
+// generalizeCoords simplifies the coordinates if the tile is generalized
+func (br *DefaultBuilder) generalizeCoords(points []geom.LatLon) []geom.LatLon {
+	if !br.generalized {
+		return points
 	}
-	// for _, other := range others {
-	// 	fmt.Fprintf(os.Stderr, "other : %f %f ~ %f %f\n", other.points[0][0], other.points[0][1], other.points[len(other.points)-1][0], other.points[len(other.points)-1][1])
-	// }
-
-	return rt
+	return GeneralizeCoords(points, br.zoom)
 }
 
 func (br *DefaultBuilder) compileRelation(rel *Relation) []Object {
@@ -355,52 +321,31 @@ func (br *DefaultBuilder) compileRelation(rel *Relation) []Object {
 	// if br.verbose {
 	// 	br.log.Tracef("building... REL:%d", rel.Id)
 	// }
-	var style *Style = styleFromTags(&StyleParam{Tags: rel.Tags}, br.customStyler)
+	var style *Style = styleFromTags(&StyleParam{Tags: rel.Tags, Zoom: br.zoom}, br.customStyler)
 
 	var label *Label
 	var name = rel.FindTag("name")
-	if len(name) > 0 {
+	if len(name) > 0 && !br.generalized {
 		sourceInfo += " " + name
 		clat, clon := rel.MinLat+(rel.MaxLat-rel.MinLat)/2, rel.MinLon+(rel.MaxLon-rel.MinLon)/2
 		label = &Label{
 			text:       name,
 			textColor:  style.MarkerColor,
+			fontSize:   style.FontSize,
+			bold:       style.FontWeight == FontWeightBold,
 			coord:      geom.LatLon{Lat: clat, Lon: clon},
-			rotate:     0,
 			sourceInfo: sourceInfo,
+			priority:   labelPriority(rel.Tags),
+			area:       (rel.MaxLat - rel.MinLat) * (rel.MaxLon - rel.MinLon),
 			visibleFunc: func(z int) bool {
-				return !br.hideLabels && style.MarkerVisible(z)
+				return !br.hideLabels && style.MarkerVisible(z) && style.Visible(z)
 			},
 		}
 		objects = append(objects, label)
 	}
 
 	// 한강: ./tmp/osmd render -i tcp://127.0.0.1:1918 -o ./tmp/render_out.png -v REL 152336
-	var roleItems = make([]*roleItem, 0)
-	for _, m := range rel.Members {
-		if m.Type != Relation_WAY {
-			// TODO: it can be NODE, RELATION
-			continue
-		}
-		way, ok := br.ways.Get(m.Id)
-		if way == nil || !ok {
-			//br.log.Errorf("REL[%d] not found member WAY:%d", rel.Id, m.Id)
-			continue
-		}
-
-		var points = make([]geom.LatLon, 0)
-		for _, n := range way.Nodes {
-			points = append(points, geom.LatLon{Lat: n.Lat, Lon: n.Lon})
-		}
-
-		ritem := &roleItem{
-			role:       m.Role,
-			points:     points,
-			sourceInfo: fmt.Sprintf("WAY:%d", way.Id),
-		}
-		roleItems = append(roleItems, ritem)
-	}
-
+	var roleItems = br.relationRoleItems(rel, map[int64]bool{})
 	var outerItems = make([]*roleItem, 0)
 	var innerItems = make([]*roleItem, 0)
 	for _, itm := range roleItems {
@@ -414,8 +359,16 @@ func (br *DefaultBuilder) compileRelation(rel *Relation) []Object {
 		}
 	}
 
-	inners := roleItemGroup(innerItems).linearizeCoords()
-	outers := roleItemGroup(outerItems).linearizeCoords()
+	// relations that are cut by the border of the extract are common, and they are compiled for each zoom and style
+	parts, err := assembleMultipolygon(outerItems, innerItems)
+	if err != nil {
+		br.log.Debugf("invalid multipolygon %s, %s", sourceInfo, err.Error())
+	}
+	var outers, inners [][]geom.LatLon
+	for _, part := range parts {
+		outers = append(outers, part.outer)
+		inners = append(inners, part.inners...)
+	}
 
 	if len(outers) > 0 {
 		maskedObj := &MultiPolygonObject{
@@ -426,8 +379,9 @@ func (br *DefaultBuilder) compileRelation(rel *Relation) []Object {
 			lineDash:    style.LineDash,
 			fillColor:   style.FillColor,
 			layer:       style.BaseLayer,
+			level:       style.Level,
 			sourceInfo:  sourceInfo,
-			visibleFunc: func(z int) bool { return true },
+			visibleFunc: style.Visible,
 		}
 		if maskedObj != nil {
 			objects = append(objects, maskedObj)
@@ -437,8 +391,119 @@ func (br *DefaultBuilder) compileRelation(rel *Relation) []Object {
 	return objects
 }
 
+// aggregateRelationTypes are the types of the relations that are made of their member relations
+var aggregateRelationTypes = map[string]bool{
+	"route_master": true,
+	"superroute":   true,
+	"site":         true,
+}
+
+// IsNestedMember returns true if the members of the member relation in the role are a part of the relation of the type.
+// Only the aggregate relations are made of their member relations,
+// the member relations of the others, like the subareas of a boundary, are drawn on their own.
+func IsNestedMember(relationType string, role string) bool {
+	return aggregateRelationTypes[relationType] && role != "subarea"
+}
+
+// relationRoleItems returns the member ways of the relation and of its nested member relations,
+// the ways of a member relation keep their roles in the member relation.
+// visiting has the relations that are being resolved, so that a cycle of relations is not followed again.
+func (br *DefaultBuilder) relationRoleItems(rel *Relation, visiting map[int64]bool) []*roleItem {
+	visiting[rel.Id] = true
+	defer delete(visiting, rel.Id)
+
+	var roleItems = make([]*roleItem, 0)
+	for _, m := range rel.Members {
+		switch m.Type {
+		case Relation_WAY:
+			way, ok := br.ways.Get(m.Id)
+			if way == nil || !ok || len(way.Nodes) == 0 {
+				//br.log.Errorf("REL[%d] not found member WAY:%d", rel.Id, m.Id)
+				continue
+			}
+
+			var points = make([]geom.LatLon, 0)
+			for _, n := range way.Nodes {
+				points = append(points, geom.LatLon{Lat: n.Lat, Lon: n.Lon})
+			}
+
+			ritem := &roleItem{
+				role:       m.Role,
+				points:     br.generalizeCoords(points),
+				sourceInfo: fmt.Sprintf("WAY:%d", way.Id),
+			}
+			roleItems = append(roleItems, ritem)
+		case Relation_RELATION:
+			if !IsNestedMember(rel.Tags["type"], m.Role) {
+				continue
+			}
+			if visiting[m.Id] {
+				// compiled for each zoom and style
+				br.log.Debugf("REL:%d has a cycle of the member REL:%d", rel.Id, m.Id)
+				continue
+			}
+			sub, ok := br.relations.Get(m.Id)
+			if sub == nil || !ok {
+				continue
+			}
+			roleItems = append(roleItems, br.relationRoleItems(sub, visiting)...)
+		case Relation_NODE:
+			// member nodes, like the stops of a route and the admin_centre of a boundary,
+			// are not a part of the geometry, they are drawn as nodes on their own
+			continue
+		}
+	}
+	return roleItems
+}
+
+// named nodes without MarkerZoomLimit are drawn from this zoom level
+const nodeMarkerMinZoom = 16
+
+// compileNode makes the label of the node that has a marker or a name, the marker is drawn from MarkerZoomLimit.
+// Named nodes without MarkerZoomLimit are drawn from nodeMarkerMinZoom except places.
 func (br *DefaultBuilder) compileNode(node *Node) []Object {
-	return []Object{}
+	name := node.FindTag("name")
+	style := styleFromTags(&StyleParam{Tags: node.Tags, Point: true, Zoom: br.zoom}, br.customStyler)
+	if br.generalized {
+		// generalized tiles show the names of places instead of the names of ways
+		if len(name) == 0 {
+			return []Object{}
+		}
+		label := &Label{
+			text:       name,
+			textColor:  style.MarkerColor,
+			fontSize:   style.FontSize,
+			bold:       style.FontWeight == FontWeightBold,
+			coord:      geom.LatLon{Lat: node.Lat, Lon: node.Lon},
+			sourceInfo: fmt.Sprintf("NODE:%d %s", node.Id, name),
+			priority:   labelPriority(node.Tags),
+			visibleFunc: func(z int) bool {
+				return !br.hideLabels && style.Visible(z)
+			},
+		}
+		return []Object{label}
+	}
+
+	if len(name) == 0 && style.Marker == nil {
+		return []Object{}
+	}
+	if _, isPlace := node.Tags["place"]; style.MarkerZoomLimit == 0 && !isPlace {
+		style.MarkerZoomLimit = nodeMarkerMinZoom
+	}
+	label := &Label{
+		text:       name,
+		textColor:  style.MarkerColor,
+		fontSize:   style.FontSize,
+		bold:       style.FontWeight == FontWeightBold,
+		coord:      geom.LatLon{Lat: node.Lat, Lon: node.Lon},
+		icon:       style.Marker,
+		sourceInfo: fmt.Sprintf("NODE:%d %s", node.Id, name),
+		priority:   labelPriority(node.Tags),
+		visibleFunc: func(z int) bool {
+			return style.MarkerVisible(z) && style.Visible(z) && !br.hideLabels
+		},
+	}
+	return []Object{label}
 }
 
 func (br *DefaultBuilder) compileWay(way *Way) []Object {
@@ -451,49 +516,54 @@ func (br *DefaultBuilder) compileWay(way *Way) []Object {
 		lastNode := way.Nodes[len(way.Nodes)-1]
 		closed = firstNode.Id == lastNode.Id || (firstNode.Lat == lastNode.Lat && firstNode.Lon == lastNode.Lon)
 	}
-	var style *Style = styleFromTags(&StyleParam{Tags: way.Tags, Closed: closed}, br.customStyler)
+	var style *Style = styleFromTags(&StyleParam{Tags: way.Tags, Closed: closed, Zoom: br.zoom}, br.customStyler)
 
 	polygon := br.buildPolygon(way, style, sourceInfo)
+	if casing := br.buildCasing(polygon, style); casing != nil {
+		objects = append(objects, casing)
+	}
 	objects = append(objects, polygon)
 
 	labelText := way.FindTag("name")
 	if len(labelText) > 0 {
 		sourceInfo += labelText
 	}
+	if br.generalized {
+		labelText = ""
+	}
 
 	if len(labelText) > 0 {
-		var labelRotate = 0.0
+		var labelPath []geom.LatLon
+		var labelArea = 0.0
 		var latLon geom.LatLon
 		if style.FillColor == nil {
-			count := len(polygon.outer)
+			// the text follows the line, glyphs are placed along the path by placeLabels
 			latLon = polygon.outer[0]
-			if count > 1 {
-				lon1, lat1 := polygon.outer[0].Lon, polygon.outer[0].Lat
-				lon2, lat2 := polygon.outer[1].Lon, polygon.outer[1].Lat
-				labelRotate = math.Atan2(lat2-lat1, lon2-lon1)
-				latLon.Lon, latLon.Lat = lon1+(lon2-lon1)/2, lat1+(lat2-lat1)/2
+			if len(polygon.outer) > 1 {
+				labelPath = polygon.outer
 			}
 		} else {
 			latLon.Lon = way.MinLon + (way.MaxLon-way.MinLon)/2
 			latLon.Lat = way.MinLat + (way.MaxLat-way.MinLat)/2
+			labelArea = polygon.Area()
 		}
 		label := &Label{
 			text:       labelText,
 			textColor:  style.MarkerColor,
+			fontSize:   style.FontSize,
+			bold:       style.FontWeight == FontWeightBold,
 			coord:      latLon,
-			rotate:     labelRotate,
+			path:       labelPath,
 			icon:       style.Marker,
 			sourceInfo: sourceInfo,
+			priority:   labelPriority(way.Tags),
+			area:       labelArea,
 			visibleFunc: func(z int) bool {
-				return style.MarkerVisible(br.zoom) && !br.hideLabels
+				return style.MarkerVisible(br.zoom) && style.Visible(z) && !br.hideLabels
 			},
 		}
 		objects = append(objects, label)
 	}
-
-	for _, n := range way.Nodes {
-		br.nodes.Delete(n.Id)
-	}
 	return objects
 }
 
@@ -504,25 +574,42 @@ func (br *DefaultBuilder) buildPolygon(way *Way, style *Style, sourceInfo string
 		coords = append(coords, latLon)
 	}
 
-	return br.buildPolygonLineString(coords, style, sourceInfo)
+	return br.buildPolygonLineString(br.generalizeCoords(coords), style, sourceInfo)
 }
 
 func (br *DefaultBuilder) buildPolygonLineString(coords []geom.LatLon, style *Style, sourceInfo string) *PolygonObject {
 	obj := &PolygonObject{
-		outer:      coords,
-		lineWidth:  style.LineWidth,
-		lineColor:  style.LineColor,
-		lineDash:   style.LineDash,
-		fillColor:  style.FillColor,
-		layer:      style.BaseLayer,
-		sourceInfo: sourceInfo,
-		visibleFunc: func(z int) bool {
-			return true
-		},
+		outer:       coords,
+		lineWidth:   style.LineWidth,
+		lineColor:   style.LineColor,
+		lineDash:    style.LineDash,
+		fillColor:   style.FillColor,
+		layer:       style.BaseLayer,
+		level:       style.Level,
+		sourceInfo:  sourceInfo,
+		visibleFunc: style.Visible,
 	}
 	return obj
 }
 
+// buildCasing returns the casing of the line that is drawn under the line, nil if the line has no casing
+func (br *DefaultBuilder) buildCasing(line *PolygonObject, style *Style) *PolygonObject {
+	if style.CasingColor == nil || style.FillColor != nil || style.LineColor == nil {
+		return nil
+	}
+	return &PolygonObject{
+		outer:       line.outer,
+		lineWidth:   line.lineWidth + 2*style.CasingWidth,
+		lineColor:   style.CasingColor,
+		lineDash:    style.CasingDash,
+		layer:       line.layer,
+		level:       line.level,
+		casing:      true,
+		sourceInfo:  line.sourceInfo + "(casing)",
+		visibleFunc: line.visibleFunc,
+	}
+}
+
 func (br *DefaultBuilder) dumpWay(way *Way) {
 	tagMap := way.Tags
 	name := tagMap["name"]
@@ -0,0 +1,270 @@
+package tiles
+
+import (
+	"math"
+
+	"github.com/OutOfBedlam/ots/geom"
+	"github.com/fogleman/gg"
+)
+
+// paths are clipped to the canvas with this buffer in pixels besides the widths of the lines,
+// so that the joins and the caps of the lines at the edges of the canvas are not cut
+const clipBuffer = 8.0
+
+// canvasView projects the paths to the canvas and clips them to the canvas with a buffer.
+// A path that crosses the antimeridian is unwrapped so that it is continuous,
+// and it is drawn on every copy of the world that is in the canvas.
+type canvasView struct {
+	transCoord CoordTransFunc
+	world      float64
+	min, max   [2]float64
+}
+
+// newCanvasView returns the view of the canvas of width x height pixels that is extended by buffer pixels
+func newCanvasView(transCoord CoordTransFunc, width, height float64, buffer float64) *canvasView {
+	west, _ := transCoord(geom.LatLon{Lon: -180})
+	east, _ := transCoord(geom.LatLon{Lon: 180})
+	return &canvasView{
+		transCoord: transCoord,
+		world:      east - west,
+		min:        [2]float64{-buffer, -buffer},
+		max:        [2]float64{width + buffer, height + buffer},
+	}
+}
+
+// view returns the view of the canvas of the builder without a buffer
+func (br *DefaultBuilder) view() *canvasView {
+	return newCanvasView(br.transCoordToXY, br.canvasWidth, br.canvasHeight, 0)
+}
+
+// project returns the pixels of the path, the longitudes are unwrapped from the first point
+func (v *canvasView) project(coords []geom.LatLon) [][2]float64 {
+	pts := make([][2]float64, len(coords))
+	offset := 0.0
+	for i, c := range coords {
+		x, y := v.transCoord(c)
+		x += offset
+		if i > 0 && v.world > 0 {
+			if d := x - pts[i-1][0]; d > v.world/2 {
+				offset -= v.world
+				x -= v.world
+			} else if d < -v.world/2 {
+				offset += v.world
+				x += v.world
+			}
+		}
+		pts[i] = [2]float64{x, y}
+	}
+	return pts
+}
+
+// projectNearest returns the pixels of the path on the copy of the world that the first point is the nearest to the view
+func (v *canvasView) projectNearest(coords []geom.LatLon) [][2]float64 {
+	pts := v.project(coords)
+	if len(pts) == 0 {
+		return pts
+	}
+	return shiftPoints(pts, nearestCopy(pts[0][0], v.world, (v.min[0]+v.max[0])/2)-pts[0][0])
+}
+
+// copies returns the horizontal shifts of the copies of the path that are in the canvas
+func (v *canvasView) copies(pts [][2]float64) []float64 {
+	if len(pts) == 0 {
+		return nil
+	}
+	minX, maxX := pts[0][0], pts[0][0]
+	for _, p := range pts[1:] {
+		minX = math.Min(minX, p[0])
+		maxX = math.Max(maxX, p[0])
+	}
+	if v.world <= 0 {
+		return []float64{0}
+	}
+	var ret []float64
+	first := math.Ceil((v.min[0] - maxX) / v.world)
+	last := math.Floor((v.max[0] - minX) / v.world)
+	// a path can not be in more than a few copies of the world, even at the zoom level 0
+	for k := math.Max(first, -2); k <= math.Min(last, 2); k++ {
+		ret = append(ret, k*v.world)
+	}
+	return ret
+}
+
+// polygon adds the ring to the path of the context, clipped to the view
+func (v *canvasView) polygon(dc *gg.Context, ring []geom.LatLon) {
+	pts := v.project(ring)
+	for _, dx := range v.copies(pts) {
+		clipped := clipPolygon(shiftPoints(pts, dx), v.min, v.max)
+		if len(clipped) < 3 {
+			continue
+		}
+		dc.MoveTo(clipped[0][0], clipped[0][1])
+		for _, p := range clipped[1:] {
+			dc.LineTo(p[0], p[1])
+		}
+		dc.ClosePath()
+	}
+}
+
+// polyline adds the line to the path of the context, the parts of the line that are out of the view are dropped
+func (v *canvasView) polyline(dc *gg.Context, line []geom.LatLon) {
+	pts := v.project(line)
+	for _, dx := range v.copies(pts) {
+		for _, part := range clipPolyline(shiftPoints(pts, dx), v.min, v.max) {
+			dc.MoveTo(part[0][0], part[0][1])
+			for _, p := range part[1:] {
+				dc.LineTo(p[0], p[1])
+			}
+		}
+	}
+}
+
+// point returns the pixel of the copy of the point that is the nearest to the center of the view
+func (v *canvasView) point(c geom.LatLon) (float64, float64) {
+	x, y := v.transCoord(c)
+	return nearestCopy(x, v.world, (v.min[0]+v.max[0])/2), y
+}
+
+func nearestCopy(x, world, center float64) float64 {
+	if world <= 0 {
+		return x
+	}
+	return x - math.Round((x-center)/world)*world
+}
+
+func shiftPoints(pts [][2]float64, dx float64) [][2]float64 {
+	if dx == 0 {
+		return pts
+	}
+	ret := make([][2]float64, len(pts))
+	for i, p := range pts {
+		ret[i] = [2]float64{p[0] + dx, p[1]}
+	}
+	return ret
+}
+
+// clipPolygon clips the ring to the box by Sutherland-Hodgman algorithm
+func clipPolygon(pts [][2]float64, min, max [2]float64) [][2]float64 {
+	if inBox(pts, min, max) {
+		return pts
+	}
+	edges := []struct {
+		axis    int
+		v       float64
+		greater bool
+	}{
+		{0, min[0], true}, {0, max[0], false}, {1, min[1], true}, {1, max[1], false},
+	}
+	ret := pts
+	for _, e := range edges {
+		inside := func(p [2]float64) bool {
+			if e.greater {
+				return p[e.axis] >= e.v
+			}
+			return p[e.axis] <= e.v
+		}
+		in := ret
+		if len(in) == 0 {
+			break
+		}
+		ret = make([][2]float64, 0, len(in)+4)
+		prev := in[len(in)-1]
+		for _, p := range in {
+			if inside(p) {
+				if !inside(prev) {
+					ret = append(ret, intersectAxis(prev, p, e.axis, e.v))
+				}
+				ret = append(ret, p)
+			} else if inside(prev) {
+				ret = append(ret, intersectAxis(prev, p, e.axis, e.v))
+			}
+			prev = p
+		}
+	}
+	return ret
+}
+
+// clipPolyline clips the line to the box by Liang-Barsky algorithm, the line is split where it goes out of the box
+func clipPolyline(pts [][2]float64, min, max [2]float64) [][][2]float64 {
+	if len(pts) < 2 {
+		return nil
+	}
+	if inBox(pts, min, max) {
+		return [][][2]float64{pts}
+	}
+	var ret [][][2]float64
+	var part [][2]float64
+	for i := 1; i < len(pts); i++ {
+		a, b, ok := clipSegment(pts[i-1], pts[i], min, max)
+		if !ok {
+			if len(part) > 1 {
+				ret = append(ret, part)
+			}
+			part = nil
+			continue
+		}
+		if len(part) == 0 || part[len(part)-1] != a {
+			if len(part) > 1 {
+				ret = append(ret, part)
+			}
+			part = [][2]float64{a}
+		}
+		part = append(part, b)
+	}
+	if len(part) > 1 {
+		ret = append(ret, part)
+	}
+	return ret
+}
+
+func clipSegment(a, b [2]float64, min, max [2]float64) ([2]float64, [2]float64, bool) {
+	t0, t1 := 0.0, 1.0
+	d := [2]float64{b[0] - a[0], b[1] - a[1]}
+	for axis := 0; axis < 2; axis++ {
+		for _, pq := range [][2]float64{{-d[axis], a[axis] - min[axis]}, {d[axis], max[axis] - a[axis]}} {
+			p, q := pq[0], pq[1]
+			if p == 0 {
+				if q < 0 {
+					return a, b, false
+				}
+				continue
+			}
+			t := q / p
+			if p < 0 {
+				if t > t1 {
+					return a, b, false
+				}
+				t0 = math.Max(t0, t)
+			} else {
+				if t < t0 {
+					return a, b, false
+				}
+				t1 = math.Min(t1, t)
+			}
+		}
+	}
+	ca, cb := a, b
+	if t0 > 0 {
+		ca = [2]float64{a[0] + t0*d[0], a[1] + t0*d[1]}
+	}
+	if t1 < 1 {
+		cb = [2]float64{a[0] + t1*d[0], a[1] + t1*d[1]}
+	}
+	return ca, cb, true
+}
+
+func intersectAxis(a, b [2]float64, axis int, v float64) [2]float64 {
+	t := (v - a[axis]) / (b[axis] - a[axis])
+	p := [2]float64{a[0] + t*(b[0]-a[0]), a[1] + t*(b[1]-a[1])}
+	p[axis] = v
+	return p
+}
+
+func inBox(pts [][2]float64, min, max [2]float64) bool {
+	for _, p := range pts {
+		if p[0] < min[0] || p[1] < min[1] || p[0] > max[0] || p[1] > max[1] {
+			return false
+		}
+	}
+	return true
+}
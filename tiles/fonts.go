@@ -0,0 +1,255 @@
+package tiles
+
+import (
+	"image"
+	"os"
+	"strings"
+	"sync"
+	"unicode"
+
+	"github.com/golang/freetype/truetype"
+	"github.com/pkg/errors"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/opentype"
+	"golang.org/x/image/font/sfnt"
+	"golang.org/x/image/math/fixed"
+)
+
+const (
+	FontWeightNormal = "normal"
+	FontWeightBold   = "bold"
+)
+
+// labelFont is a font in the fallback chain of the labels,
+// the font is used only for the characters of its scripts if scripts are specified.
+type labelFont struct {
+	scripts []*unicode.RangeTable
+	hasRune func(r rune) bool
+	newFace func(size float64) font.Face
+}
+
+func (lf *labelFont) covers(r rune) bool {
+	if len(lf.scripts) > 0 && !unicode.IsOneOf(lf.scripts, r) {
+		return false
+	}
+	return lf.hasRune(r)
+}
+
+// chains of the fonts of the labels, FontD2Coding is the last fallback of the chains
+var labelFonts = struct {
+	sync.RWMutex
+	normal []*labelFont
+	bold   []*labelFont
+	pools  map[faceKey]*sync.Pool
+}{}
+
+type faceKey struct {
+	bold bool
+	size float64
+}
+
+// SetFonts sets the fonts of the labels in the order of fallback, bold fonts are for the labels in FontWeightBold.
+// A font file can be prefixed with the scripts that it is used for, like "Arabic,Hebrew:./NotoSansArabic.ttf",
+// the names of the scripts are the names of unicode.Scripts.
+// Labels in bold are drawn with the normal fonts if no bold font has the character.
+func SetFonts(normal []string, bold []string) error {
+	normalFonts, err := loadLabelFonts(normal)
+	if err != nil {
+		return err
+	}
+	boldFonts, err := loadLabelFonts(bold)
+	if err != nil {
+		return err
+	}
+	labelFonts.Lock()
+	defer labelFonts.Unlock()
+	labelFonts.normal = normalFonts
+	labelFonts.bold = boldFonts
+	labelFonts.pools = nil
+	return nil
+}
+
+func loadLabelFonts(specs []string) ([]*labelFont, error) {
+	ret := make([]*labelFont, 0, len(specs))
+	for _, spec := range specs {
+		path := spec
+		var scripts []*unicode.RangeTable
+		if i := strings.Index(spec, ":"); i > 0 {
+			names := strings.Split(spec[:i], ",")
+			for _, name := range names {
+				if table, ok := unicode.Scripts[strings.TrimSpace(name)]; ok {
+					scripts = append(scripts, table)
+				}
+			}
+			// windows paths like "C:\..." are not prefixed
+			if len(scripts) == len(names) {
+				path = spec[i+1:]
+			} else {
+				scripts = nil
+			}
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		f, err := opentype.Parse(data)
+		if err != nil {
+			return nil, errors.Wrapf(err, "font %s", path)
+		}
+		lf := newOpenTypeFont(f)
+		lf.scripts = scripts
+		ret = append(ret, lf)
+	}
+	return ret, nil
+}
+
+func newOpenTypeFont(f *sfnt.Font) *labelFont {
+	return &labelFont{
+		hasRune: func(r rune) bool {
+			idx, err := f.GlyphIndex(nil, r)
+			return err == nil && idx != 0
+		},
+		newFace: func(size float64) font.Face {
+			face, err := opentype.NewFace(f, &opentype.FaceOptions{Size: size, DPI: 72, Hinting: font.HintingNone})
+			if err != nil {
+				return nil
+			}
+			return face
+		},
+	}
+}
+
+func newTrueTypeFont(f *truetype.Font) *labelFont {
+	return &labelFont{
+		hasRune: func(r rune) bool {
+			return f.Index(r) != 0
+		},
+		newFace: func(size float64) font.Face {
+			return truetype.NewFace(f, &truetype.Options{Size: size})
+		},
+	}
+}
+
+// NewLabelFace returns a face of the label fonts of the weight in size pixels, the face should be closed after use
+func NewLabelFace(weight string, size float64) font.Face {
+	labelFonts.RLock()
+	defer labelFonts.RUnlock()
+	return newFallbackFace(labelFontChain(weight == FontWeightBold), size)
+}
+
+// labelFontChain returns the fonts in the order of fallback, labelFonts should be locked
+func labelFontChain(bold bool) []*labelFont {
+	chain := make([]*labelFont, 0, len(labelFonts.bold)+len(labelFonts.normal)+1)
+	if bold {
+		chain = append(chain, labelFonts.bold...)
+	}
+	chain = append(chain, labelFonts.normal...)
+	return append(chain, newTrueTypeFont(FontD2Coding))
+}
+
+// hasBoldFonts returns false if the labels in bold are drawn with the normal fonts
+func hasBoldFonts() bool {
+	labelFonts.RLock()
+	defer labelFonts.RUnlock()
+	return len(labelFonts.bold) > 0
+}
+
+// acquireLabelFace returns the face of the fonts in size pixels, the face should be released by releaseLabelFace.
+// Faces are not safe for concurrent use, they are pooled to be reused by the tiles that are rendered at the same time.
+func acquireLabelFace(bold bool, size float64) font.Face {
+	key := faceKey{bold: bold, size: size}
+	labelFonts.Lock()
+	if labelFonts.pools == nil {
+		labelFonts.pools = map[faceKey]*sync.Pool{}
+	}
+	pool, ok := labelFonts.pools[key]
+	if !ok {
+		chain := labelFontChain(bold)
+		pool = &sync.Pool{New: func() any { return newFallbackFace(chain, size) }}
+		labelFonts.pools[key] = pool
+	}
+	labelFonts.Unlock()
+	return pool.Get().(font.Face)
+}
+
+func releaseLabelFace(bold bool, size float64, face font.Face) {
+	key := faceKey{bold: bold, size: size}
+	labelFonts.RLock()
+	pool, ok := labelFonts.pools[key]
+	labelFonts.RUnlock()
+	if ok {
+		pool.Put(face)
+	}
+}
+
+// fallbackFace draws each character with the first font of the chain that has the character,
+// metrics are of the first font that covers all scripts.
+type fallbackFace struct {
+	fonts   []*labelFont
+	faces   []font.Face
+	primary int
+	picked  map[rune]int
+}
+
+func newFallbackFace(chain []*labelFont, size float64) *fallbackFace {
+	f := &fallbackFace{fonts: chain, faces: make([]font.Face, len(chain)), picked: map[rune]int{}}
+	for i, lf := range chain {
+		f.faces[i] = lf.newFace(size)
+	}
+	f.primary = len(chain) - 1
+	for i, lf := range chain {
+		if len(lf.scripts) == 0 && f.faces[i] != nil {
+			f.primary = i
+			break
+		}
+	}
+	return f
+}
+
+func (f *fallbackFace) pick(r rune) font.Face {
+	i, ok := f.picked[r]
+	if !ok {
+		i = len(f.fonts) - 1
+		for n, lf := range f.fonts {
+			if f.faces[n] != nil && lf.covers(r) {
+				i = n
+				break
+			}
+		}
+		f.picked[r] = i
+	}
+	return f.faces[i]
+}
+
+func (f *fallbackFace) Close() error {
+	for _, face := range f.faces {
+		if face != nil {
+			face.Close()
+		}
+	}
+	return nil
+}
+
+func (f *fallbackFace) Glyph(dot fixed.Point26_6, r rune) (image.Rectangle, image.Image, image.Point, fixed.Int26_6, bool) {
+	return f.pick(r).Glyph(dot, r)
+}
+
+func (f *fallbackFace) GlyphBounds(r rune) (fixed.Rectangle26_6, fixed.Int26_6, bool) {
+	return f.pick(r).GlyphBounds(r)
+}
+
+func (f *fallbackFace) GlyphAdvance(r rune) (fixed.Int26_6, bool) {
+	return f.pick(r).GlyphAdvance(r)
+}
+
+func (f *fallbackFace) Kern(r0, r1 rune) fixed.Int26_6 {
+	face := f.pick(r0)
+	if face != f.pick(r1) {
+		return 0
+	}
+	return face.Kern(r0, r1)
+}
+
+func (f *fallbackFace) Metrics() font.Metrics {
+	return f.faces[f.primary].Metrics()
+}
@@ -0,0 +1,72 @@
+package tiles_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/OutOfBedlam/ots/tiles"
+	"github.com/golang/freetype/truetype"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/gofont/goregular"
+	"golang.org/x/image/font/opentype"
+)
+
+func TestFontFallback(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "goregular.ttf")
+	require.Nil(t, os.WriteFile(path, goregular.TTF, 0644))
+	t.Cleanup(func() { tiles.SetFonts(nil, nil) })
+
+	goFont, err := opentype.Parse(goregular.TTF)
+	require.Nil(t, err)
+	goFace, err := opentype.NewFace(goFont, &opentype.FaceOptions{Size: 20, DPI: 72, Hinting: font.HintingNone})
+	require.Nil(t, err)
+	d2Face := truetype.NewFace(tiles.FontD2Coding, &truetype.Options{Size: 20})
+
+	advance := func(face font.Face, r rune) float64 {
+		a, ok := face.GlyphAdvance(r)
+		require.True(t, ok)
+		return float64(a) / 64
+	}
+
+	// latin from the go font, hangul from the embedded font
+	require.Nil(t, tiles.SetFonts([]string{path}, nil))
+	face := tiles.NewLabelFace(tiles.FontWeightNormal, 20)
+	assert.Equal(t, advance(goFace, 'W'), advance(face, 'W'))
+	assert.Equal(t, advance(d2Face, '한'), advance(face, '한'))
+	face.Close()
+
+	// the go font is only for the hangul that it does not have
+	require.Nil(t, tiles.SetFonts([]string{"Hangul:" + path}, nil))
+	face = tiles.NewLabelFace(tiles.FontWeightNormal, 20)
+	assert.Equal(t, advance(d2Face, 'W'), advance(face, 'W'))
+	face.Close()
+
+	// bold falls back to the normal fonts
+	require.Nil(t, tiles.SetFonts([]string{path}, []string{"Hangul:" + path}))
+	face = tiles.NewLabelFace(tiles.FontWeightBold, 20)
+	assert.Equal(t, advance(goFace, 'W'), advance(face, 'W'))
+	face.Close()
+
+	assert.NotNil(t, tiles.SetFonts([]string{filepath.Join(t.TempDir(), "none.ttf")}, nil))
+	assert.NotNil(t, tiles.SetFonts([]string{writeStyleSheet(t, "font.ttf", "not a font")}, nil))
+}
+
+func TestStyleSheetFont(t *testing.T) {
+	ss, err := tiles.LoadStyleSheet(writeStyleSheet(t, "font.hcl", `
+rule "place=city" {
+    font-size   = 30
+    font-weight = "normal"
+}
+`))
+	require.Nil(t, err)
+	style := &tiles.Style{}
+	ss.StyleFunc()(style, &tiles.StyleParam{Tags: map[string]string{"place": "city"}})
+	assert.Equal(t, 30.0, style.FontSize)
+	assert.Equal(t, tiles.FontWeightNormal, style.FontWeight)
+
+	_, err = tiles.LoadStyleSheet(writeStyleSheet(t, "weight.hcl", `rule "place" { font-weight = "heavy" }`))
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,165 @@
+package tiles
+
+import (
+	"math"
+	"strconv"
+
+	"github.com/OutOfBedlam/ots/geom"
+)
+
+// zoom levels up to GeneralizedMaxZoom are rendered with generalized objects,
+// only the major features are drawn and their geometries are simplified.
+const GeneralizedMaxZoom = 10
+
+// an area is drawn in the generalized tiles if its extent is larger than this pixels (of 256 pixels tile)
+const generalizedMinAreaPixels = 8
+
+// GeneralizedMinZoom returns the lowest zoom level that the feature of the tags is drawn in the generalized tiles,
+// it returns GeneralizedMaxZoom+1 if the feature is not a major feature.
+// extent is the larger side of the bounds of the feature in degrees, water areas are drawn only when they are large enough.
+func GeneralizedMinZoom(tags map[string]string, extent float64) int {
+	const none = GeneralizedMaxZoom + 1
+
+	if v, ok := tags["place"]; ok {
+		switch v {
+		case "country":
+			return 3
+		case "state", "province":
+			return 5
+		case "city":
+			return 6
+		case "town":
+			return 9
+		}
+		return none
+	}
+	if v, ok := tags["highway"]; ok {
+		switch v {
+		case "motorway":
+			return 5
+		case "trunk":
+			return 6
+		case "primary":
+			return 8
+		case "motorway_link", "trunk_link":
+			return 10
+		}
+		return none
+	}
+	if tags["boundary"] == "administrative" {
+		level, err := strconv.Atoi(tags["admin_level"])
+		switch {
+		case err != nil:
+			return none
+		case level <= 2:
+			return 0
+		case level <= 4:
+			return 4
+		case level <= 6:
+			return 8
+		}
+		return none
+	}
+	if tags["natural"] == "coastline" {
+		return 0
+	}
+	if tags["waterway"] == "river" {
+		return 8
+	}
+	if isWaterArea(tags) {
+		return areaMinZoom(extent)
+	}
+	return none
+}
+
+func isWaterArea(tags map[string]string) bool {
+	switch tags["natural"] {
+	case "water", "bay", "strait":
+		return true
+	}
+	if _, ok := tags["water"]; ok {
+		return true
+	}
+	return tags["waterway"] == "riverbank" || tags["landuse"] == "reservoir"
+}
+
+// areaMinZoom returns the zoom level from which the area of extent degrees is larger than generalizedMinAreaPixels
+func areaMinZoom(extent float64) int {
+	if extent <= 0 {
+		return GeneralizedMaxZoom + 1
+	}
+	z := int(math.Ceil(math.Log2(360 * generalizedMinAreaPixels / (256 * extent))))
+	if z < 0 {
+		return 0
+	} else if z > GeneralizedMaxZoom {
+		return GeneralizedMaxZoom + 1
+	}
+	return z
+}
+
+// GeneralizeTolerance returns the tolerance of simplification in degrees, a pixel of 256 pixels tile of the zoom
+func GeneralizeTolerance(zoom int) float64 {
+	return 360 / (256 * math.Exp2(float64(zoom)))
+}
+
+// GeneralizeCoords simplifies the line or the ring for the zoom level
+func GeneralizeCoords(points []geom.LatLon, zoom int) []geom.LatLon {
+	if len(points) <= 3 {
+		return points
+	}
+	ep := GeneralizeTolerance(zoom)
+	last := len(points) - 1
+	if points[0] != points[last] {
+		return geom.SimplifyTrajectory(points, ep)
+	}
+	// distances from the line of a closed ring are not defined, simplify two halves of the ring
+	mid := last / 2
+	left := geom.SimplifyTrajectory(points[:mid+1], ep)
+	right := geom.SimplifyTrajectory(points[mid:], ep)
+	ret := make([]geom.LatLon, 0, len(left)+len(right)-1)
+	ret = append(ret, left...)
+	return append(ret, right[1:]...)
+}
+
+// GeneralizeWay returns a copy of the way that has simplified nodes for the zoom level,
+// the removed nodes are dropped as they do not affect the rendering of low zoom tiles.
+func GeneralizeWay(way *Way, zoom int) *Way {
+	points := make([]geom.LatLon, len(way.Nodes))
+	for i, n := range way.Nodes {
+		points[i] = geom.LatLon{Lat: n.Lat, Lon: n.Lon}
+	}
+	simplified := GeneralizeCoords(points, zoom)
+	if len(simplified) == len(points) {
+		return way
+	}
+
+	ret := &Way{
+		Id:     way.Id,
+		Tags:   way.Tags,
+		MinLat: way.MinLat,
+		MinLon: way.MinLon,
+		MaxLat: way.MaxLat,
+		MaxLon: way.MaxLon,
+		Nodes:  make([]*Way_NodeRef, 0, len(simplified)),
+	}
+	// simplified points are a subsequence of the points
+	i := 0
+	for _, p := range simplified {
+		for ; i < len(points); i++ {
+			if points[i] == p {
+				ret.Nodes = append(ret.Nodes, way.Nodes[i])
+				i++
+				break
+			}
+		}
+	}
+	return ret
+}
+
+func (w *Way) Extent() float64 {
+	return math.Max(w.MaxLat-w.MinLat, w.MaxLon-w.MinLon)
+}
+
+func (r *Relation) Extent() float64 {
+	return math.Max(r.MaxLat-r.MinLat, r.MaxLon-r.MinLon)
+}
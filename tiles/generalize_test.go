@@ -0,0 +1,55 @@
+package tiles_test
+
+import (
+	"testing"
+
+	"github.com/OutOfBedlam/ots/geom"
+	"github.com/OutOfBedlam/ots/tiles"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGeneralizedMinZoom(t *testing.T) {
+	none := tiles.GeneralizedMaxZoom + 1
+	assert.Equal(t, 5, tiles.GeneralizedMinZoom(map[string]string{"highway": "motorway"}, 0))
+	assert.Equal(t, none, tiles.GeneralizedMinZoom(map[string]string{"highway": "residential"}, 0))
+	assert.Equal(t, 0, tiles.GeneralizedMinZoom(map[string]string{"boundary": "administrative", "admin_level": "2"}, 10))
+	assert.Equal(t, none, tiles.GeneralizedMinZoom(map[string]string{"boundary": "administrative", "admin_level": "8"}, 0.1))
+	assert.Equal(t, 6, tiles.GeneralizedMinZoom(map[string]string{"place": "city", "name": "Seoul"}, 0))
+	assert.Equal(t, none, tiles.GeneralizedMinZoom(map[string]string{"building": "yes"}, 1))
+
+	// larger lakes appear from lower zoom levels
+	lake := map[string]string{"natural": "water"}
+	assert.Less(t, tiles.GeneralizedMinZoom(lake, 1), tiles.GeneralizedMinZoom(lake, 0.1))
+	assert.Equal(t, none, tiles.GeneralizedMinZoom(lake, 0.0001))
+}
+
+func TestGeneralizeCoords(t *testing.T) {
+	// a ring of 100 points on a square
+	ring := make([]geom.LatLon, 0)
+	for i := 0; i < 25; i++ {
+		ring = append(ring, geom.LatLon{Lat: 0, Lon: float64(i) / 25})
+	}
+	for i := 0; i < 25; i++ {
+		ring = append(ring, geom.LatLon{Lat: float64(i) / 25, Lon: 1})
+	}
+	for i := 0; i < 25; i++ {
+		ring = append(ring, geom.LatLon{Lat: 1, Lon: 1 - float64(i)/25})
+	}
+	for i := 0; i < 25; i++ {
+		ring = append(ring, geom.LatLon{Lat: 1 - float64(i)/25, Lon: 0})
+	}
+	ring = append(ring, ring[0])
+
+	simplified := tiles.GeneralizeCoords(ring, 5)
+	assert.Equal(t, 5, len(simplified))
+	assert.Equal(t, simplified[0], simplified[len(simplified)-1])
+
+	way := &tiles.Way{Id: 1}
+	for i, p := range ring {
+		way.Nodes = append(way.Nodes, &tiles.Way_NodeRef{Id: int64(i), Lat: p.Lat, Lon: p.Lon})
+	}
+	gw := tiles.GeneralizeWay(way, 5)
+	assert.Equal(t, 5, len(gw.Nodes))
+	assert.Equal(t, 101, len(way.Nodes))
+	assert.Equal(t, way.Nodes[0].Id, gw.Nodes[0].Id)
+}
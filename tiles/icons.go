@@ -1,21 +1,35 @@
 package tiles
 
 import (
-	_ "embed"
+	"embed"
+	"io/fs"
+	"os"
+	"path"
+	"strings"
+	"sync"
 
 	"github.com/fogleman/gg"
 	"github.com/golang/freetype/truetype"
+	"github.com/pkg/errors"
 )
 
 //go:embed fonts/fa-solid-900.ttf
 var faSold900Data []byte
 var FontFaSolid900 *truetype.Font
 
+// bundle of the icons that are registered by the file names without extension
+//
+//go:embed icons/*.svg
+var iconsBundle embed.FS
+
 func init() {
 	var err error
 	if FontFaSolid900, err = truetype.Parse(faSold900Data); err != nil {
 		panic("invalid font")
 	}
+	if _, err = LoadIconsFS(iconsBundle, "icons"); err != nil {
+		panic("invalid icon, " + err.Error())
+	}
 }
 
 type Icon interface {
@@ -38,8 +52,146 @@ var (
 	fa_university    = newFaIcon('\uf19c')
 	fa_fire          = newFaIcon('\uf06d')
 	fa_user_shield   = newFaIcon('\uf505')
+	fa_shopping_cart = newFaIcon('\uf07a')
+	fa_store         = newFaIcon('\uf54e')
+	fa_utensils      = newFaIcon('\uf2e7')
+	fa_coffee        = newFaIcon('\uf0f4')
+	fa_bus           = newFaIcon('\uf207')
+	fa_train         = newFaIcon('\uf238')
+	fa_traffic_light = newFaIcon('\uf637')
+	fa_mountain      = newFaIcon('\uf6fc')
 )
 
+var iconsByName = map[string]Icon{
+	"swimmer":       fa_swimmer,
+	"anchor":        fa_anchor,
+	"parking":       fa_parking,
+	"school":        fa_school,
+	"gas-pump":      fa_gasPump,
+	"helicopter":    fa_helicopter,
+	"hospital":      fa_hostpital_alt,
+	"child":         fa_child,
+	"book":          fa_book,
+	"university":    fa_university,
+	"fire":          fa_fire,
+	"user-shield":   fa_user_shield,
+	"shopping-cart": fa_shopping_cart,
+	"store":         fa_store,
+	"utensils":      fa_utensils,
+	"coffee":        fa_coffee,
+	"bus":           fa_bus,
+	"train":         fa_train,
+	"traffic-light": fa_traffic_light,
+	"mountain":      fa_mountain,
+	// font-awesome icons that are not used by the built-in styles
+	"bank":             newFaIcon('\uf66f'),
+	"money-bill":       newFaIcon('\uf0d6'),
+	"credit-card":      newFaIcon('\uf09d'),
+	"hotel":            newFaIcon('\uf594'),
+	"bed":              newFaIcon('\uf236'),
+	"church":           newFaIcon('\uf51d'),
+	"mosque":           newFaIcon('\uf678'),
+	"synagogue":        newFaIcon('\uf69b'),
+	"place-of-worship": newFaIcon('\uf67f'),
+	"tree":             newFaIcon('\uf1bb'),
+	"water":            newFaIcon('\uf773'),
+	"toilet":           newFaIcon('\uf7d8'),
+	"pills":            newFaIcon('\uf486'),
+	"clinic":           newFaIcon('\uf7f2'),
+	"tooth":            newFaIcon('\uf5c9'),
+	"film":             newFaIcon('\uf008'),
+	"theater":          newFaIcon('\uf630'),
+	"beer":             newFaIcon('\uf0fc'),
+	"cocktail":         newFaIcon('\uf561'),
+	"ice-cream":        newFaIcon('\uf810'),
+	"hamburger":        newFaIcon('\uf805'),
+	"pizza":            newFaIcon('\uf818'),
+	"bread":            newFaIcon('\uf7ec'),
+	"wine":             newFaIcon('\uf72f'),
+	"bicycle":          newFaIcon('\uf206'),
+	"car":              newFaIcon('\uf1b9'),
+	"charging-station": newFaIcon('\uf5e7'),
+	"subway":           newFaIcon('\uf239'),
+	"plane":            newFaIcon('\uf072'),
+	"ship":             newFaIcon('\uf21a'),
+	"taxi":             newFaIcon('\uf1ba'),
+	"info":             newFaIcon('\uf05a'),
+	"camera":           newFaIcon('\uf030'),
+	"campground":       newFaIcon('\uf6bb'),
+	"fitness":          newFaIcon('\uf44b'),
+	"soccer":           newFaIcon('\uf1e3'),
+	"golf":             newFaIcon('\uf450'),
+	"hiking":           newFaIcon('\uf6ec'),
+	"binoculars":       newFaIcon('\uf1e5'),
+	"monument":         newFaIcon('\uf5a6'),
+	"clothes":          newFaIcon('\uf553'),
+	"hairdresser":      newFaIcon('\uf0c4'),
+	"envelope":         newFaIcon('\uf0e0'),
+	"phone":            newFaIcon('\uf095'),
+	"recycle":          newFaIcon('\uf1b8'),
+	"trash":            newFaIcon('\uf1f8'),
+	"veterinary":       newFaIcon('\uf1b0'),
+	"wheelchair":       newFaIcon('\uf193'),
+	"music":            newFaIcon('\uf001'),
+}
+
+var iconsLock sync.RWMutex
+
+// IconByName returns the icon of the name that is used in style sheets
+func IconByName(name string) (Icon, bool) {
+	iconsLock.RLock()
+	defer iconsLock.RUnlock()
+	icon, ok := iconsByName[name]
+	return icon, ok
+}
+
+// RegisterIcon adds the icon of the name, it replaces the icon that has the same name
+func RegisterIcon(name string, icon Icon) {
+	iconsLock.Lock()
+	defer iconsLock.Unlock()
+	iconsByName[name] = icon
+}
+
+// LoadIcons registers the *.svg and *.png files in the directory by their file names without extension,
+// it returns the number of the registered icons. Icons should be loaded before the style sheets that use them.
+func LoadIcons(dir string) (int, error) {
+	return LoadIconsFS(os.DirFS(dir), ".")
+}
+
+// LoadIconsFS registers the *.svg and *.png files in the directory of fsys
+func LoadIconsFS(fsys fs.FS, dir string) (int, error) {
+	entries, err := fs.ReadDir(fsys, dir)
+	if err != nil {
+		return 0, err
+	}
+	count := 0
+	for _, ent := range entries {
+		if ent.IsDir() {
+			continue
+		}
+		ext := strings.ToLower(path.Ext(ent.Name()))
+		if ext != ".svg" && ext != ".png" {
+			continue
+		}
+		data, err := fs.ReadFile(fsys, path.Join(dir, ent.Name()))
+		if err != nil {
+			return count, err
+		}
+		var icon Icon
+		if ext == ".svg" {
+			icon, err = newSvgIcon(data)
+		} else {
+			icon, err = newImageIcon(data)
+		}
+		if err != nil {
+			return count, errors.Wrapf(err, "icon %s", ent.Name())
+		}
+		RegisterIcon(strings.TrimSuffix(ent.Name(), path.Ext(ent.Name())), icon)
+		count++
+	}
+	return count, nil
+}
+
 func newFaIcon(code rune) Icon {
 	return &faIcon{
 		code: code,
@@ -0,0 +1,93 @@
+package tiles
+
+import (
+	"bytes"
+	"image"
+	_ "image/png"
+	"math"
+	"sync"
+
+	"github.com/fogleman/gg"
+	"github.com/srwiley/oksvg"
+	"github.com/srwiley/rasterx"
+	"golang.org/x/image/draw"
+)
+
+// imageIcon rasterizes an icon once for each pixel size,
+// the icon is scaled to fit in the square of the size keeping its aspect ratio.
+type imageIcon struct {
+	sync.Mutex
+	images map[int]image.Image
+	render func(w, h int) image.Image
+	width  float64
+	height float64
+}
+
+func (icn *imageIcon) image(size float64) image.Image {
+	px := int(math.Ceil(size))
+	if px <= 0 {
+		return nil
+	}
+	icn.Lock()
+	defer icn.Unlock()
+	if img, ok := icn.images[px]; ok {
+		return img
+	}
+	w, h := px, px
+	if icn.width > icn.height {
+		h = int(math.Max(1, math.Round(float64(px)*icn.height/icn.width)))
+	} else if icn.height > icn.width {
+		w = int(math.Max(1, math.Round(float64(px)*icn.width/icn.height)))
+	}
+	img := icn.render(w, h)
+	if icn.images == nil {
+		icn.images = map[int]image.Image{}
+	}
+	icn.images[px] = img
+	return img
+}
+
+func (icn *imageIcon) Draw(dc *gg.Context, x, y, size float64) {
+	icn.DrawAnchored(dc, x, y, size, 0.5, 0.5)
+}
+
+func (icn *imageIcon) DrawAnchored(dc *gg.Context, x, y, size, ax, ay float64) {
+	img := icn.image(size)
+	if img == nil {
+		return
+	}
+	dc.DrawImageAnchored(img, int(math.Round(x)), int(math.Round(y)), ax, ay)
+}
+
+// newSvgIcon makes the icon of the svg document, it is drawn in the colors of the document
+func newSvgIcon(data []byte) (Icon, error) {
+	svg, err := oksvg.ReadIconStream(bytes.NewReader(data), oksvg.StrictErrorMode)
+	if err != nil {
+		return nil, err
+	}
+	icn := &imageIcon{width: svg.ViewBox.W, height: svg.ViewBox.H}
+	icn.render = func(w, h int) image.Image {
+		img := image.NewRGBA(image.Rect(0, 0, w, h))
+		svg.SetTarget(0, 0, float64(w), float64(h))
+		scanner := rasterx.NewScannerGV(w, h, img, img.Bounds())
+		svg.Draw(rasterx.NewDasher(w, h, scanner), 1.0)
+		return img
+	}
+	return icn, nil
+}
+
+// newImageIcon makes the icon of the png image
+func newImageIcon(data []byte) (Icon, error) {
+	src, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	b := src.Bounds()
+	icn := &imageIcon{width: float64(b.Dx()), height: float64(b.Dy())}
+	icn.render = func(w, h int) image.Image {
+		img := image.NewRGBA(image.Rect(0, 0, w, h))
+		draw.CatmullRom.Scale(img, img.Bounds(), src, b, draw.Over, nil)
+		return img
+	}
+	return icn, nil
+}
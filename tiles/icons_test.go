@@ -0,0 +1,66 @@
+package tiles_test
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/OutOfBedlam/ots/tiles"
+	"github.com/fogleman/gg"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testIconSVG = `<svg xmlns="http://www.w3.org/2000/svg" width="10" height="10" viewBox="0 0 10 10">
+  <path fill="#ff0000" d="M0 0h10v10h-10z"/>
+</svg>`
+
+func TestLoadIcons(t *testing.T) {
+	_, ok := tiles.IconByName("pharmacy")
+	assert.True(t, ok, "bundled icon")
+
+	dir := t.TempDir()
+	require.Nil(t, os.WriteFile(filepath.Join(dir, "test-red.svg"), []byte(testIconSVG), 0644))
+	img := image.NewRGBA(image.Rect(0, 0, 4, 2))
+	for x := 0; x < 4; x++ {
+		for y := 0; y < 2; y++ {
+			img.Set(x, y, color.RGBA{0, 0, 255, 255})
+		}
+	}
+	var buf bytes.Buffer
+	require.Nil(t, png.Encode(&buf, img))
+	require.Nil(t, os.WriteFile(filepath.Join(dir, "test-blue.png"), buf.Bytes(), 0644))
+	require.Nil(t, os.WriteFile(filepath.Join(dir, "README.txt"), []byte("not an icon"), 0644))
+
+	n, err := tiles.LoadIcons(dir)
+	require.Nil(t, err)
+	assert.Equal(t, 2, n)
+
+	dc := gg.NewContext(64, 32)
+	red, ok := tiles.IconByName("test-red")
+	require.True(t, ok)
+	red.Draw(dc, 16, 16, 20)
+	blue, ok := tiles.IconByName("test-blue")
+	require.True(t, ok)
+	blue.Draw(dc, 48, 16, 20)
+
+	r, _, _, _ := dc.Image().At(16, 16).RGBA()
+	assert.Equal(t, uint32(0xffff), r)
+	_, _, b, _ := dc.Image().At(48, 16).RGBA()
+	assert.Equal(t, uint32(0xffff), b)
+	// the png of 2:1 is drawn in 20x10 pixels
+	_, _, _, a := dc.Image().At(48, 24).RGBA()
+	assert.Equal(t, uint32(0), a)
+
+	// style sheets reference the icons by name
+	_, err = tiles.LoadStyleSheet(writeStyleSheet(t, "icons.hcl", `rule "amenity=cafe" { marker = "test-red" }`))
+	assert.Nil(t, err)
+
+	require.Nil(t, os.WriteFile(filepath.Join(dir, "broken.svg"), []byte("<svg"), 0644))
+	_, err = tiles.LoadIcons(dir)
+	assert.NotNil(t, err)
+}
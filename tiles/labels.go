@@ -0,0 +1,405 @@
+package tiles
+
+import (
+	"math"
+	"sort"
+
+	"github.com/fogleman/gg"
+	"github.com/tidwall/rtree"
+	"golang.org/x/image/font"
+)
+
+// font size of labels in pixels of DefaultTileSize
+const labelFontSize = 20
+
+// same as the arguments of DrawStringWrapped in Label.Draw, every word is in its own line
+const (
+	labelWrapWidth   = 0.8
+	labelLineSpacing = 1.06
+)
+
+// margins around the boxes of icons and texts in pixels of DefaultTileSize
+const (
+	labelIconMargin = 4.0
+	labelTextMargin = 2.0
+)
+
+// labelPriority returns the rank of the feature class, labels of higher rank are placed first
+func labelPriority(tags map[string]string) int {
+	if v, ok := tags["place"]; ok {
+		switch v {
+		case "country":
+			return 100
+		case "state", "province":
+			return 95
+		case "city":
+			return 90
+		case "town":
+			return 85
+		case "village", "suburb":
+			return 80
+		case "quarter", "neighbourhood":
+			return 70
+		}
+		return 60
+	}
+	if v, ok := tags["highway"]; ok {
+		switch v {
+		case "motorway", "trunk":
+			return 55
+		case "primary":
+			return 50
+		case "secondary":
+			return 45
+		case "tertiary":
+			return 40
+		}
+		return 25
+	}
+	if _, ok := tags["amenity"]; ok {
+		return 35
+	}
+	if _, ok := tags["natural"]; ok {
+		return 30
+	}
+	if _, ok := tags["waterway"]; ok {
+		return 30
+	}
+	if _, ok := tags["building"]; ok {
+		return 10
+	}
+	return 20
+}
+
+// distance between the repeated labels along a line in pixels of DefaultTileSize
+const labelRepeatDistance = 256.0
+
+// max angle between the neighbour glyphs of a text along a line
+const labelMaxBend = math.Pi / 4
+
+// labelGlyph is a character of the text along a line,
+// its center is (dx, dy) from the anchor of the label and it is rotated by angle
+type labelGlyph struct {
+	text   string
+	dx, dy float64
+	angle  float64
+}
+
+// labelCandidate is an offset of the text from the anchor of the label
+type labelCandidate struct {
+	dx, dy float64
+}
+
+// placeLabels drops the labels that collide with the labels of higher priority,
+// a colliding text is shifted around its icon or its anchor before it is dropped.
+// objs should be sorted in z-order, labels are returned after the other objects.
+func (br *DefaultBuilder) placeLabels(objs []Object) []Object {
+	others := make([]Object, 0, len(objs))
+	labels := make([]*Label, 0)
+	for _, o := range objs {
+		if label, ok := o.(*Label); ok {
+			labels = append(labels, label)
+		} else {
+			others = append(others, o)
+		}
+	}
+	if len(labels) == 0 {
+		return objs
+	}
+
+	sort.SliceStable(labels, func(i, j int) bool {
+		if labels[i].priority != labels[j].priority {
+			return labels[i].priority > labels[j].priority
+		}
+		return labels[i].area > labels[j].area
+	})
+
+	// measure the texts with the faces of the labels
+	dc := gg.NewContext(1, 1)
+	faces := map[faceKey]font.Face{}
+	defer func() {
+		for k, face := range faces {
+			releaseLabelFace(k.bold, k.size, face)
+		}
+	}()
+	setFace := func(label *Label) {
+		k := faceKey{bold: label.bold, size: label.textSize(br.scale)}
+		face, ok := faces[k]
+		if !ok {
+			face = acquireLabelFace(k.bold, k.size)
+			faces[k] = face
+		}
+		dc.SetFontFace(face)
+	}
+
+	placed := rtree.Generic[struct{}]{}
+	collides := func(boxes ...labelBox) bool {
+		hit := false
+		for _, b := range boxes {
+			placed.Search(b.min, b.max, func(_, _ [2]float64, _ struct{}) bool {
+				hit = true
+				return false
+			})
+			if hit {
+				return true
+			}
+		}
+		return false
+	}
+
+	view := br.view()
+	for _, label := range labels {
+		setFace(label)
+		if len(label.path) > 0 {
+			for _, l := range br.placeAlongPath(label, dc, &placed, collides) {
+				others = append(others, l)
+			}
+			continue
+		}
+
+		x, y := view.point(label.coord)
+		boxes := make([]labelBox, 0, 2)
+
+		var iconSize float64
+		if label.icon != nil {
+			iconSize = label.iconPixels() * br.scale
+			m := labelIconMargin * br.scale
+			iconBox := newLabelBox(x-iconSize/2-m, y-iconSize/2-m, x+iconSize/2+m, y+iconSize/2+m)
+			if !br.labelInCanvas(iconBox) || collides(iconBox) {
+				continue
+			}
+			boxes = append(boxes, iconBox)
+		}
+
+		if len(label.text) > 0 {
+			w, h := measureLabelText(dc, label.text)
+			m := labelTextMargin * br.scale
+			ok := false
+			for _, c := range label.candidates(iconSize, w, h, m) {
+				cx, cy := x+c.dx, y+c.dy
+				textBox := newLabelBox(cx-w/2-m, cy-h/2-m, cx+w/2+m, cy+h/2+m)
+				if !br.labelInCanvas(textBox) || collides(textBox) {
+					continue
+				}
+				boxes = append(boxes, textBox)
+				// the label is shared by the tiles in the object cache
+				copied := *label
+				copied.placed = true
+				copied.dx, copied.dy = c.dx, c.dy
+				label = &copied
+				ok = true
+				break
+			}
+			if !ok {
+				continue
+			}
+		}
+
+		for _, b := range boxes {
+			placed.Insert(b.min, b.max, struct{}{})
+		}
+		others = append(others, label)
+	}
+	return others
+}
+
+// labelInCanvas returns true if the box can be drawn in the canvas,
+// the box should be within the canvas, that has the margin around the tiles, if the labels are placed once for the metatile.
+func (br *DefaultBuilder) labelInCanvas(b labelBox) bool {
+	if br.labelsInside {
+		return b.min[0] >= 0 && b.min[1] >= 0 && b.max[0] <= br.canvasWidth && b.max[1] <= br.canvasHeight
+	}
+	return b.overlaps(0, 0, br.canvasWidth, br.canvasHeight)
+}
+
+// candidates returns the positions of the text, below the icon or at the anchor first
+func (label *Label) candidates(iconSize, w, h, margin float64) []labelCandidate {
+	if label.icon != nil {
+		return []labelCandidate{
+			{0, iconSize/2 + h/2},
+			{0, -iconSize/2 - h/2 - margin},
+			{iconSize/2 + w/2 + margin, 0},
+			{-iconSize/2 - w/2 - margin, 0},
+		}
+	}
+	return []labelCandidate{
+		{0, 0},
+		{0, -h/2 - margin},
+		{0, h/2 + margin},
+	}
+}
+
+// placeAlongPath places the text of the label along its path, repeated at every labelRepeatDistance.
+// The positions are measured from the start of the path so that the neighbour tiles agree on them.
+// A label is not placed where the path is shorter than the text or bends too much,
+// the glyphs are placed from the right end when the path runs to the left so that the text is kept upright.
+func (br *DefaultBuilder) placeAlongPath(label *Label, dc *gg.Context, placed *rtree.Generic[struct{}], collides func(...labelBox) bool) []*Label {
+	pts := br.view().projectNearest(label.path)
+	line := newLabelLine(pts)
+
+	chars := make([]string, 0, len(label.text))
+	advances := make([]float64, 0, len(label.text))
+	w := 0.0
+	for _, r := range label.text {
+		a, _ := dc.MeasureString(string(r))
+		chars = append(chars, string(r))
+		advances = append(advances, a)
+		w += a
+	}
+	h := dc.FontHeight()
+	m := labelTextMargin * br.scale
+	if line.length < w+2*m {
+		return nil
+	}
+
+	repeat := labelRepeatDistance * br.scale
+	count := int(line.length / repeat)
+	positions := []float64{line.length / 2}
+	if count > 1 {
+		positions = positions[:0]
+		offset := (line.length - float64(count)*repeat) / 2
+		for i := 0; i < count; i++ {
+			positions = append(positions, offset+(float64(i)+0.5)*repeat)
+		}
+	}
+
+	ret := make([]*Label, 0, len(positions))
+	for _, s := range positions {
+		if s-w/2 < 0 || s+w/2 > line.length {
+			continue
+		}
+		x0, _, _ := line.at(s - w/2)
+		x1, _, _ := line.at(s + w/2)
+		reverse := x1 < x0
+
+		glyphs := make([]labelGlyph, len(chars))
+		boxes := make([]labelBox, len(chars))
+		union := newLabelBox(math.Inf(1), math.Inf(1), math.Inf(-1), math.Inf(-1))
+		ok := true
+		cursor := 0.0
+		for i, a := range advances {
+			at := s - w/2 + cursor + a/2
+			if reverse {
+				at = s + w/2 - cursor - a/2
+			}
+			cursor += a
+			cx, cy, angle := line.at(at)
+			if reverse {
+				angle += math.Pi
+			}
+			if i > 0 && math.Abs(math.Remainder(angle-glyphs[i-1].angle, 2*math.Pi)) > labelMaxBend {
+				ok = false
+				break
+			}
+			glyphs[i] = labelGlyph{text: chars[i], dx: cx - pts[0][0], dy: cy - pts[0][1], angle: angle}
+			boxes[i] = newLabelBox(cx-a/2-m, cy-h/2-m, cx+a/2+m, cy+h/2+m).rotate(angle, cx, cy)
+			union.min = [2]float64{math.Min(union.min[0], boxes[i].min[0]), math.Min(union.min[1], boxes[i].min[1])}
+			union.max = [2]float64{math.Max(union.max[0], boxes[i].max[0]), math.Max(union.max[1], boxes[i].max[1])}
+		}
+		if !ok || !br.labelInCanvas(union) || collides(boxes...) {
+			continue
+		}
+		for _, b := range boxes {
+			placed.Insert(b.min, b.max, struct{}{})
+		}
+		// the label is shared by the tiles in the object cache
+		copied := *label
+		copied.placed = true
+		copied.glyphs = glyphs
+		ret = append(ret, &copied)
+	}
+	return ret
+}
+
+// labelLine is a path in pixels with the distances from its start
+type labelLine struct {
+	pts    [][2]float64
+	dist   []float64
+	length float64
+}
+
+// newLabelLine drops the repeated points, pts should not be empty
+func newLabelLine(pts [][2]float64) *labelLine {
+	l := &labelLine{pts: pts[:1], dist: []float64{0}}
+	for _, p := range pts[1:] {
+		last := l.pts[len(l.pts)-1]
+		d := math.Hypot(p[0]-last[0], p[1]-last[1])
+		if d == 0 {
+			continue
+		}
+		l.pts = append(l.pts, p)
+		l.dist = append(l.dist, l.dist[len(l.dist)-1]+d)
+	}
+	l.length = l.dist[len(l.dist)-1]
+	return l
+}
+
+// at returns the point at the distance s from the start and the direction of the path there
+func (l *labelLine) at(s float64) (float64, float64, float64) {
+	if len(l.pts) < 2 {
+		return l.pts[0][0], l.pts[0][1], 0
+	}
+	i := sort.SearchFloat64s(l.dist, s)
+	if i == 0 {
+		i = 1
+	} else if i >= len(l.pts) {
+		i = len(l.pts) - 1
+	}
+	p, q := l.pts[i-1], l.pts[i]
+	t := (s - l.dist[i-1]) / (l.dist[i] - l.dist[i-1])
+	return p[0] + (q[0]-p[0])*t, p[1] + (q[1]-p[1])*t, math.Atan2(q[1]-p[1], q[0]-p[0])
+}
+
+// textSize returns the font size of the label in pixels of the canvas
+func (label *Label) textSize(scale float64) float64 {
+	if label.fontSize > 0 {
+		return label.fontSize * scale
+	}
+	return labelFontSize * scale
+}
+
+// iconPixels returns the size of the icon in pixels of DefaultTileSize
+func (label *Label) iconPixels() float64 {
+	if label.iconSize > 0 {
+		return label.iconSize
+	}
+	return 28.0
+}
+
+// measureLabelText returns the size of the text as DrawStringWrapped in Label.Draw
+func measureLabelText(dc *gg.Context, text string) (float64, float64) {
+	lines := dc.WordWrap(text, labelWrapWidth)
+	w := 0.0
+	for _, line := range lines {
+		lw, _ := dc.MeasureString(line)
+		w = math.Max(w, lw)
+	}
+	fh := dc.FontHeight()
+	h := float64(len(lines))*fh*labelLineSpacing - (labelLineSpacing-1)*fh
+	return w, h
+}
+
+type labelBox struct {
+	min, max [2]float64
+}
+
+func newLabelBox(minX, minY, maxX, maxY float64) labelBox {
+	return labelBox{min: [2]float64{minX, minY}, max: [2]float64{maxX, maxY}}
+}
+
+// rotate returns the bounding box of the box rotated about (x, y)
+func (b labelBox) rotate(angle, x, y float64) labelBox {
+	sin, cos := math.Sin(angle), math.Cos(angle)
+	ret := newLabelBox(math.Inf(1), math.Inf(1), math.Inf(-1), math.Inf(-1))
+	for _, p := range [][2]float64{b.min, b.max, {b.min[0], b.max[1]}, {b.max[0], b.min[1]}} {
+		px, py := p[0]-x, p[1]-y
+		rx, ry := x+px*cos-py*sin, y+px*sin+py*cos
+		ret.min = [2]float64{math.Min(ret.min[0], rx), math.Min(ret.min[1], ry)}
+		ret.max = [2]float64{math.Max(ret.max[0], rx), math.Max(ret.max[1], ry)}
+	}
+	return ret
+}
+
+func (b labelBox) overlaps(minX, minY, maxX, maxY float64) bool {
+	return b.min[0] < maxX && b.max[0] > minX && b.min[1] < maxY && b.max[1] > minY
+}
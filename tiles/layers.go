@@ -2,92 +2,69 @@ package tiles
 
 type Layer = int
 
+// layers in the z-order from the bottom, features are drawn in the order of their layers first
 const (
 	LayerBackground = Layer(0x00000000)
 	LayerNature     = Layer(0x000000F0)
 	LayerLanduse    = Layer(0x00000F00)
 	LayerPlace      = Layer(0x0000F000)
 	LayerAmenity    = Layer(0x000F0000)
-	LayerRoad       = Layer(0x000FF000)
 	LayerBuilding   = Layer(0x00F00000)
-	LayerRoute      = Layer(0x0F000000)
-	LayerBorder     = Layer(0x0F000000)
+	LayerRoad       = Layer(0x0F000000)
+	LayerRoute      = Layer(0x1F000000)
+	LayerBorder     = Layer(0x2F000000)
 	LayerAero       = Layer(0xF0000000)
 	LayerLabel      = Layer(0xFFFFFF00)
 	LayerWatermark  = Layer(0xFFFFFFFF)
 )
 
-//// true: z-order 아래로, false: z-order 위로
-func LayerCompareOrder(lo Object, ro Object) bool {
-	if label, ok := lo.(*Label); ok {
-		switch other := ro.(type) {
-		default:
-			return false
-		case *Label:
-			return label.Layer() < other.Layer()
-		}
-	} else if obj, ok := lo.(*PolygonObject); ok {
-		switch other := ro.(type) {
-		case *Label:
-			return true // true: z-order 아래로,   false: z-order 위로
-		case *PolygonObject:
-			if (obj.layer < LayerPlace || other.layer < LayerPlace) && obj.Layer() != other.Layer() {
-				return obj.Layer() < other.Layer()
-			}
+// FeatureClass orders the features of the same layer and level, areas are below the lines
+type FeatureClass int
 
-			if obj.fillColor != nil && other.fillColor != nil {
-				return obj.Area() > other.Area()
-			} else if obj.fillColor != nil {
-				return true // true: z-order 아래로,   false: z-order 위로
-			} else {
-				return false // true: z-order 아래로,   false: z-order 위로
-			}
-		case *MultiPolygonObject:
-			if (obj.layer < LayerPlace || other.layer < LayerPlace) && obj.Layer() != other.Layer() {
-				return obj.Layer() < other.Layer()
-			}
+const (
+	FeatureArea FeatureClass = iota
+	FeatureCasing
+	FeatureLine
+	FeaturePoint
+)
 
-			if obj.fillColor != nil && other.fillColor != nil {
-				return obj.Area() > other.Area()
-			} else if obj.fillColor != nil {
-				return true // true: z-order 아래로,   false: z-order 위로
-			} else {
-				return false // true: z-order 아래로,   false: z-order 위로
-			}
-		default:
-			return obj.Layer() < other.Layer()
-		}
-	} else if obj, ok := lo.(*MultiPolygonObject); ok {
-		switch other := ro.(type) {
-		case *Label:
-			return true // true: z-order 아래로,   false: z-order 위로
-		case *PolygonObject:
-			if (obj.layer < LayerPlace || other.layer < LayerPlace) && obj.Layer() != other.Layer() {
-				return obj.Layer() < other.Layer()
-			}
+// SortKey is the z-order of an object, objects are drawn from the lowest key.
+// Objects are ordered by the layer of the style, the level of the OSM layer tag, the feature class
+// and then the area; the larger area is drawn below.
+type SortKey struct {
+	Layer Layer
+	Level int
+	Class FeatureClass
+	Area  float64
+}
 
-			if obj.fillColor != nil && other.fillColor != nil {
-				return obj.Area() > other.Area()
-			} else if obj.fillColor != nil {
-				return true // true: z-order 아래로,   false: z-order 위로
-			} else {
-				return false // true: z-order 아래로,   false: z-order 위로
-			}
-		case *MultiPolygonObject:
-			if (obj.layer < LayerPlace || other.layer < LayerPlace) && obj.Layer() != other.Layer() {
-				return obj.Layer() < other.Layer()
-			}
+func (k SortKey) Less(o SortKey) bool {
+	if k.Layer != o.Layer {
+		return k.Layer < o.Layer
+	}
+	if k.Level != o.Level {
+		return k.Level < o.Level
+	}
+	if k.Class != o.Class {
+		return k.Class < o.Class
+	}
+	return k.Area > o.Area
+}
+
+// SortKeyer is implemented by the objects that are ordered by more than their layers
+type SortKeyer interface {
+	SortKey() SortKey
+}
 
-			if obj.fillColor != nil && other.fillColor != nil {
-				return obj.Area() > other.Area()
-			} else if obj.fillColor != nil {
-				return true // true: z-order 아래로,   false: z-order 위로
-			} else {
-				return false // true: z-order 아래로,   false: z-order 위로
-			}
-		default:
-			return obj.Layer() < other.Layer()
-		}
+// SortKeyOf returns the z-order of the object, the key of an object that is not a SortKeyer is its layer
+func SortKeyOf(obj Object) SortKey {
+	if sk, ok := obj.(SortKeyer); ok {
+		return sk.SortKey()
 	}
-	return false
+	return SortKey{Layer: obj.Layer(), Class: FeaturePoint}
+}
+
+//// true: z-order 아래로, false: z-order 위로
+func LayerCompareOrder(lo Object, ro Object) bool {
+	return SortKeyOf(lo).Less(SortKeyOf(ro))
 }
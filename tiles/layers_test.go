@@ -0,0 +1,34 @@
+package tiles_test
+
+import (
+	"sort"
+	"testing"
+
+	"github.com/OutOfBedlam/ots/tiles"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLayerOrder(t *testing.T) {
+	layers := []tiles.Layer{
+		tiles.LayerBackground, tiles.LayerNature, tiles.LayerLanduse, tiles.LayerPlace, tiles.LayerAmenity,
+		tiles.LayerBuilding, tiles.LayerRoad, tiles.LayerRoute, tiles.LayerBorder, tiles.LayerAero,
+		tiles.LayerLabel, tiles.LayerWatermark,
+	}
+	for i := 1; i < len(layers); i++ {
+		assert.Less(t, layers[i-1], layers[i])
+	}
+
+	park := tiles.SortKey{Layer: tiles.LayerLanduse, Class: tiles.FeatureArea, Area: 10}
+	pond := tiles.SortKey{Layer: tiles.LayerLanduse, Class: tiles.FeatureArea, Area: 1}
+	casing := tiles.SortKey{Layer: tiles.LayerRoad, Class: tiles.FeatureCasing}
+	road := tiles.SortKey{Layer: tiles.LayerRoad, Class: tiles.FeatureLine}
+	bridgeCasing := tiles.SortKey{Layer: tiles.LayerRoad, Level: 1, Class: tiles.FeatureCasing}
+	bridge := tiles.SortKey{Layer: tiles.LayerRoad, Level: 1, Class: tiles.FeatureLine}
+	tunnel := tiles.SortKey{Layer: tiles.LayerRoad, Level: -1, Class: tiles.FeatureLine}
+	building := tiles.SortKey{Layer: tiles.LayerBuilding, Level: 2, Class: tiles.FeatureArea, Area: 5}
+	label := tiles.SortKey{Layer: tiles.LayerLabel, Class: tiles.FeaturePoint}
+
+	keys := []tiles.SortKey{label, bridge, road, building, pond, tunnel, bridgeCasing, casing, park}
+	sort.SliceStable(keys, func(i, j int) bool { return keys[i].Less(keys[j]) })
+	assert.Equal(t, []tiles.SortKey{park, pond, building, tunnel, casing, road, bridgeCasing, bridge, label}, keys)
+}
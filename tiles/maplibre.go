@@ -0,0 +1,1026 @@
+package tiles
+
+import (
+	"encoding/json"
+	"fmt"
+	"image/color"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/image/colornames"
+)
+
+// mapLibreStyle is the subset of MapLibre (Mapbox GL) style spec
+type mapLibreStyle struct {
+	Version int              `json:"version"`
+	Name    string           `json:"name"`
+	Layers  []*mapLibreLayer `json:"layers"`
+}
+
+type mapLibreLayer struct {
+	Id          string         `json:"id"`
+	Type        string         `json:"type"`
+	SourceLayer string         `json:"source-layer"`
+	Filter      any            `json:"filter"`
+	MinZoom     *float64       `json:"minzoom"`
+	MaxZoom     *float64       `json:"maxzoom"`
+	Layout      map[string]any `json:"layout"`
+	Paint       map[string]any `json:"paint"`
+}
+
+// isMapLibreStyle returns true if the json content is a MapLibre style, not a StyleSheet
+func isMapLibreStyle(content []byte) bool {
+	probe := struct {
+		Layers json.RawMessage `json:"layers"`
+	}{}
+	return json.Unmarshal(content, &probe) == nil && len(probe.Layers) > 0
+}
+
+// LoadMapLibreStyle imports a MapLibre style json file as a StyleSheet,
+// the name of the style sheet is the file name as the names of MapLibre styles are for display.
+//
+// The supported subset is
+//
+//	layers     fill, line, symbol (icon-image, text-size and bold of text-font, text is drawn by the built-in labels) and background
+//	filter     legacy filters and expressions over osm tags, "$type" and ["geometry-type"] are "Polygon" for closed ways
+//	source-layer  the layer names of the vector tiles of ots (water, landuse, roads, ...), other names are ignored
+//	properties constants, zoom functions ({"stops": ...}) and expressions ("interpolate", "step", "match", "case", ...)
+//
+// Layers are drawn in the order of the style within the category of their source-layer,
+// other layer types (raster, circle, fill-extrusion, ...) and unsupported properties are ignored.
+func LoadMapLibreStyle(path string) (*StyleSheet, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	ml := &mapLibreStyle{}
+	if err := json.Unmarshal(content, ml); err != nil {
+		return nil, errors.Wrap(err, path)
+	}
+
+	ss := &StyleSheet{
+		Name: strings.TrimSuffix(filepath.Base(path), filepath.Ext(path)),
+		Base: "none",
+		// layers have zoom ranges and properties of zoom functions
+		zoomDependent: true,
+	}
+	if !styleSheetNameRegexp.MatchString(ss.Name) {
+		return nil, errors.Errorf("invalid style name %q of %s", ss.Name, path)
+	}
+	for i, l := range ml.Layers {
+		if v, ok := l.Layout["visibility"]; ok && v == "none" {
+			continue
+		}
+		if l.Type == "background" {
+			bg, err := compileMapLibreColor(l.Paint, "background-color", "background-opacity")
+			if err != nil {
+				return nil, errors.Wrapf(err, "%s layer %q", path, l.Id)
+			}
+			if bg != nil {
+				ss.background = func(zoom int) color.Color { return bg(&StyleParam{Zoom: zoom}) }
+			}
+			continue
+		}
+		rule, err := compileMapLibreLayer(l, i)
+		if err != nil {
+			return nil, errors.Wrapf(err, "%s layer %q", path, l.Id)
+		}
+		if rule != nil {
+			ss.Rules = append(ss.Rules, rule)
+		}
+	}
+	return ss, nil
+}
+
+// source-layer names to the categories of Layer, names of OpenMapTiles are included for the base layers
+var mapLibreSourceLayers = map[string]Layer{
+	VectorLayerWater:    LayerNature,
+	VectorLayerLanduse:  LayerLanduse,
+	VectorLayerPlace:    LayerPlace,
+	VectorLayerAmenity:  LayerAmenity,
+	VectorLayerRoads:    LayerRoad,
+	VectorLayerRailway:  LayerRoad,
+	VectorLayerBuilding: LayerBuilding,
+	VectorLayerRoute:    LayerRoute,
+	VectorLayerBoundary: LayerBorder,
+	VectorLayerPower:    LayerBorder,
+	VectorLayerPoi:      LayerAmenity,
+	VectorLayerOther:    LayerLanduse,
+	"waterway":          LayerNature,
+	"landcover":         LayerNature,
+	"park":              LayerLanduse,
+	"transportation":    LayerRoad,
+	"building":          LayerBuilding,
+	"aeroway":           LayerAero,
+}
+
+// compileMapLibreLayer returns the rule of the layer, nil if the layer type is not supported.
+// order is the index of the layer in the style.
+func compileMapLibreLayer(l *mapLibreLayer, order int) (*StyleRule, error) {
+	layer, ok := mapLibreSourceLayers[l.SourceLayer]
+	if !ok {
+		layer = LayerLanduse
+		if l.Type == "line" {
+			layer = LayerRoad
+		}
+	}
+	layer += Layer(order)
+
+	filter, err := compileMapLibreFilter(l.Filter)
+	if err != nil {
+		return nil, errors.Wrap(err, "filter")
+	}
+	minZoom, maxZoom := math.Inf(-1), math.Inf(1)
+	if l.MinZoom != nil {
+		minZoom = *l.MinZoom
+	}
+	if l.MaxZoom != nil {
+		maxZoom = *l.MaxZoom
+	}
+	// features are selected by the layers of the vector tiles of ots, the layers of other schemas are ignored
+	sourceLayer := ""
+	if _, ok := mapLibreSourceLayers[l.SourceLayer]; ok && !isOpenMapTilesLayer(l.SourceLayer) {
+		sourceLayer = l.SourceLayer
+	}
+	polygonOnly := l.Type == "fill"
+
+	rule := &StyleRule{Selector: l.Id}
+	rule.filter = func(p *StyleParam) bool {
+		// maxzoom is exclusive
+		if z := float64(p.Zoom); z < minZoom || z >= maxZoom {
+			return false
+		}
+		if polygonOnly && !p.Closed {
+			return false
+		}
+		if len(sourceLayer) > 0 && !inVectorLayer(p, sourceLayer) {
+			return false
+		}
+		return filter(p)
+	}
+
+	switch l.Type {
+	case "fill":
+		fill, err := compileMapLibreColor(l.Paint, "fill-color", "fill-opacity")
+		if err != nil {
+			return nil, err
+		}
+		outline, err := compileMapLibreColor(l.Paint, "fill-outline-color", "fill-opacity")
+		if err != nil {
+			return nil, err
+		}
+		if fill == nil {
+			fill = func(*StyleParam) color.Color { return color.Black }
+		}
+		rule.paint = func(style *Style, p *StyleParam) {
+			style.FillColor = fill(p)
+			if outline != nil {
+				style.LineColor = outline(p)
+			}
+			style.BaseLayer = layer
+		}
+	case "line":
+		line, err := compileMapLibreColor(l.Paint, "line-color", "line-opacity")
+		if err != nil {
+			return nil, err
+		}
+		if line == nil {
+			line = func(*StyleParam) color.Color { return color.Black }
+		}
+		width, err := compileMapLibreNumber(l.Paint, "line-width", 1)
+		if err != nil {
+			return nil, err
+		}
+		dash, err := compileMapLibreExpr(l.Paint["line-dasharray"])
+		if err != nil {
+			return nil, errors.Wrap(err, "line-dasharray")
+		}
+		rule.paint = func(style *Style, p *StyleParam) {
+			style.LineColor = line(p)
+			style.LineWidth = width(p)
+			style.LineDash = nil
+			// dash lengths are in line widths
+			if arr, ok := dash(p).([]any); ok {
+				for _, v := range arr {
+					if f, ok := mapLibreToNumber(v); ok {
+						style.LineDash = append(style.LineDash, f*style.LineWidth)
+					}
+				}
+			}
+			style.BaseLayer = layer
+		}
+	case "symbol":
+		icon, err := compileMapLibreExpr(l.Layout["icon-image"])
+		if err != nil {
+			return nil, errors.Wrap(err, "icon-image")
+		}
+		iconColor, err := compileMapLibreColor(l.Paint, "icon-color", "icon-opacity")
+		if err != nil {
+			return nil, err
+		}
+		_, hasTextSize := l.Layout["text-size"]
+		textSize, err := compileMapLibreNumber(l.Layout, "text-size", 0)
+		if err != nil {
+			return nil, err
+		}
+		textBold := false
+		if fonts, ok := l.Layout["text-font"].([]any); ok {
+			for _, f := range fonts {
+				if name, ok := f.(string); ok && strings.Contains(strings.ToLower(name), "bold") {
+					textBold = true
+				}
+			}
+		}
+		rule.paint = func(style *Style, p *StyleParam) {
+			if hasTextSize {
+				style.FontSize = textSize(p)
+			}
+			if textBold {
+				style.FontWeight = FontWeightBold
+			}
+			name, ok := icon(p).(string)
+			if !ok {
+				return
+			}
+			if marker, ok := mapLibreIcon(name, p.Tags); ok {
+				style.Marker = marker
+				if iconColor != nil {
+					style.MarkerColor = iconColor(p)
+				}
+			}
+		}
+	default:
+		return nil, nil
+	}
+	return rule, nil
+}
+
+func isOpenMapTilesLayer(name string) bool {
+	switch name {
+	case "waterway", "landcover", "park", "transportation", "building", "aeroway":
+		return true
+	}
+	return false
+}
+
+// inVectorLayer returns true if the feature is in the vector tile layer,
+// nodes are in "place" or "poi" and the other features that do not belong to any layer are in "other".
+func inVectorLayer(p *StyleParam, name string) bool {
+	if p.Point {
+		return VectorLayerOfNode(p.Tags) == name
+	}
+	layer := VectorLayerFromTags(p.Tags)
+	if len(layer) == 0 {
+		return name == VectorLayerOther
+	}
+	return layer == name
+}
+
+var mapLibreIconToken = regexp.MustCompile(`\{([^}]+)\}`)
+var mapLibreIconSuffix = regexp.MustCompile(`[-_]\d+$`)
+
+// mapLibreIcon returns the icon of the sprite name, tokens like "{amenity}" are replaced with the tags
+// and size suffixes of sprites like "school_11" are ignored.
+func mapLibreIcon(name string, tags map[string]string) (Icon, bool) {
+	name = mapLibreIconToken.ReplaceAllStringFunc(name, func(tok string) string {
+		return tags[tok[1:len(tok)-1]]
+	})
+	if icon, ok := IconByName(name); ok {
+		return icon, true
+	}
+	return IconByName(mapLibreIconSuffix.ReplaceAllString(name, ""))
+}
+
+// mapLibreExpr evaluates a property or a filter of MapLibre style for the feature
+type mapLibreExpr func(p *StyleParam) any
+
+func compileMapLibreNumber(props map[string]any, name string, defaultValue float64) (func(p *StyleParam) float64, error) {
+	v, ok := props[name]
+	if !ok {
+		return func(*StyleParam) float64 { return defaultValue }, nil
+	}
+	expr, err := compileMapLibreExpr(v)
+	if err != nil {
+		return nil, errors.Wrap(err, name)
+	}
+	return func(p *StyleParam) float64 {
+		if f, ok := mapLibreToNumber(expr(p)); ok {
+			return f
+		}
+		return defaultValue
+	}, nil
+}
+
+// compileMapLibreColor returns nil if the color property is not specified
+func compileMapLibreColor(props map[string]any, name string, opacityName string) (func(p *StyleParam) color.Color, error) {
+	v, ok := props[name]
+	if !ok {
+		return nil, nil
+	}
+	if s, ok := v.(string); ok {
+		if _, err := parseMapLibreColor(s); err != nil {
+			return nil, errors.Wrap(err, name)
+		}
+	}
+	expr, err := compileMapLibreExpr(v)
+	if err != nil {
+		return nil, errors.Wrap(err, name)
+	}
+	opacity, err := compileMapLibreNumber(props, opacityName, 1)
+	if err != nil {
+		return nil, err
+	}
+	return func(p *StyleParam) color.Color {
+		c, ok := mapLibreToColor(expr(p))
+		if !ok {
+			return nil
+		}
+		if op := opacity(p); op < 1 {
+			c.A = uint8(math.Max(0, float64(c.A)*op))
+		}
+		return c
+	}, nil
+}
+
+// compileMapLibreFilter compiles the legacy filters and the expressions
+func compileMapLibreFilter(v any) (func(p *StyleParam) bool, error) {
+	if v == nil {
+		return func(*StyleParam) bool { return true }, nil
+	}
+	arr, ok := v.([]any)
+	if !ok || len(arr) == 0 {
+		expr, err := compileMapLibreExpr(v)
+		if err != nil {
+			return nil, err
+		}
+		return func(p *StyleParam) bool { return mapLibreTruthy(expr(p)) }, nil
+	}
+	op, _ := arr[0].(string)
+	switch op {
+	case "all", "any", "none":
+		subs := make([]func(p *StyleParam) bool, len(arr)-1)
+		for i, a := range arr[1:] {
+			sub, err := compileMapLibreFilter(a)
+			if err != nil {
+				return nil, err
+			}
+			subs[i] = sub
+		}
+		return func(p *StyleParam) bool {
+			for _, sub := range subs {
+				ok := sub(p)
+				if op == "all" && !ok {
+					return false
+				} else if op != "all" && ok {
+					return op == "any"
+				}
+			}
+			return op != "any"
+		}, nil
+	case "!":
+		if len(arr) != 2 {
+			return nil, errors.New("'!' takes one argument")
+		}
+		sub, err := compileMapLibreFilter(arr[1])
+		if err != nil {
+			return nil, err
+		}
+		return func(p *StyleParam) bool { return !sub(p) }, nil
+	}
+	// legacy filters have the key as the first argument
+	if key, ok := mapLibreLegacyKey(arr); ok {
+		return compileMapLibreLegacyFilter(op, key, arr[2:])
+	}
+	expr, err := compileMapLibreExpr(v)
+	if err != nil {
+		return nil, err
+	}
+	return func(p *StyleParam) bool { return mapLibreTruthy(expr(p)) }, nil
+}
+
+func mapLibreLegacyKey(arr []any) (string, bool) {
+	if len(arr) < 2 {
+		return "", false
+	}
+	switch arr[0] {
+	case "==", "!=", "<", "<=", ">", ">=", "in", "!in", "has", "!has":
+		key, ok := arr[1].(string)
+		return key, ok
+	}
+	return "", false
+}
+
+func compileMapLibreLegacyFilter(op string, key string, values []any) (func(p *StyleParam) bool, error) {
+	get := func(p *StyleParam) any {
+		if key == "$type" {
+			return mapLibreGeometryType(p)
+		}
+		if v, ok := p.Tags[key]; ok {
+			return v
+		}
+		return nil
+	}
+	switch op {
+	case "has", "!has":
+		return func(p *StyleParam) bool { return (get(p) != nil) == (op == "has") }, nil
+	case "in", "!in":
+		return func(p *StyleParam) bool {
+			v := get(p)
+			for _, want := range values {
+				if mapLibreEqual(v, want) {
+					return op == "in"
+				}
+			}
+			return op == "!in"
+		}, nil
+	}
+	if len(values) != 1 {
+		return nil, errors.Errorf("%q takes a key and a value", op)
+	}
+	want := values[0]
+	return func(p *StyleParam) bool {
+		return mapLibreCompare(op, get(p), want)
+	}, nil
+}
+
+func mapLibreGeometryType(p *StyleParam) string {
+	if p.Closed {
+		return "Polygon"
+	}
+	return "LineString"
+}
+
+// compileMapLibreExpr compiles a constant, a zoom function or an expression
+func compileMapLibreExpr(v any) (mapLibreExpr, error) {
+	switch val := v.(type) {
+	case map[string]any:
+		return compileMapLibreFunction(val)
+	case []any:
+		if len(val) == 0 {
+			return func(*StyleParam) any { return val }, nil
+		}
+		op, ok := val[0].(string)
+		if !ok {
+			// array of constants, eg) line-dasharray
+			return func(*StyleParam) any { return val }, nil
+		}
+		return compileMapLibreOp(op, val[1:])
+	default:
+		return func(*StyleParam) any { return val }, nil
+	}
+}
+
+func compileMapLibreArgs(args []any) ([]mapLibreExpr, error) {
+	ret := make([]mapLibreExpr, len(args))
+	for i, a := range args {
+		e, err := compileMapLibreExpr(a)
+		if err != nil {
+			return nil, err
+		}
+		ret[i] = e
+	}
+	return ret, nil
+}
+
+func compileMapLibreOp(op string, args []any) (mapLibreExpr, error) {
+	switch op {
+	case "literal":
+		if len(args) != 1 {
+			return nil, errors.New("'literal' takes one argument")
+		}
+		return func(*StyleParam) any { return args[0] }, nil
+	case "zoom":
+		return func(p *StyleParam) any { return float64(p.Zoom) }, nil
+	case "geometry-type":
+		return func(p *StyleParam) any { return mapLibreGeometryType(p) }, nil
+	case "get", "has":
+		if len(args) != 1 {
+			return nil, errors.Errorf("%q takes one argument", op)
+		}
+		key, ok := args[0].(string)
+		if !ok {
+			return nil, errors.Errorf("%q takes a key", op)
+		}
+		return func(p *StyleParam) any {
+			v, ok := p.Tags[key]
+			if op == "has" {
+				return ok
+			} else if !ok {
+				return nil
+			}
+			return v
+		}, nil
+	case "interpolate":
+		return compileMapLibreInterpolate(args)
+	case "step":
+		return compileMapLibreStep(args)
+	case "match":
+		return compileMapLibreMatch(args)
+	}
+
+	exprs, err := compileMapLibreArgs(args)
+	if err != nil {
+		return nil, err
+	}
+	switch op {
+	case "==", "!=", "<", "<=", ">", ">=":
+		if len(exprs) != 2 {
+			return nil, errors.Errorf("%q takes two arguments", op)
+		}
+		return func(p *StyleParam) any { return mapLibreCompare(op, exprs[0](p), exprs[1](p)) }, nil
+	case "!":
+		if len(exprs) != 1 {
+			return nil, errors.New("'!' takes one argument")
+		}
+		return func(p *StyleParam) any { return !mapLibreTruthy(exprs[0](p)) }, nil
+	case "all":
+		return func(p *StyleParam) any {
+			for _, e := range exprs {
+				if !mapLibreTruthy(e(p)) {
+					return false
+				}
+			}
+			return true
+		}, nil
+	case "any":
+		return func(p *StyleParam) any {
+			for _, e := range exprs {
+				if mapLibreTruthy(e(p)) {
+					return true
+				}
+			}
+			return false
+		}, nil
+	case "in":
+		if len(exprs) != 2 {
+			return nil, errors.New("'in' takes two arguments")
+		}
+		return func(p *StyleParam) any {
+			needle := exprs[0](p)
+			switch haystack := exprs[1](p).(type) {
+			case []any:
+				for _, v := range haystack {
+					if mapLibreEqual(needle, v) {
+						return true
+					}
+				}
+			case string:
+				s, ok := needle.(string)
+				return ok && strings.Contains(haystack, s)
+			}
+			return false
+		}, nil
+	case "case":
+		if len(exprs) < 3 || len(exprs)%2 != 1 {
+			return nil, errors.New("'case' takes pairs of condition and output, and a fallback")
+		}
+		return func(p *StyleParam) any {
+			for i := 0; i+1 < len(exprs); i += 2 {
+				if mapLibreTruthy(exprs[i](p)) {
+					return exprs[i+1](p)
+				}
+			}
+			return exprs[len(exprs)-1](p)
+		}, nil
+	case "coalesce":
+		return func(p *StyleParam) any {
+			for _, e := range exprs {
+				if v := e(p); v != nil {
+					return v
+				}
+			}
+			return nil
+		}, nil
+	case "concat":
+		return func(p *StyleParam) any {
+			sb := &strings.Builder{}
+			for _, e := range exprs {
+				sb.WriteString(mapLibreToString(e(p)))
+			}
+			return sb.String()
+		}, nil
+	case "to-string":
+		if len(exprs) != 1 {
+			return nil, errors.New("'to-string' takes one argument")
+		}
+		return func(p *StyleParam) any { return mapLibreToString(exprs[0](p)) }, nil
+	case "to-number":
+		if len(exprs) == 0 {
+			return nil, errors.New("'to-number' takes arguments")
+		}
+		return func(p *StyleParam) any {
+			for _, e := range exprs {
+				if f, ok := mapLibreToNumber(e(p)); ok {
+					return f
+				}
+			}
+			return nil
+		}, nil
+	}
+	return nil, errors.Errorf("unsupported expression %q", op)
+}
+
+// ["match", input, label(s), output, ..., fallback]
+func compileMapLibreMatch(args []any) (mapLibreExpr, error) {
+	if len(args) < 4 || len(args)%2 != 0 {
+		return nil, errors.New("'match' takes an input, pairs of labels and output, and a fallback")
+	}
+	input, err := compileMapLibreExpr(args[0])
+	if err != nil {
+		return nil, err
+	}
+	outputs, err := compileMapLibreArgs(args[2:])
+	if err != nil {
+		return nil, err
+	}
+	labels := make([][]any, 0)
+	for i := 1; i < len(args)-1; i += 2 {
+		if arr, ok := args[i].([]any); ok {
+			labels = append(labels, arr)
+		} else {
+			labels = append(labels, []any{args[i]})
+		}
+	}
+	return func(p *StyleParam) any {
+		v := input(p)
+		for i, ls := range labels {
+			for _, l := range ls {
+				if mapLibreEqual(v, l) {
+					return outputs[i*2](p)
+				}
+			}
+		}
+		return outputs[len(outputs)-1](p)
+	}, nil
+}
+
+type mapLibreStop struct {
+	input  float64
+	output mapLibreExpr
+}
+
+func compileMapLibreStops(args []any) ([]mapLibreStop, error) {
+	if len(args) == 0 || len(args)%2 != 0 {
+		return nil, errors.New("stops should be pairs of input and output")
+	}
+	stops := make([]mapLibreStop, 0, len(args)/2)
+	for i := 0; i < len(args); i += 2 {
+		in, ok := args[i].(float64)
+		if !ok {
+			return nil, errors.New("input of stops should be a number")
+		}
+		out, err := compileMapLibreExpr(args[i+1])
+		if err != nil {
+			return nil, err
+		}
+		stops = append(stops, mapLibreStop{input: in, output: out})
+	}
+	return stops, nil
+}
+
+// ["interpolate", ["linear"] | ["exponential", base], input, stop_input_1, stop_output_1, ...]
+func compileMapLibreInterpolate(args []any) (mapLibreExpr, error) {
+	if len(args) < 4 {
+		return nil, errors.New("'interpolate' takes an interpolation type, an input and stops")
+	}
+	base := 1.0
+	if typ, ok := args[0].([]any); ok && len(typ) > 0 {
+		switch typ[0] {
+		case "linear":
+		case "exponential":
+			if len(typ) != 2 {
+				return nil, errors.New("'exponential' takes a base")
+			}
+			if base, ok = typ[1].(float64); !ok {
+				return nil, errors.New("base of 'exponential' should be a number")
+			}
+		default:
+			return nil, errors.Errorf("unsupported interpolation %v", typ[0])
+		}
+	} else {
+		return nil, errors.New("invalid interpolation type")
+	}
+	input, err := compileMapLibreExpr(args[1])
+	if err != nil {
+		return nil, err
+	}
+	stops, err := compileMapLibreStops(args[2:])
+	if err != nil {
+		return nil, err
+	}
+	return func(p *StyleParam) any {
+		x, _ := mapLibreToNumber(input(p))
+		return mapLibreInterpolate(stops, base, x, p)
+	}, nil
+}
+
+// ["step", input, output_0, stop_input_1, stop_output_1, ...]
+func compileMapLibreStep(args []any) (mapLibreExpr, error) {
+	if len(args) < 2 || len(args)%2 != 0 {
+		return nil, errors.New("'step' takes an input, a default output and stops")
+	}
+	input, err := compileMapLibreExpr(args[0])
+	if err != nil {
+		return nil, err
+	}
+	first, err := compileMapLibreExpr(args[1])
+	if err != nil {
+		return nil, err
+	}
+	stops := []mapLibreStop{{input: math.Inf(-1), output: first}}
+	if len(args) > 2 {
+		more, err := compileMapLibreStops(args[2:])
+		if err != nil {
+			return nil, err
+		}
+		stops = append(stops, more...)
+	}
+	return func(p *StyleParam) any {
+		x, _ := mapLibreToNumber(input(p))
+		return mapLibreStep(stops, x, p)
+	}, nil
+}
+
+// compileMapLibreFunction compiles the legacy functions, {"base": 1.2, "stops": [[12, 1], [18, 6]]},
+// the functions of a property are categorical.
+func compileMapLibreFunction(fn map[string]any) (mapLibreExpr, error) {
+	rawStops, ok := fn["stops"].([]any)
+	if !ok {
+		return nil, errors.New("function without stops")
+	}
+	if property, ok := fn["property"].(string); ok {
+		return compileMapLibreCategorical(property, rawStops, fn["default"])
+	}
+	args := make([]any, 0, len(rawStops)*2)
+	for _, s := range rawStops {
+		pair, ok := s.([]any)
+		if !ok || len(pair) != 2 {
+			return nil, errors.New("stop should be [input, output]")
+		}
+		args = append(args, pair...)
+	}
+	stops, err := compileMapLibreStops(args)
+	if err != nil {
+		return nil, err
+	}
+	base := 1.0
+	if b, ok := fn["base"].(float64); ok {
+		base = b
+	}
+	interval := fn["type"] == "interval"
+	return func(p *StyleParam) any {
+		if interval {
+			return mapLibreStep(stops, float64(p.Zoom), p)
+		}
+		return mapLibreInterpolate(stops, base, float64(p.Zoom), p)
+	}, nil
+}
+
+func compileMapLibreCategorical(property string, rawStops []any, defaultValue any) (mapLibreExpr, error) {
+	args := []any{[]any{"get", property}}
+	for _, s := range rawStops {
+		pair, ok := s.([]any)
+		if !ok || len(pair) != 2 {
+			return nil, errors.New("stop should be [input, output]")
+		}
+		args = append(args, pair[0], pair[1])
+	}
+	return compileMapLibreMatch(append(args, defaultValue))
+}
+
+func mapLibreStep(stops []mapLibreStop, x float64, p *StyleParam) any {
+	i := 0
+	for i+1 < len(stops) && stops[i+1].input <= x {
+		i++
+	}
+	return stops[i].output(p)
+}
+
+// mapLibreInterpolate interpolates numbers and colors, other values are stepped
+func mapLibreInterpolate(stops []mapLibreStop, base float64, x float64, p *StyleParam) any {
+	if x <= stops[0].input {
+		return stops[0].output(p)
+	}
+	last := stops[len(stops)-1]
+	if x >= last.input {
+		return last.output(p)
+	}
+	i := 0
+	for stops[i+1].input <= x {
+		i++
+	}
+	lo, hi := stops[i], stops[i+1]
+	t := (x - lo.input) / (hi.input - lo.input)
+	if base != 1 {
+		t = (math.Pow(base, x-lo.input) - 1) / (math.Pow(base, hi.input-lo.input) - 1)
+	}
+	v0, v1 := lo.output(p), hi.output(p)
+	if f0, ok := v0.(float64); ok {
+		if f1, ok := v1.(float64); ok {
+			return f0 + (f1-f0)*t
+		}
+	}
+	if c0, ok := mapLibreToColor(v0); ok {
+		if c1, ok := mapLibreToColor(v1); ok {
+			mix := func(a, b uint8) uint8 { return uint8(math.Round(float64(a) + (float64(b)-float64(a))*t)) }
+			return color.NRGBA{R: mix(c0.R, c1.R), G: mix(c0.G, c1.G), B: mix(c0.B, c1.B), A: mix(c0.A, c1.A)}
+		}
+	}
+	return v0
+}
+
+func mapLibreTruthy(v any) bool {
+	switch val := v.(type) {
+	case nil:
+		return false
+	case bool:
+		return val
+	case float64:
+		return val != 0
+	case string:
+		return len(val) > 0
+	}
+	return true
+}
+
+func mapLibreToNumber(v any) (float64, bool) {
+	switch val := v.(type) {
+	case float64:
+		return val, true
+	case bool:
+		if val {
+			return 1, true
+		}
+		return 0, true
+	case string:
+		f, err := strconv.ParseFloat(strings.TrimSpace(val), 64)
+		return f, err == nil
+	}
+	return 0, false
+}
+
+func mapLibreToString(v any) string {
+	switch val := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return val
+	case float64:
+		return strconv.FormatFloat(val, 'f', -1, 64)
+	}
+	return fmt.Sprintf("%v", v)
+}
+
+func mapLibreToColor(v any) (color.NRGBA, bool) {
+	switch val := v.(type) {
+	case color.NRGBA:
+		return val, true
+	case string:
+		c, err := parseMapLibreColor(val)
+		return c, err == nil
+	}
+	return color.NRGBA{}, false
+}
+
+// mapLibreEqual compares the values, osm tags are strings so that numbers are compared with the tag values as numbers
+func mapLibreEqual(a, b any) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	if sa, ok := a.(string); ok {
+		if sb, ok := b.(string); ok {
+			return sa == sb
+		}
+	}
+	if fa, ok := mapLibreToNumber(a); ok {
+		if fb, ok := mapLibreToNumber(b); ok {
+			return fa == fb
+		}
+	}
+	return a == b
+}
+
+func mapLibreCompare(op string, a, b any) bool {
+	switch op {
+	case "==":
+		return mapLibreEqual(a, b)
+	case "!=":
+		return !mapLibreEqual(a, b)
+	}
+	var cmp int
+	sa, okA := a.(string)
+	sb, okB := b.(string)
+	if okA && okB {
+		cmp = strings.Compare(sa, sb)
+	} else {
+		fa, okA := mapLibreToNumber(a)
+		fb, okB := mapLibreToNumber(b)
+		if !okA || !okB {
+			return false
+		}
+		if fa < fb {
+			cmp = -1
+		} else if fa > fb {
+			cmp = 1
+		}
+	}
+	switch op {
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	case ">":
+		return cmp > 0
+	case ">=":
+		return cmp >= 0
+	}
+	return false
+}
+
+var mapLibreColorFunc = regexp.MustCompile(`^(rgba?|hsla?)\(([^)]*)\)$`)
+
+// parseMapLibreColor parses css colors; "#rgb", "#rrggbb", "rgb()", "rgba()", "hsl()", "hsla()" and the names
+func parseMapLibreColor(str string) (color.NRGBA, error) {
+	str = strings.ToLower(strings.TrimSpace(str))
+	if strings.HasPrefix(str, "#") {
+		hex := str[1:]
+		if len(hex) == 3 || len(hex) == 4 {
+			expanded := make([]byte, 0, len(hex)*2)
+			for i := range hex {
+				expanded = append(expanded, hex[i], hex[i])
+			}
+			hex = string(expanded)
+		}
+		if len(hex) == 6 {
+			hex += "ff"
+		}
+		v, err := strconv.ParseUint(hex, 16, 32)
+		if len(hex) != 8 || err != nil {
+			return color.NRGBA{}, errors.Errorf("invalid color %q", str)
+		}
+		return color.NRGBA{R: uint8(v >> 24), G: uint8(v >> 16), B: uint8(v >> 8), A: uint8(v)}, nil
+	}
+	if m := mapLibreColorFunc.FindStringSubmatch(str); m != nil {
+		args := strings.Split(m[2], ",")
+		if len(args) != 3 && len(args) != 4 {
+			return color.NRGBA{}, errors.Errorf("invalid color %q", str)
+		}
+		vals := make([]float64, len(args))
+		for i, a := range args {
+			f, err := strconv.ParseFloat(strings.TrimSuffix(strings.TrimSpace(a), "%"), 64)
+			if err != nil {
+				return color.NRGBA{}, errors.Errorf("invalid color %q", str)
+			}
+			vals[i] = f
+		}
+		alpha := 1.0
+		if len(vals) == 4 {
+			alpha = vals[3]
+		}
+		var r, g, b float64
+		if strings.HasPrefix(m[1], "rgb") {
+			r, g, b = vals[0]/255, vals[1]/255, vals[2]/255
+		} else {
+			r, g, b = hslToRGB(vals[0], vals[1]/100, vals[2]/100)
+		}
+		to8 := func(f float64) uint8 { return uint8(math.Round(math.Max(0, math.Min(1, f)) * 255)) }
+		return color.NRGBA{R: to8(r), G: to8(g), B: to8(b), A: to8(alpha)}, nil
+	}
+	if str == "transparent" {
+		return color.NRGBA{}, nil
+	}
+	if c, ok := colornames.Map[str]; ok {
+		return color.NRGBA{R: c.R, G: c.G, B: c.B, A: c.A}, nil
+	}
+	return color.NRGBA{}, errors.Errorf("invalid color %q", str)
+}
+
+func hslToRGB(h, s, l float64) (float64, float64, float64) {
+	h = math.Mod(math.Mod(h, 360)+360, 360) / 360
+	if s == 0 {
+		return l, l, l
+	}
+	q := l * (1 + s)
+	if l >= 0.5 {
+		q = l + s - l*s
+	}
+	p := 2*l - q
+	hue := func(t float64) float64 {
+		t = math.Mod(t+1, 1)
+		switch {
+		case t < 1.0/6:
+			return p + (q-p)*6*t
+		case t < 1.0/2:
+			return q
+		case t < 2.0/3:
+			return p + (q-p)*(2.0/3-t)*6
+		}
+		return p
+	}
+	return hue(h + 1.0/3), hue(h), hue(h - 1.0/3)
+}
@@ -0,0 +1,85 @@
+package tiles_test
+
+import (
+	"image/color"
+	"testing"
+
+	"github.com/OutOfBedlam/ots/tiles"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testMapLibreStyle = `{
+	"version": 8,
+	"name": "Bright",
+	"sources": {"ots": {"type": "vector", "tiles": ["http://localhost:1919/tiles/{z}/{x}/{y}.mvt"]}},
+	"layers": [
+		{"id": "background", "type": "background", "paint": {"background-color": "rgb(240, 240, 230)"}},
+		{"id": "water", "type": "fill", "source": "ots", "source-layer": "water",
+			"filter": ["==", "$type", "Polygon"],
+			"paint": {"fill-color": "#a0c8f0", "fill-opacity": 0.5}},
+		{"id": "major-roads", "type": "line", "source": "ots", "source-layer": "roads",
+			"filter": ["in", "highway", "motorway", "trunk"],
+			"paint": {
+				"line-color": ["match", ["get", "highway"], "motorway", "#e892a2", "#f9b29c"],
+				"line-width": ["interpolate", ["linear"], ["zoom"], 10, 1, 18, 9]
+			}},
+		{"id": "paths", "type": "line", "source": "ots", "source-layer": "roads", "minzoom": 15,
+			"filter": ["all", ["==", ["get", "highway"], "footway"], ["!", ["has", "tunnel"]]],
+			"paint": {"line-color": "hsl(0, 0%, 50%)", "line-width": {"stops": [[15, 1], [17, 2]]}, "line-dasharray": [2, 1]}},
+		{"id": "schools", "type": "symbol", "source": "ots", "source-layer": "amenity",
+			"layout": {"icon-image": "{amenity}_11"}, "paint": {"icon-color": "red"}},
+		{"id": "hillshade", "type": "hillshade", "source": "dem"}
+	]
+}`
+
+func TestMapLibreStyle(t *testing.T) {
+	ss, err := tiles.LoadStyleSheet(writeStyleSheet(t, "bright.json", testMapLibreStyle))
+	require.Nil(t, err)
+	assert.Equal(t, "bright", ss.Name)
+	assert.True(t, ss.ZoomDependent())
+	assert.Equal(t, color.NRGBA{R: 240, G: 240, B: 230, A: 255}, ss.BackgroundColor(12))
+
+	fn := ss.StyleFunc()
+	styleOf := func(tags map[string]string, closed bool, zoom int) *tiles.Style {
+		style := &tiles.Style{}
+		fn(style, &tiles.StyleParam{Tags: tags, Closed: closed, Zoom: zoom})
+		return style
+	}
+
+	lake := styleOf(map[string]string{"natural": "water"}, true, 12)
+	assert.Equal(t, color.NRGBA{R: 0xa0, G: 0xc8, B: 0xf0, A: 127}, lake.FillColor)
+	assert.Nil(t, styleOf(map[string]string{"natural": "water"}, false, 12).FillColor)
+
+	motorway := styleOf(map[string]string{"highway": "motorway"}, false, 14)
+	assert.Equal(t, color.NRGBA{R: 0xe8, G: 0x92, B: 0xa2, A: 0xff}, motorway.LineColor)
+	assert.Equal(t, 5.0, motorway.LineWidth)
+	trunk := styleOf(map[string]string{"highway": "trunk"}, false, 20)
+	assert.Equal(t, color.NRGBA{R: 0xf9, G: 0xb2, B: 0x9c, A: 0xff}, trunk.LineColor)
+	assert.Equal(t, 9.0, trunk.LineWidth)
+
+	// minzoom of the layer
+	assert.Nil(t, styleOf(map[string]string{"highway": "footway"}, false, 14).LineColor)
+	footway := styleOf(map[string]string{"highway": "footway"}, false, 16)
+	assert.Equal(t, color.NRGBA{R: 128, G: 128, B: 128, A: 255}, footway.LineColor)
+	assert.Equal(t, 1.5, footway.LineWidth)
+	assert.Equal(t, []float64{3, 1.5}, footway.LineDash)
+	assert.Nil(t, styleOf(map[string]string{"highway": "footway", "tunnel": "yes"}, false, 16).LineColor)
+
+	school := styleOf(map[string]string{"amenity": "school"}, true, 16)
+	assert.NotNil(t, school.Marker)
+	assert.Equal(t, color.NRGBA{R: 255, A: 255}, school.MarkerColor)
+	assert.Nil(t, styleOf(map[string]string{"amenity": "vending_machine"}, true, 16).Marker)
+}
+
+func TestMapLibreStyleInvalid(t *testing.T) {
+	invalids := []string{
+		`{"layers": [{"id": "a", "type": "fill", "paint": {"fill-color": "not-a-color"}}]}`,
+		`{"layers": [{"id": "a", "type": "line", "filter": ["within", {}]}]}`,
+		`{"layers": [{"id": "a", "type": "line", "paint": {"line-width": ["interpolate", ["cubic-bezier", 0, 0, 1, 1], ["zoom"], 1, 1]}}]}`,
+	}
+	for _, s := range invalids {
+		_, err := tiles.LoadStyleSheet(writeStyleSheet(t, "invalid.json", s))
+		assert.NotNil(t, err, s)
+	}
+}
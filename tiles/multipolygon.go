@@ -0,0 +1,164 @@
+package tiles
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/OutOfBedlam/ots/geom"
+	"github.com/pkg/errors"
+)
+
+// roleItem is a member way of a relation
+type roleItem struct {
+	role       string
+	points     []geom.LatLon
+	sourceInfo string
+}
+
+func (r *roleItem) first() geom.LatLon {
+	return r.points[0]
+}
+
+func (r *roleItem) last() geom.LatLon {
+	return r.points[len(r.points)-1]
+}
+
+func (r *roleItem) isClosed() bool {
+	return len(r.points) >= 4 && r.first() == r.last()
+}
+
+type roleItemGroup []*roleItem
+
+// assembleRings joins the ways into closed rings, a way is joined to the end of the ring that it shares an endpoint with,
+// reversed if the endpoints are in the opposite direction.
+// The ways that do not make a closed ring are reported by the error, the rings that are closed are returned anyway.
+func (rg roleItemGroup) assembleRings() ([][]geom.LatLon, error) {
+	rings := make([][]geom.LatLon, 0)
+	opens := make([]*roleItem, 0, len(rg))
+	var invalids []string
+	for _, r := range rg {
+		if len(r.points) < 2 {
+			invalids = append(invalids, r.sourceInfo)
+		} else if r.isClosed() {
+			rings = append(rings, r.points)
+		} else {
+			opens = append(opens, r)
+		}
+	}
+
+	used := make([]bool, len(opens))
+	for i, start := range opens {
+		if used[i] {
+			continue
+		}
+		used[i] = true
+		ring := append([]geom.LatLon{}, start.points...)
+		members := []string{start.sourceInfo}
+		for ring[0] != ring[len(ring)-1] {
+			joined := false
+			for n, other := range opens {
+				if used[n] {
+					continue
+				}
+				end := ring[len(ring)-1]
+				if other.first() == end {
+					ring = append(ring, other.points[1:]...)
+				} else if other.last() == end {
+					ring = append(ring, reversedPoints(other.points)[1:]...)
+				} else {
+					continue
+				}
+				used[n] = true
+				members = append(members, other.sourceInfo)
+				joined = true
+				break
+			}
+			if !joined {
+				break
+			}
+		}
+		if ring[0] == ring[len(ring)-1] && len(ring) >= 4 {
+			rings = append(rings, ring)
+		} else {
+			invalids = append(invalids, members...)
+		}
+	}
+
+	if len(invalids) > 0 {
+		return rings, errors.Errorf("not closed ring of %s", strings.Join(invalids, ","))
+	}
+	return rings, nil
+}
+
+func reversedPoints(points []geom.LatLon) []geom.LatLon {
+	ret := make([]geom.LatLon, len(points))
+	for i, p := range points {
+		ret[len(points)-1-i] = p
+	}
+	return ret
+}
+
+// polygonPart is an outer ring of a multipolygon with the inner rings in it
+type polygonPart struct {
+	outer  []geom.LatLon
+	inners [][]geom.LatLon
+}
+
+// assembleMultipolygon assembles the outer and inner member ways into the rings,
+// each inner ring belongs to the smallest outer ring that contains it.
+// The ways that do not make closed rings and the inner rings out of any outer ring are reported by the error,
+// the parts that are valid are returned anyway.
+func assembleMultipolygon(outerItems, innerItems []*roleItem) ([]polygonPart, error) {
+	var reports []string
+	outers, err := roleItemGroup(outerItems).assembleRings()
+	if err != nil {
+		reports = append(reports, "outer: "+err.Error())
+	}
+	inners, err := roleItemGroup(innerItems).assembleRings()
+	if err != nil {
+		reports = append(reports, "inner: "+err.Error())
+	}
+
+	// the smaller outer first, so that the inner ring is assigned to the nearest outer around it
+	sort.SliceStable(outers, func(i, j int) bool {
+		return _calcArea(outers[i]) < _calcArea(outers[j])
+	})
+	parts := make([]polygonPart, len(outers))
+	for i, o := range outers {
+		parts[i].outer = o
+	}
+	orphans := 0
+	for _, in := range inners {
+		assigned := false
+		for i := range parts {
+			if ringInside(in, parts[i].outer) {
+				parts[i].inners = append(parts[i].inners, in)
+				assigned = true
+				break
+			}
+		}
+		if !assigned {
+			orphans++
+		}
+	}
+	if orphans > 0 {
+		reports = append(reports, "inner: rings out of the outer rings")
+	}
+
+	if len(reports) > 0 {
+		return parts, errors.New(strings.Join(reports, "; "))
+	}
+	return parts, nil
+}
+
+// ringInside returns true if the most of the points of the inner ring are in the outer ring,
+// the inner ring may touch the outer ring at some points.
+func ringInside(inner, outer []geom.LatLon) bool {
+	in := 0
+	for _, p := range inner[:len(inner)-1] {
+		if _ringContains(outer, p) {
+			in++
+		}
+	}
+	return in*2 >= len(inner)-1
+}
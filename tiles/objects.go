@@ -9,7 +9,8 @@ import (
 )
 
 type Object interface {
-	Draw(dc *gg.Context, coordTrans CoordTransFunc)
+	// scale is the ratio of the canvas to DefaultTileSize, line widths, fonts and icons should be scaled by it
+	Draw(dc *gg.Context, coordTrans CoordTransFunc, scale float64)
 	// returns euclidean distance from 'from' coordinates
 	DistanceFrom(from geom.LatLon) float64
 	Layer() Layer
@@ -22,12 +23,22 @@ type Object interface {
 type Label struct {
 	text        string
 	coord       geom.LatLon
-	rotate      float64
+	path        []geom.LatLon
 	textColor   color.Color
+	fontSize    float64
+	bold        bool
 	icon        Icon
 	iconSize    float64
 	sourceInfo  string
 	visibleFunc func(int) bool
+	// rank of the feature class and area of the feature for the placement
+	priority int
+	area     float64
+	// offset of the text center from the anchor, set by the placement
+	placed bool
+	dx, dy float64
+	// glyphs of the text along the path, set by the placement
+	glyphs []labelGlyph
 }
 
 func (label *Label) Layer() Layer {
@@ -45,45 +56,73 @@ func (label *Label) SourceInfo() string {
 	return label.sourceInfo
 }
 
+// Offset returns the offset of the text center from the anchor in pixels of the canvas, it is set by the placement
+func (label *Label) Offset() (float64, float64) {
+	return label.dx, label.dy
+}
+
 func (label *Label) DistanceFrom(from geom.LatLon) float64 {
+	if len(label.path) > 1 {
+		return _minDistanceFrom(label.path, from)
+	}
 	return geom.DistanceEuclidean(label.coord.Point(), from.Point())
 }
 
-func (label *Label) Draw(dc *gg.Context, transCoord CoordTransFunc) {
+func (label *Label) Draw(dc *gg.Context, transCoord CoordTransFunc, scale float64) {
 	if len(label.text) == 0 && label.icon == nil {
 		return
 	}
 
 	dc.Push()
+	defer dc.Pop()
 	if label.textColor != nil {
 		dc.SetColor(label.textColor)
 	} else {
 		dc.SetHexColor("#000000")
 	}
 
-	var iconSize = 28.0
-	if label.iconSize > 0 {
-		iconSize = label.iconSize
-	}
+	iconSize := label.iconPixels() * scale
 
-	x, y := transCoord(label.coord)
+	view := newCanvasView(transCoord, float64(dc.Width()), float64(dc.Height()), 0)
+	x, y := view.point(label.coord)
 	if label.icon != nil {
 		label.icon.Draw(dc, x, y, iconSize)
 	}
-	if len(label.text) > 0 {
-		if label.rotate != 0.0 {
-			dc.RotateAbout(label.rotate, x, y)
-		}
+	if len(label.text) == 0 {
+		return
+	}
 
+	size := label.textSize(scale)
+	face := acquireLabelFace(label.bold, size)
+	defer releaseLabelFace(label.bold, size, face)
+	dc.SetFontFace(face)
+	// bold is imitated by drawing the text twice if there is no bold font
+	offsets := []float64{0}
+	if label.bold && !hasBoldFonts() {
+		offsets = append(offsets, size/24)
+	}
+
+	if len(label.path) > 0 {
+		for _, g := range label.glyphs {
+			dc.Push()
+			dc.RotateAbout(g.angle, x+g.dx, y+g.dy)
+			for _, o := range offsets {
+				dc.DrawStringAnchored(g.text, x+g.dx+o, y+g.dy, 0.5, 0.5)
+			}
+			dc.Pop()
+		}
+	} else {
 		ax, ay := 0.5, 0.5
-		if label.icon != nil {
+		if label.placed {
+			x, y = x+label.dx, y+label.dy
+		} else if label.icon != nil {
 			y += iconSize / 2
 			ay = 0
 		}
-		dc.DrawStringWrapped(label.text, x, y, ax, ay, 0.8, 1.06, gg.AlignCenter)
+		for _, o := range offsets {
+			dc.DrawStringWrapped(label.text, x+o, y, ax, ay, labelWrapWidth, labelLineSpacing, gg.AlignCenter)
+		}
 	}
-
-	dc.Pop()
 }
 
 //#endregion
@@ -100,6 +139,10 @@ type PolygonObject struct {
 	area        float64
 	sourceInfo  string
 	visibleFunc func(int) bool
+	// vertical level of the layer tag
+	level int
+	// casing of a line that is drawn under the line
+	casing bool
 }
 
 func (obj *PolygonObject) SetLayer(l Layer) {
@@ -113,6 +156,10 @@ func (obj *PolygonObject) Layer() int {
 	return obj.layer
 }
 
+func (obj *PolygonObject) SortKey() SortKey {
+	return polygonSortKey(obj.Layer(), obj.level, obj.casing, obj.fillColor, obj.Area)
+}
+
 func (obj *PolygonObject) SourceInfo() string {
 	return obj.sourceInfo
 }
@@ -138,52 +185,49 @@ func (obj *PolygonObject) DistanceFrom(from geom.LatLon) float64 {
 	} else if lenOuter == 1 {
 		return geom.DistanceEuclidean(from.Point(), obj.outer[0].Point())
 	}
+	// the area that covers the point is drawn however far its edges are
+	if obj.fillColor != nil && _ringContains(obj.outer, from) {
+		return 0
+	}
 
 	return _minDistanceFrom(obj.outer, from)
 }
 
-func (obj *PolygonObject) Draw(dc *gg.Context, transCoord CoordTransFunc) {
+func (obj *PolygonObject) Draw(dc *gg.Context, transCoord CoordTransFunc, scale float64) {
 	if len(obj.outer) < 2 {
 		return
 	}
+	lineWidth := 1.0
+	if obj.lineWidth > 0 {
+		lineWidth = obj.lineWidth
+	}
+	view := newCanvasView(transCoord, float64(dc.Width()), float64(dc.Height()), lineWidth*scale+clipBuffer)
+
 	dc.Push()
 	if len(obj.inner) > 2 {
-		x, y := transCoord(obj.inner[0])
-		dc.MoveTo(x, y)
-		for _, in := range obj.inner[1:] {
-			x, y := transCoord(in)
-			dc.LineTo(x, y)
-		}
+		view.polygon(dc, obj.inner)
 		dc.Clip()
 		dc.InvertMask()
 		dc.ClearPath()
 	}
 
 	if obj.fillColor != nil {
-		x, y := transCoord(obj.outer[0])
-		dc.MoveTo(x, y)
-		for _, n := range obj.outer[1:] {
-			x, y = transCoord(n)
-			dc.LineTo(x, y)
-		}
+		view.polygon(dc, obj.outer)
 		dc.SetColor(obj.fillColor)
 		dc.Fill()
 		dc.ClearPath()
 	}
 	if obj.lineColor != nil {
-		x, y := transCoord(obj.outer[0])
-		dc.MoveTo(x, y)
-		for _, n := range obj.outer[1:] {
-			x, y = transCoord(n)
-			dc.LineTo(x, y)
-		}
+		view.polyline(dc, obj.outer)
 		if len(obj.lineDash) > 0 {
-			dc.SetDash(obj.lineDash...)
+			dc.SetDash(scaleDash(obj.lineDash, scale)...)
+			if obj.casing {
+				// round caps of the wide casing would fill the gaps of the dashes
+				dc.SetLineCapButt()
+			}
 		}
 		dc.SetColor(obj.lineColor)
-		if obj.lineWidth > 0 {
-			dc.SetLineWidth(obj.lineWidth)
-		}
+		dc.SetLineWidth(lineWidth * scale)
 		dc.Stroke()
 	}
 	dc.ResetClip()
@@ -204,6 +248,8 @@ type MultiPolygonObject struct {
 	area        float64
 	sourceInfo  string
 	visibleFunc func(int) bool
+	// vertical level of the layer tag
+	level int
 }
 
 func (obj *MultiPolygonObject) DistanceFrom(from geom.LatLon) float64 {
@@ -212,6 +258,9 @@ func (obj *MultiPolygonObject) DistanceFrom(from geom.LatLon) float64 {
 		if len(outer) == 0 {
 			continue
 		}
+		if obj.fillColor != nil && _ringContains(outer, from) {
+			return 0
+		}
 		d := _minDistanceFrom(outer, from)
 		if d < min {
 			min = d
@@ -220,34 +269,27 @@ func (obj *MultiPolygonObject) DistanceFrom(from geom.LatLon) float64 {
 	return min
 }
 
-func (mp *MultiPolygonObject) Draw(dc *gg.Context, transCoord CoordTransFunc) {
+func (mp *MultiPolygonObject) Draw(dc *gg.Context, transCoord CoordTransFunc, scale float64) {
 	if len(mp.outers) == 0 {
 		return
 	}
-	dc.Push()
-	for _, in := range mp.inners {
-		x, y := transCoord(in[0])
-		dc.MoveTo(x, y)
-		for _, n := range in[1:] {
-			x, y = transCoord(n)
-			dc.LineTo(x, y)
-		}
-	}
-	if len(mp.inners) > 0 {
-		dc.Clip()
-		dc.InvertMask()
-		dc.ClearPath()
+	lineWidth := 1.0
+	if mp.lineWidth > 0 {
+		lineWidth = mp.lineWidth
 	}
+	view := newCanvasView(transCoord, float64(dc.Width()), float64(dc.Height()), lineWidth*scale+clipBuffer)
 
+	dc.Push()
 	if mp.fillColor != nil {
+		// the even-odd rule leaves the holes of the inner rings,
+		// and fills an island of an outer ring that is in the hole of another outer ring
+		dc.SetFillRuleEvenOdd()
 		dc.SetColor(mp.fillColor)
 		for _, out := range mp.outers {
-			x, y := transCoord(out[0])
-			dc.MoveTo(x, y)
-			for _, n := range out[1:] {
-				x, y = transCoord(n)
-				dc.LineTo(x, y)
-			}
+			view.polygon(dc, out)
+		}
+		for _, in := range mp.inners {
+			view.polygon(dc, in)
 		}
 		dc.Fill()
 		dc.ClearPath()
@@ -255,23 +297,18 @@ func (mp *MultiPolygonObject) Draw(dc *gg.Context, transCoord CoordTransFunc) {
 
 	if mp.lineColor != nil {
 		for _, out := range mp.outers {
-			x, y := transCoord(out[0])
-			dc.MoveTo(x, y)
-			for _, n := range out[1:] {
-				x, y = transCoord(n)
-				dc.LineTo(x, y)
-			}
+			view.polyline(dc, out)
+		}
+		for _, in := range mp.inners {
+			view.polyline(dc, in)
 		}
 		if len(mp.lineDash) > 0 {
-			dc.SetDash(mp.lineDash...)
+			dc.SetDash(scaleDash(mp.lineDash, scale)...)
 		}
 		dc.SetColor(mp.lineColor)
-		if mp.lineWidth > 0 {
-			dc.SetLineWidth(mp.lineWidth)
-		}
+		dc.SetLineWidth(lineWidth * scale)
 		dc.Stroke()
 	}
-	dc.ResetClip()
 	dc.Pop()
 }
 func (mp *MultiPolygonObject) Layer() Layer {
@@ -285,6 +322,10 @@ func (obj *MultiPolygonObject) Visible(zoom int) bool {
 	return false
 }
 
+func (mp *MultiPolygonObject) SortKey() SortKey {
+	return polygonSortKey(mp.Layer(), mp.level, false, mp.fillColor, mp.Area)
+}
+
 func (mp *MultiPolygonObject) SourceInfo() string {
 	return mp.sourceInfo
 }
@@ -300,6 +341,17 @@ func (mp *MultiPolygonObject) Area() float64 {
 
 //#endregion
 
+func scaleDash(dash []float64, scale float64) []float64 {
+	if scale == 1 {
+		return dash
+	}
+	ret := make([]float64, len(dash))
+	for i, d := range dash {
+		ret[i] = d * scale
+	}
+	return ret
+}
+
 func _minDistanceFrom(points []geom.LatLon, from geom.LatLon) float64 {
 	min := math.MaxFloat64
 	lenOuter := len(points)
@@ -338,6 +390,19 @@ func _minDistanceFrom(points []geom.LatLon, from geom.LatLon) float64 {
 	return min
 }
 
+// _ringContains returns true if the point is inside the ring by the even-odd rule
+func _ringContains(ring []geom.LatLon, p geom.LatLon) bool {
+	in := false
+	for i, j := 0, len(ring)-1; i < len(ring); j, i = i, i+1 {
+		a, b := ring[i], ring[j]
+		if (a.Lat > p.Lat) != (b.Lat > p.Lat) &&
+			p.Lon < (b.Lon-a.Lon)*(p.Lat-a.Lat)/(b.Lat-a.Lat)+a.Lon {
+			in = !in
+		}
+	}
+	return in
+}
+
 func _calcDistanceFromLine(start, end, coord geom.LatLon) float64 {
 	a := start.Lat - end.Lat
 	b := end.Lon - start.Lon
@@ -366,3 +431,15 @@ func _calcArea(linestring []geom.LatLon) float64 {
 	}
 	return (maxx - minx) * (maxy - miny)
 }
+
+// polygonSortKey returns the z-order of the polygon, only the areas are ordered by the area
+func polygonSortKey(layer Layer, level int, casing bool, fillColor color.Color, area func() float64) SortKey {
+	key := SortKey{Layer: layer, Level: level, Class: FeatureLine}
+	if casing {
+		key.Class = FeatureCasing
+	} else if fillColor != nil {
+		key.Class = FeatureArea
+		key.Area = area()
+	}
+	return key
+}
@@ -26,7 +26,7 @@ func (label *TileBackground) DistanceFrom(from geom.LatLon) float64 {
 	return 0
 }
 
-func (t *TileBackground) Draw(dc *gg.Context, transCoord CoordTransFunc) {
+func (t *TileBackground) Draw(dc *gg.Context, transCoord CoordTransFunc, scale float64) {
 	dc.Push()
 	dc.SetColor(t.color)
 	dc.Clear()
@@ -61,7 +61,7 @@ func (label *Watermark) DistanceFrom(from geom.LatLon) float64 {
 	return 0
 }
 
-func (wm *Watermark) Draw(dc *gg.Context, transCoord CoordTransFunc) {
+func (wm *Watermark) Draw(dc *gg.Context, transCoord CoordTransFunc, scale float64) {
 	S := wm.size
 	dc.Push()
 	if wm.tintColor != nil {
@@ -2,6 +2,9 @@ package tiles
 
 import (
 	"image/color"
+	"math"
+	"strconv"
+	"strings"
 )
 
 type Style struct {
@@ -13,11 +16,27 @@ type Style struct {
 	Marker          Icon
 	MarkerZoomLimit int
 	BaseLayer       Layer
+	// size of the label in pixels of DefaultTileSize, 0 is the default size
+	FontSize   float64
+	FontWeight string
+	// zoom range that the feature is drawn, 0 means no limit
+	MinZoom int
+	MaxZoom int
+	// casing is drawn under the line, wider than the line by CasingWidth on each side
+	CasingColor color.Color
+	CasingWidth float64
+	CasingDash  []float64
+	// vertical level of the feature from the layer tag, higher levels are drawn above
+	Level int
 }
 
 type StyleParam struct {
 	Tags   map[string]string
 	Closed bool
+	// Point is true for nodes
+	Point bool
+	// zoom level of the tile, styles that vary by zoom level should be cached per zoom level
+	Zoom int
 }
 
 type StyleFunc func(style *Style, p *StyleParam)
@@ -29,6 +48,11 @@ func (s *Style) MarkerVisible(zoom int) bool {
 	return zoom >= s.MarkerZoomLimit
 }
 
+// Visible returns true if the feature is drawn at the zoom level
+func (s *Style) Visible(zoom int) bool {
+	return (s.MinZoom == 0 || zoom >= s.MinZoom) && (s.MaxZoom == 0 || zoom <= s.MaxZoom)
+}
+
 type style_of_func struct {
 	BaseTag string
 	Func    func(*Style, string, *StyleParam)
@@ -57,8 +81,8 @@ var styleFuncs = []style_of_func{
 	{BaseTag: "power", Func: styleOfPower},
 }
 
-func styleFromTags(p *StyleParam, customs ...StyleFunc) *Style {
-	style := &Style{
+func newStyle() *Style {
+	return &Style{
 		FillColor:   nil,
 		LineColor:   nil,
 		LineWidth:   1.0,
@@ -67,12 +91,18 @@ func styleFromTags(p *StyleParam, customs ...StyleFunc) *Style {
 		Marker:      nil,
 		BaseLayer:   LayerBackground + 1,
 	}
+}
+
+func styleFromTags(p *StyleParam, customs ...StyleFunc) *Style {
+	style := newStyle()
 	for _, sf := range styleFuncs {
 		if v, b := p.Tags[sf.BaseTag]; b {
 			sf.Func(style, v, p)
 		}
 	}
 
+	style.Level = styleLevel(p.Tags)
+
 	for _, custom := range customs {
 		if custom == nil {
 			continue
@@ -114,7 +144,9 @@ func styleOfRelationType(style *Style, typ string, p *StyleParam) {
 		route, _ := p.Tags["route"]
 		styleOfRoute(style, route, p)
 	case "route_master":
-		style.FillColor = nil
+		//// the routes of the members are drawn as the route of the master
+		route, _ := p.Tags["route_master"]
+		styleOfRoute(style, route, p)
 	case "restriction":
 		style.FillColor = nil
 	case "boundary":
@@ -140,7 +172,8 @@ func styleOfRelationType(style *Style, typ string, p *StyleParam) {
 	case "associatedStreet":
 		style.FillColor = nil
 	case "superroute":
-		style.FillColor = nil
+		route, _ := p.Tags["route"]
+		styleOfRoute(style, route, p)
 	case "site":
 		style.FillColor = nil
 	case "network":
@@ -158,11 +191,61 @@ func styleOfRelationType(style *Style, typ string, p *StyleParam) {
 	}
 }
 
+// roadClass is the look of a class of roads, width is in pixels of DefaultTileSize at roadWidthZoom
+type roadClass struct {
+	width  float64
+	fill   color.Color
+	casing color.Color
+}
+
+var roadClasses = map[string]roadClass{
+	"motorway":       {12, Red300, Red800},
+	"motorway_link":  {7, Red300, Red800},
+	"trunk":          {11, Orange300, Orange800},
+	"trunk_link":     {7, Orange300, Orange800},
+	"primary":        {10, Amber200, Amber800},
+	"primary_link":   {7, Amber200, Amber800},
+	"secondary":      {9, Yellow200, Yellow800},
+	"secondary_link": {6, Yellow200, Yellow800},
+	"tertiary":       {8, color.White, Gray500},
+	"tertiary_link":  {5, color.White, Gray500},
+	"unclassified":   {6, color.White, Gray500},
+	"residential":    {6, color.White, Gray500},
+	"living_street":  {6, color.White, Gray500},
+	"service":        {4, color.White, Gray500},
+}
+
+// roads are drawn in the width of their class at this zoom level
+const roadWidthZoom = 16
+
+// roadWidth returns the width of the road at the zoom level, roads get wider by sqrt(2) for each zoom level
+func roadWidth(width float64, zoom int) float64 {
+	return math.Max(1.0, width*math.Pow(2, float64(zoom-roadWidthZoom)/2))
+}
+
+// zoomStyledTags returns true if the built-in style of the tags varies by zoom level other than the visibility,
+// roads of the classes have the widths of the zoom level.
+func zoomStyledTags(tags map[string]string) bool {
+	_, ok := roadClasses[tags["highway"]]
+	return ok
+}
+
 func styleOfHighway(style *Style, highway string, p *StyleParam) {
 	style.FillColor = nil
 	style.MarkerColor = BlueGray900
 	style.BaseLayer = LayerRoad
 
+	if class, ok := roadClasses[highway]; ok {
+		style.LineWidth = roadWidth(class.width, p.Zoom)
+		style.LineDash = nil
+		style.LineColor = class.fill
+		// roads of the generalized tiles are too thin for casings
+		if p.Zoom > GeneralizedMaxZoom {
+			style.CasingColor = class.casing
+			style.CasingWidth = math.Max(1.0, style.LineWidth*0.15)
+		}
+	}
+
 	switch highway {
 	default:
 		style.LineWidth = 2.0
@@ -184,48 +267,65 @@ func styleOfHighway(style *Style, highway string, p *StyleParam) {
 		style.LineDash = []float64{3}
 		style.LineColor = BlueGray400
 		style.MarkerZoomLimit = 17
-	case "service":
-		style.LineWidth = 2.0
-		style.LineDash = nil
-		style.LineColor = Red400
-		style.MarkerZoomLimit = 17
-	case "residential":
-		style.LineWidth = 2.0
-		style.LineDash = nil
-		style.LineColor = Red400
+	case "service", "residential":
 		style.MarkerZoomLimit = 17
 	case "tertiary":
-		style.LineWidth = 2.0
-		style.LineDash = nil
-		style.LineColor = Red400
 		style.MarkerZoomLimit = 16
-	case "secondary":
-		style.LineWidth = 3.0
-		style.LineDash = nil
-		style.LineColor = Red400
+	case "secondary", "secondary_link":
 		style.MarkerZoomLimit = 15
-	case "secondary_link":
-		style.LineWidth = 3.0
-		style.LineDash = nil
-		style.LineColor = Red400
-		style.MarkerZoomLimit = 15
-	case "trunk":
-		style.LineWidth = 3.0
-		style.LineDash = nil
-		style.LineColor = Red400
-	case "trunk_link":
-		style.LineWidth = 3.0
-		style.LineDash = nil
-		style.LineColor = Red400
-	case "primary_link":
-		style.LineWidth = 3.0
-		style.LineDash = nil
-		style.LineColor = Red400
-	case "primary":
-		style.LineWidth = 5.0
-		style.LineDash = nil
-		style.LineColor = Red400
+	case "motorway", "motorway_link", "trunk", "trunk_link", "primary", "primary_link",
+		"tertiary_link", "unclassified", "living_street":
+		//// nodes on the roads
+	case "bus_stop":
+		style.Marker = fa_bus
+		style.MarkerZoomLimit = 16
+	case "traffic_signals":
+		style.Marker = fa_traffic_light
+		style.MarkerZoomLimit = 17
+	}
+
+	// bridges have dark casings, tunnels are faded with dashed casings
+	if isStructure(p.Tags["bridge"]) && style.CasingColor != nil {
+		style.CasingColor = Gray800
+	}
+	if isStructure(p.Tags["tunnel"]) {
+		style.LineColor = fadeColor(style.LineColor, 0.5)
+		if style.CasingColor != nil {
+			style.CasingDash = []float64{4, 2}
+		}
+	}
+}
+
+// isStructure returns true if the value of bridge or tunnel tag is not "no"
+func isStructure(v string) bool {
+	return len(v) > 0 && v != "no"
+}
+
+// styleLevel returns the vertical level from the layer tag, bridges are above the ground and tunnels are below
+func styleLevel(tags map[string]string) int {
+	if v, ok := tags["layer"]; ok {
+		if level, err := strconv.Atoi(strings.TrimSpace(v)); err == nil {
+			return level
+		}
+	}
+	if isStructure(tags["bridge"]) {
+		return 1
+	} else if isStructure(tags["tunnel"]) {
+		return -1
 	}
+	return 0
+}
+
+// fadeColor mixes the color with white by the ratio, the color stays opaque so that the casing under it is not seen through
+func fadeColor(c color.Color, ratio float64) color.Color {
+	if c == nil {
+		return nil
+	}
+	n := color.NRGBAModel.Convert(c).(color.NRGBA)
+	fade := func(v uint8) uint8 {
+		return uint8(float64(v) + (255-float64(v))*ratio)
+	}
+	return color.NRGBA{R: fade(n.R), G: fade(n.G), B: fade(n.B), A: n.A}
 }
 
 func styleOfAmenity(style *Style, amenity string, p *StyleParam) {
@@ -243,12 +343,18 @@ func styleOfAmenity(style *Style, amenity string, p *StyleParam) {
 	case "cafe":
 		style.FillColor = Orange300
 		style.LineColor = Orange700
+		style.Marker = fa_coffee
+		style.MarkerZoomLimit = 17
 	case "fast_food":
 		style.FillColor = Orange300
 		style.LineColor = Orange700
+		style.Marker = fa_utensils
+		style.MarkerZoomLimit = 17
 	case "food_court":
 		style.FillColor = Orange300
 		style.LineColor = Orange700
+		style.Marker = fa_utensils
+		style.MarkerZoomLimit = 17
 	case "ice_cream":
 		style.FillColor = Orange300
 		style.LineColor = Orange700
@@ -258,6 +364,8 @@ func styleOfAmenity(style *Style, amenity string, p *StyleParam) {
 	case "restaurant":
 		style.FillColor = Orange300
 		style.LineColor = Orange700
+		style.Marker = fa_utensils
+		style.MarkerZoomLimit = 17
 		//// Education
 	case "college":
 		style.FillColor = Cyan50
@@ -305,6 +413,9 @@ func styleOfAmenity(style *Style, amenity string, p *StyleParam) {
 		style.LineColor = Red200
 		style.Marker = fa_hostpital_alt
 		style.MarkerZoomLimit = 15
+	case "pharmacy":
+		style.Marker, _ = IconByName("pharmacy")
+		style.MarkerZoomLimit = 17
 		//// TODO: Entertainment, Aarts & Curture
 		//// TODO: Public Service
 	case "police":
@@ -315,7 +426,16 @@ func styleOfAmenity(style *Style, amenity string, p *StyleParam) {
 		style.FillColor = Red50
 		style.LineColor = Red200
 		style.Marker = fa_fire
-		//// TODO: Facilities
+		//// Facilities
+	case "bench":
+		style.Marker, _ = IconByName("bench")
+		style.MarkerZoomLimit = 18
+	case "drinking_water":
+		style.Marker, _ = IconByName("drinking-water")
+		style.MarkerZoomLimit = 17
+	case "post_box":
+		style.Marker, _ = IconByName("post-box")
+		style.MarkerZoomLimit = 17
 		//// TODO: Waste Management
 		//// TODO: Others
 	}
@@ -342,15 +462,24 @@ func styleOfBuildingPart(style *Style, building string, p *StyleParam) {
 
 func styleOfPlace(style *Style, place string, p *StyleParam) {
 	style.BaseLayer = LayerPlace
+	style.FontWeight = FontWeightBold
 
 	switch place {
 	default:
+	case "country":
+		style.FontSize = 28
+	case "state", "province", "city":
+		style.FontSize = 24
+	case "town":
+		style.FontSize = 22
 	case "square":
 		style.FillColor = BlueGray50
 		style.LineColor = BlueGray300
 	case "village":
 		style.FillColor = Orange50
 		style.LineColor = Orange100
+	case "hamlet", "isolated_dwelling", "locality", "neighbourhood":
+		style.MarkerZoomLimit = 15
 	}
 }
 
@@ -424,6 +553,9 @@ func styleOfNatural(style *Style, natural string, p *StyleParam) {
 		//// Geology related
 	case "sand":
 		style.FillColor = Amber100
+	case "peak":
+		style.Marker = fa_mountain
+		style.MarkerZoomLimit = 13
 	}
 }
 
@@ -431,7 +563,12 @@ func styleOfShop(style *Style, shop string, p *StyleParam) {
 	style.BaseLayer = LayerBuilding
 	style.FillColor = Gray400
 	style.LineColor = Gray600
-	// app == "supermarket"
+	style.Marker = fa_store
+	style.MarkerZoomLimit = 17
+	if shop == "supermarket" {
+		style.Marker = fa_shopping_cart
+		style.MarkerZoomLimit = 16
+	}
 }
 
 func styleOfLeisure(style *Style, leisure string, p *StyleParam) {
@@ -521,6 +658,9 @@ func styleOfRailway(style *Style, railway string, p *StyleParam) {
 	style.LineColor = Brown800
 	style.BaseLayer = LayerRoute
 	switch railway {
+	case "station", "halt":
+		style.Marker = fa_train
+		style.MarkerZoomLimit = 14
 	case "construction":
 		style.LineColor = Brown400
 		style.LineDash = []float64{10.0, 10.0}
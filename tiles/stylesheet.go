@@ -0,0 +1,475 @@
+package tiles
+
+import (
+	"encoding/json"
+	"image/color"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/hashicorp/hcl/v2/gohcl"
+	"github.com/hashicorp/hcl/v2/hclparse"
+	"github.com/pkg/errors"
+)
+
+// StyleSheet is the declarative styles loaded from a file (*.hcl or *.json).
+// Rules are applied in order to the features that match their selectors, the later rule overrides the earlier one.
+//
+//	name       = "dark"
+//	base       = "none"        // "default": rules are applied over the built-in styles (default), "none": from scratch
+//	background = "#263238"
+//	color-filter = "night"     // "grayscale", "high-contrast" or "night" applied to the colors after the rules
+//
+//	rule "highway=motorway|trunk" {
+//	    line       = "#ff7043"
+//	    line-width = 4
+//	    layer      = "road+1"
+//	}
+//	rule "building !name" {
+//	    fill     = "#bcaaa4"
+//	    min-zoom = 15
+//	}
+//
+// The same in json
+//
+//	{"name": "dark", "base": "none", "rules": [{"selector": "highway=motorway|trunk", "line": "#ff7043"}]}
+//
+// A json file of MapLibre style spec is imported by LoadMapLibreStyle.
+type StyleSheet struct {
+	Name        string       `hcl:"name,optional" json:"name"`
+	Base        string       `hcl:"base,optional" json:"base"`
+	Background  *string      `hcl:"background,optional" json:"background,omitempty"`
+	ColorFilter string       `hcl:"color-filter,optional" json:"color-filter,omitempty"`
+	Rules       []*StyleRule `hcl:"rule,block" json:"rules"`
+
+	background    func(zoom int) color.Color
+	colorFilter   func(c color.Color) color.Color
+	zoomDependent bool
+}
+
+// StyleRule sets the properties of the style that are specified.
+//
+// Selector is space separated conditions on tags, all conditions should be satisfied.
+//
+//	key          the tag exists
+//	!key         the tag does not exist
+//	key=v1|v2    the value of the tag is one of v1, v2
+//	key!=v1|v2   the value of the tag is none of v1, v2 (or the tag does not exist)
+//	*            every feature
+//
+// Colors are "#rgb", "#rrggbb", "#rrggbbaa" or "none", layer is a number or a name
+// (background, nature, landuse, place, amenity, building, road, route, border, aero) with optional offset like "road+1",
+// the names are in the z-order from the bottom.
+// font-size is in pixels of DefaultTileSize and font-weight is "normal" or "bold".
+// casing is the color of the outline of the lines and casing-width is its width on each side of the line.
+type StyleRule struct {
+	Selector      string    `hcl:"selector,label" json:"selector"`
+	Closed        *bool     `hcl:"closed,optional" json:"closed,omitempty"`
+	MinZoom       int       `hcl:"min-zoom,optional" json:"min-zoom,omitempty"`
+	MaxZoom       int       `hcl:"max-zoom,optional" json:"max-zoom,omitempty"`
+	Fill          *string   `hcl:"fill,optional" json:"fill,omitempty"`
+	Line          *string   `hcl:"line,optional" json:"line,omitempty"`
+	LineWidth     *float64  `hcl:"line-width,optional" json:"line-width,omitempty"`
+	Dash          []float64 `hcl:"dash,optional" json:"dash,omitempty"`
+	Marker        *string   `hcl:"marker,optional" json:"marker,omitempty"`
+	MarkerColor   *string   `hcl:"marker-color,optional" json:"marker-color,omitempty"`
+	MarkerMinZoom *int      `hcl:"marker-min-zoom,optional" json:"marker-min-zoom,omitempty"`
+	Layer         *string   `hcl:"layer,optional" json:"layer,omitempty"`
+	FontSize      *float64  `hcl:"font-size,optional" json:"font-size,omitempty"`
+	FontWeight    *string   `hcl:"font-weight,optional" json:"font-weight,omitempty"`
+	Casing        *string   `hcl:"casing,optional" json:"casing,omitempty"`
+	CasingWidth   *float64  `hcl:"casing-width,optional" json:"casing-width,omitempty"`
+
+	conds       []tagCond
+	fill        color.Color
+	line        color.Color
+	casing      color.Color
+	marker      Icon
+	markerColor color.Color
+	layer       Layer
+
+	// rules imported from MapLibre styles
+	filter func(p *StyleParam) bool
+	paint  func(style *Style, p *StyleParam)
+}
+
+type tagCond struct {
+	key    string
+	values []string
+	negate bool
+}
+
+var styleSheetNameRegexp = regexp.MustCompile(`^[A-Za-z0-9_\-]+$`)
+
+// LoadStyleSheet loads the style sheet file, the name of the style sheet is the file name if it is not specified.
+func LoadStyleSheet(path string) (*StyleSheet, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	ss := &StyleSheet{}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		if isMapLibreStyle(content) {
+			return LoadMapLibreStyle(path)
+		}
+		if err := json.Unmarshal(content, ss); err != nil {
+			return nil, errors.Wrap(err, path)
+		}
+	case ".hcl":
+		f, diags := hclparse.NewParser().ParseHCL(content, path)
+		if diags.HasErrors() {
+			return nil, diags
+		}
+		if diags := gohcl.DecodeBody(f.Body, nil, ss); diags.HasErrors() {
+			return nil, diags
+		}
+	default:
+		return nil, errors.Errorf("style sheet %s should be *.hcl or *.json", path)
+	}
+
+	if len(ss.Name) == 0 {
+		ss.Name = strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	}
+	if err := ss.compile(); err != nil {
+		return nil, errors.Wrap(err, path)
+	}
+	return ss, nil
+}
+
+func (ss *StyleSheet) compile() error {
+	if !styleSheetNameRegexp.MatchString(ss.Name) {
+		return errors.Errorf("invalid style name %q", ss.Name)
+	}
+	switch ss.Base {
+	case "", "default", "none":
+	default:
+		return errors.Errorf("unknown base %q", ss.Base)
+	}
+	if ss.Background != nil {
+		c, err := parseStyleColor(*ss.Background)
+		if err != nil {
+			return errors.Wrap(err, "background")
+		}
+		ss.background = func(int) color.Color { return c }
+	}
+	if len(ss.ColorFilter) > 0 {
+		filter, ok := colorFilters[ss.ColorFilter]
+		if !ok {
+			return errors.Errorf("unknown color-filter %q", ss.ColorFilter)
+		}
+		ss.colorFilter = filter
+	}
+	for _, r := range ss.Rules {
+		if err := r.compile(); err != nil {
+			return errors.Wrapf(err, "rule %q", r.Selector)
+		}
+	}
+	return nil
+}
+
+func (r *StyleRule) compile() (err error) {
+	r.conds = r.conds[:0]
+	for _, tok := range strings.Fields(r.Selector) {
+		if tok == "*" {
+			continue
+		}
+		cond := tagCond{}
+		if strings.HasPrefix(tok, "!") {
+			cond.key = tok[1:]
+			cond.negate = true
+		} else if i := strings.Index(tok, "!="); i > 0 {
+			cond.key = tok[:i]
+			cond.values = strings.Split(tok[i+2:], "|")
+			cond.negate = true
+		} else if i := strings.Index(tok, "="); i > 0 {
+			cond.key = tok[:i]
+			cond.values = strings.Split(tok[i+1:], "|")
+		} else {
+			cond.key = tok
+		}
+		if len(cond.key) == 0 || strings.ContainsAny(cond.key, "=!|") {
+			return errors.Errorf("invalid condition %q", tok)
+		}
+		r.conds = append(r.conds, cond)
+	}
+
+	if r.Fill != nil {
+		if r.fill, err = parseStyleColor(*r.Fill); err != nil {
+			return err
+		}
+	}
+	if r.Line != nil {
+		if r.line, err = parseStyleColor(*r.Line); err != nil {
+			return err
+		}
+	}
+	if r.Casing != nil {
+		if r.casing, err = parseStyleColor(*r.Casing); err != nil {
+			return err
+		}
+	}
+	if r.MarkerColor != nil {
+		if r.markerColor, err = parseStyleColor(*r.MarkerColor); err != nil {
+			return err
+		}
+	}
+	if r.Marker != nil && *r.Marker != "none" {
+		icon, ok := IconByName(*r.Marker)
+		if !ok {
+			return errors.Errorf("unknown marker %q", *r.Marker)
+		}
+		r.marker = icon
+	}
+	if r.Layer != nil {
+		if r.layer, err = parseStyleLayer(*r.Layer); err != nil {
+			return err
+		}
+	}
+	if r.FontWeight != nil && *r.FontWeight != FontWeightNormal && *r.FontWeight != FontWeightBold {
+		return errors.Errorf("unknown font-weight %q", *r.FontWeight)
+	}
+	return nil
+}
+
+func (r *StyleRule) match(p *StyleParam) bool {
+	if r.Closed != nil && *r.Closed != p.Closed {
+		return false
+	}
+	if r.filter != nil && !r.filter(p) {
+		return false
+	}
+	for _, c := range r.conds {
+		v, ok := p.Tags[c.key]
+		if ok && len(c.values) > 0 {
+			ok = false
+			for _, cv := range c.values {
+				if cv == v || cv == "*" {
+					ok = true
+					break
+				}
+			}
+		}
+		if ok == c.negate {
+			return false
+		}
+	}
+	return true
+}
+
+func (r *StyleRule) apply(style *Style, p *StyleParam) {
+	if r.MinZoom != 0 {
+		style.MinZoom = r.MinZoom
+	}
+	if r.MaxZoom != 0 {
+		style.MaxZoom = r.MaxZoom
+	}
+	if r.Fill != nil {
+		style.FillColor = r.fill
+	}
+	if r.Line != nil {
+		style.LineColor = r.line
+	}
+	if r.LineWidth != nil {
+		style.LineWidth = *r.LineWidth
+	}
+	if r.Dash != nil {
+		// empty list makes the line solid
+		style.LineDash = r.Dash
+	}
+	if r.Casing != nil {
+		style.CasingColor = r.casing
+	}
+	if r.CasingWidth != nil {
+		style.CasingWidth = *r.CasingWidth
+	}
+	if r.Marker != nil {
+		style.Marker = r.marker
+	}
+	if r.MarkerColor != nil {
+		style.MarkerColor = r.markerColor
+	}
+	if r.MarkerMinZoom != nil {
+		style.MarkerZoomLimit = *r.MarkerMinZoom
+	}
+	if r.Layer != nil {
+		style.BaseLayer = r.layer
+	}
+	if r.FontSize != nil {
+		style.FontSize = *r.FontSize
+	}
+	if r.FontWeight != nil {
+		style.FontWeight = *r.FontWeight
+	}
+	if r.paint != nil {
+		r.paint(style, p)
+	}
+}
+
+// StyleFunc returns the hook that applies the rules and then the color filter of the style sheet
+func (ss *StyleSheet) StyleFunc() StyleFunc {
+	return func(style *Style, p *StyleParam) {
+		if ss.Base == "none" {
+			*style = *newStyle()
+			style.Level = styleLevel(p.Tags)
+		}
+		for _, r := range ss.Rules {
+			if r.match(p) {
+				r.apply(style, p)
+			}
+		}
+		if ss.colorFilter != nil {
+			style.FillColor = ss.filterColor(style.FillColor)
+			style.LineColor = ss.filterColor(style.LineColor)
+			style.CasingColor = ss.filterColor(style.CasingColor)
+			style.MarkerColor = ss.filterColor(style.MarkerColor)
+		}
+	}
+}
+
+// BackgroundColor returns the color of the background at the zoom level, nil if the style sheet does not change it
+func (ss *StyleSheet) BackgroundColor(zoom int) color.Color {
+	var c color.Color
+	if ss.background != nil {
+		c = ss.background(zoom)
+	}
+	if ss.colorFilter == nil {
+		return c
+	}
+	if c == nil {
+		c = Gray50
+	}
+	return ss.filterColor(c)
+}
+
+func (ss *StyleSheet) filterColor(c color.Color) color.Color {
+	if c == nil || ss.colorFilter == nil {
+		return c
+	}
+	return ss.colorFilter(c)
+}
+
+var colorFilters = map[string]func(c color.Color) color.Color{
+	"grayscale":     grayscaleColor,
+	"high-contrast": highContrastColor,
+	"night":         nightColor,
+}
+
+func grayscaleColor(c color.Color) color.Color {
+	n := color.NRGBAModel.Convert(c).(color.NRGBA)
+	y := uint8(math.Round(0.299*float64(n.R) + 0.587*float64(n.G) + 0.114*float64(n.B)))
+	return color.NRGBA{R: y, G: y, B: y, A: n.A}
+}
+
+// highContrastColor pushes the channels away from the middle gray
+func highContrastColor(c color.Color) color.Color {
+	n := color.NRGBAModel.Convert(c).(color.NRGBA)
+	stretch := func(v uint8) uint8 {
+		return uint8(math.Max(0, math.Min(255, math.Round((float64(v)-128)*1.6+128))))
+	}
+	return color.NRGBA{R: stretch(n.R), G: stretch(n.G), B: stretch(n.B), A: n.A}
+}
+
+// nightColor inverts the lightness keeping the hue, light backgrounds turn dark
+func nightColor(c color.Color) color.Color {
+	n := color.NRGBAModel.Convert(c).(color.NRGBA)
+	h, s, l := rgbToHSL(float64(n.R)/255, float64(n.G)/255, float64(n.B)/255)
+	r, g, b := hslToRGB(h, s, 1-l)
+	to8 := func(f float64) uint8 { return uint8(math.Round(math.Max(0, math.Min(1, f)) * 255)) }
+	return color.NRGBA{R: to8(r), G: to8(g), B: to8(b), A: n.A}
+}
+
+// rgbToHSL returns hue in degrees, saturation and lightness in 0 ~ 1
+func rgbToHSL(r, g, b float64) (h, s, l float64) {
+	max, min := math.Max(r, math.Max(g, b)), math.Min(r, math.Min(g, b))
+	l = (max + min) / 2
+	if max == min {
+		return 0, 0, l
+	}
+	d := max - min
+	if l > 0.5 {
+		s = d / (2 - max - min)
+	} else {
+		s = d / (max + min)
+	}
+	switch max {
+	case r:
+		h = (g - b) / d
+		if g < b {
+			h += 6
+		}
+	case g:
+		h = (b-r)/d + 2
+	default:
+		h = (r-g)/d + 4
+	}
+	return h * 60, s, l
+}
+
+// ZoomDependent returns true if the styles vary by zoom level other than min-zoom and max-zoom
+func (ss *StyleSheet) ZoomDependent() bool {
+	return ss.zoomDependent
+}
+
+func parseStyleColor(str string) (color.Color, error) {
+	if str == "none" {
+		return nil, nil
+	}
+	hex := strings.TrimPrefix(str, "#")
+	if len(hex) == len(str) {
+		return nil, errors.Errorf("invalid color %q", str)
+	}
+	if len(hex) == 3 {
+		hex = string([]byte{hex[0], hex[0], hex[1], hex[1], hex[2], hex[2]})
+	}
+	if len(hex) == 6 {
+		hex += "ff"
+	}
+	if len(hex) != 8 {
+		return nil, errors.Errorf("invalid color %q", str)
+	}
+	v, err := strconv.ParseUint(hex, 16, 32)
+	if err != nil {
+		return nil, errors.Errorf("invalid color %q", str)
+	}
+	// color.RGBA is alpha-premultiplied
+	c := color.NRGBA{R: uint8(v >> 24), G: uint8(v >> 16), B: uint8(v >> 8), A: uint8(v)}
+	return c, nil
+}
+
+var layerNames = map[string]Layer{
+	"background": LayerBackground,
+	"nature":     LayerNature,
+	"landuse":    LayerLanduse,
+	"place":      LayerPlace,
+	"amenity":    LayerAmenity,
+	"road":       LayerRoad,
+	"building":   LayerBuilding,
+	"route":      LayerRoute,
+	"border":     LayerBorder,
+	"aero":       LayerAero,
+}
+
+func parseStyleLayer(str string) (Layer, error) {
+	if v, err := strconv.ParseInt(str, 0, 64); err == nil {
+		return Layer(v), nil
+	}
+	name, offset := str, 0
+	if i := strings.IndexAny(str, "+-"); i > 0 {
+		name = str[:i]
+		v, err := strconv.Atoi(str[i:])
+		if err != nil {
+			return 0, errors.Errorf("invalid layer %q", str)
+		}
+		offset = v
+	}
+	layer, ok := layerNames[name]
+	if !ok {
+		return 0, errors.Errorf("unknown layer %q", str)
+	}
+	return layer + Layer(offset), nil
+}
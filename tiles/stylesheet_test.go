@@ -0,0 +1,126 @@
+package tiles_test
+
+import (
+	"image/color"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/OutOfBedlam/ots/tiles"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testStyleSheetHCL = `
+base = "none"
+
+rule "highway=motorway|trunk" {
+    line       = "#ff7043"
+    line-width = 4
+    layer      = "road+1"
+}
+
+rule "building !name" {
+    closed   = true
+    fill     = "#bca"
+    min-zoom = 15
+}
+`
+
+const testStyleSheetJSON = `{
+	"name": "night",
+	"rules": [
+		{"selector": "highway!=motorway", "line": "#00000080", "dash": [2, 2]}
+	]
+}`
+
+func writeStyleSheet(t *testing.T, name, content string) string {
+	path := filepath.Join(t.TempDir(), name)
+	require.Nil(t, os.WriteFile(path, []byte(content), 0644))
+	return path
+}
+
+func TestStyleSheetHCL(t *testing.T) {
+	ss, err := tiles.LoadStyleSheet(writeStyleSheet(t, "day.hcl", testStyleSheetHCL))
+	require.Nil(t, err)
+	assert.Equal(t, "day", ss.Name)
+	assert.Equal(t, 2, len(ss.Rules))
+
+	fn := ss.StyleFunc()
+
+	style := &tiles.Style{LineColor: color.Black}
+	fn(style, &tiles.StyleParam{Tags: map[string]string{"highway": "trunk"}})
+	assert.Equal(t, color.NRGBA{R: 0xff, G: 0x70, B: 0x43, A: 0xff}, style.LineColor)
+	assert.Equal(t, 4.0, style.LineWidth)
+	assert.Equal(t, tiles.LayerRoad+1, style.BaseLayer)
+
+	// base "none" resets the styles of the features that no rules match
+	style = &tiles.Style{LineColor: color.Black}
+	fn(style, &tiles.StyleParam{Tags: map[string]string{"highway": "residential"}})
+	assert.Nil(t, style.LineColor)
+
+	style = &tiles.Style{}
+	fn(style, &tiles.StyleParam{Tags: map[string]string{"building": "yes"}, Closed: true})
+	assert.Equal(t, color.NRGBA{R: 0xbb, G: 0xcc, B: 0xaa, A: 0xff}, style.FillColor)
+	assert.False(t, style.Visible(14))
+	assert.True(t, style.Visible(15))
+
+	style = &tiles.Style{}
+	fn(style, &tiles.StyleParam{Tags: map[string]string{"building": "yes", "name": "tower"}, Closed: true})
+	assert.Nil(t, style.FillColor)
+	assert.True(t, style.Visible(14))
+}
+
+func TestStyleSheetJSON(t *testing.T) {
+	ss, err := tiles.LoadStyleSheet(writeStyleSheet(t, "style.json", testStyleSheetJSON))
+	require.Nil(t, err)
+	assert.Equal(t, "night", ss.Name)
+
+	fn := ss.StyleFunc()
+
+	// the tag that does not exist satisfies '!='
+	style := &tiles.Style{}
+	fn(style, &tiles.StyleParam{Tags: map[string]string{"waterway": "river"}})
+	assert.Equal(t, color.NRGBA{A: 0x80}, style.LineColor)
+	assert.Equal(t, []float64{2, 2}, style.LineDash)
+
+	style = &tiles.Style{}
+	fn(style, &tiles.StyleParam{Tags: map[string]string{"highway": "motorway"}})
+	assert.Nil(t, style.LineColor)
+}
+
+func TestStyleSheetInvalid(t *testing.T) {
+	invalids := []string{
+		`rule "highway" { line = "red" }`,
+		`rule "highway" { marker = "unknown" }`,
+		`rule "highway" { layer = "sky" }`,
+		`base = "dark"`,
+		`rule "=motorway" { line = "#fff" }`,
+	}
+	for _, s := range invalids {
+		_, err := tiles.LoadStyleSheet(writeStyleSheet(t, "invalid.hcl", s))
+		assert.NotNil(t, err, s)
+	}
+	_, err := tiles.LoadStyleSheet(writeStyleSheet(t, "style.yaml", "name: x"))
+	assert.NotNil(t, err)
+}
+
+func TestStyleSheetColorFilter(t *testing.T) {
+	ss, err := tiles.LoadStyleSheet(writeStyleSheet(t, "gray.hcl", `color-filter = "grayscale"`))
+	require.Nil(t, err)
+
+	style := &tiles.Style{FillColor: color.NRGBA{R: 255, A: 255}}
+	ss.StyleFunc()(style, &tiles.StyleParam{})
+	assert.Equal(t, color.NRGBA{R: 76, G: 76, B: 76, A: 255}, style.FillColor)
+	assert.Nil(t, style.LineColor)
+	// background of the built-in styles is filtered
+	assert.Equal(t, color.NRGBA{R: 250, G: 250, B: 250, A: 255}, ss.BackgroundColor(15))
+
+	ss, err = tiles.LoadStyleSheet(writeStyleSheet(t, "night.hcl", `color-filter = "night"`))
+	require.Nil(t, err)
+	r, g, b, _ := ss.BackgroundColor(15).RGBA()
+	assert.Less(t, r+g+b, uint32(3*0x1000))
+
+	_, err = tiles.LoadStyleSheet(writeStyleSheet(t, "sepia.hcl", `color-filter = "sepia"`))
+	assert.NotNil(t, err)
+}
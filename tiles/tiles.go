@@ -1,15 +1,19 @@
 package tiles
 
 import (
+	"bytes"
 	"context"
 	"fmt"
+	"image"
 	"image/color"
+	"image/png"
 	"io"
 	"math"
 
 	"github.com/OutOfBedlam/ots/geom"
 	"github.com/OutOfBedlam/ots/logging"
 	"github.com/OutOfBedlam/ots/projection"
+	"github.com/OutOfBedlam/ots/projection/mercator"
 	"github.com/fogleman/gg"
 	"github.com/golang/freetype/truetype"
 	"github.com/paulmach/osm"
@@ -21,6 +25,7 @@ type TileBuilder interface {
 	AddRelations(rels ...*Relation)
 	Build(ctx context.Context) (*Tile, error)
 	SetBuildLayerRange(start, end int)
+	SetStyleSheet(ss *StyleSheet)
 	SetHideLabels(bool)
 	SetVerbose(bool)
 	SetWatermark(string)
@@ -29,86 +34,147 @@ type TileBuilder interface {
 
 type Tile struct {
 	width, height   int
+	scale           float64
 	defaultFont     *truetype.Font
 	objs            []Object
 	coordTranslator CoordTransFunc
 	watermark       string
 	tint            bool
+	// pixels around the tiles that are drawn but not encoded
+	margin int
 }
 
 func TilesToBounds(x, y, z int) geom.Bound {
+	return MetatileToBounds(x, y, z, 1)
+}
+
+// MetatileToBounds returns the bounds of n x n tiles from the tile (x, y) at the top-left
+func MetatileToBounds(x, y, z, n int) geom.Bound {
 	maxLat, minLon := projection.Tile2LatLon(x, y, z)
-	minLat, maxLon := projection.Tile2LatLon(x+1, y+1, z)
+	minLat, maxLon := projection.Tile2LatLon(x+n, y+n, z)
 	return geom.Bound{
 		Min: geom.LatLon{Lat: minLat, Lon: minLon},
 		Max: geom.LatLon{Lat: maxLat, Lon: maxLon},
 	}
 }
 
+// MetatileBuffer is the margin around a metatile in pixels of DefaultTileSize,
+// labels that cross the edges of the metatile are drawn over the margin instead of being cut at the edges.
+const MetatileBuffer = 128
+
+// MetatileToBufferedBounds returns the bounds of n x n tiles from the tile (x, y) at the top-left with MetatileBuffer around them,
+// the objects in the bounds are drawn on the metatile.
+func MetatileToBufferedBounds(x, y, z, n int) geom.Bound {
+	return bufferedBounds(x, y, z, n, MetatileBuffer)
+}
+
+// bufferedBounds returns the bounds of n x n tiles with the margin of buffer pixels of DefaultTileSize
+func bufferedBounds(x, y, z, n int, buffer float64) geom.Bound {
+	b := MetatileToBounds(x, y, z, n)
+	if buffer == 0 {
+		return b
+	}
+	left, top := mercator.LatLonToMeters(b.Max.Lat, b.Min.Lon)
+	right, bottom := mercator.LatLonToMeters(b.Min.Lat, b.Max.Lon)
+	m := (right - left) / float64(n) * buffer / DefaultTileSize
+	maxLat, minLon := mercator.MetersToLatLon(left-m, top+m)
+	minLat, maxLon := mercator.MetersToLatLon(right+m, bottom-m)
+	return geom.MakeBound(minLat, minLon, maxLat, maxLon)
+}
+
+// DefaultTileSize is the pixel size of the tile that line widths, fonts and icons of styles are designed for
+const DefaultTileSize = 512
+
 func NewBuilder(x, y, z int) TileBuilder {
+	return NewBuilderSize(x, y, z, DefaultTileSize)
+}
+
+// NewBuilderSize makes a builder of the tile that is rendered in size x size pixels,
+// eg) 256 for standard tiles, 512 for @2x (retina) tiles.
+// Line widths, fonts and icons are scaled by size/DefaultTileSize.
+func NewBuilderSize(x, y, z int, size int) TileBuilder {
+	return newTilesBuilder(x, y, z, 1, size, 0)
+}
+
+// NewMetaBuilder makes a builder of the metatile of n x n tiles from the tile (x, y) at the top-left,
+// each tile is size x size pixels. Labels are placed once for the metatile so that the tiles cut
+// from it agree on the labels. The metatile is drawn with MetatileBuffer around it so that
+// the labels that cross the edges of the metatile are not cut. The placement is independent per metatile,
+// the neighbour metatile may place a label that crosses their edge differently when it collides with other labels.
+func NewMetaBuilder(x, y, z, n int, size int) TileBuilder {
+	builder := newTilesBuilder(x, y, z, n, size, MetatileBuffer)
+	builder.labelsInside = true
+	return builder
+}
+
+// newTilesBuilder makes a builder of n x n tiles with the margin of buffer pixels of DefaultTileSize around them
+func newTilesBuilder(x, y, z, n int, size int, buffer float64) *DefaultBuilder {
+	scale := float64(size) / DefaultTileSize
+	margin := math.Round(buffer * scale)
 	builder := &DefaultBuilder{
 		log:             logging.GetLog(fmt.Sprintf("tiles-%d-%d-%d", z, x, y)),
-		canvasWidth:     512,
-		canvasHeight:    512,
+		canvasWidth:     float64(size*n) + 2*margin,
+		canvasHeight:    float64(size*n) + 2*margin,
+		margin:          margin,
+		scale:           scale,
 		zoom:            z,
+		generalized:     z <= GeneralizedMaxZoom,
 		buildLayerStart: 0,
 		buildLayerEnd:   math.MaxInt,
 	}
 
 	// requested bounds
 	maxLat, minLon := projection.Tile2LatLon(x, y, z)
-	minLat, maxLon := projection.Tile2LatLon(x+1, y+1, z)
-
-	pixelPerLat := projection.TileSize / (maxLat - minLat)
-	pixelPerLon := projection.TileSize / (maxLon - minLon)
+	minLat, maxLon := projection.Tile2LatLon(x+n, y+n, z)
 
-	dpiXScale := builder.canvasWidth / projection.TileSize
-	dpiYScale := builder.canvasHeight / projection.TileSize
+	builder.bounds = bufferedBounds(x, y, z, n, buffer)
 
-	builder.bounds = geom.MakeBound(minLat, minLon, maxLat, maxLon)
-
-	// converter: lat/lon to local (gg.Context) x,y coord
-	builder.transCoordToXY = func(p geom.LatLon) (float64, float64) {
-		x := math.Ceil((p.Lon-minLon)*pixelPerLon) * dpiXScale
-		y := math.Ceil((maxLat-p.Lat)*pixelPerLat) * dpiYScale
-		return x, y
-	}
+	// converter: lat/lon to local (gg.Context) x,y coord, the tiles are drawn inside the margin
+	left, top := mercator.LatLonToMeters(maxLat, minLon)
+	right, _ := mercator.LatLonToMeters(minLat, maxLon)
+	pixelPerMeter := float64(size*n) / (right - left)
+	builder.transCoordToXY = mercatorTransCoord(left-margin/pixelPerMeter, top+margin/pixelPerMeter, pixelPerMeter)
 
 	return builder
 }
 
+// NewBuilderBounds makes a builder of the bounds that fits in outputWidth x outputHeight pixels,
+// the bounds crosses the antimeridian if its Max.Lon is less than its Min.Lon.
 func NewBuilderBounds(bounds geom.Bound, outputWidth, outputHeight float64) TileBuilder {
 	builder := &DefaultBuilder{
-		log:          logging.GetLog("bounds"),
-		canvasWidth:  outputWidth,
-		canvasHeight: outputHeight,
-		zoom:         projection.TileZoom(5), // 5 meters/pixel
+		log:             logging.GetLog("bounds"),
+		canvasWidth:     outputWidth,
+		canvasHeight:    outputHeight,
+		scale:           1,
+		zoom:            projection.TileZoom(5), // 5 meters/pixel
+		buildLayerStart: 0,
+		buildLayerEnd:   math.MaxInt,
 	}
 
+	if bounds.Max.Lon < bounds.Min.Lon {
+		bounds.Max.Lon += 360
+	}
 	tileSize := math.Min(outputWidth, outputHeight)
 
-	minLon := bounds.Min.Lon
-	maxLat := bounds.Max.Lat
-	pixelPerLat := tileSize / (maxLat - bounds.Min.Lat)
-	pixelPerLon := tileSize / (bounds.Max.Lon - minLon)
-
-	pixelPerCoord := math.Min(pixelPerLat, pixelPerLon)
-	pixelPerLat = pixelPerCoord
-	pixelPerLon = pixelPerCoord
-
-	dpiXScale := 1.0
-	dpiYScale := 1.0
+	left, top := mercator.LatLonToMeters(mercator.ClampLatitude(bounds.Max.Lat), bounds.Min.Lon)
+	right, bottom := mercator.LatLonToMeters(mercator.ClampLatitude(bounds.Min.Lat), bounds.Max.Lon)
+	pixelPerMeter := math.Min(tileSize/(right-left), tileSize/(top-bottom))
 
 	builder.bounds = bounds
-	builder.transCoordToXY = func(p geom.LatLon) (float64, float64) {
-		x := math.Ceil((p.Lon-minLon)*pixelPerLon) * dpiXScale
-		y := math.Ceil((maxLat-p.Lat)*pixelPerLat) * dpiYScale
-		return x, y
-	}
+	builder.transCoordToXY = mercatorTransCoord(left, top, pixelPerMeter)
 
 	return builder
 }
 
+// mercatorTransCoord returns the converter of lat/lon to the pixels of the canvas in Spherical Mercator,
+// (left, top) is the top-left corner of the canvas in meters of the projection.
+func mercatorTransCoord(left, top float64, pixelPerMeter float64) CoordTransFunc {
+	return func(p geom.LatLon) (float64, float64) {
+		x, y := mercator.LatLonToMeters(mercator.ClampLatitude(p.Lat), p.Lon)
+		return (x - left) * pixelPerMeter, (top - y) * pixelPerMeter
+	}
+}
+
 func (r *Relation) FindTag(key string) string {
 	if v, b := r.Tags[key]; b {
 		return v
@@ -157,24 +223,56 @@ func (t *Tile) CountObjects() int {
 	return len(t.objs)
 }
 
+// Objects returns the objects of the tile in the drawing order
+func (t *Tile) Objects() []Object {
+	return t.objs
+}
+
 func (t *Tile) EncodePNG(writer io.Writer) error {
-	// canvas
+	canvas := t.render()
+	if t.margin > 0 {
+		img := canvas.Image().(*image.RGBA)
+		return png.Encode(writer, img.SubImage(image.Rect(t.margin, t.margin, t.width-t.margin, t.height-t.margin)))
+	}
+	err := canvas.EncodePNG(writer)
+	return err
+}
+
+// EncodePNGTiles cuts the metatile into n x n tiles, the tiles are in the order of rows
+func (t *Tile) EncodePNGTiles(n int) ([][]byte, error) {
+	img := t.render().Image().(*image.RGBA)
+	w, h := (t.width-2*t.margin)/n, (t.height-2*t.margin)/n
+	ret := make([][]byte, 0, n*n)
+	for dy := 0; dy < n; dy++ {
+		for dx := 0; dx < n; dx++ {
+			x0, y0 := t.margin+dx*w, t.margin+dy*h
+			sub := img.SubImage(image.Rect(x0, y0, x0+w, y0+h))
+			var buf bytes.Buffer
+			if err := png.Encode(&buf, sub); err != nil {
+				return nil, err
+			}
+			ret = append(ret, buf.Bytes())
+		}
+	}
+	return ret, nil
+}
+
+func (t *Tile) render() *gg.Context {
 	canvas := gg.NewContext(t.width, t.height)
 
 	if t.defaultFont != nil {
-		face := truetype.NewFace(t.defaultFont, &truetype.Options{Size: 20})
+		face := truetype.NewFace(t.defaultFont, &truetype.Options{Size: labelFontSize * t.scale})
 		canvas.SetFontFace(face)
 		defer face.Close()
 	}
 	for _, obj := range t.objs {
-		obj.Draw(canvas, t.coordTranslator)
+		obj.Draw(canvas, t.coordTranslator, t.scale)
 	}
-	err := canvas.EncodePNG(writer)
-	return err
+	return canvas
 }
 
 func (t *Tile) AddWatermark(text string, tint bool) {
-	face := truetype.NewFace(t.defaultFont, &truetype.Options{Size: 60})
+	face := truetype.NewFace(t.defaultFont, &truetype.Options{Size: 60 * t.scale})
 	wm := &Watermark{
 		text:      text,
 		size:      math.Min(float64(t.width), float64(t.height)),
@@ -23,6 +23,8 @@ const _ = grpc.SupportPackageIsVersion7
 // For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
 type TileClient interface {
 	Find(ctx context.Context, in *FindRequest, opts ...grpc.CallOption) (*FindResponse, error)
+	// sends objects in chunks of FindResponse, so that it is not limited by the max message size
+	FindStream(ctx context.Context, in *FindRequest, opts ...grpc.CallOption) (Tile_FindStreamClient, error)
 	Get(ctx context.Context, in *GetRequest, opts ...grpc.CallOption) (*GetResponse, error)
 	Scan(ctx context.Context, in *ScanRequest, opts ...grpc.CallOption) (*ScanResponse, error)
 }
@@ -44,6 +46,38 @@ func (c *tileClient) Find(ctx context.Context, in *FindRequest, opts ...grpc.Cal
 	return out, nil
 }
 
+func (c *tileClient) FindStream(ctx context.Context, in *FindRequest, opts ...grpc.CallOption) (Tile_FindStreamClient, error) {
+	stream, err := c.cc.NewStream(ctx, &Tile_ServiceDesc.Streams[0], "/Tile/FindStream", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &tileFindStreamClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type Tile_FindStreamClient interface {
+	Recv() (*FindResponse, error)
+	grpc.ClientStream
+}
+
+type tileFindStreamClient struct {
+	grpc.ClientStream
+}
+
+func (x *tileFindStreamClient) Recv() (*FindResponse, error) {
+	m := new(FindResponse)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
 func (c *tileClient) Get(ctx context.Context, in *GetRequest, opts ...grpc.CallOption) (*GetResponse, error) {
 	out := new(GetResponse)
 	err := c.cc.Invoke(ctx, "/Tile/Get", in, out, opts...)
@@ -67,6 +101,8 @@ func (c *tileClient) Scan(ctx context.Context, in *ScanRequest, opts ...grpc.Cal
 // for forward compatibility
 type TileServer interface {
 	Find(context.Context, *FindRequest) (*FindResponse, error)
+	// sends objects in chunks of FindResponse, so that it is not limited by the max message size
+	FindStream(*FindRequest, Tile_FindStreamServer) error
 	Get(context.Context, *GetRequest) (*GetResponse, error)
 	Scan(context.Context, *ScanRequest) (*ScanResponse, error)
 	mustEmbedUnimplementedTileServer()
@@ -79,6 +115,9 @@ type UnimplementedTileServer struct {
 func (UnimplementedTileServer) Find(context.Context, *FindRequest) (*FindResponse, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method Find not implemented")
 }
+func (UnimplementedTileServer) FindStream(*FindRequest, Tile_FindStreamServer) error {
+	return status.Errorf(codes.Unimplemented, "method FindStream not implemented")
+}
 func (UnimplementedTileServer) Get(context.Context, *GetRequest) (*GetResponse, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method Get not implemented")
 }
@@ -116,6 +155,27 @@ func _Tile_Find_Handler(srv interface{}, ctx context.Context, dec func(interface
 	return interceptor(ctx, in, info, handler)
 }
 
+func _Tile_FindStream_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(FindRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(TileServer).FindStream(m, &tileFindStreamServer{stream})
+}
+
+type Tile_FindStreamServer interface {
+	Send(*FindResponse) error
+	grpc.ServerStream
+}
+
+type tileFindStreamServer struct {
+	grpc.ServerStream
+}
+
+func (x *tileFindStreamServer) Send(m *FindResponse) error {
+	return x.ServerStream.SendMsg(m)
+}
+
 func _Tile_Get_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
 	in := new(GetRequest)
 	if err := dec(in); err != nil {
@@ -172,6 +232,12 @@ var Tile_ServiceDesc = grpc.ServiceDesc{
 			Handler:    _Tile_Scan_Handler,
 		},
 	},
-	Streams:  []grpc.StreamDesc{},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "FindStream",
+			Handler:       _Tile_FindStream_Handler,
+			ServerStreams: true,
+		},
+	},
 	Metadata: "tiles.proto",
 }
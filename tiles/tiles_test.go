@@ -1,11 +1,22 @@
 package tiles_test
 
 import (
+	"bytes"
+	"context"
 	"fmt"
+	"image"
+	"image/color"
+	"image/png"
 	"testing"
 
+	"github.com/OutOfBedlam/ots/geom"
+	"github.com/OutOfBedlam/ots/projection"
+	"github.com/OutOfBedlam/ots/projection/mercator"
+	"github.com/OutOfBedlam/ots/tiles"
 	"github.com/fogleman/gg"
 	"github.com/golang/freetype/truetype"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"golang.org/x/image/font/gofont/goregular"
 )
 
@@ -117,3 +128,486 @@ func TestFillArea(t *testing.T) {
 
 	dc.SavePNG(outputDir + "out.png")
 }
+
+func TestBuilderSize(t *testing.T) {
+	// 17/111812/50783
+	x, y, z := 111812, 50783, 17
+	b := tiles.TilesToBounds(x, y, z)
+
+	for _, size := range []int{256, 512, 1024} {
+		builder := tiles.NewBuilderSize(x, y, z, size)
+		builder.AddWays(&tiles.Way{
+			Id:   1001,
+			Tags: map[string]string{"highway": "primary", "name": "road"},
+			Nodes: []*tiles.Way_NodeRef{
+				{Id: 1, Lat: b.Min.Lat, Lon: b.Min.Lon},
+				{Id: 2, Lat: b.Max.Lat, Lon: b.Max.Lon},
+			},
+		})
+		tile, err := builder.Build(context.Background())
+		assert.Nil(t, err)
+
+		var buf bytes.Buffer
+		assert.Nil(t, tile.EncodePNG(&buf))
+		img, err := png.Decode(&buf)
+		assert.Nil(t, err)
+		assert.Equal(t, size, img.Bounds().Dx())
+		assert.Equal(t, size, img.Bounds().Dy())
+	}
+}
+
+func TestLabelCollision(t *testing.T) {
+	x, y, z := 436, 198, 9
+	b := tiles.TilesToBounds(x, y, z)
+	c := b.Center()
+	// latitude of a pixel of the tile
+	pixel := (b.Max.Lat - b.Min.Lat) / 512
+
+	// build returns the placed labels
+	build := func(nodes ...*tiles.Node) []*tiles.Label {
+		builder := tiles.NewBuilder(x, y, z)
+		builder.AddNodes(nodes...)
+		tile, err := builder.Build(context.Background())
+		require.Nil(t, err)
+		labels := make([]*tiles.Label, 0)
+		for _, o := range tile.Objects() {
+			if label, ok := o.(*tiles.Label); ok {
+				labels = append(labels, label)
+			}
+		}
+		return labels
+	}
+	names := func(labels []*tiles.Label) []string {
+		ret := make([]string, len(labels))
+		for i, l := range labels {
+			ret[i] = l.SourceInfo()
+		}
+		return ret
+	}
+
+	city := &tiles.Node{Id: 2001, Lat: c.Lat, Lon: c.Lon, Tags: map[string]string{"place": "city", "name": "City"}}
+	// the town of lower priority collides with the city even after shifting up and down
+	town := &tiles.Node{Id: 2002, Lat: c.Lat, Lon: c.Lon, Tags: map[string]string{"place": "town", "name": "Town"}}
+	assert.Equal(t, []string{"NODE:2002 Town"}, names(build(town)))
+	// the city is placed first whatever the order of the nodes
+	assert.Equal(t, []string{"NODE:2001 City"}, names(build(town, city)))
+	assert.Equal(t, []string{"NODE:2001 City"}, names(build(city, town)))
+
+	far := &tiles.Node{Id: 2003, Lat: c.Lat + (b.Max.Lat-c.Lat)/2, Lon: c.Lon, Tags: map[string]string{"place": "town", "name": "Far"}}
+	assert.ElementsMatch(t, []string{"NODE:2001 City", "NODE:2003 Far"}, names(build(city, far)))
+
+	// the town just above the city collides at its anchor, and it is shifted up
+	above := &tiles.Node{Id: 2004, Lat: c.Lat + 20*pixel, Lon: c.Lon, Tags: map[string]string{"place": "town", "name": "Above"}}
+	labels := build(city, above)
+	require.ElementsMatch(t, []string{"NODE:2001 City", "NODE:2004 Above"}, names(labels))
+	for _, l := range labels {
+		dx, dy := l.Offset()
+		assert.Equal(t, 0.0, dx)
+		if l.SourceInfo() == "NODE:2001 City" {
+			assert.Equal(t, 0.0, dy)
+		} else {
+			assert.Less(t, dy, 0.0)
+		}
+	}
+}
+
+func TestMetatile(t *testing.T) {
+	// 17/111812/50783 and its neighbours
+	x, y, z, n := 111812, 50782, 17, 2
+	b := tiles.MetatileToBounds(x, y, z, n)
+	assert.Equal(t, tiles.TilesToBounds(x, y, z).Min.Lon, b.Min.Lon)
+	assert.Equal(t, tiles.TilesToBounds(x+1, y+1, z).Min.Lat, b.Min.Lat)
+
+	builder := tiles.NewMetaBuilder(x, y, z, n, 256)
+	builder.AddWays(&tiles.Way{
+		Id:   1001,
+		Tags: map[string]string{"highway": "primary", "name": "road"},
+		Nodes: []*tiles.Way_NodeRef{
+			{Id: 1, Lat: b.Min.Lat, Lon: b.Min.Lon},
+			{Id: 2, Lat: b.Max.Lat, Lon: b.Max.Lon},
+		},
+	})
+	tile, err := builder.Build(context.Background())
+	assert.Nil(t, err)
+
+	pngs, err := tile.EncodePNGTiles(n)
+	assert.Nil(t, err)
+	assert.Equal(t, n*n, len(pngs))
+	for _, p := range pngs {
+		img, err := png.Decode(bytes.NewReader(p))
+		assert.Nil(t, err)
+		assert.Equal(t, 256, img.Bounds().Dx())
+		assert.Equal(t, 256, img.Bounds().Dy())
+	}
+}
+
+func TestMetatileLabel(t *testing.T) {
+	x, y, z := 111812, 50780, 17
+
+	// render returns the tiles of the metatile of n x n tiles from the tile (mx, y)
+	render := func(mx, n int, node *tiles.Node) []image.Image {
+		builder := tiles.NewMetaBuilder(mx, y, z, n, 256)
+		builder.AddNodes(node)
+		tile, err := builder.Build(context.Background())
+		require.Nil(t, err)
+		pngs, err := tile.EncodePNGTiles(n)
+		require.Nil(t, err)
+		ret := make([]image.Image, len(pngs))
+		for i, p := range pngs {
+			ret[i], err = png.Decode(bytes.NewReader(p))
+			require.Nil(t, err)
+			assert.Equal(t, 256, ret[i].Bounds().Dx())
+		}
+		return ret
+	}
+	column := func(img image.Image, px int) []color.Color {
+		ret := make([]color.Color, img.Bounds().Dy())
+		for py := range ret {
+			ret[py] = colorAt(img, img.Bounds().Min.X+px, img.Bounds().Min.Y+py)
+		}
+		return ret
+	}
+	drawn := func(col []color.Color, background color.Color) bool {
+		for _, c := range col {
+			if c != background {
+				return true
+			}
+		}
+		return false
+	}
+	seamNode := func(id int64, edge int) *tiles.Node {
+		b := tiles.TilesToBounds(edge, y, z)
+		return &tiles.Node{Id: id, Lat: b.Center().Lat, Lon: b.Min.Lon, Tags: map[string]string{"place": "city", "name": "Seam City"}}
+	}
+	// the label on the left edge of the tile whole[i] is drawn on the both sides of the edge,
+	// the same as on the metatile of 4 x 4 tiles
+	straddle := func(whole []image.Image, i int, left, right image.Image) {
+		background := colorAt(whole[0], 0, 0)
+		assert.True(t, drawn(column(left, 255), background))
+		assert.True(t, drawn(column(right, 0), background))
+		assert.Equal(t, column(whole[i-1], 255), column(left, 255))
+		assert.Equal(t, column(whole[i], 0), column(right, 0))
+	}
+
+	// the edge between two tiles of a metatile
+	node := seamNode(2101, x+1)
+	meta := render(x, 2, node)
+	straddle(render(x, 4, node), 1, meta[0], meta[1])
+
+	// the edge between two metatiles, the label that does not collide with others is placed by the both metatiles
+	node = seamNode(2102, x+2)
+	straddle(render(x, 4, node), 2, render(x, 2, node)[1], render(x+2, 2, node)[0])
+}
+
+func TestRoadLabel(t *testing.T) {
+	x, y, z, n := 111812, 50780, 17, 4
+	b := tiles.MetatileToBounds(x, y, z, n)
+	c := b.Center()
+
+	build := func(id int64, lon1, lon2 float64) int {
+		builder := tiles.NewMetaBuilder(x, y, z, n, 256)
+		builder.AddWays(&tiles.Way{
+			Id:   id,
+			Tags: map[string]string{"highway": "primary", "name": "Main Street"},
+			Nodes: []*tiles.Way_NodeRef{
+				{Id: 1, Lat: c.Lat, Lon: lon1},
+				{Id: 2, Lat: c.Lat, Lon: lon2},
+			},
+		})
+		tile, err := builder.Build(context.Background())
+		assert.Nil(t, err)
+		// without the background, the casing and the road
+		return tile.CountObjects() - 3
+	}
+
+	// repeated at every 128 pixels of the 1024 pixels road, the tiles are the half of DefaultTileSize
+	assert.Equal(t, 8, build(1101, b.Min.Lon, b.Max.Lon))
+	// the text is kept upright on the road to the west
+	assert.Equal(t, 8, build(1102, b.Max.Lon, b.Min.Lon))
+	// the road is shorter than the text
+	assert.Equal(t, 0, build(1103, c.Lon, c.Lon+(b.Max.Lon-b.Min.Lon)/100))
+}
+
+func TestNodeMarker(t *testing.T) {
+	build := func(z int, node *tiles.Node) int {
+		x, y := projection.LatLon2Tile(node.Lat, node.Lon, z)
+		builder := tiles.NewBuilder(x, y, z)
+		builder.AddNodes(node)
+		tile, err := builder.Build(context.Background())
+		assert.Nil(t, err)
+		// without the background
+		return tile.CountObjects() - 1
+	}
+	lat, lon := 37.5140, 127.1050
+
+	busStop := &tiles.Node{Id: 3001, Lat: lat, Lon: lon, Tags: map[string]string{"highway": "bus_stop"}}
+	assert.Equal(t, 1, build(17, busStop))
+	assert.Equal(t, 0, build(15, busStop))
+
+	museum := &tiles.Node{Id: 3002, Lat: lat, Lon: lon, Tags: map[string]string{"tourism": "museum", "name": "Museum"}}
+	assert.Equal(t, 1, build(17, museum))
+	assert.Equal(t, 0, build(15, museum))
+
+	village := &tiles.Node{Id: 3003, Lat: lat, Lon: lon, Tags: map[string]string{"place": "village", "name": "Village"}}
+	assert.Equal(t, 1, build(12, village))
+
+	untagged := &tiles.Node{Id: 3004, Lat: lat, Lon: lon}
+	assert.Equal(t, 0, build(17, untagged))
+}
+
+func TestRoadCasing(t *testing.T) {
+	x, y, z := 111812, 50780, 17
+	b := tiles.TilesToBounds(x, y, z)
+	c := b.Center()
+
+	// the color at the crossing of the primary road to the north and the residential road to the east
+	crossing := func(id int64, tags map[string]string) color.Color {
+		builder := tiles.NewBuilder(x, y, z)
+		tags["highway"] = "primary"
+		builder.AddWays(&tiles.Way{
+			Id:   id,
+			Tags: tags,
+			Nodes: []*tiles.Way_NodeRef{
+				{Id: 1, Lat: b.Min.Lat, Lon: c.Lon},
+				{Id: 2, Lat: b.Max.Lat, Lon: c.Lon},
+			},
+		}, &tiles.Way{
+			Id:   id + 1,
+			Tags: map[string]string{"highway": "residential"},
+			Nodes: []*tiles.Way_NodeRef{
+				{Id: 3, Lat: c.Lat, Lon: b.Min.Lon},
+				{Id: 4, Lat: c.Lat, Lon: b.Max.Lon},
+			},
+		})
+		tile, err := builder.Build(context.Background())
+		require.Nil(t, err)
+		// the background, the roads and their casings
+		assert.Equal(t, 5, tile.CountObjects())
+
+		buf := &bytes.Buffer{}
+		require.Nil(t, tile.EncodePNG(buf))
+		img, err := png.Decode(buf)
+		require.Nil(t, err)
+		return color.NRGBAModel.Convert(img.At(img.Bounds().Dx()/2, img.Bounds().Dy()/2))
+	}
+
+	white := color.NRGBA{R: 255, G: 255, B: 255, A: 255}
+	// the bridge is above the residential road
+	assert.Equal(t, color.NRGBAModel.Convert(tiles.Amber200), crossing(4101, map[string]string{"bridge": "yes"}))
+	assert.Equal(t, color.NRGBAModel.Convert(tiles.Amber200), crossing(4103, map[string]string{"layer": "2"}))
+	// the tunnel is below the residential road
+	assert.Equal(t, white, crossing(4105, map[string]string{"tunnel": "yes"}))
+	assert.Equal(t, white, crossing(4107, map[string]string{"bridge": "yes", "layer": "-1"}))
+}
+
+// renderImage builds and renders the tile of the builder
+func renderImage(t *testing.T, builder tiles.TileBuilder) image.Image {
+	tile, err := builder.Build(context.Background())
+	require.Nil(t, err)
+	buf := &bytes.Buffer{}
+	require.Nil(t, tile.EncodePNG(buf))
+	img, err := png.Decode(buf)
+	require.Nil(t, err)
+	return img
+}
+
+func colorAt(img image.Image, x, y int) color.Color {
+	return color.NRGBAModel.Convert(img.At(x, y))
+}
+
+func TestMercatorProjection(t *testing.T) {
+	// the north-east quarter of the world is a square in the projection
+	builder := tiles.NewBuilderBounds(geom.MakeBound(0, 0, mercator.MaxLatitude, 180), 512, 512)
+	// the latitude at the half of the height of the quarter
+	_, top := mercator.LatLonToMeters(mercator.MaxLatitude, 0)
+	lat, _ := mercator.MetersToLatLon(0, top/2)
+	builder.AddWays(&tiles.Way{
+		Id:   5101,
+		Tags: map[string]string{"highway": "primary"},
+		Nodes: []*tiles.Way_NodeRef{
+			{Id: 1, Lat: lat, Lon: 10},
+			{Id: 2, Lat: lat, Lon: 170},
+		},
+	})
+	img := renderImage(t, builder)
+	assert.Equal(t, color.NRGBAModel.Convert(tiles.Amber200), colorAt(img, 256, 256))
+}
+
+func TestAntimeridian(t *testing.T) {
+	z := 12
+	east := 1<<z - 1
+	_, y := projection.LatLon2Tile(60, 180, z)
+	lat := tiles.TilesToBounds(east, y, z).Center().Lat
+	road := &tiles.Way{
+		Id:   5201,
+		Tags: map[string]string{"highway": "primary"},
+		Nodes: []*tiles.Way_NodeRef{
+			{Id: 1, Lat: lat, Lon: 179.95},
+			{Id: 2, Lat: lat, Lon: -179.95},
+		},
+	}
+	amber := color.NRGBAModel.Convert(tiles.Amber200)
+
+	// the road goes across the right edge of the east tile and the left edge of the west tile
+	builder := tiles.NewBuilder(east, y, z)
+	builder.AddWays(road)
+	img := renderImage(t, builder)
+	assert.Equal(t, amber, colorAt(img, 508, 256))
+
+	builder = tiles.NewBuilder(0, y, z)
+	builder.AddWays(road)
+	img = renderImage(t, builder)
+	assert.Equal(t, amber, colorAt(img, 4, 256))
+
+	// bounds across the antimeridian, the latitudes of 0.1 degree are as long as the longitudes of 0.2 degree at 60N
+	builder = tiles.NewBuilderBounds(geom.MakeBound(lat-0.05, 179.9, lat+0.05, -179.9), 512, 512)
+	builder.AddWays(road)
+	img = renderImage(t, builder)
+	assert.Equal(t, amber, colorAt(img, 256, 256))
+}
+
+func TestClipHugePolygon(t *testing.T) {
+	x, y, z := 111812, 50780, 17
+	b := tiles.TilesToBounds(x, y, z)
+	// the forest is far larger than the tile
+	builder := tiles.NewBuilder(x, y, z)
+	builder.AddWays(&tiles.Way{
+		Id:   5301,
+		Tags: map[string]string{"landuse": "forest"},
+		Nodes: []*tiles.Way_NodeRef{
+			{Id: 1, Lat: b.Min.Lat - 10, Lon: b.Min.Lon - 10},
+			{Id: 2, Lat: b.Min.Lat - 10, Lon: b.Max.Lon + 10},
+			{Id: 3, Lat: b.Max.Lat + 10, Lon: b.Max.Lon + 10},
+			{Id: 4, Lat: b.Max.Lat + 10, Lon: b.Min.Lon - 10},
+			{Id: 1, Lat: b.Min.Lat - 10, Lon: b.Min.Lon - 10},
+		},
+	})
+	img := renderImage(t, builder)
+	center := colorAt(img, 256, 256)
+	assert.NotEqual(t, colorAt(renderImage(t, tiles.NewBuilder(x, y, z)), 256, 256), center)
+	assert.Equal(t, center, colorAt(img, 0, 0))
+	assert.Equal(t, center, colorAt(img, 511, 511))
+}
+
+func TestMultipolygon(t *testing.T) {
+	x, y, z := 111812, 50780, 17
+	b := tiles.TilesToBounds(x, y, z)
+	// the node at the pixel of the tile
+	node := func(id int64, px, py float64) *tiles.Way_NodeRef {
+		return &tiles.Way_NodeRef{
+			Id:  id,
+			Lat: b.Max.Lat - (b.Max.Lat-b.Min.Lat)*py/512,
+			Lon: b.Min.Lon + (b.Max.Lon-b.Min.Lon)*px/512,
+		}
+	}
+	// the outer ring is split into the ways that are not in order, and the second way is reversed
+	ways := []*tiles.Way{
+		{Id: 5401, Nodes: []*tiles.Way_NodeRef{node(1, 448, 448), node(2, 64, 448), node(3, 64, 64)}},
+		{Id: 5402, Nodes: []*tiles.Way_NodeRef{node(4, 448, 64), node(5, 448, 256), node(1, 448, 448)}},
+		{Id: 5403, Nodes: []*tiles.Way_NodeRef{node(3, 64, 64), node(4, 448, 64)}},
+		// the hole
+		{Id: 5404, Nodes: []*tiles.Way_NodeRef{node(6, 160, 160), node(7, 352, 160), node(8, 352, 352), node(9, 160, 352), node(6, 160, 160)}},
+		// the island in the hole
+		{Id: 5405, Nodes: []*tiles.Way_NodeRef{node(10, 224, 224), node(11, 288, 224), node(12, 288, 288), node(13, 224, 288), node(10, 224, 224)}},
+	}
+	background := colorAt(renderImage(t, tiles.NewBuilder(x, y, z)), 256, 256)
+
+	builder := tiles.NewBuilder(x, y, z)
+	builder.AddWays(ways...)
+	builder.AddRelations(&tiles.Relation{
+		Id:   5410,
+		Tags: map[string]string{"type": "multipolygon", "natural": "water"},
+		Members: []*tiles.Relation_Member{
+			{Id: 5401, Type: tiles.Relation_WAY, Role: "outer"},
+			{Id: 5404, Type: tiles.Relation_WAY, Role: "inner"},
+			{Id: 5402, Type: tiles.Relation_WAY, Role: "outer"},
+			{Id: 5405, Type: tiles.Relation_WAY, Role: "outer"},
+			{Id: 5403, Type: tiles.Relation_WAY, Role: "outer"},
+		},
+	})
+	img := renderImage(t, builder)
+	water := colorAt(img, 100, 256)
+	assert.NotEqual(t, background, water)
+	assert.Equal(t, background, colorAt(img, 190, 256))
+	assert.Equal(t, water, colorAt(img, 256, 256))
+	assert.Equal(t, background, colorAt(img, 30, 256))
+
+	// the ring that is not closed is reported, and the other rings are drawn
+	builder = tiles.NewBuilder(x, y, z)
+	builder.AddWays(ways...)
+	builder.AddRelations(&tiles.Relation{
+		Id:   5411,
+		Tags: map[string]string{"type": "multipolygon", "natural": "water"},
+		Members: []*tiles.Relation_Member{
+			{Id: 5401, Type: tiles.Relation_WAY, Role: "outer"},
+			{Id: 5402, Type: tiles.Relation_WAY, Role: "outer"},
+			{Id: 5405, Type: tiles.Relation_WAY, Role: "outer"},
+		},
+	})
+	img = renderImage(t, builder)
+	assert.Equal(t, background, colorAt(img, 100, 256))
+	assert.Equal(t, water, colorAt(img, 256, 256))
+}
+
+func TestNestedRelation(t *testing.T) {
+	x, y, z := 111812, 50780, 17
+	b := tiles.TilesToBounds(x, y, z)
+	lat := b.Center().Lat
+	background := colorAt(renderImage(t, tiles.NewBuilder(x, y, z)), 256, 256)
+
+	builder := tiles.NewBuilder(x, y, z)
+	builder.AddWays(&tiles.Way{
+		Id: 5501,
+		Nodes: []*tiles.Way_NodeRef{
+			{Id: 1, Lat: lat, Lon: b.Min.Lon - 0.001},
+			{Id: 2, Lat: lat, Lon: b.Max.Lon + 0.001},
+		},
+	})
+	builder.AddWays(&tiles.Way{
+		Id: 5502,
+		Nodes: []*tiles.Way_NodeRef{
+			{Id: 3, Lat: b.Max.Lat - (b.Max.Lat-b.Min.Lat)/4, Lon: b.Min.Lon - 0.001},
+			{Id: 4, Lat: b.Max.Lat - (b.Max.Lat-b.Min.Lat)/4, Lon: b.Max.Lon + 0.001},
+		},
+	})
+	// the route is drawn by the route master, and the superroute of the route has the master as its member to make a cycle,
+	// the subarea of the master is not a part of the master
+	builder.AddRelations(
+		&tiles.Relation{
+			Id:   5510,
+			Tags: map[string]string{"type": "route_master", "route_master": "bus"},
+			Members: []*tiles.Relation_Member{
+				{Id: 5511, Type: tiles.Relation_RELATION},
+				{Id: 5512, Type: tiles.Relation_RELATION, Role: "subarea"},
+			},
+		},
+		&tiles.Relation{
+			Id:   5511,
+			Tags: map[string]string{"type": "superroute"},
+			Members: []*tiles.Relation_Member{
+				{Id: 5501, Type: tiles.Relation_WAY},
+				{Id: 5510, Type: tiles.Relation_RELATION},
+			},
+		},
+		&tiles.Relation{
+			Id: 5512,
+			Members: []*tiles.Relation_Member{
+				{Id: 5502, Type: tiles.Relation_WAY},
+			},
+		},
+	)
+	img := renderImage(t, builder)
+	assert.NotEqual(t, background, colorAt(img, 256, 256))
+	assert.Equal(t, background, colorAt(img, 256, 200))
+	assert.Equal(t, background, colorAt(img, 256, 128))
+}
+
+func TestIsNestedMember(t *testing.T) {
+	assert.True(t, tiles.IsNestedMember("route_master", ""))
+	assert.True(t, tiles.IsNestedMember("superroute", ""))
+	assert.True(t, tiles.IsNestedMember("site", "entrance"))
+	assert.False(t, tiles.IsNestedMember("site", "subarea"))
+	assert.False(t, tiles.IsNestedMember("boundary", "subarea"))
+	assert.False(t, tiles.IsNestedMember("multipolygon", "outer"))
+	assert.False(t, tiles.IsNestedMember("route", ""))
+}
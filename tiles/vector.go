@@ -0,0 +1,316 @@
+package tiles
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/OutOfBedlam/ots/geom"
+	"github.com/OutOfBedlam/ots/logging"
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/encoding/mvt"
+	"github.com/paulmach/orb/geojson"
+	"github.com/paulmach/orb/maptile"
+	"github.com/tidwall/btree"
+)
+
+// mapbox vector tile layer names
+const (
+	VectorLayerWater    = "water"
+	VectorLayerLanduse  = "landuse"
+	VectorLayerPlace    = "place"
+	VectorLayerAmenity  = "amenity"
+	VectorLayerRoads    = "roads"
+	VectorLayerRailway  = "railway"
+	VectorLayerBuilding = "buildings"
+	VectorLayerRoute    = "route"
+	VectorLayerBoundary = "boundary"
+	VectorLayerPower    = "power"
+	VectorLayerPoi      = "poi"
+	VectorLayerOther    = "other"
+)
+
+type vector_layer_of struct {
+	BaseTag string
+	Layer   string
+}
+
+// same precedence with styleFuncs
+var vectorLayers = []vector_layer_of{
+	{BaseTag: "building", Layer: VectorLayerBuilding},
+	{BaseTag: "building:part", Layer: VectorLayerBuilding},
+	{BaseTag: "shop", Layer: VectorLayerAmenity},
+	{BaseTag: "amenity", Layer: VectorLayerAmenity},
+	{BaseTag: "place", Layer: VectorLayerPlace},
+	{BaseTag: "highway", Layer: VectorLayerRoads},
+	{BaseTag: "landuse", Layer: VectorLayerLanduse},
+	{BaseTag: "natural", Layer: VectorLayerLanduse},
+	{BaseTag: "leisure", Layer: VectorLayerLanduse},
+	{BaseTag: "route", Layer: VectorLayerRoute},
+	{BaseTag: "railway", Layer: VectorLayerRailway},
+	{BaseTag: "waterway", Layer: VectorLayerWater},
+	{BaseTag: "water", Layer: VectorLayerWater},
+	{BaseTag: "boundary", Layer: VectorLayerBoundary},
+	{BaseTag: "barrier", Layer: VectorLayerBoundary},
+	{BaseTag: "power", Layer: VectorLayerPower},
+}
+
+// returns the name of vector tile layer that the tags of the way or the relation belong to,
+// nodes are in the layer of VectorLayerOfNode.
+func VectorLayerFromTags(tags map[string]string) string {
+	if natural, b := tags["natural"]; b {
+		switch natural {
+		case "water", "bay", "coastline", "wetland":
+			return VectorLayerWater
+		}
+	}
+	for _, vl := range vectorLayers {
+		if _, b := tags[vl.BaseTag]; b {
+			return vl.Layer
+		}
+	}
+	return ""
+}
+
+// VectorLayerOfNode returns the name of vector tile layer of the node, places are in the place layer
+// and the others like shops and amenities are in the poi layer.
+func VectorLayerOfNode(tags map[string]string) string {
+	if VectorLayerFromTags(tags) == VectorLayerPlace {
+		return VectorLayerPlace
+	}
+	return VectorLayerPoi
+}
+
+type VectorBuilder struct {
+	log       logging.Log
+	x, y, z   int
+	ways      btree.Map[int64, *Way]
+	relations btree.Map[int64, *Relation]
+	nodes     btree.Map[int64, *Node]
+}
+
+type VectorTile struct {
+	tile   maptile.Tile
+	layers map[string]*geojson.FeatureCollection
+}
+
+func NewVectorBuilder(x, y, z int) *VectorBuilder {
+	return &VectorBuilder{
+		log: logging.GetLog("vector"),
+		x:   x,
+		y:   y,
+		z:   z,
+	}
+}
+
+func (vb *VectorBuilder) AddWays(ways ...*Way) {
+	for _, way := range ways {
+		if way == nil {
+			continue
+		}
+		vb.ways.Set(way.Id, way)
+	}
+}
+
+func (vb *VectorBuilder) AddNodes(nodes ...*Node) {
+	for _, node := range nodes {
+		if node == nil {
+			continue
+		}
+		vb.nodes.Set(node.Id, node)
+	}
+}
+
+func (vb *VectorBuilder) AddRelations(rels ...*Relation) {
+	for _, rel := range rels {
+		if rel == nil {
+			continue
+		}
+		vb.relations.Set(rel.Id, rel)
+	}
+}
+
+func (vb *VectorBuilder) Build(ctx context.Context) (*VectorTile, error) {
+	vt := &VectorTile{
+		tile:   maptile.New(uint32(vb.x), uint32(vb.y), maptile.Zoom(vb.z)),
+		layers: make(map[string]*geojson.FeatureCollection),
+	}
+
+	// low zoom tiles have only the major features
+	generalized := vb.z <= GeneralizedMaxZoom
+
+	// ways that are used as members of relations should not be rendered twice
+	members := make(map[int64]bool)
+	for _, rel := range vb.relations.Values() {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		if generalized && GeneralizedMinZoom(rel.Tags, rel.Extent()) > vb.z {
+			continue
+		}
+		layer := VectorLayerFromTags(rel.Tags)
+		if len(layer) == 0 {
+			continue
+		}
+		for _, m := range rel.Members {
+			if m.Type == Relation_WAY {
+				members[m.Id] = true
+			}
+		}
+		if g := vb.relationGeometry(rel); g != nil {
+			vt.add(layer, rel.Id, rel.Tags, g)
+		}
+	}
+
+	for _, way := range vb.ways.Values() {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		if generalized && GeneralizedMinZoom(way.Tags, way.Extent()) > vb.z {
+			continue
+		}
+		layer := VectorLayerFromTags(way.Tags)
+		if len(layer) == 0 {
+			if members[way.Id] || len(way.Tags) == 0 {
+				continue
+			}
+			layer = VectorLayerOther
+		}
+		g, closed := vb.wayGeometry(way)
+		if g == nil {
+			continue
+		}
+		if layer == VectorLayerBuilding && !closed {
+			// only the closed ways are buildings
+			layer = VectorLayerOther
+		}
+		vt.add(layer, way.Id, way.Tags, g)
+	}
+
+	for _, node := range vb.nodes.Values() {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		if len(node.Tags) == 0 {
+			continue
+		}
+		if generalized && GeneralizedMinZoom(node.Tags, 0) > vb.z {
+			continue
+		}
+		vt.add(VectorLayerOfNode(node.Tags), node.Id, node.Tags, orb.Point{node.Lon, node.Lat})
+	}
+
+	return vt, nil
+}
+
+// wayGeometry returns the polygon of the closed way that is filled or the line string, and whether the way is closed
+func (vb *VectorBuilder) wayGeometry(way *Way) (orb.Geometry, bool) {
+	if len(way.Nodes) < 2 {
+		return nil, false
+	}
+	ls := make(orb.LineString, len(way.Nodes))
+	for i, n := range way.Nodes {
+		ls[i] = orb.Point{n.Lon, n.Lat}
+	}
+	closed := len(ls) >= 4 && ls[0] == ls[len(ls)-1]
+	style := styleFromTags(&StyleParam{Tags: way.Tags, Closed: closed})
+	if closed && style.FillColor != nil {
+		return orb.Polygon{orb.Ring(ls)}, true
+	}
+	return ls, closed
+}
+
+func (vb *VectorBuilder) relationGeometry(rel *Relation) orb.Geometry {
+	var outerItems = make([]*roleItem, 0)
+	var innerItems = make([]*roleItem, 0)
+	var lines = make(orb.MultiLineString, 0)
+	for _, m := range rel.Members {
+		if m.Type != Relation_WAY {
+			continue
+		}
+		way, ok := vb.ways.Get(m.Id)
+		if !ok || len(way.Nodes) == 0 {
+			continue
+		}
+		points := make([]geom.LatLon, len(way.Nodes))
+		for i, n := range way.Nodes {
+			points[i] = geom.LatLon{Lat: n.Lat, Lon: n.Lon}
+		}
+		itm := &roleItem{role: m.Role, points: points, sourceInfo: fmt.Sprintf("WAY:%d", way.Id)}
+		switch m.Role {
+		case "outer":
+			outerItems = append(outerItems, itm)
+		case "inner":
+			innerItems = append(innerItems, itm)
+		default:
+			lines = append(lines, _latLonsToLineString(points))
+		}
+	}
+
+	parts, _ := assembleMultipolygon(outerItems, innerItems)
+	if len(parts) > 0 {
+		mp := make(orb.MultiPolygon, 0, len(parts))
+		for _, part := range parts {
+			poly := orb.Polygon{orb.Ring(_latLonsToLineString(part.outer))}
+			for _, in := range part.inners {
+				poly = append(poly, orb.Ring(_latLonsToLineString(in)))
+			}
+			mp = append(mp, poly)
+		}
+		if len(mp) == 1 {
+			return mp[0]
+		}
+		return mp
+	}
+
+	if len(lines) == 0 {
+		return nil
+	} else if len(lines) == 1 {
+		return lines[0]
+	}
+	return lines
+}
+
+func _latLonsToLineString(points []geom.LatLon) orb.LineString {
+	ls := make(orb.LineString, len(points))
+	for i, p := range points {
+		ls[i] = orb.Point{p.Lon, p.Lat}
+	}
+	return ls
+}
+
+func (vt *VectorTile) add(layer string, id int64, tags map[string]string, g orb.Geometry) {
+	fc, ok := vt.layers[layer]
+	if !ok {
+		fc = geojson.NewFeatureCollection()
+		vt.layers[layer] = fc
+	}
+	f := geojson.NewFeature(g)
+	f.ID = id
+	for k, v := range tags {
+		f.Properties[k] = v
+	}
+	fc.Append(f)
+}
+
+func (vt *VectorTile) CountObjects() int {
+	cnt := 0
+	for _, fc := range vt.layers {
+		cnt += len(fc.Features)
+	}
+	return cnt
+}
+
+func (vt *VectorTile) EncodeMVT(writer io.Writer) error {
+	layers := mvt.NewLayers(vt.layers)
+	layers.ProjectToTile(vt.tile)
+	layers.Clip(mvt.MapboxGLDefaultExtentBound)
+	layers.RemoveEmpty(1.0, 1.0)
+
+	data, err := mvt.Marshal(layers)
+	if err != nil {
+		return err
+	}
+	_, err = writer.Write(data)
+	return err
+}
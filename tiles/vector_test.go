@@ -0,0 +1,81 @@
+package tiles_test
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/OutOfBedlam/ots/tiles"
+	"github.com/paulmach/orb/encoding/mvt"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVectorLayerFromTags(t *testing.T) {
+	assert.Equal(t, tiles.VectorLayerRoads, tiles.VectorLayerFromTags(map[string]string{"highway": "primary"}))
+	assert.Equal(t, tiles.VectorLayerBuilding, tiles.VectorLayerFromTags(map[string]string{"building": "yes", "amenity": "school"}))
+	assert.Equal(t, tiles.VectorLayerWater, tiles.VectorLayerFromTags(map[string]string{"natural": "water"}))
+	assert.Equal(t, tiles.VectorLayerLanduse, tiles.VectorLayerFromTags(map[string]string{"natural": "wood"}))
+	assert.Equal(t, tiles.VectorLayerAmenity, tiles.VectorLayerFromTags(map[string]string{"shop": "bakery"}))
+	assert.Equal(t, "", tiles.VectorLayerFromTags(map[string]string{"name": "nothing"}))
+
+	// nodes are places or pois
+	assert.Equal(t, tiles.VectorLayerPlace, tiles.VectorLayerOfNode(map[string]string{"place": "city"}))
+	assert.Equal(t, tiles.VectorLayerPoi, tiles.VectorLayerOfNode(map[string]string{"shop": "bakery"}))
+	assert.Equal(t, tiles.VectorLayerPoi, tiles.VectorLayerOfNode(map[string]string{"amenity": "cafe", "building": "yes"}))
+}
+
+func TestVectorTileEncode(t *testing.T) {
+	// 17/111812/50783
+	x, y, z := 111812, 50783, 17
+	b := tiles.TilesToBounds(x, y, z)
+	c := b.Center()
+
+	builder := tiles.NewVectorBuilder(x, y, z)
+	builder.AddWays(&tiles.Way{
+		Id:   1,
+		Tags: map[string]string{"highway": "primary", "name": "road"},
+		Nodes: []*tiles.Way_NodeRef{
+			{Id: 1, Lat: b.Min.Lat, Lon: b.Min.Lon},
+			{Id: 2, Lat: b.Max.Lat, Lon: b.Max.Lon},
+		},
+	})
+	// the closed way of building is a building, the open one is not
+	building := []*tiles.Way_NodeRef{
+		{Id: 5, Lat: c.Lat, Lon: c.Lon},
+		{Id: 6, Lat: c.Lat, Lon: b.Max.Lon},
+		{Id: 7, Lat: b.Max.Lat, Lon: b.Max.Lon},
+		{Id: 5, Lat: c.Lat, Lon: c.Lon},
+	}
+	builder.AddWays(
+		&tiles.Way{Id: 2, Tags: map[string]string{"building": "yes"}, Nodes: building},
+		&tiles.Way{Id: 3, Tags: map[string]string{"building": "yes"}, Nodes: building[:3]},
+	)
+	builder.AddNodes(&tiles.Node{Id: 3, Tags: map[string]string{"shop": "bakery"}, Lat: c.Lat, Lon: c.Lon})
+	builder.AddNodes(&tiles.Node{Id: 4, Lat: c.Lat, Lon: c.Lon})
+
+	tile, err := builder.Build(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, 4, tile.CountObjects())
+
+	var buf bytes.Buffer
+	assert.Nil(t, tile.EncodeMVT(&buf))
+
+	layers, err := mvt.Unmarshal(buf.Bytes())
+	assert.Nil(t, err)
+	names := map[string]int{}
+	for _, l := range layers {
+		names[l.Name] = len(l.Features)
+	}
+	assert.Equal(t, 1, names[tiles.VectorLayerRoads])
+	assert.Equal(t, 1, names[tiles.VectorLayerBuilding])
+	assert.Equal(t, 1, names[tiles.VectorLayerOther])
+	assert.Equal(t, 1, names[tiles.VectorLayerPoi])
+
+	// canceled while encoding the nodes
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	builder = tiles.NewVectorBuilder(x, y, z)
+	builder.AddNodes(&tiles.Node{Id: 3, Tags: map[string]string{"shop": "bakery"}, Lat: c.Lat, Lon: c.Lon})
+	_, err = builder.Build(ctx)
+	assert.ErrorIs(t, err, context.Canceled)
+}